@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// activityStore persists when each owner was last seen.
+type activityStore interface {
+	LoadActivity() (map[string]time.Time, error)
+	SaveActivity(owner string, at time.Time) error
+}
+
+// ownerActivity tracks the newest message timestamp processed per owner. A
+// nil store keeps it in memory only.
+type ownerActivity struct {
+	mu       sync.RWMutex
+	store    activityStore
+	lastSeen map[string]time.Time
+}
+
+func loadOwnerActivity(store activityStore) (*ownerActivity, error) {
+	a := &ownerActivity{store: store, lastSeen: make(map[string]time.Time)}
+	if store == nil {
+		return a, nil
+	}
+
+	seen, err := store.LoadActivity()
+	if err != nil {
+		return nil, err
+	}
+	a.lastSeen = seen
+
+	return a, nil
+}
+
+// Seen records a message of the owner sent at, older timestamps are ignored.
+func (a *ownerActivity) Seen(owner string, at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !at.After(a.lastSeen[owner]) {
+		return
+	}
+	a.lastSeen[owner] = at
+
+	if a.store != nil {
+		persistence.Report("owner activity", a.store.SaveActivity(owner, at))
+	}
+}
+
+// LastSeen returns a copy of the last seen time per owner.
+func (a *ownerActivity) LastSeen() map[string]time.Time {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	seen := make(map[string]time.Time, len(a.lastSeen))
+	for o, t := range a.lastSeen {
+		seen[o] = t
+	}
+
+	return seen
+}
+
+type OwnerSummary struct {
+	Owner string `json:"owner"`
+	// LastSeen is unset for owners with cached entries but no message
+	// recorded since the activity tracking started.
+	LastSeen    *time.Time `json:"lastSeen,omitempty"`
+	CachedCount int        `json:"cachedCount"`
+	CachedBytes int64      `json:"cachedBytes"`
+}
+
+// ownerSummaries combines the owner activity with the cached entries, sorted
+// by owner.
+func ownerSummaries(lastSeen map[string]time.Time, entries []CacheEntry) []OwnerSummary {
+	byOwner := make(map[string]*OwnerSummary)
+	get := func(owner string) *OwnerSummary {
+		s, ok := byOwner[owner]
+		if !ok {
+			s = &OwnerSummary{Owner: owner}
+			byOwner[owner] = s
+		}
+		return s
+	}
+
+	for o, t := range lastSeen {
+		t := t
+		get(o).LastSeen = &t
+	}
+	for _, e := range entries {
+		s := get(e.Owner)
+		s.CachedCount++
+		s.CachedBytes += int64(e.Size)
+	}
+
+	summaries := make([]OwnerSummary, 0, len(byOwner))
+	for _, s := range byOwner {
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Owner < summaries[j].Owner })
+
+	return summaries
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOwnerLastSeenAdvances(t *testing.T) {
+	b := newTestFSBackend(t)
+	c := newTestCache(t)
+	c.backend = b
+	now := time.Now().Truncate(time.Millisecond)
+
+	send := func(seed string, at time.Time) {
+		t.Helper()
+		cid := testCID(seed)
+		addDataset(t, b, cid, []byte("snapshot"))
+		err := c.OnNewEnvelope(testEnvelope(encodeMessage(t, QakuMessage{
+			Type:      cacheMessageType,
+			Payload:   CacheRequest{CID: cid, Owner: "alice"},
+			Timestamp: Timestamp(at.UnixMilli()),
+		})))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		seed string
+		at   time.Time
+		want time.Time
+	}{
+		{seed: "first", at: now.Add(-time.Minute), want: now.Add(-time.Minute)},
+		{seed: "newer", at: now, want: now},
+		{seed: "older", at: now.Add(-30 * time.Second), want: now},
+	}
+
+	for _, tt := range tests {
+		send(tt.seed, tt.at)
+		if got := c.activity.LastSeen()["alice"]; !got.Equal(tt.want) {
+			t.Errorf("%s: last seen %s, want %s", tt.seed, got, tt.want)
+		}
+	}
+}
+
+func TestOwnerActivityPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c, err := NewCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.UnixMilli(time.Now().UnixMilli())
+	c.activity.Seen("alice", at)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.activity.LastSeen()["alice"]; !got.Equal(at) {
+		t.Errorf("last seen %s after a restart, want %s", got, at)
+	}
+}
+
+func TestOwnersEndpoint(t *testing.T) {
+	c := newTestCache(t)
+	c.backend = newTestFSBackend(t)
+	h := newTestServer(t, c, testAdmin)
+	seen := time.UnixMilli(time.Now().UnixMilli()).UTC()
+	c.activity.Seen("alice", seen)
+	c.index.Put(CacheEntry{CID: testCID("a1"), Owner: "alice", Size: 10})
+	c.index.Put(CacheEntry{CID: testCID("a2"), Owner: "alice", Size: 5})
+	c.index.Put(CacheEntry{CID: testCID("b1"), Owner: "bob", Size: 7})
+
+	if w := get(h, "/api/qaku/v1/owners", nil); w.Code == http.StatusOK {
+		t.Error("listed the owners without admin credentials")
+	}
+	w := get(h, "/api/qaku/v1/owners", adminHeader())
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var got []OwnerSummary
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d owners, want alice and bob: %+v", len(got), got)
+	}
+	if a := got[0]; a.Owner != "alice" || a.CachedCount != 2 || a.CachedBytes != 15 || a.LastSeen == nil || !a.LastSeen.Equal(seen) {
+		t.Errorf("got %+v, want 2 entries of 15 bytes for alice last seen %s", a, seen)
+	}
+	if b := got[1]; b.Owner != "bob" || b.CachedCount != 1 || b.CachedBytes != 7 || b.LastSeen != nil {
+		t.Errorf("got %+v, want 1 entry of 7 bytes for bob, never seen", b)
+	}
+}
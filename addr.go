@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+const envInfoAddrMatch = "QAKU_CACHE_INFO_ADDR_MATCH"
+
+// addrRank scores an announce address, higher is better: a configured
+// substring match, then DNS names, then public IPs, then anything that is not
+// loopback or unspecified.
+func addrRank(addr string, match string) int {
+	if match != "" && strings.Contains(addr, match) {
+		return 4
+	}
+
+	m, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return 0
+	}
+
+	for _, p := range m.Protocols() {
+		switch p.Code {
+		case ma.P_DNS, ma.P_DNS4, ma.P_DNS6, ma.P_DNSADDR:
+			if manet.IsPublicAddr(m) {
+				return 3
+			}
+		}
+	}
+
+	if manet.IsPublicAddr(m) {
+		return 2
+	}
+
+	if !manet.IsIPLoopback(m) && !manet.IsIPUnspecified(m) {
+		return 1
+	}
+
+	return 0
+}
+
+// selectAnnounceAddr picks the most useful address for clients to connect to,
+// keeping Codex's order between equally ranked addresses. It returns false
+// when there are no addresses.
+func selectAnnounceAddr(addrs []string, match string) (string, bool) {
+	if len(addrs) == 0 {
+		return "", false
+	}
+
+	best, bestRank := addrs[0], addrRank(addrs[0], match)
+	for _, a := range addrs[1:] {
+		if r := addrRank(a, match); r > bestRank {
+			best, bestRank = a, r
+		}
+	}
+
+	return best, true
+}
+
+// validStaticNodes returns the trimmed static node multiaddrs, logging and
+// skipping the ones that cannot be dialed so one typo does not cost the rest.
+func validStaticNodes(addrs []string) []string {
+	valid := []string{}
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		m, err := ma.NewMultiaddr(addr)
+		if err == nil {
+			_, err = m.ValueForProtocol(ma.P_P2P)
+		}
+		if err != nil {
+			slog.Warn("skipping invalid static node", "addr", addr, "error", err)
+			continue
+		}
+		valid = append(valid, addr)
+	}
+
+	return valid
+}
+
+// parseBootnodes parses the discv5 bootstrap ENRs, ignoring blank entries.
+// Unlike static nodes a malformed ENR is an error: the bootnodes are often
+// the only way into a private cluster.
+func parseBootnodes(enrs []string) ([]*enode.Node, error) {
+	nodes := []*enode.Node{}
+	for _, enr := range enrs {
+		enr = strings.TrimSpace(enr)
+		if enr == "" {
+			continue
+		}
+
+		n, err := enode.Parse(enode.ValidSchemes, enr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap node %q: %w", enr, err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	return nodes, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+)
+
+func TestSelectAnnounceAddr(t *testing.T) {
+	const (
+		loopback = "/ip4/127.0.0.1/tcp/8070"
+		private  = "/ip4/10.0.0.5/tcp/8070"
+		public   = "/ip4/8.8.8.8/tcp/8070"
+		dns      = "/dns4/codex.example.com/tcp/8070"
+	)
+
+	tests := []struct {
+		name  string
+		addrs []string
+		match string
+		want  string
+	}{
+		{name: "public over private", addrs: []string{loopback, private, public}, want: public},
+		{name: "dns over public", addrs: []string{public, dns, private}, want: dns},
+		{name: "private over loopback", addrs: []string{loopback, private}, want: private},
+		{name: "match wins", addrs: []string{dns, public, private}, match: "10.0.0", want: private},
+		{name: "first of equals", addrs: []string{"/ip4/10.0.0.6/tcp/1", private}, want: "/ip4/10.0.0.6/tcp/1"},
+		{name: "malformed ignored", addrs: []string{"garbage", loopback, private}, want: private},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := selectAnnounceAddr(tt.addrs, tt.match)
+			if !ok || got != tt.want {
+				t.Errorf("selectAnnounceAddr(%v, %q) = %q, %t, want %q", tt.addrs, tt.match, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectAnnounceAddrEmpty(t *testing.T) {
+	for _, addrs := range [][]string{nil, {}} {
+		if got, ok := selectAnnounceAddr(addrs, ""); ok {
+			t.Errorf("selectAnnounceAddr(%v) = %q, want no address", addrs, got)
+		}
+	}
+}
+
+func TestValidStaticNodes(t *testing.T) {
+	const (
+		first  = "/ip4/10.0.0.1/tcp/60000/p2p/16Uiu2HAmESyLSfFZJrK4zpnSNYA8UT4ALGUyP17bGjBnDux9wEMh"
+		second = "/dns4/node.example.com/tcp/30303/p2p/16Uiu2HAmESyLSfFZJrK4zpnSNYA8UT4ALGUyP17bGjBnDux9wEMh"
+	)
+
+	got := validStaticNodes([]string{
+		first,
+		" " + second + " ",
+		"",
+		"not a multiaddr",
+		"/ip4/10.0.0.2/tcp/60000",
+		"/ip4/10.0.0.3/tcp/60000/p2p/nope",
+	})
+	if len(got) != 2 || got[0] != first || got[1] != second {
+		t.Errorf("validStaticNodes = %q, want the two valid nodes", got)
+	}
+}
+
+// testENR returns the ENR of a new node key.
+func testENR(t *testing.T) (string, *enode.Node) {
+	t.Helper()
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r enr.Record
+	if err := enode.SignV4(&r, key); err != nil {
+		t.Fatal(err)
+	}
+	n, err := enode.New(enode.ValidSchemes, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n.String(), n
+}
+
+func TestParseBootnodes(t *testing.T) {
+	first, firstNode := testENR(t)
+	second, secondNode := testENR(t)
+
+	nodes, err := parseBootnodes([]string{first, " " + second, ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0].ID() != firstNode.ID() || nodes[1].ID() != secondNode.ID() {
+		t.Errorf("parsed %v, want both bootstrap nodes in order", nodes)
+	}
+
+	clearConfigEnv(t)
+	t.Setenv(envDiscV5Bootnodes, first+","+second)
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err := parseBootnodes(cfg.Bootnodes); err != nil || len(nodes) != 2 {
+		t.Errorf("parsed %v, %v from %s, want both bootstrap nodes", nodes, err, envDiscV5Bootnodes)
+	}
+
+	if nodes, err := parseBootnodes(nil); err != nil || len(nodes) != 0 {
+		t.Errorf("parseBootnodes(nil) = %v, %v, want no nodes", nodes, err)
+	}
+
+	_, err = parseBootnodes([]string{first, "enr:-not-a-record"})
+	if err == nil || !strings.Contains(err.Error(), "enr:-not-a-record") {
+		t.Errorf("got error %v, want the malformed entry reported", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envAllowanceURL      = "QAKU_CACHE_ALLOWANCE_URL"
+	envAllowanceCacheTTL = "QAKU_CACHE_ALLOWANCE_CACHE_TTL"
+	envAllowanceFailOpen = "QAKU_CACHE_ALLOWANCE_FAIL_OPEN"
+
+	defaultAllowanceCacheTTL = 30 * time.Second
+	allowanceTimeout         = 5 * time.Second
+)
+
+var (
+	snapAllowanceDenied = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_allowance_denied",
+		Help: "The number of cache requests rejected for exceeding the owner's allowance",
+	})
+	allowanceErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_allowance_errors",
+		Help: "The number of failed allowance lookups",
+	})
+)
+
+type AllowanceResponse struct {
+	Remaining int64 `json:"remaining"`
+}
+
+type cachedAllowance struct {
+	remaining int64
+	fetchedAt time.Time
+}
+
+// allowanceChecker asks an external service how many bytes an owner may
+// still cache. Answers are reused for ttl to limit calls. When the service
+// cannot be reached, failOpen decides whether the request goes ahead.
+type allowanceChecker struct {
+	url      string
+	ttl      time.Duration
+	failOpen bool
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedAllowance
+}
+
+func newAllowanceChecker(url string, ttl time.Duration, failOpen bool) *allowanceChecker {
+	return &allowanceChecker{
+		url:      url,
+		ttl:      ttl,
+		failOpen: failOpen,
+		client:   &http.Client{Timeout: allowanceTimeout},
+		cache:    make(map[string]cachedAllowance),
+	}
+}
+
+// Check returns an error if owner may not cache size more bytes. A nil checker
+// allows everything.
+func (a *allowanceChecker) Check(ctx context.Context, owner string, size int) error {
+	if a == nil {
+		return nil
+	}
+
+	remaining, err := a.remaining(ctx, owner)
+	if err != nil {
+		allowanceErrors.Inc()
+		if a.failOpen {
+			slog.Warn("allowance lookup failed, allowing", "owner", owner, "error", err)
+			return nil
+		}
+		return fmt.Errorf("allowance lookup for %s failed: %w", owner, err)
+	}
+
+	if int64(size) > remaining {
+		snapAllowanceDenied.Inc()
+		return fmt.Errorf("owner %s has %d bytes of allowance left, dataset needs %d", owner, remaining, size)
+	}
+
+	return nil
+}
+
+// Shed drops the cached answers to relieve memory pressure and returns how
+// many were dropped. They are fetched from the service again when needed.
+func (a *allowanceChecker) Shed() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := len(a.cache)
+	a.cache = make(map[string]cachedAllowance)
+
+	return n
+}
+
+func (a *allowanceChecker) remaining(ctx context.Context, owner string) (int64, error) {
+	a.mu.Lock()
+	cached, ok := a.cache[owner]
+	a.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < a.ttl {
+		return cached.remaining, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url+"?owner="+url.QueryEscape(owner), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("allowance service returned %s", resp.Status)
+	}
+
+	ar := AllowanceResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&ar)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode allowance: %w", err)
+	}
+
+	a.mu.Lock()
+	a.cache[owner] = cachedAllowance{remaining: ar.Remaining, fetchedAt: time.Now()}
+	a.mu.Unlock()
+
+	return ar.Remaining, nil
+}
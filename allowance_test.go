@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// allowanceService answers allowance lookups from a fixed map of owners.
+type allowanceService struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	lookups int
+}
+
+func newAllowanceService(t *testing.T, remaining map[string]int64) *allowanceService {
+	t.Helper()
+
+	s := &allowanceService{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.lookups++
+		s.mu.Unlock()
+
+		json.NewEncoder(w).Encode(AllowanceResponse{Remaining: remaining[r.URL.Query().Get("owner")]})
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *allowanceService) Lookups() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lookups
+}
+
+func TestAllowanceChecker(t *testing.T) {
+	live := newAllowanceService(t, map[string]int64{"alice": 100, "bob": 10})
+	down := newAllowanceService(t, nil)
+	down.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		failOpen bool
+		owner    string
+		size     int
+		wantErr  bool
+	}{
+		{name: "allowed", url: live.URL, owner: "alice", size: 100},
+		{name: "denied", url: live.URL, owner: "bob", size: 11, wantErr: true},
+		{name: "unknown owner", url: live.URL, owner: "carol", size: 1, wantErr: true},
+		{name: "down fail closed", url: down.URL, owner: "alice", size: 1, wantErr: true},
+		{name: "down fail open", url: down.URL, failOpen: true, owner: "alice", size: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAllowanceChecker(tt.url, time.Minute, tt.failOpen)
+			err := a.Check(context.Background(), tt.owner, tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+
+	var nilChecker *allowanceChecker
+	if err := nilChecker.Check(context.Background(), "alice", 1); err != nil {
+		t.Errorf("a nil checker denied a request: %v", err)
+	}
+}
+
+func TestAllowanceCached(t *testing.T) {
+	s := newAllowanceService(t, map[string]int64{"alice": 100})
+	a := newAllowanceChecker(s.URL, time.Minute, false)
+
+	for i := 0; i < 3; i++ {
+		if err := a.Check(context.Background(), "alice", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.Lookups(); got != 1 {
+		t.Errorf("looked up the allowance %d times within the TTL, want 1", got)
+	}
+
+	a.ttl = 0
+	if err := a.Check(context.Background(), "alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Lookups(); got != 2 {
+		t.Errorf("looked up the allowance %d times after the TTL, want 2", got)
+	}
+
+	if n := a.Shed(); n != 1 {
+		t.Errorf("shed %d cached answers, want 1", n)
+	}
+	if err := a.Check(context.Background(), "alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Lookups(); got != 3 {
+		t.Errorf("looked up the allowance %d times after shedding, want 3", got)
+	}
+}
+
+func TestProcessChecksAllowance(t *testing.T) {
+	s := newAllowanceService(t, map[string]int64{"alice": 100, "bob": 1})
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	c.allowance = newAllowanceChecker(s.URL, time.Minute, false)
+
+	for _, tt := range []struct {
+		owner string
+		want  bool
+	}{{owner: "alice", want: true}, {owner: "bob", want: false}} {
+		cid := testCID(tt.owner)
+		m.Add(cid, []byte("data"))
+		c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, tt.owner)))
+		if got := c.index.Has(cid); got != tt.want {
+			t.Errorf("cached the dataset of %s = %t, want %t", tt.owner, got, tt.want)
+		}
+	}
+}
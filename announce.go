@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+	"github.com/waku-org/go-waku/waku/v2/protocol/lightpush"
+	"github.com/waku-org/go-waku/waku/v2/protocol/pb"
+	"github.com/waku-org/go-waku/waku/v2/utils"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	envAnnounceTopic    = "QAKU_CACHE_ANNOUNCE_TOPIC"
+	envAnnounceMinPeers = "QAKU_CACHE_ANNOUNCE_MIN_PEERS"
+
+	defaultAnnounceMinPeers = 1
+	announceQueueSize       = 100
+	announceTimeout         = 10 * time.Second
+
+	messageTypeCached = "cached"
+)
+
+var (
+	announceSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_announcements",
+		Help: "The total number of cache confirmations published to Waku",
+	})
+	announceSuppressed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_announcements_suppressed",
+		Help: "The total number of cache confirmations dropped because too few peers were connected",
+	})
+)
+
+// announcer publishes a confirmation over Waku lightpush for every cached
+// dataset. Confirmations are dropped while the node has fewer than minPeers
+// connected peers, since there is nobody to deliver them to.
+type announcer struct {
+	nodes       wakuNodes
+	topic       protocol.ContentTopic
+	pubsubTopic string
+	minPeers    int
+	queue       chan CacheRequest
+}
+
+func newAnnouncer(nodes wakuNodes, topic protocol.ContentTopic, pubsubTopic string, minPeers int) *announcer {
+	if pubsubTopic == "" {
+		pubsubTopic = contentTopicShard(topic)
+	}
+
+	return &announcer{
+		nodes:       nodes,
+		topic:       topic,
+		pubsubTopic: pubsubTopic,
+		minPeers:    minPeers,
+		queue:       make(chan CacheRequest, announceQueueSize),
+	}
+}
+
+// Announce queues a confirmation for cr without blocking.
+func (a *announcer) Announce(cr CacheRequest) {
+	if a == nil {
+		return
+	}
+
+	select {
+	case a.queue <- cr:
+	default:
+		slog.Warn("announce queue full, dropping confirmation", "cid", cr.CID)
+	}
+}
+
+func (a *announcer) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cr := <-a.queue:
+			if peers := a.nodes.Node().PeerCount(); peers < a.minPeers {
+				announceSuppressed.Inc()
+				slog.Info("not announcing, too few peers", "cid", cr.CID, "peers", peers, "minPeers", a.minPeers)
+				continue
+			}
+
+			err := a.publish(ctx, cr)
+			if err != nil {
+				slog.Error("failed to announce", "cid", cr.CID, "error", err)
+				continue
+			}
+			announceSent.Inc()
+		}
+	}
+}
+
+func (a *announcer) publish(ctx context.Context, cr CacheRequest) error {
+	payload, err := json.Marshal(QakuMessage{
+		Type:      messageTypeCached,
+		Payload:   cr,
+		Timestamp: Timestamp(time.Now().UnixMilli()),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, announceTimeout)
+	defer cancel()
+
+	_, err = a.nodes.Node().Lightpush().Publish(ctx, &pb.WakuMessage{
+		Payload:      payload,
+		ContentTopic: a.topic.String(),
+		Timestamp:    utils.GetUnixEpoch(),
+		Version:      proto.Uint32(0),
+	}, lightpush.WithPubSubTopic(a.pubsubTopic))
+
+	return err
+}
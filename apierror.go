@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIError is the body of every API error response, wrapped in an "error"
+// field.
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// errorCode derives the machine readable code from the status, e.g.
+// not_found for 404.
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+
+	return strings.ToLower(strings.ReplaceAll(strings.ReplaceAll(text, "-", "_"), " ", "_"))
+}
+
+// newAPIError describes the error of the request, for handlers that answer
+// with more fields next to the error envelope.
+func newAPIError(c *gin.Context, status int, message string) APIError {
+	return APIError{
+		Code:      errorCode(status),
+		Message:   message,
+		RequestID: requestIDFrom(c.Request.Context()),
+	}
+}
+
+// apiError aborts the request with the error envelope.
+func apiError(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": newAPIError(c, status, message)})
+}
+
+// handleErrors answers requests whose handler recorded errors in c.Errors
+// without writing a response.
+func handleErrors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		apiError(c, http.StatusInternalServerError, c.Errors.Last().Error())
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := map[int]string{
+		http.StatusBadRequest:           "bad_request",
+		http.StatusNotFound:             "not_found",
+		http.StatusBadGateway:           "bad_gateway",
+		http.StatusNonAuthoritativeInfo: "non_authoritative_information",
+		599:                             "error",
+	}
+
+	for status, want := range tests {
+		if got := errorCode(status); got != want {
+			t.Errorf("errorCode(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+// decodeAPIError decodes the error envelope of a response body.
+func decodeAPIError(t *testing.T, body []byte) APIError {
+	t.Helper()
+
+	var resp struct {
+		Error *APIError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Error == nil {
+		t.Fatalf("body %s is not an error envelope: %v", body, err)
+	}
+
+	return *resp.Error
+}
+
+func TestAPIErrorResponses(t *testing.T) {
+	noRetries(t)
+	c := newTestCache(t)
+	c.backend = newCodexBackend(codexInfoServer(t, http.StatusInternalServerError, "boom"))
+	h := newTestServer(t, c, nil)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{name: "invalid CID", method: http.MethodGet, path: "/api/qaku/v1/snapshot/nope", wantStatus: http.StatusBadRequest},
+		{name: "Codex failing", method: http.MethodGet, path: "/api/qaku/v1/info", wantStatus: http.StatusBadGateway},
+		{name: "admin disabled", method: http.MethodDelete, path: "/api/qaku/v1/snapshot/" + testCID("x"), wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(h, tt.method, tt.path, nil, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+				t.Errorf("got Content-Type %q, want JSON", ct)
+			}
+			got := decodeAPIError(t, w.Body.Bytes())
+			if got.Code != errorCode(tt.wantStatus) || got.Message == "" {
+				t.Errorf("got %+v, want code %s and a message", got, errorCode(tt.wantStatus))
+			}
+			if id := w.Header().Get(defaultRequestIDHeader); got.RequestID != id {
+				t.Errorf("got request id %q, want %q", got.RequestID, id)
+			}
+		})
+	}
+}
+
+func TestHandleErrors(t *testing.T) {
+	r := gin.New()
+	r.Use(requestID(), handleErrors())
+	r.GET("/recorded", func(c *gin.Context) { c.Error(errors.New("store unavailable")) })
+	r.GET("/written", func(c *gin.Context) {
+		c.Error(errors.New("logged only"))
+		c.String(http.StatusTeapot, "answered")
+	})
+
+	w := get(r, "/recorded", nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d for a recorded error, want 500", w.Code)
+	}
+	if got := decodeAPIError(t, w.Body.Bytes()); got.Message != "store unavailable" || got.Code != "internal_server_error" {
+		t.Errorf("got %+v, want the recorded error", got)
+	}
+
+	if w := get(r, "/written", nil); w.Code != http.StatusTeapot || w.Body.String() != "answered" {
+		t.Errorf("got %d %q, want the handler's own response", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const envAuditPath = "QAKU_CACHE_AUDIT_PATH"
+
+// auditSink appends audit events to a dedicated JSONL file. Every record
+// carries the hash of the previous one and its own hash over that and its
+// content, so removing or editing a record breaks the chain.
+type auditSink struct {
+	mu   sync.Mutex
+	f    *os.File
+	prev string
+}
+
+// auditLog is the destination of audit events, nil writes them to the
+// operational log instead.
+var auditLog *auditSink
+
+// openAuditSink opens path for appending and resumes the hash chain from its
+// last record.
+func openAuditSink(path string) (*auditSink, error) {
+	prev, err := lastAuditHash(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	return &auditSink{f: f, prev: prev}, nil
+}
+
+func lastAuditHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer f.Close()
+
+	last := ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		record := struct {
+			Hash string `json:"hash"`
+		}{}
+		if json.Unmarshal(scanner.Bytes(), &record) == nil && record.Hash != "" {
+			last = record.Hash
+		}
+	}
+
+	return last, scanner.Err()
+}
+
+func (s *auditSink) write(entry map[string]any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry["prev"] = s.prev
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(append([]byte(s.prev), content...))
+	entry["hash"] = hex.EncodeToString(sum[:])
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.f.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	s.prev = entry["hash"].(string)
+
+	return nil
+}
+
+// audit records a security relevant event.
+func audit(event string, fields map[string]any) {
+	entry := map[string]any{
+		"event": event,
+		"time":  time.Now().UTC(),
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+
+	if auditLog != nil {
+		err := auditLog.write(entry)
+		if err == nil {
+			return
+		}
+		slog.Error("failed to write audit event", "error", err)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("failed to marshal audit event", "error", err)
+		return
+	}
+
+	slog.Info("audit", "event", json.RawMessage(data))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	envAdminAuth       = "QAKU_CACHE_ADMIN_AUTH"
+	envAdminHMACSecret = "QAKU_CACHE_ADMIN_HMAC_SECRET"
+	envAdminJWTSecret  = "QAKU_CACHE_ADMIN_JWT_SECRET"
+	envAdminJWTIssuer  = "QAKU_CACHE_ADMIN_JWT_ISSUER"
+
+	adminAuthToken = "token"
+	adminAuthHMAC  = "hmac"
+	adminAuthJWT   = "jwt"
+
+	hmacTimestampHeader = "X-Qaku-Timestamp"
+	hmacSignatureHeader = "X-Qaku-Signature"
+	hmacMaxSkew         = 5 * time.Minute
+
+	// hmacMaxBodySize bounds the body read before the request is
+	// authenticated, the admin API only takes small JSON bodies.
+	hmacMaxBodySize = 1 << 20
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+// AdminAuthenticator decides whether a request may use the admin endpoints.
+type AdminAuthenticator interface {
+	Authenticate(r *http.Request) error
+}
+
+// newAdminAuthenticator builds the strategy selected by QAKU_CACHE_ADMIN_AUTH.
+// It returns nil when the selected strategy has no secret configured, which
+// disables the admin endpoints.
+func newAdminAuthenticator() (AdminAuthenticator, error) {
+	switch strategy := os.Getenv(envAdminAuth); strategy {
+	case "", adminAuthToken:
+		if token := os.Getenv(envAdminToken); token != "" {
+			return &staticTokenAuth{token: token}, nil
+		}
+	case adminAuthHMAC:
+		if secret := os.Getenv(envAdminHMACSecret); secret != "" {
+			return &hmacAuth{secret: []byte(secret), maxSkew: hmacMaxSkew}, nil
+		}
+	case adminAuthJWT:
+		if secret := os.Getenv(envAdminJWTSecret); secret != "" {
+			return &jwtAuth{secret: []byte(secret), issuer: os.Getenv(envAdminJWTIssuer)}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown %s strategy %q", envAdminAuth, strategy)
+	}
+
+	return nil, nil
+}
+
+// staticTokenAuth expects "Authorization: Bearer <token>".
+type staticTokenAuth struct {
+	token string
+}
+
+func (a *staticTokenAuth) Authenticate(r *http.Request) error {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.token)) != 1 {
+		return errUnauthorized
+	}
+
+	return nil
+}
+
+// hmacAuth expects the unix timestamp in X-Qaku-Timestamp and a hex encoded
+// HMAC-SHA256 in X-Qaku-Signature over
+// "<method>\n<path>\n<raw query>\n<timestamp>\n<hex sha256 of body>".
+type hmacAuth struct {
+	secret  []byte
+	maxSkew time.Duration
+	now     func() time.Time
+}
+
+func (a *hmacAuth) Authenticate(r *http.Request) error {
+	ts := r.Header.Get(hmacTimestampHeader)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errUnauthorized
+	}
+
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	if skew := now().Sub(time.Unix(sec, 0)); skew > a.maxSkew || skew < -a.maxSkew {
+		return fmt.Errorf("%w: timestamp outside allowed skew", errUnauthorized)
+	}
+
+	sig, err := hex.DecodeString(r.Header.Get(hmacSignatureHeader))
+	if err != nil {
+		return errUnauthorized
+	}
+
+	body := []byte{}
+	if r.Body != nil {
+		body, err = io.ReadAll(http.MaxBytesReader(nil, r.Body, hmacMaxBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return fmt.Errorf("%w: body larger than %d bytes", errUnauthorized, tooLarge.Limit)
+		}
+		if err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	bodyHash := sha256.Sum256(body)
+
+	if !hmac.Equal(sig, signHMAC(a.secret, r.Method, r.URL.Path, r.URL.RawQuery, ts, hex.EncodeToString(bodyHash[:]))) {
+		return errUnauthorized
+	}
+
+	return nil
+}
+
+func signHMAC(secret []byte, parts ...string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return mac.Sum(nil)
+}
+
+// jwtAuth validates HS256 bearer tokens, checking exp/nbf and, if configured,
+// the issuer.
+type jwtAuth struct {
+	secret []byte
+	issuer string
+	now    func() time.Time
+}
+
+type jwtClaims struct {
+	Issuer    string `json:"iss"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+func (a *jwtAuth) Authenticate(r *http.Request) error {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return errUnauthorized
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errUnauthorized
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+	}{}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return errUnauthorized
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, signHS256(a.secret, parts[0]+"."+parts[1])) {
+		return errUnauthorized
+	}
+
+	claims := jwtClaims{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return errUnauthorized
+	}
+
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	if claims.ExpiresAt == 0 || now().Unix() >= claims.ExpiresAt {
+		return fmt.Errorf("%w: token expired", errUnauthorized)
+	}
+	if claims.NotBefore != 0 && now().Unix() < claims.NotBefore {
+		return fmt.Errorf("%w: token not yet valid", errUnauthorized)
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return fmt.Errorf("%w: unexpected issuer", errUnauthorized)
+	}
+
+	return nil
+}
+
+func signHS256(secret []byte, data string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
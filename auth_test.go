@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaticTokenAuth(t *testing.T) {
+	a := &staticTokenAuth{token: "secret"}
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "Bearer secret", want: true},
+		{header: "Bearer wrong"},
+		{header: "secret"},
+		{header: ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/qaku/v1/inflight", nil)
+		r.Header.Set("Authorization", tt.header)
+		if err := a.Authenticate(r); (err == nil) != tt.want {
+			t.Errorf("Authorization %q: got %v, want accepted %t", tt.header, err, tt.want)
+		}
+	}
+}
+
+// hmacRequest builds a request signed for secret at ts.
+func hmacRequest(secret string, method string, target string, body string, ts time.Time) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	sum := sha256.Sum256([]byte(body))
+	stamp := strconv.FormatInt(ts.Unix(), 10)
+	sig := signHMAC([]byte(secret), method, r.URL.Path, r.URL.RawQuery, stamp, hex.EncodeToString(sum[:]))
+	r.Header.Set(hmacTimestampHeader, stamp)
+	r.Header.Set(hmacSignatureHeader, hex.EncodeToString(sig))
+
+	return r
+}
+
+func TestHMACAuth(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	a := &hmacAuth{secret: []byte("secret"), maxSkew: time.Minute, now: func() time.Time { return now }}
+
+	tests := []struct {
+		name string
+		req  func() *http.Request
+		want bool
+	}{
+		{
+			name: "valid",
+			req:  func() *http.Request { return hmacRequest("secret", "POST", "/api/qaku/v1/cache", `{"cid":"x"}`, now) },
+			want: true,
+		},
+		{
+			name: "wrong secret",
+			req:  func() *http.Request { return hmacRequest("other", "POST", "/api/qaku/v1/cache", `{}`, now) },
+		},
+		{
+			name: "stale",
+			req: func() *http.Request {
+				return hmacRequest("secret", "POST", "/api/qaku/v1/cache", `{}`, now.Add(-2*time.Minute))
+			},
+		},
+		{
+			name: "tampered body",
+			req: func() *http.Request {
+				r := hmacRequest("secret", "POST", "/api/qaku/v1/cache", `{"cid":"x"}`, now)
+				r.Body = httptest.NewRequest("POST", "/", strings.NewReader(`{"cid":"y"}`)).Body
+				return r
+			},
+		},
+		{
+			name: "tampered query",
+			req: func() *http.Request {
+				r := hmacRequest("secret", "GET", "/api/qaku/v1/entries?owner=a", "", now)
+				r.URL.RawQuery = "owner=b"
+				return r
+			},
+		},
+		{
+			name: "body too large",
+			req: func() *http.Request {
+				return hmacRequest("secret", "POST", "/api/qaku/v1/cache", strings.Repeat("x", hmacMaxBodySize+1), now)
+			},
+		},
+		{
+			name: "missing headers",
+			req:  func() *http.Request { return httptest.NewRequest("GET", "/api/qaku/v1/inflight", nil) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.Authenticate(tt.req())
+			if (err == nil) != tt.want {
+				t.Errorf("got %v, want accepted %t", err, tt.want)
+			}
+			if err != nil && !errors.Is(err, errUnauthorized) {
+				t.Errorf("got %v, want errUnauthorized", err)
+			}
+		})
+	}
+}
+
+func TestHMACAuthKeepsBody(t *testing.T) {
+	now := time.Now()
+	a := &hmacAuth{secret: []byte("secret"), maxSkew: time.Minute}
+	r := hmacRequest("secret", "POST", "/api/qaku/v1/cache", `{"cid":"x"}`, now)
+
+	if err := a.Authenticate(r); err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	body.ReadFrom(r.Body)
+	if body.String() != `{"cid":"x"}` {
+		t.Errorf("handler would read %q", body.String())
+	}
+}
+
+// jwtToken signs the claims with secret, alg overrides HS256.
+func jwtToken(t *testing.T, secret string, alg string, claims jwtClaims) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return signing + "." + base64.RawURLEncoding.EncodeToString(signHS256([]byte(secret), signing))
+}
+
+func TestJWTAuth(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	a := &jwtAuth{secret: []byte("secret"), issuer: "ops", now: func() time.Time { return now }}
+	valid := jwtClaims{Issuer: "ops", ExpiresAt: now.Add(time.Hour).Unix()}
+
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{name: "valid", token: jwtToken(t, "secret", "HS256", valid), want: true},
+		{name: "wrong secret", token: jwtToken(t, "other", "HS256", valid)},
+		{name: "alg none", token: jwtToken(t, "secret", "none", valid)},
+		{name: "expired", token: jwtToken(t, "secret", "HS256", jwtClaims{Issuer: "ops", ExpiresAt: now.Unix()})},
+		{name: "no expiry", token: jwtToken(t, "secret", "HS256", jwtClaims{Issuer: "ops"})},
+		{name: "not yet valid", token: jwtToken(t, "secret", "HS256", jwtClaims{Issuer: "ops", ExpiresAt: valid.ExpiresAt, NotBefore: now.Add(time.Minute).Unix()})},
+		{name: "wrong issuer", token: jwtToken(t, "secret", "HS256", jwtClaims{Issuer: "dev", ExpiresAt: valid.ExpiresAt})},
+		{name: "malformed", token: "a.b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/qaku/v1/inflight", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			if err := a.Authenticate(r); (err == nil) != tt.want {
+				t.Errorf("got %v, want accepted %t", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAdminAuthenticator(t *testing.T) {
+	tests := []struct {
+		env     map[string]string
+		want    string
+		wantErr bool
+	}{
+		{env: map[string]string{envAdminToken: "t"}, want: "*main.staticTokenAuth"},
+		{env: map[string]string{envAdminAuth: adminAuthHMAC, envAdminHMACSecret: "s"}, want: "*main.hmacAuth"},
+		{env: map[string]string{envAdminAuth: adminAuthJWT, envAdminJWTSecret: "s"}, want: "*main.jwtAuth"},
+		{env: map[string]string{envAdminAuth: adminAuthHMAC}, want: "<nil>"},
+		{env: map[string]string{envAdminAuth: "basic"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		for _, k := range []string{envAdminAuth, envAdminToken, envAdminHMACSecret, envAdminJWTSecret} {
+			t.Setenv(k, tt.env[k])
+		}
+
+		a, err := newAdminAuthenticator()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: got error %v, want %t", tt.env, err, tt.wantErr)
+			continue
+		}
+		if got := fmt.Sprintf("%T", a); !tt.wantErr && got != tt.want {
+			t.Errorf("%v: got %s, want %s", tt.env, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	envBackend      = "QAKU_CACHE_BACKEND"
+	envFSBackendDir = "QAKU_CACHE_FS_BACKEND_DIR"
+
+	backendCodex = "codex"
+	backendFS    = "fs"
+
+	// fsBackendBlockSize is reported as the manifest block size, the Codex
+	// default.
+	fsBackendBlockSize = 64 * 1024
+)
+
+// Backend stores the cached datasets. The cache and the proxy only talk to
+// the storage through it.
+type Backend interface {
+	// DebugInfo returns the identity of the storage node.
+	DebugInfo(ctx context.Context) (*DebugInfo, error)
+	// FetchManifest retrieves the dataset manifest from the network.
+	FetchManifest(ctx context.Context, cid string) (*CodexDataContent, error)
+	// Download requests the locally stored dataset with the extra header,
+	// the caller has to close the response body.
+	Download(ctx context.Context, cid string, header http.Header) (*http.Response, error)
+	// Stream reads the dataset from the network whether or not it is local
+	// yet, the caller has to close the response body.
+	Stream(ctx context.Context, cid string) (*http.Response, error)
+	// FetchToNetwork fetches the dataset from the network into the local
+	// store. It returns errDatasetNotFound if the network does not know it.
+	FetchToNetwork(ctx context.Context, cid string) error
+	// Unpin removes the dataset from the local store.
+	Unpin(ctx context.Context, cid string) error
+	// Has reports whether the dataset is in the local store, without
+	// reading it.
+	Has(ctx context.Context, cid string) (bool, error)
+	// Upload stores data in the local store and returns its CID.
+	Upload(ctx context.Context, data []byte) (string, error)
+}
+
+// errDatasetNotFound marks datasets the network does not know.
+var errDatasetNotFound = errors.New("dataset not found")
+
+func validBackend(kind string) bool {
+	return kind == backendCodex || kind == backendFS
+}
+
+// newBackend creates the backend of the given kind.
+func newBackend(kind string) (Backend, error) {
+	switch kind {
+	case backendCodex:
+		return newCodexBackend(getCodexUrl()), nil
+	case backendFS:
+		return newFSBackend(os.Getenv(envFSBackendDir))
+	}
+
+	return nil, fmt.Errorf("unknown %s %q, expected %s or %s", envBackend, kind, backendCodex, backendFS)
+}
+
+// fsBackend keeps datasets in a directory, meant for testing without a Codex
+// node. Files in the network directory, named by CID, stand in for the
+// network and pinned datasets are copied to the local directory.
+type fsBackend struct {
+	network string
+	local   string
+}
+
+func newFSBackend(dir string) (*fsBackend, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("%s must be set for the %s backend", envFSBackendDir, backendFS)
+	}
+
+	b := &fsBackend{network: filepath.Join(dir, "network"), local: filepath.Join(dir, "local")}
+	for _, d := range []string{b.network, b.local} {
+		err := os.MkdirAll(d, 0o755)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backend directory: %w", err)
+		}
+	}
+
+	return b, nil
+}
+
+func (b *fsBackend) DebugInfo(ctx context.Context) (*DebugInfo, error) {
+	return &DebugInfo{ID: backendFS, AnnouncedAddrs: []string{}}, nil
+}
+
+func (b *fsBackend) FetchManifest(ctx context.Context, cid string) (*CodexDataContent, error) {
+	info, err := os.Stat(filepath.Join(b.network, filepath.Base(cid)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+
+	return &CodexDataContent{
+		Cid: cid,
+		Manifest: CodexManifest{
+			DatasetSize: int(info.Size()),
+			BlockSize:   fsBackendBlockSize,
+			TreeCid:     cid,
+			UploadedAt:  info.ModTime().UTC().Format(time.RFC3339),
+		},
+	}, nil
+}
+
+// Download ignores the header, the whole dataset is always returned.
+func (b *fsBackend) Download(ctx context.Context, cid string, header http.Header) (*http.Response, error) {
+	return fileResponse(filepath.Join(b.local, filepath.Base(cid)))
+}
+
+func (b *fsBackend) Stream(ctx context.Context, cid string) (*http.Response, error) {
+	return fileResponse(filepath.Join(b.network, filepath.Base(cid)))
+}
+
+func (b *fsBackend) FetchToNetwork(ctx context.Context, cid string) error {
+	name := filepath.Base(cid)
+	src, err := os.Open(filepath.Join(b.network, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to fetch %s: %w", cid, errDatasetNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", cid, err)
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(b.local, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", cid, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", cid, err)
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(b.local, name))
+}
+
+func (b *fsBackend) Unpin(ctx context.Context, cid string) error {
+	err := os.Remove(filepath.Join(b.local, filepath.Base(cid)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to unpin %s: %w", cid, err)
+	}
+
+	return nil
+}
+
+func (b *fsBackend) Has(ctx context.Context, cid string) (bool, error) {
+	_, err := os.Stat(filepath.Join(b.local, filepath.Base(cid)))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s: %w", cid, err)
+	}
+
+	return true, nil
+}
+
+// Upload names the file after the SHA-256 digest of data and makes it
+// available on the network as well.
+func (b *fsBackend) Upload(ctx context.Context, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	cid := hex.EncodeToString(sum[:])
+
+	for _, dir := range []string{b.network, b.local} {
+		err := os.WriteFile(filepath.Join(dir, cid), data, 0o644)
+		if err != nil {
+			return "", fmt.Errorf("failed to upload: %w", err)
+		}
+	}
+
+	return cid, nil
+}
+
+// fileResponse serves the file like the Codex API would, a missing file is
+// a 404.
+func fileResponse(path string) (*http.Response, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &http.Response{
+			Status:     "404 Not Found",
+			StatusCode: http.StatusNotFound,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"application/octet-stream"}},
+		Body:          f,
+		ContentLength: info.Size(),
+	}, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestNewBackend(t *testing.T) {
+	t.Setenv(envFSBackendDir, t.TempDir())
+	if b, err := newBackend(backendFS); err != nil {
+		t.Error(err)
+	} else if _, ok := b.(*fsBackend); !ok {
+		t.Errorf("newBackend(%s) = %T, want the filesystem backend", backendFS, b)
+	}
+	if b, err := newBackend(backendCodex); err != nil {
+		t.Error(err)
+	} else if _, ok := b.(*codexBackend); !ok {
+		t.Errorf("newBackend(%s) = %T, want the Codex backend", backendCodex, b)
+	}
+	if _, err := newBackend("ipfs"); err == nil {
+		t.Error("created an unknown backend")
+	}
+
+	t.Setenv(envFSBackendDir, "")
+	if _, err := newBackend(backendFS); err == nil {
+		t.Errorf("created the filesystem backend without %s", envFSBackendDir)
+	}
+}
+
+// downloadStatus returns the status of downloading cid from the local store
+// of b.
+func downloadStatus(t *testing.T, b Backend, cid string) int {
+	t.Helper()
+
+	resp, err := b.Download(context.Background(), cid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestFSBackend(t *testing.T) {
+	ctx := context.Background()
+	b := newTestFSBackend(t)
+	known, unknown := testCID("known"), testCID("unknown")
+	addDataset(t, b, known, []byte("snapshot"))
+
+	if _, err := b.FetchManifest(ctx, unknown); err == nil {
+		t.Error("fetched the manifest of an unknown dataset")
+	}
+	if err := b.FetchToNetwork(ctx, unknown); !errors.Is(err, errDatasetNotFound) {
+		t.Errorf("FetchToNetwork = %v, want %v", err, errDatasetNotFound)
+	}
+	if got := downloadStatus(t, b, known); got != http.StatusNotFound {
+		t.Errorf("Download before the fetch answered %d, want 404", got)
+	}
+
+	cdc, err := b.FetchManifest(ctx, known)
+	if err != nil || cdc.Manifest.DatasetSize != len("snapshot") {
+		t.Errorf("FetchManifest = %+v, %v, want the dataset size", cdc, err)
+	}
+	if err := b.FetchToNetwork(ctx, known); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := b.Download(ctx, known, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "snapshot" {
+		t.Errorf("downloaded %q, want the fetched dataset", data)
+	}
+
+	if err := b.Unpin(ctx, known); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Unpin(ctx, known); err != nil {
+		t.Errorf("unpinning twice = %v, want no error", err)
+	}
+	if got := downloadStatus(t, b, known); got != http.StatusNotFound {
+		t.Errorf("Download of the unpinned dataset answered %d, want 404", got)
+	}
+}
+
+func TestCachePipelineOnFSBackend(t *testing.T) {
+	t.Setenv(envFSBackendDir, t.TempDir())
+	backend, err := newBackend(backendFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCache(t)
+	c.backend = backend
+	h := newTestServer(t, c, testAdmin)
+	cid := testCID("pipeline")
+	addDataset(t, backend.(*fsBackend), cid, []byte("snapshot"))
+
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(h, "/api/qaku/v1/snapshot/"+cid, nil); w.Code != http.StatusOK || w.Body.String() != "snapshot" {
+		t.Errorf("got %d %q, want the cached snapshot", w.Code, w.Body.String())
+	}
+	if w := do(h, http.MethodDelete, "/api/qaku/v1/snapshot/"+cid, adminHeader(), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete answered %d: %s", w.Code, w.Body)
+	}
+	if downloadStatus(t, backend, cid) != http.StatusNotFound || c.index.Has(cid) {
+		t.Error("the deleted snapshot is still stored")
+	}
+	if w := get(h, "/api/qaku/v1/snapshot/"+cid, nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d for the deleted snapshot, want 404", w.Code)
+	}
+}
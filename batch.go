@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envMaxBatchSize = "QAKU_CACHE_MAX_BATCH_SIZE"
+
+	defaultMaxBatchSize = 4 * defaultMaxSize
+)
+
+var errBatchCap = errors.New("batch size cap exceeded")
+
+var batchItems = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "qaku_cache_batch_items",
+	Help: "The number of processed batch request items by result",
+}, []string{"result"})
+
+// maxBatchSize caps the combined dataset size cached from one batch request.
+var maxBatchSize = defaultMaxBatchSize
+
+// BatchItem is one dataset of a batch cache request.
+type BatchItem struct {
+	CID  string `json:"cid"`
+	Hash string `json:"hash,omitempty"`
+
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// checkCIDs validates the CID of a single request or every CID of a batch,
+// which must not set the single CID as well.
+func checkCIDs(p CacheRequest) error {
+	if len(p.Batch) == 0 {
+		if !isValidCID(p.CID) {
+			return fmt.Errorf("invalid CID %q", p.CID)
+		}
+		return nil
+	}
+
+	if p.CID != "" {
+		return fmt.Errorf("batch request must not set a CID, got %q", p.CID)
+	}
+	for _, item := range p.Batch {
+		if !isValidCID(item.CID) {
+			return fmt.Errorf("invalid CID %q in batch", item.CID)
+		}
+	}
+
+	return nil
+}
+
+// processBatch caches the batch items in order until their combined size
+// reaches maxBatchSize. Items that do not fit or fail are reported in the
+// returned error, the others stay cached.
+func (c *Cache) processBatch(ctx context.Context, cr *QakuMessage, start time.Time) error {
+	remaining := maxBatchSize
+	errs := []error{}
+	for _, item := range cr.Payload.Batch {
+		msg := *cr
+		msg.Payload = CacheRequest{CID: item.CID, Owner: cr.Payload.Owner, Hash: item.Hash, Encrypted: item.Encrypted}
+
+		if remaining <= 0 {
+			batchItems.WithLabelValues(resultFailed).Inc()
+			errs = append(errs, fmt.Errorf("%s: %w", item.CID, errBatchCap))
+			c.deadLetters.Add("batch_cap", &msg, errBatchCap)
+			continue
+		}
+
+		result, err := c.process(ctx, &msg, start, remaining)
+		batchItems.WithLabelValues(result).Inc()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", item.CID, err))
+			continue
+		}
+		if e, ok := c.index.Get(item.CID); ok && result == resultCached {
+			remaining -= e.Size
+		}
+	}
+
+	c.logger.Info("processed batch request", "request", requestIDFrom(ctx), "owner", cr.Payload.Owner, "items", len(cr.Payload.Batch), "failed", len(errs))
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func batchMessage(t *testing.T, owner string, cids ...string) []byte {
+	t.Helper()
+
+	items := []BatchItem{}
+	for _, cid := range cids {
+		items = append(items, BatchItem{CID: cid})
+	}
+
+	return encodeMessage(t, QakuMessage{
+		Type:      cacheMessageType,
+		Payload:   CacheRequest{Owner: owner, Batch: items},
+		Timestamp: Timestamp(time.Now().UnixMilli()),
+	})
+}
+
+func TestBatchRequestAllCached(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	cids := []string{testCID("one"), testCID("two"), testCID("three")}
+	for _, cid := range cids {
+		m.Add(cid, []byte("snapshot"))
+	}
+
+	cached := testutil.ToFloat64(batchItems.WithLabelValues(resultCached))
+	if err := c.OnNewEnvelope(testEnvelope(batchMessage(t, "alice", cids...))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cid := range cids {
+		if e, ok := indexedEntry(c, cid); !ok || e.Owner != "alice" {
+			t.Errorf("%s cached %t as %+v, want it cached for alice", cid, ok, e)
+		}
+	}
+	if got := testutil.ToFloat64(batchItems.WithLabelValues(resultCached)) - cached; got != 3 {
+		t.Errorf("counted %v cached items, want 3", got)
+	}
+}
+
+func TestBatchRequestPartlyCached(t *testing.T) {
+	setGlobal(t, &maxBatchSize, 10)
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	first, tooBig, fits, unknown := testCID("first"), testCID("too big"), testCID("fits"), testCID("unknown")
+	m.Add(first, []byte("sixsix"))
+	// Only four bytes of the cap are left after the first item.
+	m.Add(tooBig, []byte("sixsix"))
+	m.Add(fits, []byte("abc"))
+
+	failed := testutil.ToFloat64(batchItems.WithLabelValues(resultFailed))
+	err := c.OnNewEnvelope(testEnvelope(batchMessage(t, "alice", first, tooBig, fits, unknown)))
+	if err == nil {
+		t.Fatal("a partly failed batch reported success")
+	}
+	if !errors.Is(err, errBatchCap) {
+		t.Errorf("got error %v, want it to include %v", err, errBatchCap)
+	}
+	for _, cid := range []string{tooBig, unknown} {
+		if !strings.Contains(err.Error(), cid) {
+			t.Errorf("error %q does not report %s", err, cid)
+		}
+	}
+
+	for cid, want := range map[string]bool{first: true, tooBig: false, fits: true, unknown: false} {
+		if got := c.index.Has(cid); got != want {
+			t.Errorf("%s cached = %t, want %t", cid, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(batchItems.WithLabelValues(resultFailed)) - failed; got != 2 {
+		t.Errorf("counted %v failed items, want 2", got)
+	}
+}
+
+func TestCheckCIDs(t *testing.T) {
+	valid := testCID("valid")
+	tests := []struct {
+		name    string
+		req     CacheRequest
+		wantErr bool
+	}{
+		{name: "single", req: CacheRequest{CID: valid}},
+		{name: "single invalid", req: CacheRequest{CID: "nope"}, wantErr: true},
+		{name: "batch", req: CacheRequest{Batch: []BatchItem{{CID: valid}, {CID: testCID("other")}}}},
+		{name: "batch invalid", req: CacheRequest{Batch: []BatchItem{{CID: valid}, {CID: "nope"}}}, wantErr: true},
+		{name: "batch and single", req: CacheRequest{CID: valid, Batch: []BatchItem{{CID: valid}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		if err := checkCIDs(tt.req); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkCIDs = %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envBodyCacheDir     = "QAKU_CACHE_BODY_CACHE_DIR"
+	envBodyCacheMaxSize = "QAKU_CACHE_BODY_CACHE_MAX_SIZE"
+
+	defaultBodyCacheMaxSize = 1024 * 1024 * 1024
+
+	// bodyCacheHeader tells the proxy the response came from the body cache.
+	bodyCacheHeader = "X-Qaku-Cache"
+
+	bodyCacheTempPrefix = ".tmp-"
+)
+
+var (
+	serveHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_serve_hits",
+		Help: "The number of snapshot downloads served from the local body cache",
+	})
+	serveMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_serve_misses",
+		Help: "The number of snapshot downloads that had to be fetched from the backend",
+	})
+)
+
+// bodyCache keeps downloaded snapshot bodies on disk, one file per CID, and
+// drops the least recently served ones once maxSize bytes are exceeded.
+type bodyCache struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	size  int64
+}
+
+type bodyCacheItem struct {
+	cid  string
+	size int64
+}
+
+// newBodyCache opens the cache in dir, picking up the bodies stored by a
+// previous run.
+func newBodyCache(dir string, maxSize int64) (*bodyCache, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create body cache directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body cache directory: %w", err)
+	}
+
+	files := []os.FileInfo{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(e.Name(), bodyCacheTempPrefix) {
+			os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+
+	b := &bodyCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+	for _, f := range files {
+		b.items[f.Name()] = b.lru.PushBack(&bodyCacheItem{cid: f.Name(), size: f.Size()})
+		b.size += f.Size()
+	}
+	b.mu.Lock()
+	b.shrink()
+	b.mu.Unlock()
+
+	return b, nil
+}
+
+func (b *bodyCache) path(cid string) string {
+	return filepath.Join(b.dir, cid)
+}
+
+// Open returns the cached body of the CID and its size.
+func (b *bodyCache) Open(cid string) (*os.File, int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	el, ok := b.items[cid]
+	if !ok {
+		return nil, 0, false
+	}
+
+	f, err := os.Open(b.path(cid))
+	if err != nil {
+		slog.Warn("dropping unreadable cached body", "cid", cid, "error", err)
+		b.remove(el)
+		return nil, 0, false
+	}
+
+	b.lru.MoveToFront(el)
+	now := time.Now()
+	os.Chtimes(b.path(cid), now, now)
+
+	return f, el.Value.(*bodyCacheItem).size, true
+}
+
+// Create starts writing the body of the CID to a temporary file, it only
+// becomes visible once committed.
+func (b *bodyCache) Create(cid string) (*os.File, error) {
+	return os.CreateTemp(b.dir, bodyCacheTempPrefix+cid+"-*")
+}
+
+// Commit moves the completely written temporary file into the cache.
+func (b *bodyCache) Commit(cid string, tmp string, size int64) error {
+	if size > b.maxSize {
+		os.Remove(tmp)
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := os.Rename(tmp, b.path(cid))
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to store body of %s: %w", cid, err)
+	}
+
+	if el, ok := b.items[cid]; ok {
+		b.size -= el.Value.(*bodyCacheItem).size
+		b.lru.Remove(el)
+	}
+	b.items[cid] = b.lru.PushFront(&bodyCacheItem{cid: cid, size: size})
+	b.size += size
+	b.shrink()
+
+	return nil
+}
+
+// Remove drops the cached body of the CID.
+func (b *bodyCache) Remove(cid string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if el, ok := b.items[cid]; ok {
+		b.remove(el)
+	}
+}
+
+// Shed drops the bookkeeping and the files of the least recently served half
+// of the bodies, which are fetched from the backend again when needed, and
+// returns how many were dropped.
+func (b *bodyCache) Shed() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := (b.lru.Len() + 1) / 2
+	for i := 0; i < n; i++ {
+		b.remove(b.lru.Back())
+	}
+	// A map keeps its buckets when keys are deleted, only a copy is smaller.
+	items := make(map[string]*list.Element, len(b.items))
+	for cid, el := range b.items {
+		items[cid] = el
+	}
+	b.items = items
+
+	return n
+}
+
+// shrink drops the least recently used bodies until the cache fits, the
+// caller must hold the lock.
+func (b *bodyCache) shrink() {
+	for b.size > b.maxSize {
+		el := b.lru.Back()
+		if el == nil {
+			return
+		}
+		b.remove(el)
+	}
+}
+
+// remove drops the body of the element, the caller must hold the lock.
+func (b *bodyCache) remove(el *list.Element) {
+	item := el.Value.(*bodyCacheItem)
+	b.lru.Remove(el)
+	delete(b.items, item.cid)
+	b.size -= item.size
+	os.Remove(b.path(item.cid))
+}
+
+// cachingBackend serves full snapshot downloads from the body cache and
+// stores the bodies fetched from the backend. Range requests always go to
+// the backend.
+type cachingBackend struct {
+	Backend
+	bodies *bodyCache
+}
+
+func (cc *cachingBackend) Download(ctx context.Context, cid string, header http.Header) (*http.Response, error) {
+	if header.Get("Range") != "" {
+		return cc.Backend.Download(ctx, cid, header)
+	}
+
+	if f, size, ok := cc.bodies.Open(cid); ok {
+		serveHits.Inc()
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"application/octet-stream"}, bodyCacheHeader: {"hit"}, "Content-Length": {strconv.FormatInt(size, 10)}},
+			Body:          f,
+			ContentLength: size,
+		}, nil
+	}
+
+	serveMisses.Inc()
+	resp, err := cc.Backend.Download(ctx, cid, header)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	tmp, err := cc.bodies.Create(cid)
+	if err != nil {
+		slog.Warn("failed to cache snapshot body", "cid", cid, "error", err)
+		return resp, nil
+	}
+	resp.Body = &bodyCacheWriter{body: resp.Body, tmp: tmp, cid: cid, want: resp.ContentLength, bodies: cc.bodies}
+
+	return resp, nil
+}
+
+func (cc *cachingBackend) Unpin(ctx context.Context, cid string) error {
+	cc.bodies.Remove(cid)
+	return cc.Backend.Unpin(ctx, cid)
+}
+
+// bodyCacheWriter copies the body into a temporary file while it is read and
+// commits it to the cache if it was read to the end.
+type bodyCacheWriter struct {
+	body   io.ReadCloser
+	tmp    *os.File
+	cid    string
+	want   int64
+	n      int64
+	eof    bool
+	failed bool
+	bodies *bodyCache
+}
+
+func (w *bodyCacheWriter) Read(p []byte) (int, error) {
+	n, err := w.body.Read(p)
+	if n > 0 && !w.failed {
+		_, werr := w.tmp.Write(p[:n])
+		if werr != nil {
+			w.failed = true
+		}
+		w.n += int64(n)
+	}
+	if err == io.EOF {
+		w.eof = true
+	}
+
+	return n, err
+}
+
+func (w *bodyCacheWriter) Close() error {
+	err := w.body.Close()
+
+	name := w.tmp.Name()
+	cerr := w.tmp.Close()
+	if !w.eof || w.failed || cerr != nil || (w.want >= 0 && w.n != w.want) {
+		os.Remove(name)
+		return err
+	}
+
+	if cerr := w.bodies.Commit(w.cid, name, w.n); cerr != nil {
+		slog.Warn("failed to cache snapshot body", "cid", w.cid, "error", cerr)
+	}
+
+	return err
+}
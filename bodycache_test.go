@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSnapshotServedFromBodyCache(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	bodies, err := newBodyCache(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCache(t)
+	c.backend = &cachingBackend{Backend: c.backend, bodies: bodies}
+	cid := testCID("popular")
+	m.Add(cid, []byte("snapshot"))
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, c, nil)
+
+	hits, misses := testutil.ToFloat64(serveHits), testutil.ToFloat64(serveMisses)
+	downloads := m.Calls("download")
+	for i := 0; i < 2; i++ {
+		w := get(h, "/api/qaku/v1/snapshot/"+cid, nil)
+		if w.Code != http.StatusOK || w.Body.String() != "snapshot" {
+			t.Fatalf("request %d got %d %q, want the snapshot", i+1, w.Code, w.Body.String())
+		}
+	}
+	if got := m.Calls("download") - downloads; got != 1 {
+		t.Errorf("downloaded from Codex %d times, want once", got)
+	}
+	if testutil.ToFloat64(serveHits)-hits != 1 || testutil.ToFloat64(serveMisses)-misses != 1 {
+		t.Errorf("counted %v hits and %v misses, want one each", testutil.ToFloat64(serveHits)-hits, testutil.ToFloat64(serveMisses)-misses)
+	}
+
+	// Ranges are answered by Codex.
+	get(h, "/api/qaku/v1/snapshot/"+cid, http.Header{"Range": {"bytes=0-3"}})
+	if got := m.Calls("download") - downloads; got != 2 {
+		t.Errorf("downloaded from Codex %d times, want the range request passed on", got)
+	}
+
+	// Unpinning drops the body, so it is not served after eviction.
+	if err := c.backend.Unpin(context.Background(), cid); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := bodies.Open(cid); ok {
+		t.Error("the body of an unpinned snapshot is still cached")
+	}
+	if _, err := os.Stat(filepath.Join(bodies.dir, cid)); !os.IsNotExist(err) {
+		t.Errorf("body file of the unpinned snapshot: %v, want it removed", err)
+	}
+}
+
+func TestBodyCacheEvictsLeastRecentlyServed(t *testing.T) {
+	dir := t.TempDir()
+	bodies, err := newBodyCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := func(cid string, body string) {
+		t.Helper()
+		f, err := bodies.Create(cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(f, strings.NewReader(body))
+		f.Close()
+		if err := bodies.Commit(cid, f.Name(), int64(len(body))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store("a", "aaaa")
+	store("b", "bbbb")
+	// Serving a makes b the least recently served.
+	if f, _, ok := bodies.Open("a"); ok {
+		f.Close()
+	}
+	store("c", "cccc")
+	for cid, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		f, _, ok := bodies.Open(cid)
+		if ok {
+			f.Close()
+		}
+		if ok != want {
+			t.Errorf("%s cached = %t, want %t", cid, ok, want)
+		}
+	}
+
+	// Bodies over the limit are never stored.
+	store("big", "0123456789a")
+	if _, _, ok := bodies.Open("big"); ok {
+		t.Error("cached a body larger than the cache")
+	}
+
+	// A new cache on the directory picks up the stored bodies.
+	reopened, err := newBodyCache(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, size, ok := reopened.Open("c")
+	if !ok || size != 4 {
+		t.Fatalf("reopened cache has c %t with size %d, want 4 bytes", ok, size)
+	}
+	f.Close()
+}
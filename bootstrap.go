@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/waku-org/go-waku/waku/v2/api/filter"
+	"github.com/waku-org/go-waku/waku/v2/node"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+	"github.com/waku-org/go-waku/waku/v2/protocol/store"
+)
+
+const (
+	envStoreLookback = "QAKU_CACHE_STORE_LOOKBACK"
+
+	defaultStoreLookback = 24 * time.Hour
+)
+
+// bootstrapFromStore replays the messages published within lookback on the
+// subscribed content topics from a Waku store node through next, so requests
+// broadcast while the cache was down are not missed. Already cached or
+// duplicate requests are skipped further down the chain. Without a reachable
+// store node the cache continues with filter messages only.
+func bootstrapFromStore(ctx context.Context, wn *node.WakuNode, cfs []protocol.ContentFilter, lookback time.Duration, next filter.EnevelopeProcessor) {
+	start := time.Now().Add(-lookback).UnixNano()
+	for _, cf := range cfs {
+		replayed := 0
+		result, err := wn.Store().Query(ctx, store.FilterCriteria{ContentFilter: cf, TimeStart: &start}, store.WithPaging(true, store.MaxPageSize))
+		for err == nil {
+			for _, m := range result.Messages() {
+				if m.Message == nil {
+					continue
+				}
+
+				next.OnNewEnvelope(protocol.NewEnvelope(m.Message, time.Now().UnixNano(), m.GetPubsubTopic()))
+				replayed++
+			}
+			if result.IsComplete() {
+				break
+			}
+
+			err = result.Next(ctx)
+		}
+		if err != nil {
+			slog.Warn("failed to query store, continuing with filter messages only", "pubsubTopic", cf.PubsubTopic, "error", err)
+		}
+
+		slog.Info("replayed messages from store", "pubsubTopic", cf.PubsubTopic, "messages", replayed, "lookback", lookback)
+	}
+}
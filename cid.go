@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var snapInvalidCID = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qaku_cache_invalid_cid",
+	Help: "The number of messages rejected for a malformed CID",
+})
+
+// isValidCID reports whether s parses as a multibase encoded CIDv1 with a
+// multihash, the shape of the CIDs Codex hands out.
+func isValidCID(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	c, err := cid.Decode(s)
+	if err != nil {
+		return false
+	}
+
+	return c.Version() == 1 && len(c.Hash()) > 0
+}
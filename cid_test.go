@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestIsValidCID(t *testing.T) {
+	h, err := multihash.Sum([]byte("snapshot"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := cid.NewCidV1(cid.Raw, h)
+	base58, err := v1.StringOfBase(multibase.Base58BTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cid  string
+		want bool
+	}{
+		{cid: v1.String(), want: true},
+		{cid: base58, want: true},
+		{cid: testCID("other"), want: true},
+		{cid: ""},
+		{cid: "not a cid"},
+		{cid: "../../etc/passwd"},
+		{cid: v1.String()[:20]},
+		// Codex only hands out CIDv1.
+		{cid: cid.NewCidV0(h).String()},
+	}
+
+	for _, tt := range tests {
+		if got := isValidCID(tt.cid); got != tt.want {
+			t.Errorf("isValidCID(%q) = %t, want %t", tt.cid, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidCIDRejectedEarly(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+
+	invalid := testutil.ToFloat64(snapInvalidCID)
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, "not-a-cid", "alice"))); err == nil {
+		t.Error("accepted a message with an invalid CID")
+	}
+	if got := testutil.ToFloat64(snapInvalidCID) - invalid; got != 1 {
+		t.Errorf("counted %v invalid CIDs, want 1", got)
+	}
+
+	if w := get(newTestServer(t, c, nil), "/api/qaku/v1/snapshot/not-a-cid", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("/snapshot answered %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if got := m.Calls("manifest") + m.Calls("download"); got != 0 {
+		t.Errorf("made %d Codex requests, want none for an invalid CID", got)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envCodexRequestIDHeader = "QAKU_CACHE_CODEX_REQUEST_ID_HEADER"
+	envManifestRetries      = "QAKU_CACHE_INCOMPLETE_MANIFEST_RETRIES"
+	envManifestRetryDelay   = "QAKU_CACHE_INCOMPLETE_MANIFEST_DELAY"
+	envCodexTimeout         = "QAKU_CACHE_CODEX_TIMEOUT"
+	envCodexToken           = "QAKU_CACHE_CODEX_TOKEN"
+
+	defaultRequestIDHeader    = "X-Request-ID"
+	defaultManifestRetryDelay = 10 * time.Second
+	defaultCodexTimeout       = 30 * time.Second
+)
+
+var snapIncompleteManifest = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qaku_cache_incomplete_manifests",
+	Help: "The number of manifests fetched before Codex finished ingesting the dataset",
+})
+
+// errIncompleteManifest is returned when Codex still reports an incomplete
+// manifest after all retries.
+var errIncompleteManifest = errors.New("incomplete manifest")
+
+type requestIDKey struct{}
+
+func newRequestID() string {
+	return uuid.NewString()[:8]
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// codexRequestIDHeader is the header the request ID is forwarded to Codex in,
+// empty to not forward it. It only renames the outbound header, callers
+// always send and get the ID in X-Request-ID.
+var codexRequestIDHeader = defaultRequestIDHeader
+
+// codexRequestIDHeaderFromEnv returns the header used to forward the request
+// ID to Codex. Setting the env var to "-" disables forwarding.
+func codexRequestIDHeaderFromEnv() string {
+	h := os.Getenv(envCodexRequestIDHeader)
+	if h == "" {
+		return defaultRequestIDHeader
+	}
+	if h == "-" {
+		return ""
+	}
+
+	return h
+}
+
+func codexDo(ctx context.Context, method string, url string) (*http.Response, error) {
+	return codexDoHeader(ctx, method, url, nil)
+}
+
+// codexToken is sent as a bearer token with every Codex request if set.
+var codexToken string
+
+// codexDoHeader sends a request with the extra header to Codex. All Codex
+// requests go through here so they share the client, request ID and
+// credentials.
+func codexDoHeader(ctx context.Context, method string, url string, header http.Header) (*http.Response, error) {
+	return codexDoBody(ctx, method, url, header, nil)
+}
+
+// codexDoBody is codexDoHeader with a request body.
+func codexDoBody(ctx context.Context, method string, url string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if codexToken != "" {
+		req.Header.Set("Authorization", "Bearer "+codexToken)
+	}
+
+	if h, id := codexRequestIDHeader, requestIDFrom(ctx); h != "" && id != "" {
+		req.Header.Set(h, id)
+	}
+
+	return codexClient.Do(req)
+}
+
+var codexLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "qaku_cache_codex_request_duration_seconds",
+	Help:    "Time until Codex responded with headers, by operation",
+	Buckets: prometheus.DefBuckets,
+}, []string{"operation"})
+
+// codexClient is shared by all Codex requests and records their latency.
+var codexClient = newCodexClient(defaultCodexTimeout)
+
+// newCodexClient returns a client whose timeout covers connecting and waiting
+// for the response headers. Reading the body is not limited so large snapshot
+// downloads are not cut off.
+func newCodexClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = timeout
+	transport.ResponseHeaderTimeout = timeout
+
+	return &http.Client{Transport: timedTransport{next: transport}}
+}
+
+type timedTransport struct {
+	next http.RoundTripper
+}
+
+func (t timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	codexLatency.WithLabelValues(codexOperation(req.Method, req.URL.Path)).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+// codexOperation names the Codex API call for the latency metric.
+func codexOperation(method string, path string) string {
+	path = strings.TrimPrefix(path, "/api/codex/v1/")
+	switch {
+	case path == "debug/info":
+		return "debug_info"
+	case strings.HasSuffix(path, "/network/manifest"):
+		return "manifest"
+	case strings.HasSuffix(path, "/network/stream"):
+		return "stream"
+	case strings.HasSuffix(path, "/network") && method == http.MethodPost:
+		return "network_pin"
+	case path == "data" && method == http.MethodPost:
+		return "upload"
+	case path == "data":
+		return "list"
+	case strings.HasPrefix(path, "data/") && method == http.MethodDelete:
+		return "unpin"
+	case strings.HasPrefix(path, "data/"):
+		return "download"
+	}
+
+	return "other"
+}
+
+func codexGet(ctx context.Context, url string) (*http.Response, error) {
+	return codexDo(ctx, http.MethodGet, url)
+}
+
+func codexPost(ctx context.Context, url string) (*http.Response, error) {
+	return codexDo(ctx, http.MethodPost, url)
+}
+
+func codexDelete(ctx context.Context, url string) (*http.Response, error) {
+	return codexDo(ctx, http.MethodDelete, url)
+}
+
+// DebugInfo is the part of the Codex debug info the cache exposes.
+type DebugInfo struct {
+	ID             string   `json:"id"`
+	AnnouncedAddrs []string `json:"announceAddresses"`
+}
+
+// codexBackend stores datasets in the Codex node whose REST API is at url.
+type codexBackend struct {
+	url string
+}
+
+func newCodexBackend(url string) *codexBackend {
+	return &codexBackend{url: url}
+}
+
+func (h *codexBackend) DebugInfo(ctx context.Context) (*DebugInfo, error) {
+	resp, err := codexGet(ctx, fmt.Sprintf("%s/api/codex/v1/debug/info", h.url))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch Codex info: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to fetch Codex info: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	codexBytesRead.Add(float64(len(body)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Codex info: %w", err)
+	}
+
+	info := &DebugInfo{}
+	err = json.Unmarshal(body, info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal Codex info: %w", err)
+	}
+
+	return info, nil
+}
+
+func (h *codexBackend) FetchManifest(ctx context.Context, cid string) (*CodexDataContent, error) {
+	url := fmt.Sprintf("%s/api/codex/v1/data/%s/network/manifest", h.url, cid)
+	resp, err := codexRetry(ctx, func() (*http.Response, error) { return codexGet(ctx, url) })
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("failed to fetch manifest: %w: %s", errCodexUnavailable, resp.Status)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to fetch manifest: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	codexBytesRead.Add(float64(len(body)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest data: %w", err)
+	}
+
+	cdc := &CodexDataContent{}
+	err = json.Unmarshal(body, cdc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+
+	return cdc, nil
+}
+
+func (h *codexBackend) Download(ctx context.Context, cid string, header http.Header) (*http.Response, error) {
+	resp, err := codexDoHeader(ctx, http.MethodGet, fmt.Sprintf("%s/api/codex/v1/data/%s", h.url, cid), header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", cid, err)
+	}
+
+	return resp, nil
+}
+
+func (h *codexBackend) FetchToNetwork(ctx context.Context, cid string) error {
+	url := fmt.Sprintf("%s/api/codex/v1/data/%s/network", h.url, cid)
+	resp, err := codexRetry(ctx, func() (*http.Response, error) { return codexPost(ctx, url) })
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("request to Codex failed: %w: %s", errCodexUnavailable, resp.Status)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("request to Codex failed: %w: %s", errDatasetNotFound, resp.Status)
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("request to Codex failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (h *codexBackend) Stream(ctx context.Context, cid string) (*http.Response, error) {
+	resp, err := codexGet(ctx, fmt.Sprintf("%s/api/codex/v1/data/%s/network/stream", h.url, cid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream %s: %w", cid, err)
+	}
+
+	return resp, nil
+}
+
+func (h *codexBackend) Upload(ctx context.Context, data []byte) (string, error) {
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err := codexDoBody(ctx, http.MethodPost, fmt.Sprintf("%s/api/codex/v1/data", h.url), header, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to upload: %s", resp.Status)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (h *codexBackend) Unpin(ctx context.Context, cid string) error {
+	resp, err := codexDelete(ctx, fmt.Sprintf("%s/api/codex/v1/data/%s", h.url, cid))
+	if err != nil {
+		return fmt.Errorf("failed to unpin %s: %w", cid, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to unpin %s: %s", cid, resp.Status)
+	}
+
+	return nil
+}
+
+// Has checks whether the local Codex node serves the CID. Only the status
+// is read, the body is closed before any of the dataset is transferred.
+func (h *codexBackend) Has(ctx context.Context, cid string) (bool, error) {
+	resp, err := codexGet(ctx, fmt.Sprintf("%s/api/codex/v1/data/%s", h.url, cid))
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s: %w", cid, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("failed to check %s: %s", cid, resp.Status)
+}
+
+type codexDataList struct {
+	Content []CodexDataContent `json:"content"`
+}
+
+// ListLocal returns the set of CIDs stored by the local Codex node. It
+// returns errListUnsupported if Codex has no listing endpoint.
+func (h *codexBackend) ListLocal(ctx context.Context) (map[string]bool, error) {
+	resp, err := codexGet(ctx, fmt.Sprintf("%s/api/codex/v1/data", h.url))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return nil, errListUnsupported
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(countingReader{resp.Body})
+	if err != nil {
+		return nil, err
+	}
+
+	list := &codexDataList{}
+	err = json.Unmarshal(body, list)
+	if err != nil {
+		return nil, err
+	}
+
+	local := make(map[string]bool, len(list.Content))
+	for _, c := range list.Content {
+		local[c.Cid] = true
+	}
+
+	return local, nil
+}
+
+// incomplete reports whether the manifest is missing fields Codex fills in
+// once it has finished ingesting the upload.
+func (m CodexManifest) incomplete() bool {
+	return m.DatasetSize == 0 || m.TreeCid == ""
+}
+
+// fetchCompleteManifest fetches the manifest, retrying up to retries times
+// with delay in between while Codex reports it incomplete.
+func fetchCompleteManifest(ctx context.Context, backend Backend, cid string, retries int, delay time.Duration) (*CodexDataContent, error) {
+	for attempt := 0; ; attempt++ {
+		cdc, err := backend.FetchManifest(ctx, cid)
+		if err != nil {
+			return nil, err
+		}
+		if !cdc.Manifest.incomplete() {
+			return cdc, nil
+		}
+
+		snapIncompleteManifest.Inc()
+		if attempt >= retries {
+			return nil, fmt.Errorf("%w for %s: datasetSize %d, treeCid %q", errIncompleteManifest, cid, cdc.Manifest.DatasetSize, cdc.Manifest.TreeCid)
+		}
+
+		slog.Info("manifest is incomplete, retrying", "cid", cid, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// countingReader counts the bytes read from Codex into codexBytesRead.
+type countingReader struct {
+	r io.Reader
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	codexBytesRead.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchCompleteManifest(t *testing.T) {
+	cid := testCID("incomplete")
+	tests := []struct {
+		name        string
+		incomplete  int
+		retries     int
+		wantErr     error
+		wantFetches int
+	}{
+		{name: "complete", incomplete: 0, retries: 0, wantFetches: 1},
+		{name: "completes on retry", incomplete: 2, retries: 2, wantFetches: 3},
+		{name: "still incomplete", incomplete: 3, retries: 2, wantErr: errIncompleteManifest, wantFetches: 3},
+		{name: "rejected without retries", incomplete: 1, retries: 0, wantErr: errIncompleteManifest, wantFetches: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			m.Add(cid, []byte("data"))
+			m.Incomplete(cid, tt.incomplete)
+
+			cdc, err := fetchCompleteManifest(context.Background(), m.Backend(), cid, tt.retries, time.Millisecond)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && cdc.Manifest.incomplete() {
+				t.Error("returned an incomplete manifest")
+			}
+			if got := m.Calls("manifest"); got != tt.wantFetches {
+				t.Errorf("fetched the manifest %d times, want %d", got, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestProcessRejectsIncompleteManifest(t *testing.T) {
+	m := newMockCodex(t)
+	cid := testCID("incomplete")
+	m.Add(cid, []byte("data"))
+	m.Incomplete(cid, 1)
+	c := newTestCache(t)
+
+	err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "")))
+	if !errors.Is(err, errIncompleteManifest) {
+		t.Errorf("got error %v, want %v", err, errIncompleteManifest)
+	}
+	if c.index.Has(cid) {
+		t.Error("cached a dataset with an incomplete manifest")
+	}
+}
+
+func TestCodexClientTimeout(t *testing.T) {
+	noRetries(t)
+	setGlobal(t, &codexClient, newCodexClient(50*time.Millisecond))
+	cid := testCID("slow")
+
+	m := newMockCodex(t)
+	m.Add(cid, []byte("data"))
+	m.Delay("manifest", 5*time.Second)
+
+	start := time.Now()
+	_, err := m.Backend().FetchManifest(context.Background(), cid)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %s", elapsed)
+	}
+}
+
+func TestCodexClientSlowBody(t *testing.T) {
+	setGlobal(t, &codexClient, newCodexClient(50*time.Millisecond))
+
+	// The headers arrive in time, the body takes longer than the timeout.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("slow "))
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("snapshot"))
+	}))
+	t.Cleanup(srv.Close)
+
+	resp, err := codexGet(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "slow snapshot" {
+		t.Errorf("read %q, %v, want the complete slow body", body, err)
+	}
+}
+
+func TestCodexTokenSentWithEveryRequest(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	// The gateway in front of the node turns away requests without the token.
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		m.ServeHTTP(w, r)
+	}))
+	t.Cleanup(gateway.Close)
+	setGlobal(t, &codexURL, gateway.URL)
+
+	// A snapshot cached with the token, for the downloads below.
+	cached := testCID("cached")
+	m.Add(cached, []byte("snapshot"))
+	setGlobal(t, &codexToken, "secret")
+	if err := newTestCache(t).OnNewEnvelope(testEnvelope(cacheMessage(t, cached, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		wantOK bool
+	}{
+		{name: "token", token: "secret", wantOK: true},
+		{name: "no token"},
+		{name: "wrong token", token: "guess"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &codexToken, tt.token)
+			c := newTestCache(t)
+			h := newTestServer(t, c, nil)
+			cid := testCID(tt.name)
+			m.Add(cid, []byte("snapshot"))
+
+			err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice")))
+			if (err == nil) != tt.wantOK {
+				t.Errorf("OnNewEnvelope = %v, want success %t", err, tt.wantOK)
+			}
+			if got := get(h, "/api/qaku/v1/info", nil).Code; (got == http.StatusOK) != tt.wantOK {
+				t.Errorf("/info answered %d, want success %t", got, tt.wantOK)
+			}
+			w := get(h, "/api/qaku/v1/snapshot/"+cached, nil)
+			if (w.Code == http.StatusOK && w.Body.String() == "snapshot") != tt.wantOK {
+				t.Errorf("/snapshot answered %d %q, want success %t", w.Code, w.Body.String(), tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCodexBackend(t *testing.T) {
+	noRetries(t)
+	known := testCID("known")
+	unknown := testCID("unknown")
+
+	tests := []struct {
+		name     string
+		fail     map[string]int
+		call     func(h *codexBackend) error
+		wantFail bool
+	}{
+		{
+			name: "manifest",
+			call: func(h *codexBackend) error {
+				cdc, err := h.FetchManifest(context.Background(), known)
+				if err == nil && cdc.Manifest.DatasetSize != len("data") {
+					return errors.New("wrong dataset size")
+				}
+				return err
+			},
+		},
+		{
+			name:     "manifest unknown",
+			call:     func(h *codexBackend) error { _, err := h.FetchManifest(context.Background(), unknown); return err },
+			wantFail: true,
+		},
+		{
+			name: "fetch",
+			call: func(h *codexBackend) error { return h.FetchToNetwork(context.Background(), known) },
+		},
+		{
+			name:     "fetch unknown",
+			call:     func(h *codexBackend) error { return h.FetchToNetwork(context.Background(), unknown) },
+			wantFail: true,
+		},
+		{
+			name: "unpin",
+			call: func(h *codexBackend) error { return h.Unpin(context.Background(), known) },
+		},
+		{
+			name:     "unpin rejected",
+			fail:     map[string]int{"unpin": http.StatusForbidden},
+			call:     func(h *codexBackend) error { return h.Unpin(context.Background(), known) },
+			wantFail: true,
+		},
+		{
+			name: "download",
+			call: func(h *codexBackend) error {
+				err := h.FetchToNetwork(context.Background(), known)
+				if err != nil {
+					return err
+				}
+				resp, err := h.Download(context.Background(), known, nil)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				if string(body) != "data" {
+					return errors.New("wrong body " + string(body))
+				}
+				return nil
+			},
+		},
+		{
+			name: "has",
+			call: func(h *codexBackend) error {
+				ok, err := h.Has(context.Background(), known)
+				if err == nil && ok {
+					return errors.New("has a dataset that is not local")
+				}
+				if err == nil {
+					err = h.FetchToNetwork(context.Background(), known)
+				}
+				if err == nil {
+					ok, err = h.Has(context.Background(), known)
+				}
+				if err == nil && !ok {
+					return errors.New("does not have the fetched dataset")
+				}
+				return err
+			},
+		},
+		{
+			name:     "has unavailable",
+			fail:     map[string]int{"download": http.StatusInternalServerError},
+			call:     func(h *codexBackend) error { _, err := h.Has(context.Background(), known); return err },
+			wantFail: true,
+		},
+		{
+			name: "list local",
+			call: func(h *codexBackend) error {
+				err := h.FetchToNetwork(context.Background(), known)
+				if err != nil {
+					return err
+				}
+				local, err := h.ListLocal(context.Background())
+				if err == nil && (!local[known] || local[unknown]) {
+					return fmt.Errorf("listed %v, want only the fetched dataset", local)
+				}
+				return err
+			},
+		},
+		{
+			name: "list unsupported",
+			fail: map[string]int{"list": http.StatusNotFound},
+			call: func(h *codexBackend) error {
+				_, err := h.ListLocal(context.Background())
+				if !errors.Is(err, errListUnsupported) {
+					return fmt.Errorf("got %v, want %v", err, errListUnsupported)
+				}
+				return nil
+			},
+		},
+		{
+			name: "debug info",
+			call: func(h *codexBackend) error {
+				info, err := h.DebugInfo(context.Background())
+				if err == nil && info.ID != "mock" {
+					return errors.New("wrong id " + info.ID)
+				}
+				return err
+			},
+		},
+		{
+			name:     "debug info unavailable",
+			fail:     map[string]int{"debug_info": http.StatusInternalServerError},
+			call:     func(h *codexBackend) error { _, err := h.DebugInfo(context.Background()); return err },
+			wantFail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			m.Add(known, []byte("data"))
+			for op, status := range tt.fail {
+				m.Fail(op, status)
+			}
+
+			err := tt.call(m.Backend())
+			if (err != nil) != tt.wantFail {
+				t.Errorf("got error %v, want failure %t", err, tt.wantFail)
+			}
+		})
+	}
+}
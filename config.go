@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const envStrictConfig = "QAKU_CACHE_STRICT_CONFIG"
+
+// configErrors collects invalid configuration values so strict mode can
+// refuse to start instead of silently falling back to defaults.
+var configErrors []string
+
+func configError(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	slog.Warn("invalid config", "error", msg)
+	configErrors = append(configErrors, msg)
+}
+
+// checkConfig exits the process if strict mode is enabled and any config value
+// failed to parse. Call it after all config has been read.
+func checkConfig() {
+	if !envBool(envStrictConfig, false) || len(configErrors) == 0 {
+		return
+	}
+
+	for _, msg := range configErrors {
+		slog.Error("invalid config", "error", msg)
+	}
+	fatal("refusing to start with invalid config", "errors", len(configErrors), "strict", envStrictConfig)
+}
+
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		configError("invalid value for %s: %s", key, err)
+		return def
+	}
+
+	return i
+}
+
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		configError("invalid value for %s: %s", key, err)
+		return def
+	}
+
+	return b
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		configError("invalid value for %s: %s", key, err)
+		return def
+	}
+
+	return d
+}
+
+const (
+	envStaticNodes     = "QAKU_CACHE_STATIC_NODES"
+	envDiscV5Bootnodes = "QAKU_CACHE_DISCV5_BOOTNODES"
+	envWakuClusterID   = "QAKU_CACHE_WAKU_CLUSTER_ID"
+	envShards          = "QAKU_CACHE_SHARDS"
+
+	// envClusterID is the deprecated name of envWakuClusterID, still read
+	// when the new one is not set.
+	envClusterID = "QAKU_CACHE_CLUSTER_ID"
+
+	defaultCodexURL  = "http://codex:8080"
+	defaultClusterID = 1
+)
+
+// Config holds the settings that can be given in a YAML config file. Env
+// vars override the file, which overrides the built-in defaults. Settings
+// without a field can be set through Env, keyed by their env var name; real
+// env vars still take precedence.
+type Config struct {
+	CodexAPIURL string `yaml:"codexApiUrl"`
+	MaxSize     int    `yaml:"maxSize"`
+
+	ListenAddr  string `yaml:"listenAddr"`
+	MetricsAddr string `yaml:"metricsAddr"`
+
+	WakuPort   int `yaml:"wakuPort"`
+	DiscV5Port int `yaml:"discv5Port"`
+	ClusterID  int `yaml:"clusterId"`
+
+	// StaticNodes are multiaddrs of Waku peers dialed on start.
+	StaticNodes []string `yaml:"staticNodes"`
+	// Bootnodes are discv5 bootstrap ENRs replacing the built-in ones.
+	Bootnodes []string `yaml:"discv5Bootnodes"`
+	// Shards are further auto-sharding shards the content topics are
+	// published on, on top of the shard each topic derives.
+	Shards []uint16 `yaml:"shards"`
+
+	Env map[string]string `yaml:"env"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		CodexAPIURL: defaultCodexURL,
+		MaxSize:     defaultMaxSize,
+		ListenAddr:  defaultListenAddr,
+		MetricsAddr: defaultMetricsAddr,
+		DiscV5Port:  defaultDiscV5Port,
+		ClusterID:   defaultClusterID,
+	}
+}
+
+// LoadConfig reads the config file at path, if any, and applies the env
+// overrides. The settings in Env are exported to the process environment
+// unless already set, so the rest of the configuration picks them up.
+func LoadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read config: %w", err)
+		}
+
+		err = yaml.Unmarshal(data, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to parse config %s: %w", path, err)
+		}
+	}
+
+	for k, v := range cfg.Env {
+		if _, ok := os.LookupEnv(k); !ok {
+			os.Setenv(k, v)
+		}
+	}
+
+	if v := os.Getenv(envCodexApiUrl); v != "" {
+		cfg.CodexAPIURL = v
+	}
+	if v := os.Getenv(envListenAddr); v != "" {
+		cfg.ListenAddr = v
+	}
+	if v := os.Getenv(envMetricsAddr); v != "" {
+		cfg.MetricsAddr = v
+	}
+	if v := os.Getenv(envStaticNodes); v != "" {
+		cfg.StaticNodes = strings.Split(v, ",")
+	}
+	if v := os.Getenv(envDiscV5Bootnodes); v != "" {
+		cfg.Bootnodes = strings.Split(v, ",")
+	}
+	if v := os.Getenv(envShards); v != "" {
+		cfg.Shards = parseShards(v)
+	}
+	u, err := normalizeCodexURL(cfg.CodexAPIURL)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.CodexAPIURL = u
+
+	cfg.MaxSize = envInt(envMaxDatasetSize, cfg.MaxSize)
+
+	// The Waku node cannot fall back to a default port or cluster, so these
+	// fail instead of being reported as config errors.
+	if cfg.WakuPort, err = envIntStrict(envWakuPort, cfg.WakuPort); err != nil {
+		return cfg, err
+	}
+	if cfg.DiscV5Port, err = envIntStrict(envDiscV5Port, cfg.DiscV5Port); err != nil {
+		return cfg, err
+	}
+	clusterKey := envWakuClusterID
+	if os.Getenv(envWakuClusterID) == "" && os.Getenv(envClusterID) != "" {
+		slog.Warn("deprecated env var", "env", envClusterID, "use", envWakuClusterID)
+		clusterKey = envClusterID
+	}
+	if cfg.ClusterID, err = envIntStrict(clusterKey, cfg.ClusterID); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// envIntStrict is envInt for settings without a usable fallback, it returns
+// an error instead of def for a value that is not a number.
+func envIntStrict(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+
+	return i, nil
+}
+
+// checkWakuConfig returns an error for ports and a cluster ID the Waku node
+// cannot use.
+func checkWakuConfig(cfg Config) error {
+	for _, p := range []struct {
+		name string
+		port int
+	}{{envWakuPort, cfg.WakuPort}, {envDiscV5Port, cfg.DiscV5Port}} {
+		if p.port < 0 || p.port > 65535 {
+			return fmt.Errorf("%s must be a port number, got %d", p.name, p.port)
+		}
+	}
+	if cfg.ClusterID < 0 || cfg.ClusterID > 65535 {
+		return fmt.Errorf("%s must be a cluster ID between 0 and 65535, got %d", envWakuClusterID, cfg.ClusterID)
+	}
+
+	return nil
+}
+
+// parseShards parses a comma separated list of shard indexes, reporting and
+// skipping invalid ones.
+func parseShards(s string) []uint16 {
+	shards := []uint16{}
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		shard, err := strconv.ParseUint(raw, 10, 16)
+		if err != nil {
+			configError("invalid shard %q in %s: %s", raw, envShards, err)
+			continue
+		}
+		shards = append(shards, uint16(shard))
+	}
+
+	return shards
+}
+
+// normalizeCodexURL checks that the Codex API URL is an absolute http(s) URL
+// and strips trailing slashes so paths can be appended to it.
+func normalizeCodexURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %w", envCodexApiUrl, raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid %s %q: scheme must be http or https", envCodexApiUrl, raw)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid %s %q: missing host", envCodexApiUrl, raw)
+	}
+
+	return strings.TrimRight(u.String(), "/"), nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// clearConfigEnv unsets the env vars LoadConfig reads for the test.
+func clearConfigEnv(t *testing.T, keys ...string) {
+	t.Helper()
+
+	keys = append(keys, envCodexApiUrl, envListenAddr, envMetricsAddr, envStaticNodes,
+		envMaxDatasetSize, envWakuPort, envDiscV5Port, envWakuClusterID, envClusterID)
+	for _, k := range keys {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	clearConfigEnv(t, "QAKU_CACHE_TEST_FROM_FILE", "QAKU_CACHE_TEST_FROM_ENV")
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := defaultConfig()
+	if cfg.CodexAPIURL != want.CodexAPIURL || cfg.MaxSize != want.MaxSize || cfg.ListenAddr != want.ListenAddr || cfg.ClusterID != want.ClusterID {
+		t.Errorf("zero config = %+v, want the defaults %+v", cfg, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err = os.WriteFile(path, []byte(`
+codexApiUrl: http://file:8080/
+maxSize: 100
+listenAddr: ":1000"
+clusterId: 16
+wakuPort: 60001
+staticNodes: [/ip4/10.0.0.1/tcp/60000/p2p/file]
+env:
+  QAKU_CACHE_TEST_FROM_FILE: file
+  QAKU_CACHE_TEST_FROM_ENV: file
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CodexAPIURL != "http://file:8080" || cfg.MaxSize != 100 || cfg.ListenAddr != ":1000" || cfg.ClusterID != 16 || cfg.WakuPort != 60001 {
+		t.Errorf("file config = %+v, want the file values", cfg)
+	}
+	if cfg.MetricsAddr != defaultMetricsAddr {
+		t.Errorf("metrics address = %q, want the default for a setting missing from the file", cfg.MetricsAddr)
+	}
+	if os.Getenv("QAKU_CACHE_TEST_FROM_FILE") != "file" {
+		t.Error("did not export the env settings of the file")
+	}
+
+	t.Setenv(envCodexApiUrl, "https://env:8443")
+	t.Setenv(envMaxDatasetSize, "200")
+	t.Setenv(envWakuClusterID, "2")
+	t.Setenv(envStaticNodes, "/ip4/10.0.0.2/tcp/60000/p2p/a,/ip4/10.0.0.3/tcp/60000/p2p/b")
+	t.Setenv("QAKU_CACHE_TEST_FROM_ENV", "env")
+
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CodexAPIURL != "https://env:8443" || cfg.MaxSize != 200 || cfg.ClusterID != 2 {
+		t.Errorf("config = %+v, want the env overriding the file", cfg)
+	}
+	if !slices.Equal(cfg.StaticNodes, []string{"/ip4/10.0.0.2/tcp/60000/p2p/a", "/ip4/10.0.0.3/tcp/60000/p2p/b"}) {
+		t.Errorf("static nodes = %v, want the env ones", cfg.StaticNodes)
+	}
+	if cfg.ListenAddr != ":1000" || cfg.WakuPort != 60001 {
+		t.Errorf("config = %+v, want the file values for settings without env vars", cfg)
+	}
+	if os.Getenv("QAKU_CACHE_TEST_FROM_ENV") != "env" {
+		t.Error("the env settings of the file replaced a real env var")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	clearConfigEnv(t)
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("maxSize: [big"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	badURL := filepath.Join(dir, "url.yaml")
+	if err := os.WriteFile(badURL, []byte("codexApiUrl: ftp://codex"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{filepath.Join(dir, "missing.yaml"), invalid, badURL} {
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("LoadConfig(%s) succeeded", filepath.Base(path))
+		}
+	}
+}
+
+func TestNormalizeCodexURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: defaultCodexURL, want: "http://codex:8080"},
+		{raw: "https://codex.example.com:8443/", want: "https://codex.example.com:8443"},
+		{raw: "http://codex:8080/prefix//", want: "http://codex:8080/prefix"},
+		{raw: "codex:8080", wantErr: true},
+		{raw: "ftp://codex:8080", wantErr: true},
+		{raw: "http://", wantErr: true},
+		{raw: "http://codex:port", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeCodexURL(tt.raw)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeCodexURL(%q) = %q, %v, want %q with error %t", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadConfigNormalizesCodexURL(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv(envCodexApiUrl, "http://env:8080/")
+
+	cfg, err := LoadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CodexAPIURL != "http://env:8080" {
+		t.Errorf("Codex URL = %q, want the trailing slash stripped", cfg.CodexAPIURL)
+	}
+
+	t.Setenv(envCodexApiUrl, "env:8080")
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("loaded a Codex URL without a scheme")
+	}
+}
+
+func TestCheckWakuConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		clusterID    string
+		deprecatedID string
+		wantID       int
+		wantLoadErr  bool
+		wantCheckErr bool
+	}{
+		{name: "default", wantID: defaultClusterID},
+		{name: "override", clusterID: "42", wantID: 42},
+		{name: "deprecated name", deprecatedID: "16", wantID: 16},
+		{name: "new name wins", clusterID: "42", deprecatedID: "16", wantID: 42},
+		{name: "negative", clusterID: "-1", wantID: -1, wantCheckErr: true},
+		{name: "too large", clusterID: "65536", wantID: 65536, wantCheckErr: true},
+		{name: "not a number", clusterID: "main", wantLoadErr: true},
+		{name: "deprecated not a number", deprecatedID: "main", wantLoadErr: true},
+	}
+
+	for _, tt := range tests {
+		clearConfigEnv(t)
+		t.Setenv(envWakuClusterID, tt.clusterID)
+		t.Setenv(envClusterID, tt.deprecatedID)
+
+		cfg, err := LoadConfig("")
+		if (err != nil) != tt.wantLoadErr {
+			t.Errorf("%s: LoadConfig = %v, want error %t", tt.name, err, tt.wantLoadErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		err = checkWakuConfig(cfg)
+		if cfg.ClusterID != tt.wantID || (err != nil) != tt.wantCheckErr {
+			t.Errorf("%s: cluster ID %d with error %v, want %d with error %t", tt.name, cfg.ClusterID, err, tt.wantID, tt.wantCheckErr)
+		}
+	}
+
+	if err := checkWakuConfig(Config{WakuPort: 70000}); err == nil {
+		t.Error("accepted an invalid Waku port")
+	}
+	if err := checkWakuConfig(Config{DiscV5Port: -1}); err == nil {
+		t.Error("accepted an invalid discv5 port")
+	}
+
+	clearConfigEnv(t)
+	t.Setenv(envWakuPort, "60000/tcp")
+	if _, err := LoadConfig(""); err == nil {
+		t.Error("loaded a Waku port that is not a number")
+	}
+}
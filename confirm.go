@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	envPinConfirm         = "QAKU_CACHE_PIN_CONFIRM"
+	envPinConfirmInterval = "QAKU_CACHE_PIN_CONFIRM_INTERVAL"
+	envPinConfirmBatch    = "QAKU_CACHE_PIN_CONFIRM_BATCH"
+	envPinConfirmTimeout  = "QAKU_CACHE_PIN_CONFIRM_TIMEOUT"
+
+	defaultPinConfirmInterval = time.Second
+	defaultPinConfirmBatch    = 50
+	defaultPinConfirmTimeout  = 5 * time.Minute
+)
+
+// pinConfirmSettings configure the confirmation that fetched datasets
+// arrived in the local store.
+type pinConfirmSettings struct {
+	enabled  bool
+	interval time.Duration
+	batch    int
+	timeout  time.Duration
+}
+
+// pinConfirmFromEnv reads the pin confirmation settings. Confirmation is on
+// unless QAKU_CACHE_PIN_CONFIRM is false, as Codex answers the network fetch
+// as soon as it starts and not once the dataset is local.
+func pinConfirmFromEnv() pinConfirmSettings {
+	s := pinConfirmSettings{
+		enabled:  envBool(envPinConfirm, true),
+		interval: envDuration(envPinConfirmInterval, defaultPinConfirmInterval),
+		batch:    envInt(envPinConfirmBatch, defaultPinConfirmBatch),
+		timeout:  envDuration(envPinConfirmTimeout, defaultPinConfirmTimeout),
+	}
+	if s.interval <= 0 {
+		configError("%s must be positive, got %s", envPinConfirmInterval, s.interval)
+		s.interval = defaultPinConfirmInterval
+	}
+	if s.batch <= 0 {
+		configError("%s must be positive, got %d", envPinConfirmBatch, s.batch)
+		s.batch = defaultPinConfirmBatch
+	}
+	if s.timeout <= 0 {
+		configError("%s must be positive, got %s", envPinConfirmTimeout, s.timeout)
+		s.timeout = defaultPinConfirmTimeout
+	}
+
+	return s
+}
+
+// confirmPins makes process wait for each fetched dataset to be local before
+// counting it as cached. The confirmer runs until ctx is done.
+func (c *Cache) confirmPins(ctx context.Context, s pinConfirmSettings) {
+	if !s.enabled {
+		return
+	}
+
+	c.confirmer = newPinConfirmer(s.interval, s.batch, c.backend)
+	c.confirmTimeout = s.timeout
+	go c.confirmer.run(ctx)
+}
+
+// localLister is implemented by backends that can list their whole local
+// store in one request.
+type localLister interface {
+	ListLocal(ctx context.Context) (map[string]bool, error)
+}
+
+// errListUnsupported is returned by a localLister that turns out not to
+// support the listing.
+var errListUnsupported = errors.New("listing local data not supported")
+
+// pinConfirmer confirms that datasets requested from the network have landed
+// in the local store. Up to batchSize pending CIDs are checked together with
+// a single listing of the local datasets; if the backend does not support the
+// listing it falls back to checking each CID with Backend.Has.
+type pinConfirmer struct {
+	interval  time.Duration
+	batchSize int
+	backend   Backend
+
+	mu        sync.Mutex
+	waiting   map[string][]chan struct{}
+	order     []string
+	perCIDAPI bool
+}
+
+func newPinConfirmer(interval time.Duration, batchSize int, backend Backend) *pinConfirmer {
+	_, canList := backend.(localLister)
+
+	return &pinConfirmer{
+		interval:  interval,
+		batchSize: batchSize,
+		backend:   backend,
+		waiting:   make(map[string][]chan struct{}),
+		perCIDAPI: !canList,
+	}
+}
+
+// Wait blocks until the CID is confirmed locally or ctx is done.
+func (p *pinConfirmer) Wait(ctx context.Context, cid string) error {
+	done := make(chan struct{})
+
+	p.mu.Lock()
+	if _, ok := p.waiting[cid]; !ok {
+		p.order = append(p.order, cid)
+	}
+	p.waiting[cid] = append(p.waiting[cid], done)
+	p.mu.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.forget(cid, done)
+		return fmt.Errorf("pin of %s not confirmed: %w", cid, ctx.Err())
+	}
+}
+
+func (p *pinConfirmer) forget(cid string, done chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	waiters := p.waiting[cid]
+	for i, w := range waiters {
+		if w == done {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) > 0 {
+		p.waiting[cid] = waiters
+		return
+	}
+
+	p.drop(cid)
+}
+
+func (p *pinConfirmer) confirm(cid string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, w := range p.waiting[cid] {
+		close(w)
+	}
+	p.drop(cid)
+}
+
+// drop removes the CID from the pending set, the caller must hold the lock.
+func (p *pinConfirmer) drop(cid string) {
+	delete(p.waiting, cid)
+	for i, o := range p.order {
+		if o == cid {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// next returns up to batchSize pending CIDs, oldest first.
+func (p *pinConfirmer) next() ([]string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.order)
+	if n > p.batchSize {
+		n = p.batchSize
+	}
+
+	return append([]string(nil), p.order[:n]...), p.perCIDAPI
+}
+
+func (p *pinConfirmer) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.check(ctx)
+		}
+	}
+}
+
+func (p *pinConfirmer) check(ctx context.Context) {
+	cids, perCID := p.next()
+	if len(cids) == 0 {
+		return
+	}
+
+	if !perCID {
+		local, err := p.backend.(localLister).ListLocal(ctx)
+		if errors.Is(err, errListUnsupported) {
+			slog.Info("the backend does not support listing local data, confirming pins per CID")
+			p.mu.Lock()
+			p.perCIDAPI = true
+			p.mu.Unlock()
+		} else if err != nil {
+			slog.Error("failed to list local Codex data", "error", err)
+			return
+		} else {
+			for _, cid := range cids {
+				if local[cid] {
+					p.confirm(cid)
+				}
+			}
+			return
+		}
+	}
+
+	for _, cid := range cids {
+		ok, err := p.backend.Has(ctx, cid)
+		if err != nil {
+			slog.Error("failed to check local data", "cid", cid, "error", err)
+			continue
+		}
+		if ok {
+			p.confirm(cid)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProcessWaitsForPinConfirmation(t *testing.T) {
+	noRetries(t)
+
+	tests := []struct {
+		name       string
+		setup      func(m *mockCodex)
+		wantCached bool
+		wantErr    error
+	}{
+		{
+			// The dataset is not local for the first two checks.
+			name: "completes in time",
+			setup: func(m *mockCodex) {
+				m.Fail("list", http.StatusNotFound)
+				m.Fail("download", http.StatusNotFound, http.StatusNotFound)
+			},
+			wantCached: true,
+		},
+		{
+			// The local store does not answer before the deadline.
+			name: "times out",
+			setup: func(m *mockCodex) {
+				m.Fail("list", http.StatusNotFound)
+				m.Delay("download", time.Second)
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			cid := testCID(tt.name)
+			m.Add(cid, []byte("snapshot"))
+			tt.setup(m)
+
+			// Confirmation is on without QAKU_CACHE_PIN_CONFIRM, only the
+			// timing is shortened.
+			t.Setenv(envPinConfirm, "")
+			t.Setenv(envPinConfirmInterval, "5ms")
+			t.Setenv(envPinConfirmTimeout, "200ms")
+			c := newTestCache(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			t.Cleanup(cancel)
+			c.confirmPins(ctx, pinConfirmFromEnv())
+			if c.confirmer == nil {
+				t.Fatal("pin confirmation is off by default")
+			}
+
+			timeouts := testutil.ToFloat64(snapFailureReason.WithLabelValues("confirm_timeout"))
+			err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice")))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if _, got := indexedEntry(c, cid); got != tt.wantCached {
+				t.Errorf("cached = %t, want %t", got, tt.wantCached)
+			}
+			if tt.wantCached && m.Calls("download") < 3 {
+				t.Errorf("checked the dataset %d times, want it checked until it arrived", m.Calls("download"))
+			}
+			wantTimeouts := 0.0
+			if tt.wantErr != nil {
+				wantTimeouts = 1
+			}
+			if got := testutil.ToFloat64(snapFailureReason.WithLabelValues("confirm_timeout")) - timeouts; got != wantTimeouts {
+				t.Errorf("counted %v confirm timeouts, want %v", got, wantTimeouts)
+			}
+		})
+	}
+}
+
+func TestPinConfirmFromEnv(t *testing.T) {
+	for _, k := range []string{envPinConfirm, envPinConfirmInterval, envPinConfirmBatch, envPinConfirmTimeout} {
+		t.Setenv(k, "")
+	}
+	want := pinConfirmSettings{enabled: true, interval: defaultPinConfirmInterval, batch: defaultPinConfirmBatch, timeout: defaultPinConfirmTimeout}
+	if got := pinConfirmFromEnv(); got != want {
+		t.Errorf("default settings = %+v, want %+v", got, want)
+	}
+
+	t.Setenv(envPinConfirm, "false")
+	c := newTestCache(t)
+	c.confirmPins(context.Background(), pinConfirmFromEnv())
+	if c.confirmer != nil {
+		t.Error("confirmed pins with confirmation disabled")
+	}
+}
+
+// pendingPins starts waiting for the pins of cids and returns once the
+// confirmer has them all pending.
+func pendingPins(t *testing.T, ctx context.Context, p *pinConfirmer, cids []string) {
+	t.Helper()
+
+	for _, cid := range cids {
+		go p.Wait(ctx, cid)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		n := len(p.order)
+		p.mu.Unlock()
+		if n == len(cids) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the pins are not pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPinConfirmerBatches(t *testing.T) {
+	noRetries(t)
+	cids := []string{testCID("first"), testCID("second"), testCID("third")}
+
+	tests := []struct {
+		name          string
+		listStatus    int
+		wantLists     int
+		wantDownloads int
+	}{
+		{name: "listing", wantLists: 2},
+		{name: "per CID fallback", listStatus: http.StatusNotFound, wantLists: 1, wantDownloads: len(cids)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			for _, cid := range cids {
+				m.AddLocal(cid, []byte("snapshot"))
+			}
+			if tt.listStatus != 0 {
+				m.Fail("list", tt.listStatus)
+			}
+			p := newPinConfirmer(time.Hour, 2, m.Backend())
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pendingPins(t, ctx, p, cids)
+
+			// Each tick checks at most a batch of two.
+			p.check(ctx)
+			if got, _ := p.next(); len(got) != 1 {
+				t.Errorf("%d pins pending after a tick, want 1", len(got))
+			}
+			p.check(ctx)
+			if got, _ := p.next(); len(got) != 0 {
+				t.Errorf("%d pins pending after two ticks, want none", len(got))
+			}
+			if m.Calls("list") != tt.wantLists || m.Calls("download") != tt.wantDownloads {
+				t.Errorf("sent %d listings and %d downloads, want %d and %d", m.Calls("list"), m.Calls("download"), tt.wantLists, tt.wantDownloads)
+			}
+		})
+	}
+}
+
+func TestPinConfirmerOnFSBackend(t *testing.T) {
+	b := newTestFSBackend(t)
+	cid := testCID("fs")
+	addDataset(t, b, cid, []byte("snapshot"))
+	p := newPinConfirmer(time.Hour, 10, b)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pendingPins(t, ctx, p, []string{cid})
+
+	p.check(ctx)
+	if got, _ := p.next(); len(got) != 1 {
+		t.Fatal("confirmed a dataset that is not local")
+	}
+	if err := b.FetchToNetwork(ctx, cid); err != nil {
+		t.Fatal(err)
+	}
+	p.check(ctx)
+	if got, _ := p.next(); len(got) != 0 {
+		t.Error("did not confirm the local dataset")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-contrib/cors"
+)
+
+const envCORSOrigins = "QAKU_CACHE_CORS_ORIGINS"
+
+var defaultCORSOrigins = []string{"http://localhost:3000", "https://qaku.app"}
+
+// corsConfig builds the CORS config for the comma separated list of allowed
+// origins, "*" allows any origin. An empty list keeps the default origins.
+func corsConfig(origins string) (cors.Config, error) {
+	cfg := cors.Config{
+		AllowMethods:  []string{"GET", "HEAD", "OPTIONS"},
+		AllowHeaders:  []string{"Origin,DNT,User-Agent,X-Requested-With,If-Modified-Since,Cache-Control,Content-Type,Range"},
+		ExposeHeaders: []string{"Content-Length", defaultRequestIDHeader},
+	}
+
+	for _, o := range strings.Split(origins, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		if o == "*" {
+			cfg.AllowAllOrigins = true
+			continue
+		}
+		cfg.AllowOrigins = append(cfg.AllowOrigins, o)
+	}
+
+	if cfg.AllowAllOrigins {
+		cfg.AllowOrigins = nil
+	} else if len(cfg.AllowOrigins) == 0 {
+		cfg.AllowOrigins = defaultCORSOrigins
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		return cors.Config{}, fmt.Errorf("invalid %s: %w", envCORSOrigins, err)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCORSOrigins(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins string
+		origin  string
+		want    string
+	}{
+		{name: "default allowed", origin: "https://qaku.app", want: "https://qaku.app"},
+		{name: "default disallowed", origin: "https://qaku.example"},
+		{name: "configured allowed", origins: "https://qaku.example, https://other.example", origin: "https://qaku.example", want: "https://qaku.example"},
+		{name: "configured replaces default", origins: "https://qaku.example", origin: "https://qaku.app"},
+		{name: "wildcard", origins: "*", origin: "https://anywhere.example", want: "*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corsCfg, err := corsConfig(tt.origins)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := newTestCache(t)
+			srv := server("127.0.0.1:0", nil, corsCfg, 0, nil, discardLogger(), c, nil, nil, nil, nil)
+			t.Cleanup(func() { srv.Close() })
+
+			w := get(srv.Handler, "/api/qaku/v1/snapshots", http.Header{"Origin": {tt.origin}})
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := corsConfig("qaku.app"); err == nil {
+		t.Error("accepted an origin without a scheme")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	envDeadLetterSize = "QAKU_CACHE_DEAD_LETTER_SIZE"
+	envDeadLetterPath = "QAKU_CACHE_DEAD_LETTER_PATH"
+)
+
+type DeadLetter struct {
+	Time    time.Time    `json:"time"`
+	Reason  string       `json:"reason"`
+	Error   string       `json:"error"`
+	Message *QakuMessage `json:"message,omitempty"`
+}
+
+// deadLetterLog keeps the most recent permanently failed cache requests in
+// memory and optionally appends every entry to a JSON lines file.
+type deadLetterLog struct {
+	mu      sync.Mutex
+	size    int
+	entries []DeadLetter
+	file    *os.File
+}
+
+func newDeadLetterLog(size int, path string) (*deadLetterLog, error) {
+	d := &deadLetterLog{size: size}
+
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		d.file = f
+	}
+
+	return d, nil
+}
+
+// Add records a failed request. It is a no-op on a nil log so callers do not
+// need to check whether the dead-letter log is enabled.
+func (d *deadLetterLog) Add(reason string, msg *QakuMessage, err error) {
+	if d == nil {
+		return
+	}
+
+	entry := DeadLetter{Time: time.Now(), Reason: reason, Message: msg}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.entries = append(d.entries, entry)
+	if len(d.entries) > d.size {
+		d.entries = append([]DeadLetter(nil), d.entries[len(d.entries)-d.size:]...)
+	}
+
+	if d.file != nil {
+		data, err := json.Marshal(entry)
+		if err == nil {
+			data = append(data, '\n')
+			_, err = d.file.Write(data)
+		}
+		persistence.Report("dead letters", err)
+	}
+}
+
+// List returns the retained entries, newest first, optionally filtered by reason.
+func (d *deadLetterLog) List(reason string) []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list := []DeadLetter{}
+	for i := len(d.entries) - 1; i >= 0; i-- {
+		if reason == "" || d.entries[i].Reason == reason {
+			list = append(list, d.entries[i])
+		}
+	}
+
+	return list
+}
+
+// Sync commits the appended entries to disk. It is a no-op on a nil log or
+// without a file.
+func (d *deadLetterLog) Sync() error {
+	if d == nil || d.file == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.file.Sync()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// snapshotKeyHeader carries the hex encoded AES key a client can supply to
+// have encrypted snapshots decrypted by the proxy. Its value is never logged.
+const snapshotKeyHeader = "X-Qaku-Snapshot-Key"
+
+// parseSnapshotKey returns the AES cipher for the hex encoded key.
+func parseSnapshotKey(keyHex string) (cipher.Block, error) {
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot key encoding")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot key: %w", err)
+	}
+
+	return block, nil
+}
+
+// decryptSnapshot wraps the Codex data stream with AES-CTR decryption.
+// Encrypted snapshots are expected to start with the 16 byte IV followed by
+// the ciphertext. Whether a snapshot is encrypted comes from the cache
+// request, the Codex manifest does not know: its protected flag only means
+// the dataset is erasure coded.
+func decryptSnapshot(block cipher.Block, r io.Reader) (io.Reader, error) {
+	iv := make([]byte, aes.BlockSize)
+	_, err := io.ReadFull(r, iv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot IV: %w", err)
+	}
+
+	return &cipher.StreamReader{S: cipher.NewCTR(block, iv), R: r}, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSnapshotDecryption(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 16)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := bytes.Repeat([]byte{1}, aes.BlockSize)
+	stored := make([]byte, aes.BlockSize+len("snapshot"))
+	copy(stored, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(stored[aes.BlockSize:], []byte("snapshot"))
+
+	b := newTestFSBackend(t)
+	c := newTestCache(t)
+	c.backend = b
+	h := newTestServer(t, c, testAdmin)
+	encrypted, plain := testCID("encrypted"), testCID("plain")
+	for _, e := range []CacheEntry{{CID: encrypted, Encrypted: true}, {CID: plain}} {
+		addDataset(t, b, e.CID, stored)
+		if err := b.FetchToNetwork(context.Background(), e.CID); err != nil {
+			t.Fatal(err)
+		}
+		e.Size = len(stored)
+		e.CachedAt = time.Now()
+		c.index.Put(e)
+	}
+
+	withKey := http.Header{snapshotKeyHeader: {hex.EncodeToString(key)}}
+	if w := get(h, "/api/qaku/v1/snapshot/"+encrypted, withKey); w.Code != http.StatusOK || w.Body.String() != "snapshot" {
+		t.Errorf("got %d %q, want the decrypted snapshot", w.Code, w.Body.String())
+	}
+	if w := get(h, "/api/qaku/v1/snapshot/"+plain, withKey); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), stored) {
+		t.Errorf("got %d %q, want the snapshot not cached as encrypted served as stored", w.Code, w.Body.String())
+	}
+	if w := get(h, "/api/qaku/v1/snapshot/"+encrypted, http.Header{snapshotKeyHeader: {"not hex"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for a malformed key, want 400", w.Code)
+	}
+}
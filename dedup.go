@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/waku-org/go-waku/waku/v2/api/filter"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+)
+
+const (
+	envDedupWindow = "QAKU_CACHE_DEDUP_WINDOW"
+	envDedupSize   = "QAKU_CACHE_DEDUP_SIZE"
+
+	defaultDedupWindow = 10 * time.Minute
+	defaultDedupSize   = 10000
+)
+
+var snapDuplicates = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qaku_cache_duplicates",
+	Help: "The number of envelopes dropped as duplicates of a recently seen message",
+})
+
+// deduplicator drops envelopes whose message was already seen within the
+// window. Messages are keyed by the hash of their payload rather than the
+// envelope hash, which includes the pubsub topic, so the same message
+// delivered on several shards or subscriptions is processed once.
+type deduplicator struct {
+	window time.Duration
+	size   int
+	next   filter.EnevelopeProcessor
+
+	mu    sync.Mutex
+	seen  map[[32]byte]time.Time
+	order [][32]byte
+}
+
+func newDeduplicator(window time.Duration, size int, next filter.EnevelopeProcessor) *deduplicator {
+	return &deduplicator{
+		window: window,
+		size:   size,
+		next:   next,
+		seen:   make(map[[32]byte]time.Time),
+	}
+}
+
+func (d *deduplicator) OnNewEnvelope(envelope *protocol.Envelope) error {
+	if d.duplicate(sha256.Sum256(envelope.Message().Payload), time.Now()) {
+		snapDuplicates.Inc()
+		return nil
+	}
+
+	return d.next.OnNewEnvelope(envelope)
+}
+
+// Shed forgets the messages seen within the window to relieve memory
+// pressure and returns how many were forgotten. A message delivered again
+// is then processed again and found in the index.
+func (d *deduplicator) Shed() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := len(d.seen)
+	// A map keeps its buckets when keys are deleted, so start over.
+	d.seen = make(map[[32]byte]time.Time)
+	d.order = nil
+
+	return n
+}
+
+// duplicate records key and reports whether it was seen within the window.
+func (d *deduplicator) duplicate(key [32]byte, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Keys are appended in time order, so expired ones are at the front.
+	for len(d.order) > 0 && (len(d.order) >= d.size || now.Sub(d.seen[d.order[0]]) > d.window) {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+
+	d.seen[key] = now
+	d.order = append(d.order, key)
+
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+	"github.com/waku-org/go-waku/waku/v2/protocol/pb"
+)
+
+// countingProcessor counts the envelopes passed on to it.
+type countingProcessor struct {
+	envelopes int
+}
+
+func (p *countingProcessor) OnNewEnvelope(*protocol.Envelope) error {
+	p.envelopes++
+	return nil
+}
+
+func TestDeduplicatorAcrossShards(t *testing.T) {
+	next := &countingProcessor{}
+	d := newDeduplicator(time.Minute, 10, next)
+
+	payload := cacheMessage(t, testCID("dedup"), "")
+	for _, pubsubTopic := range []string{"/waku/2/rs/1/0", "/waku/2/rs/1/3"} {
+		msg := &pb.WakuMessage{Payload: payload, ContentTopic: testContentTopic}
+		envelope := protocol.NewEnvelope(msg, time.Now().UnixNano(), pubsubTopic)
+		if err := d.OnNewEnvelope(envelope); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if next.envelopes != 1 {
+		t.Errorf("passed on %d envelopes of the same message on two shards, want 1", next.envelopes)
+	}
+
+	if err := d.OnNewEnvelope(testEnvelope(cacheMessage(t, testCID("other"), ""))); err != nil {
+		t.Fatal(err)
+	}
+	if next.envelopes != 2 {
+		t.Errorf("passed on %d envelopes after a different message, want 2", next.envelopes)
+	}
+}
+
+func TestDeduplicatorWindow(t *testing.T) {
+	d := newDeduplicator(time.Minute, 2, nil)
+	now := time.Now()
+	a, b, c := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b")), sha256.Sum256([]byte("c"))
+
+	tests := []struct {
+		name string
+		key  [32]byte
+		at   time.Time
+		want bool
+	}{
+		{name: "first", key: a, at: now, want: false},
+		{name: "repeat", key: a, at: now.Add(time.Second), want: true},
+		{name: "expired", key: a, at: now.Add(2 * time.Minute), want: false},
+		{name: "second key", key: b, at: now.Add(2 * time.Minute), want: false},
+		{name: "evicts oldest", key: c, at: now.Add(2 * time.Minute), want: false},
+		{name: "evicted", key: a, at: now.Add(2 * time.Minute), want: false},
+	}
+
+	for _, tt := range tests {
+		if got := d.duplicate(tt.key, tt.at); got != tt.want {
+			t.Errorf("%s: duplicate = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeduplicatorShed(t *testing.T) {
+	d := newDeduplicator(time.Minute, 10, nil)
+	now := time.Now()
+	a, b := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))
+	d.duplicate(a, now)
+	d.duplicate(b, now)
+
+	if n := d.Shed(); n != 2 {
+		t.Errorf("shed %d keys, want 2", n)
+	}
+	if d.duplicate(a, now) {
+		t.Error("still remembered a shed key")
+	}
+	if len(d.seen) != 1 || len(d.order) != 1 {
+		t.Errorf("%d seen and %d ordered keys after shedding and one new key, want 1", len(d.seen), len(d.order))
+	}
+}
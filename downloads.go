@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envMaxConcurrentDownloads = "QAKU_CACHE_MAX_CONCURRENT_DOWNLOADS"
+	envDownloadQueueTimeout   = "QAKU_CACHE_DOWNLOAD_QUEUE_TIMEOUT"
+
+	// downloadRetryAfter is suggested to clients turned away at the limit.
+	downloadRetryAfter = 5 * time.Second
+)
+
+var (
+	activeDownloads = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qaku_cache_active_downloads",
+		Help: "The number of snapshots currently being proxied",
+	})
+	downloadsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_downloads_rejected",
+		Help: "The number of snapshot downloads rejected at the concurrency limit",
+	})
+)
+
+// downloadLimiter bounds the snapshots proxied at the same time. A request
+// over the limit waits up to timeout for a slot, a zero timeout rejects it
+// right away.
+type downloadLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+// newDownloadLimiter returns nil, which never limits, if max is not positive.
+func newDownloadLimiter(max int, timeout time.Duration) *downloadLimiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &downloadLimiter{slots: make(chan struct{}, max), timeout: timeout}
+}
+
+// Acquire takes a slot and reports whether it got one, the slot has to be
+// given back with Release.
+func (l *downloadLimiter) Acquire(ctx context.Context) bool {
+	if l != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if !l.wait(ctx) {
+				downloadsRejected.Inc()
+				return false
+			}
+		}
+	}
+
+	activeDownloads.Inc()
+	return true
+}
+
+func (l *downloadLimiter) wait(ctx context.Context) bool {
+	if l.timeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	return false
+}
+
+func (l *downloadLimiter) Release() {
+	activeDownloads.Dec()
+	if l != nil {
+		<-l.slots
+	}
+}
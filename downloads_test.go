@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDownloadLimitRejects(t *testing.T) {
+	noRetries(t)
+	// The first download blocks until released.
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if codexOperation(r.Method, r.URL.Path) != "download" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("snapshot"))
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	corsCfg, err := corsConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCache(t)
+	c.backend = newCodexBackend(upstream.URL)
+	srv := server("127.0.0.1:0", nil, corsCfg, 0, newDownloadLimiter(1, 0), discardLogger(), c, nil, nil, nil, nil)
+	t.Cleanup(func() { srv.Close() })
+	path := "/api/qaku/v1/snapshot/" + testCID("snapshot")
+
+	active := testutil.ToFloat64(activeDownloads)
+	rejected := testutil.ToFloat64(downloadsRejected)
+	done := make(chan int)
+	go func() { done <- get(srv.Handler, path, nil).Code }()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first download never started")
+	}
+	if got := testutil.ToFloat64(activeDownloads) - active; got != 1 {
+		t.Errorf("%v active downloads, want 1", got)
+	}
+
+	w := get(srv.Handler, path, nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "5" {
+		t.Errorf("got %d with Retry-After %q over the limit, want 503 with 5", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := testutil.ToFloat64(downloadsRejected) - rejected; got != 1 {
+		t.Errorf("counted %v rejected downloads, want 1", got)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("the first download answered %d", code)
+	}
+	if got := testutil.ToFloat64(activeDownloads) - active; got != 0 {
+		t.Errorf("%v active downloads after they finished, want 0", got)
+	}
+	if w := get(srv.Handler, path, nil); w.Code == http.StatusServiceUnavailable {
+		t.Error("the slot was not released")
+	}
+}
+
+func TestDownloadLimiterQueues(t *testing.T) {
+	l := newDownloadLimiter(1, time.Second)
+	ctx := context.Background()
+	if !l.Acquire(ctx) {
+		t.Fatal("no slot for the first download")
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l.Release()
+	}()
+	if !l.Acquire(ctx) {
+		t.Fatal("did not wait for the slot to be released")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if l.Acquire(cancelled) {
+		t.Error("got a slot for a cancelled request")
+	}
+	l.Release()
+
+	disabled := newDownloadLimiter(0, 0)
+	if !disabled.Acquire(ctx) {
+		t.Error("the disabled limiter rejected a download")
+	}
+	disabled.Release()
+}
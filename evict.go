@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envMaxVersions   = "QAKU_CACHE_MAX_VERSIONS"
+	envTotalSize     = "QAKU_CACHE_TOTAL_SIZE"
+	envEvictionGrace = "QAKU_CACHE_EVICTION_GRACE"
+
+	defaultEvictionGrace = time.Hour
+
+	evictVersionLimit = "version_limit"
+	evictBudget       = "budget"
+	evictAdmin        = "admin"
+	evictTTL          = "ttl"
+	evictInvalidated  = "invalidated"
+)
+
+// errBudgetExceeded is returned when a dataset does not fit the total size
+// budget even after evicting everything that may be evicted.
+var errBudgetExceeded = errors.New("total cache size budget exceeded")
+
+var snapEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "qaku_cache_evictions",
+	Help: "The number of cache entries evicted, by reason",
+}, []string{"reason"})
+
+// evict unpins the entry from Codex and removes it from the index. Entries
+// that fail to unpin stay indexed so they are retried on the next eviction.
+func (c *Cache) evict(ctx context.Context, e CacheEntry, reason string) error {
+	err := c.backend.Unpin(ctx, e.CID)
+	if err != nil {
+		return err
+	}
+
+	c.evicted(e, reason)
+
+	return nil
+}
+
+// evicted removes the unpinned entry from the index.
+func (c *Cache) evicted(e CacheEntry, reason string) {
+	c.index.Remove(e.CID)
+	snapEvictions.WithLabelValues(reason).Inc()
+	c.logger.Info("evicted", "cid", e.CID, "owner", e.Owner, "reason", reason)
+	audit("evict", map[string]any{"cid": e.CID, "owner": e.Owner, "reason": reason})
+}
+
+// pruneVersions evicts the oldest snapshots of owner once more than
+// c.maxVersions are cached. Snapshots carry no name, so every snapshot of an
+// owner counts as a version. Protected snapshots count towards the limit but
+// are never evicted.
+func (c *Cache) pruneVersions(ctx context.Context, owner string) {
+	if c.maxVersions <= 0 {
+		return
+	}
+
+	excess, protected := c.index.OwnerExcess(owner, c.maxVersions)
+	if protected > c.maxVersions {
+		c.logger.Warn("more protected snapshots than the version limit", "owner", owner, "protected", protected, "limit", c.maxVersions)
+	}
+
+	for _, e := range excess {
+		err := c.evict(ctx, e, evictVersionLimit)
+		if err != nil {
+			c.logger.Error("eviction failed", "error", err)
+		}
+	}
+}
+
+// makeRoom evicts least recently served entries until size more bytes fit in
+// the total size budget. Entries served within the grace window and
+// protected entries are kept. The bytes stay reserved until release is
+// called, so requests cached in parallel cannot together exceed the budget
+// before their datasets reach the index. release must be called once the
+// entry is indexed or the pin failed.
+//
+// Victims are picked and the bytes reserved under budgetMu, but unpinned
+// without it so a slow Codex does not hold up every other reservation.
+func (c *Cache) makeRoom(ctx context.Context, size int) (release func(), err error) {
+	if c.totalSize <= 0 {
+		return func() {}, nil
+	}
+	if int64(size) > c.totalSize {
+		return nil, fmt.Errorf("%w: dataset of %d bytes is larger than the budget of %d", errBudgetExceeded, size, c.totalSize)
+	}
+
+	c.budgetMu.Lock()
+	defer c.budgetMu.Unlock()
+
+	c.reserved += int64(size)
+	failed := make(map[string]bool)
+	for {
+		victims, used, ok := c.pickVictims(failed)
+		if !ok {
+			c.reserved -= int64(size)
+
+			// Protected entries are never evicted, once they fill the budget
+			// every new dataset is refused until some are unprotected.
+			if protected := c.index.ProtectedBytes(); protected+int64(size) > c.totalSize {
+				c.logger.Warn("protected snapshots leave no room in the size budget", "protected", protected, "size", size, "budget", c.totalSize)
+			}
+
+			return nil, fmt.Errorf("%w: %d bytes cached or reserved, %d more do not fit in %d", errBudgetExceeded, used-int64(size), size, c.totalSize)
+		}
+		if len(victims) == 0 {
+			break
+		}
+
+		c.budgetMu.Unlock()
+		errs := make([]error, len(victims))
+		for i, e := range victims {
+			errs[i] = c.backend.Unpin(ctx, e.CID)
+		}
+		c.budgetMu.Lock()
+
+		// A victim that failed to unpin stays indexed and counts again, so
+		// the next round picks others in its place.
+		for i, e := range victims {
+			delete(c.evicting, e.CID)
+			c.evictingBytes -= int64(e.Size)
+			if errs[i] != nil {
+				c.logger.Error("eviction failed", "cid", e.CID, "error", errs[i])
+				failed[e.CID] = true
+				continue
+			}
+			c.evicted(e, evictBudget)
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.budgetMu.Lock()
+			c.reserved -= int64(size)
+			c.budgetMu.Unlock()
+		})
+	}, nil
+}
+
+// pickVictims returns the least recently served entries to evict so the
+// reserved bytes fit in the budget, and marks them as being evicted. It
+// returns no victims if they already fit and false if evicting everything
+// allowed is not enough. used is the cached and reserved bytes net of the
+// entries already being evicted. The caller must hold budgetMu.
+func (c *Cache) pickVictims(skip map[string]bool) (victims []CacheEntry, used int64, ok bool) {
+	used = c.index.TotalBytes() + c.reserved - c.evictingBytes
+	if used <= c.totalSize {
+		return nil, used, true
+	}
+
+	free := used
+	for _, e := range c.index.LeastRecentlyServed(time.Now().Add(-c.evictionGrace)) {
+		if c.evicting[e.CID] || skip[e.CID] {
+			continue
+		}
+
+		victims = append(victims, e)
+		free -= int64(e.Size)
+		if free <= c.totalSize {
+			break
+		}
+	}
+	if free > c.totalSize {
+		return nil, used, false
+	}
+
+	if c.evicting == nil {
+		c.evicting = make(map[string]bool)
+	}
+	for _, e := range victims {
+		c.evicting[e.CID] = true
+		c.evictingBytes += int64(e.Size)
+	}
+
+	return victims, used, true
+}
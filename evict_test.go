@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPruneVersionsUnpinsOldest(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	c.maxVersions = 2
+
+	now := time.Now()
+	old, older := testCID("old"), testCID("older")
+	for n, cid := range []string{older, old} {
+		m.AddLocal(cid, []byte("version"))
+		c.index.Put(CacheEntry{CID: cid, Owner: "alice", Size: len("version"), CachedAt: now.Add(time.Duration(n-2) * time.Hour)})
+	}
+	other := testCID("other owner")
+	m.AddLocal(other, []byte("version"))
+	c.index.Put(CacheEntry{CID: other, Owner: "bob", Size: len("version"), CachedAt: now.Add(-3 * time.Hour)})
+
+	latest := testCID("latest")
+	m.Add(latest, []byte("version"))
+	err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, latest, "alice")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		cid  string
+		want bool
+	}{{older, false}, {old, true}, {latest, true}, {other, true}} {
+		if got := c.index.Has(tt.cid); got != tt.want {
+			t.Errorf("%s indexed = %t, want %t", tt.cid, got, tt.want)
+		}
+		if got := m.Local(tt.cid); got != tt.want {
+			t.Errorf("%s local = %t, want %t", tt.cid, got, tt.want)
+		}
+	}
+}
+
+func TestProtectedEntriesSurviveEviction(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	h := newTestServer(t, c, testAdmin)
+
+	now := time.Now()
+	protected, unprotected := testCID("protected"), testCID("unprotected")
+	for n, cid := range []string{protected, unprotected} {
+		m.AddLocal(cid, []byte("version"))
+		c.index.Put(CacheEntry{CID: cid, Owner: "alice", Size: len("version"), CachedAt: now.Add(time.Duration(n-2) * time.Hour)})
+	}
+
+	w := do(h, http.MethodPost, "/api/qaku/v1/entries/"+protected+"/protect", adminHeader(), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("protect returned %d: %s", w.Code, w.Body)
+	}
+	if w := do(h, http.MethodPost, "/api/qaku/v1/entries/"+testCID("missing")+"/protect", adminHeader(), nil); w.Code != http.StatusNotFound {
+		t.Errorf("protecting a missing entry returned %d, want 404", w.Code)
+	}
+
+	c.maxVersions = 1
+	c.pruneVersions(context.Background(), "alice")
+	if !c.index.Has(protected) {
+		t.Error("version pruning evicted the oldest, protected snapshot")
+	}
+	if c.index.Has(unprotected) {
+		t.Error("version pruning kept the unprotected snapshot")
+	}
+
+	c.maxVersions = 0
+	c.totalSize = int64(len("version")) + 2
+	c.evictionGrace = 0
+	if _, err := c.makeRoom(context.Background(), 4); !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("makeRoom = %v, want %v with only protected entries cached", err, errBudgetExceeded)
+	}
+	if !c.index.Has(protected) {
+		t.Error("budget eviction evicted the protected snapshot")
+	}
+
+	if w := do(h, http.MethodDelete, "/api/qaku/v1/entries/"+protected+"/protect", adminHeader(), nil); w.Code != http.StatusOK {
+		t.Fatalf("unprotect returned %d: %s", w.Code, w.Body)
+	}
+	release, err := c.makeRoom(context.Background(), 4)
+	if err != nil {
+		t.Fatalf("makeRoom after unprotecting = %v", err)
+	}
+	release()
+	if c.index.Has(protected) {
+		t.Error("budget eviction kept the unprotected snapshot")
+	}
+}
+
+func TestMakeRoomEvictsLeastRecentlyServed(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	c.totalSize = 12
+	c.evictionGrace = time.Hour
+
+	now := time.Now()
+	oldest, older, recent := testCID("oldest"), testCID("older"), testCID("recent")
+	for _, e := range []CacheEntry{
+		{CID: oldest, Size: 4, CachedAt: now.Add(-4 * time.Hour)},
+		// Cached first, but served since.
+		{CID: older, Size: 4, CachedAt: now.Add(-5 * time.Hour), LastServedAt: now.Add(-3 * time.Hour)},
+		// Served within the grace window.
+		{CID: recent, Size: 4, CachedAt: now.Add(-6 * time.Hour), LastServedAt: now.Add(-time.Minute)},
+	} {
+		m.AddLocal(e.CID, []byte("data"))
+		c.index.Put(e)
+	}
+
+	latest := testCID("latest")
+	m.Add(latest, []byte("data"))
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, latest, ""))); err != nil {
+		t.Fatal(err)
+	}
+	if c.index.Has(oldest) || !c.index.Has(older) || !c.index.Has(recent) || !c.index.Has(latest) {
+		t.Errorf("indexed oldest %t, older %t, recent %t, latest %t, want only oldest evicted",
+			c.index.Has(oldest), c.index.Has(older), c.index.Has(recent), c.index.Has(latest))
+	}
+	if m.Local(oldest) {
+		t.Error("the evicted dataset is still pinned")
+	}
+	if c.index.TotalBytes() != 12 || c.index.Len() != 3 {
+		t.Errorf("tracking %d bytes in %d datasets, want 12 in 3", c.index.TotalBytes(), c.index.Len())
+	}
+
+	// Only the dataset served within the grace window is left to evict
+	// after the next one.
+	for _, cid := range []string{testCID("next"), testCID("refused")} {
+		m.Add(cid, []byte("data"))
+		c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "")))
+	}
+	if !c.index.Has(recent) || c.index.Has(testCID("refused")) {
+		t.Errorf("indexed recent %t, refused %t, want the grace window to hold", c.index.Has(recent), c.index.Has(testCID("refused")))
+	}
+	if c.index.TotalBytes() > c.totalSize {
+		t.Errorf("tracking %d bytes over the budget of %d", c.index.TotalBytes(), c.totalSize)
+	}
+}
+
+func TestMakeRoomReservesBytes(t *testing.T) {
+	c := newTestCache(t)
+	c.totalSize = 10
+
+	first, err := c.makeRoom(context.Background(), 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.makeRoom(context.Background(), 6); !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("second reservation = %v, want %v while the first is held", err, errBudgetExceeded)
+	}
+
+	first()
+	first()
+	second, err := c.makeRoom(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("reservation after release = %v", err)
+	}
+	second()
+	if c.reserved != 0 {
+		t.Errorf("%d bytes still reserved", c.reserved)
+	}
+
+	if _, err := c.makeRoom(context.Background(), 11); !errors.Is(err, errBudgetExceeded) {
+		t.Errorf("dataset over the budget = %v, want %v", err, errBudgetExceeded)
+	}
+}
+
+func TestMakeRoomUnpinsWithoutTheBudgetLock(t *testing.T) {
+	m := newMockCodex(t)
+	m.Delay("unpin", 200*time.Millisecond)
+	c := newTestCache(t)
+	c.totalSize = 8
+
+	now := time.Now()
+	older, old := testCID("older"), testCID("old")
+	for n, cid := range []string{older, old} {
+		m.AddLocal(cid, []byte("data"))
+		c.index.Put(CacheEntry{CID: cid, Size: 4, CachedAt: now.Add(time.Duration(n-2) * time.Hour)})
+	}
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := c.makeRoom(context.Background(), 4)
+			results <- err
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Calls("unpin") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d unpins started, want both reservations evicting at once", m.Calls("unpin"))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !c.budgetMu.TryLock() {
+		t.Fatal("held the budget lock while unpinning")
+	}
+	c.budgetMu.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("makeRoom = %v", err)
+		}
+	}
+	if c.index.Len() != 0 || m.Calls("unpin") != 2 {
+		t.Errorf("%d entries left after %d unpins, want both evicted once", c.index.Len(), m.Calls("unpin"))
+	}
+	if c.reserved != 8 || c.evictingBytes != 0 || len(c.evicting) != 0 {
+		t.Errorf("reserved %d bytes with %d evicting, want 8 and none", c.reserved, c.evictingBytes)
+	}
+}
+
+func TestMakeRoomSkipsFailedUnpins(t *testing.T) {
+	m := newMockCodex(t)
+	m.Fail("unpin", http.StatusInternalServerError)
+	c := newTestCache(t)
+	c.totalSize = 8
+
+	now := time.Now()
+	older, old := testCID("older"), testCID("old")
+	for n, cid := range []string{older, old} {
+		m.AddLocal(cid, []byte("data"))
+		c.index.Put(CacheEntry{CID: cid, Size: 4, CachedAt: now.Add(time.Duration(n-2) * time.Hour)})
+	}
+
+	release, err := c.makeRoom(context.Background(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if !c.index.Has(older) || c.index.Has(old) {
+		t.Errorf("indexed older %t, old %t, want the next entry evicted in place of the failed one", c.index.Has(older), c.index.Has(old))
+	}
+	if c.reserved != 4 || c.evictingBytes != 0 {
+		t.Errorf("reserved %d bytes with %d evicting, want 4 and none", c.reserved, c.evictingBytes)
+	}
+}
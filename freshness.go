@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envMaxMessageAge = "QAKU_CACHE_MAX_MESSAGE_AGE"
+	envMaxClockSkew  = "QAKU_CACHE_MAX_CLOCK_SKEW"
+
+	defaultMaxMessageAge = 5 * time.Minute
+	defaultMaxClockSkew  = time.Minute
+)
+
+var snapStale = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qaku_cache_stale_rejected",
+	Help: "The total number of messages rejected for being too old or dated in the future",
+})
+
+// errStaleMessage is returned for messages outside the freshness window.
+var errStaleMessage = errors.New("stale message")
+
+// freshness bounds how old a message may be and how far in the future it may
+// be dated, so old signed messages cannot be replayed. A zero maxAge disables
+// the check.
+type freshness struct {
+	maxAge time.Duration
+	skew   time.Duration
+}
+
+// Check rejects messages without a timestamp or dated outside the window.
+func (f freshness) Check(ts Timestamp, now time.Time) error {
+	if f.maxAge <= 0 {
+		return nil
+	}
+	if ts == 0 {
+		return fmt.Errorf("%w: no timestamp", errStaleMessage)
+	}
+
+	at := time.UnixMilli(int64(ts))
+	if age := now.Sub(at); age > f.maxAge {
+		return fmt.Errorf("%w: %s old, at most %s allowed", errStaleMessage, age.Round(time.Second), f.maxAge)
+	}
+	if ahead := at.Sub(now); ahead > f.skew {
+		return fmt.Errorf("%w: dated %s in the future, at most %s allowed", errStaleMessage, ahead.Round(time.Second), f.skew)
+	}
+
+	return nil
+}
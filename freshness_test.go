@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFreshnessCheck(t *testing.T) {
+	now := time.Now()
+	f := freshness{maxAge: 5 * time.Minute, skew: time.Minute}
+
+	tests := []struct {
+		name    string
+		f       freshness
+		at      time.Time
+		noTime  bool
+		wantErr bool
+	}{
+		{name: "in window", f: f, at: now.Add(-4 * time.Minute)},
+		{name: "slightly ahead", f: f, at: now.Add(30 * time.Second)},
+		{name: "too old", f: f, at: now.Add(-6 * time.Minute), wantErr: true},
+		{name: "future dated", f: f, at: now.Add(2 * time.Minute), wantErr: true},
+		{name: "no timestamp", f: f, noTime: true, wantErr: true},
+		{name: "disabled", f: freshness{}, at: now.Add(-24 * time.Hour)},
+	}
+
+	for _, tt := range tests {
+		ts := Timestamp(tt.at.UnixMilli())
+		if tt.noTime {
+			ts = 0
+		}
+		err := tt.f.Check(ts, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Check = %v, want error %t", tt.name, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, errStaleMessage) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, errStaleMessage)
+		}
+	}
+}
+
+func TestOnNewEnvelopeRejectsStaleMessage(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	c.freshness = freshness{maxAge: 5 * time.Minute, skew: time.Minute}
+
+	stale := testutil.ToFloat64(snapStale)
+	for _, at := range []time.Time{time.Now().Add(-time.Hour), time.Now().Add(time.Hour)} {
+		cid := testCID(at.String())
+		m.Add(cid, []byte("snapshot"))
+		err := c.OnNewEnvelope(testEnvelope(encodeMessage(t, QakuMessage{
+			Type:      cacheMessageType,
+			Payload:   CacheRequest{CID: cid},
+			Timestamp: Timestamp(at.UnixMilli()),
+		})))
+		if !errors.Is(err, errStaleMessage) {
+			t.Errorf("got error %v, want %v", err, errStaleMessage)
+		}
+		if c.index.Has(cid) {
+			t.Error("cached a stale message")
+		}
+	}
+
+	if got := testutil.ToFloat64(snapStale) - stale; got != 2 {
+		t.Errorf("counted %v stale messages, want 2", got)
+	}
+	if got := m.Calls("manifest"); got != 0 {
+		t.Errorf("made %d manifest requests, want none for stale messages", got)
+	}
+
+	// A fresh message still goes through.
+	cid := testCID("fresh")
+	m.Add(cid, []byte("snapshot"))
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, ""))); err != nil {
+		t.Fatal(err)
+	}
+	if !c.index.Has(cid) {
+		t.Error("did not cache a fresh message")
+	}
+}
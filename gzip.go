@@ -0,0 +1,140 @@
+package main
+
+import (
+	"compress/gzip"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	envGzipMinSize = "QAKU_CACHE_GZIP_MIN_SIZE"
+
+	defaultGzipMinSize = 1024
+)
+
+// gzipJSON compresses JSON responses of at least minSize bytes for clients
+// that accept gzip. Other responses pass through, as does the snapshot stream
+// even if Codex labels it as JSON.
+func gzipJSON(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.FullPath() == snapshotRoute {
+			c.Next()
+			return
+		}
+
+		w := &gzipWriter{ResponseWriter: c.Writer, accept: acceptsGzip(c.GetHeader("Accept-Encoding")), minSize: minSize}
+		c.Writer = w
+		defer w.finish()
+
+		c.Next()
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && k == "q" {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+		}
+		return q > 0
+	}
+
+	return false
+}
+
+const (
+	gzipUndecided = iota
+	gzipPassthrough
+	gzipBuffering
+	gzipCompressing
+)
+
+// gzipWriter decides on the first write whether to compress, by then the
+// handler has set the content type. Small bodies are buffered until they
+// reach minSize and are sent uncompressed if they never do.
+type gzipWriter struct {
+	gin.ResponseWriter
+	accept  bool
+	minSize int
+
+	mode int
+	buf  []byte
+	gz   *gzip.Writer
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if w.mode == gzipUndecided {
+		w.decide()
+	}
+
+	switch w.mode {
+	case gzipBuffering:
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+		err := w.compress()
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	case gzipCompressing:
+		return w.gz.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *gzipWriter) decide() {
+	w.mode = gzipPassthrough
+
+	h := w.Header()
+	if !strings.HasPrefix(h.Get("Content-Type"), "application/json") {
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+
+	if w.accept && h.Get("Content-Encoding") == "" {
+		w.mode = gzipBuffering
+	}
+}
+
+// compress switches to compressing and flushes the buffered bytes.
+func (w *gzipWriter) compress() error {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+
+	w.mode = gzipCompressing
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	buf := w.buf
+	w.buf = nil
+	_, err := w.gz.Write(buf)
+
+	return err
+}
+
+// finish sends what is still buffered and completes the gzip stream.
+func (w *gzipWriter) finish() {
+	switch w.mode {
+	case gzipBuffering:
+		w.ResponseWriter.Write(w.buf)
+	case gzipCompressing:
+		w.gz.Close()
+	}
+}
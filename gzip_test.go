@@ -0,0 +1,117 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "gzip", want: true},
+		{header: "deflate, gzip;q=0.5", want: true},
+		{header: "*", want: true},
+		{header: "gzip;q=0"},
+		{header: "deflate, br"},
+		{header: ""},
+	}
+
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %t, want %t", tt.header, got, tt.want)
+		}
+	}
+}
+
+// jsonBackend labels the downloads of Backend as JSON.
+type jsonBackend struct{ Backend }
+
+func (b jsonBackend) Download(ctx context.Context, cid string, header http.Header) (*http.Response, error) {
+	resp, err := b.Backend.Download(ctx, cid, header)
+	if err == nil {
+		resp.Header.Set("Content-Type", "application/json")
+	}
+	return resp, err
+}
+
+func TestGzipJSONResponses(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	c.backend = jsonBackend{c.backend}
+	corsCfg, err := corsConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server("127.0.0.1:0", nil, corsCfg, 256, nil, discardLogger(), c, nil, nil, nil, nil)
+	t.Cleanup(func() { srv.Close() })
+	h := srv.Handler
+
+	// Enough entries for the listing to pass the threshold.
+	for i := 0; i < 20; i++ {
+		c.index.Put(CacheEntry{CID: testCID(strings.Repeat("x", i)), Size: i, CachedAt: time.Now()})
+	}
+	cid := testCID("snapshot")
+	m.Add(cid, []byte(strings.Repeat(`{"json":"snapshot"}`, 100)))
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, ""))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		gzip         bool
+		wantEncoding string
+		wantVary     bool
+	}{
+		{name: "large with gzip", path: "/api/qaku/v1/snapshots", gzip: true, wantEncoding: "gzip", wantVary: true},
+		{name: "large without gzip", path: "/api/qaku/v1/snapshots", wantVary: true},
+		{name: "small with gzip", path: "/healthz", gzip: true, wantVary: true},
+		{name: "snapshot stream", path: "/api/qaku/v1/snapshot/" + cid, gzip: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.gzip {
+				header.Set("Accept-Encoding", "gzip")
+			}
+			w := get(h, tt.path, header)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("got Content-Encoding %q, want %q", got, tt.wantEncoding)
+			}
+			if got := w.Header().Get("Vary") == "Accept-Encoding"; got != tt.wantVary {
+				t.Errorf("got Vary %q, want Accept-Encoding %t", w.Header().Get("Vary"), tt.wantVary)
+			}
+
+			var body io.Reader = w.Body
+			if tt.wantEncoding == "gzip" {
+				if w.Header().Get("Content-Length") != "" {
+					t.Errorf("sent Content-Length %s for the compressed body", w.Header().Get("Content-Length"))
+				}
+				gz, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gz
+			}
+			if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+				var v any
+				if err := json.NewDecoder(body).Decode(&v); err != nil {
+					t.Errorf("body is not JSON: %v", err)
+				}
+			}
+		})
+	}
+}
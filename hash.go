@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envHashAlgorithm = "QAKU_CACHE_HASH_ALGORITHM"
+
+	hashSHA256    = "sha256"
+	hashKeccak256 = "keccak256"
+	hashNone      = "none"
+)
+
+var (
+	snapHashMismatch = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_hash_mismatch",
+		Help: "The number of datasets whose content did not match the advertised hash",
+	})
+	snapDedupByHash = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_dedup_by_hash",
+		Help: "The number of cache requests skipped because a dataset with the same content hash is cached",
+	})
+)
+
+var errHashMismatch = errors.New("content hash mismatch")
+
+// newContentHasher returns the hash used to verify CacheRequest.Hash against
+// the dataset, nil disables the check. The digest covers the complete dataset
+// exactly as stored in Codex, which for encrypted snapshots is the
+// ciphertext qaku uploaded.
+var newContentHasher func() hash.Hash
+
+// contentHasherFor returns the hasher for the configured algorithm. Hash
+// checks are opt-in: qaku does not document how it computes the advertised
+// hash, so unset means none rather than a guessed default.
+func contentHasherFor(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case hashSHA256:
+		return sha256.New, nil
+	case hashKeccak256:
+		return func() hash.Hash { return crypto.NewKeccakState() }, nil
+	case "", hashNone:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unknown %s %q, expected %s, %s or %s", envHashAlgorithm, algorithm, hashSHA256, hashKeccak256, hashNone)
+}
+
+// checkHash compares a computed digest with the hex encoded expected one.
+func checkHash(sum []byte, want string) error {
+	got := hex.EncodeToString(sum)
+	if got != normalizeHash(want) {
+		return fmt.Errorf("%w: expected %s, got %s", errHashMismatch, want, got)
+	}
+
+	return nil
+}
+
+// normalizeHash returns the lower case hex digest without the 0x prefix.
+func normalizeHash(h string) string {
+	return strings.ToLower(strings.TrimPrefix(h, "0x"))
+}
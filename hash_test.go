@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestContentHasherFor(t *testing.T) {
+	sum := sha256.Sum256([]byte("snapshot"))
+
+	tests := []struct {
+		algorithm string
+		want      string
+		wantNil   bool
+		wantErr   bool
+	}{
+		{algorithm: "", wantNil: true},
+		{algorithm: hashNone, wantNil: true},
+		{algorithm: hashSHA256, want: hex.EncodeToString(sum[:])},
+		{algorithm: hashKeccak256, want: hex.EncodeToString(crypto.Keccak256([]byte("snapshot")))},
+		{algorithm: "md5", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		newHasher, err := contentHasherFor(tt.algorithm)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("contentHasherFor(%q) = %v, want error %t", tt.algorithm, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if (newHasher == nil) != tt.wantNil {
+			t.Errorf("contentHasherFor(%q) is nil %t, want %t", tt.algorithm, newHasher == nil, tt.wantNil)
+		}
+		if newHasher == nil {
+			continue
+		}
+		h := newHasher()
+		h.Write([]byte("snapshot"))
+		if got := hex.EncodeToString(h.Sum(nil)); got != tt.want {
+			t.Errorf("%s digest = %s, want %s", tt.algorithm, got, tt.want)
+		}
+	}
+}
+
+func TestProcessVerifiesHash(t *testing.T) {
+	crc := func() hash.Hash { return crc32.NewIEEE() }
+	sum := crc32.NewIEEE()
+	sum.Write([]byte("snapshot"))
+	digest := hex.EncodeToString(sum.Sum(nil))
+
+	tests := []struct {
+		name    string
+		hasher  func() hash.Hash
+		hash    string
+		wantErr error
+	}{
+		{name: "match", hasher: crc, hash: digest},
+		{name: "prefixed upper case", hasher: crc, hash: "0x" + strings.ToUpper(digest)},
+		{name: "mismatch", hasher: crc, hash: "00000000", wantErr: errHashMismatch},
+		{name: "disabled", hasher: nil, hash: "00000000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &newContentHasher, tt.hasher)
+			m := newMockCodex(t)
+			c := newTestCache(t)
+			cid := testCID(tt.name)
+			m.Add(cid, []byte("snapshot"))
+
+			mismatches := testutil.ToFloat64(snapHashMismatch)
+			err := c.OnNewEnvelope(testEnvelope(encodeMessage(t, QakuMessage{
+				Type:      cacheMessageType,
+				Payload:   CacheRequest{CID: cid, Hash: tt.hash},
+				Timestamp: Timestamp(time.Now().UnixMilli()),
+			})))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got := c.index.Has(cid); got != (tt.wantErr == nil) {
+				t.Errorf("cached = %t, want %t", got, tt.wantErr == nil)
+			}
+			wantMismatches := 0.0
+			if tt.wantErr != nil {
+				wantMismatches = 1
+			}
+			if got := testutil.ToFloat64(snapHashMismatch) - mismatches; got != wantMismatches {
+				t.Errorf("counted %v hash mismatches, want %v", got, wantMismatches)
+			}
+		})
+	}
+}
+
+func TestDedupByHash(t *testing.T) {
+	noRetries(t)
+	setGlobal(t, &newContentHasher, sha256.New)
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	sum := sha256.Sum256([]byte("snapshot"))
+	digest := hex.EncodeToString(sum[:])
+
+	request := func(cid string) error {
+		return c.OnNewEnvelope(testEnvelope(encodeMessage(t, QakuMessage{
+			Type:      cacheMessageType,
+			Payload:   CacheRequest{CID: cid, Hash: digest},
+			Timestamp: Timestamp(time.Now().UnixMilli()),
+		})))
+	}
+	first, reupload := testCID("first"), testCID("re-upload")
+	m.Add(first, []byte("snapshot"))
+	m.Add(reupload, []byte("snapshot"))
+	if err := request(first); err != nil {
+		t.Fatal(err)
+	}
+
+	dedups := testutil.ToFloat64(snapDedupByHash)
+	pins := m.Calls("network_pin")
+	if err := request(reupload); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Calls("network_pin") - pins; got != 0 {
+		t.Errorf("pinned the same content %d more times", got)
+	}
+	if c.index.Has(reupload) {
+		t.Error("cached the duplicate CID")
+	}
+	if got := testutil.ToFloat64(snapDedupByHash) - dedups; got != 1 {
+		t.Errorf("counted %v duplicates by hash, want 1", got)
+	}
+}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envIndexPath     = "QAKU_CACHE_INDEX_PATH"
+	envIndexCompress = "QAKU_CACHE_INDEX_COMPRESS"
+
+	envOwnerBytesMetric = "QAKU_CACHE_OWNER_BYTES_METRIC"
+	envOwnerBytesLimit  = "QAKU_CACHE_OWNER_BYTES_LIMIT"
+
+	defaultOwnerBytesLimit = 20
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+var (
+	cachedDatasets = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qaku_cache_datasets_total",
+		Help: "The number of datasets currently cached",
+	})
+	cachedBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qaku_cache_bytes_total",
+		Help: "The summed size of the datasets currently cached",
+	})
+	cachedOwnerBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qaku_cache_owner_bytes",
+		Help: "The summed size of the datasets currently cached, by owner",
+	}, []string{"owner"})
+)
+
+// CacheEntry records a dataset this node has cached.
+type CacheEntry struct {
+	CID   string `json:"cid"`
+	Owner string `json:"owner"`
+	Hash  string `json:"hash"`
+	// Encrypted snapshots can be decrypted by the proxy.
+	Encrypted bool      `json:"encrypted,omitempty"`
+	Size      int       `json:"size"`
+	CachedAt  time.Time `json:"cachedAt"`
+	PinnedAt  time.Time `json:"pinnedAt"`
+
+	// LastServedAt is when the proxy last served the snapshot, zero if never.
+	LastServedAt time.Time `json:"lastServedAt"`
+
+	// ExpiresAt is zero for entries that do not expire.
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// Protected entries are never evicted automatically.
+	Protected bool `json:"protected,omitempty"`
+
+	// VerifiedAt is when the snapshot was last verified, Degraded whether it
+	// failed that check.
+	VerifiedAt time.Time `json:"verifiedAt,omitempty"`
+	Degraded   bool      `json:"degraded,omitempty"`
+}
+
+// indexStore persists the cache index.
+type indexStore interface {
+	Load() ([]CacheEntry, error)
+	Save(entries []CacheEntry) error
+	Close() error
+}
+
+// entryStore is an indexStore that writes single entries, so a change to one
+// entry does not rewrite the whole index.
+type entryStore interface {
+	PutEntry(e CacheEntry) error
+	DeleteEntry(cid string) error
+}
+
+// cacheIndex keeps track of the cached datasets, optionally persisted to a
+// store so they survive restarts. If the store cannot be read the index runs
+// in memory and merges the stored entries in once it becomes readable again.
+type cacheIndex struct {
+	mu      sync.RWMutex
+	store   indexStore
+	dirty   bool
+	pending bool
+	entries map[string]CacheEntry
+
+	// changed holds the CIDs whose entries an entryStore has not written
+	// yet, dirty means the whole index has to be saved.
+	changed map[string]struct{}
+
+	// ownerLabels bounds the owners reported by the per-owner gauge, nil
+	// disables it. ownerObserved holds the labels set by the last update.
+	ownerLabels   *boundedLabels
+	ownerObserved map[string]struct{}
+}
+
+// errIndexUnavailable marks failures to read the index store, as opposed to
+// a store that was read but does not hold a valid index.
+var errIndexUnavailable = errors.New("cache index unavailable")
+
+// loadCacheIndex reads the index from store, a nil store keeps the index in
+// memory only.
+func loadCacheIndex(store indexStore) (*cacheIndex, error) {
+	i := &cacheIndex{
+		store:   store,
+		entries: make(map[string]CacheEntry),
+		changed: make(map[string]struct{}),
+	}
+	if store == nil {
+		return i, nil
+	}
+
+	err := i.load()
+	i.observe()
+	if errors.Is(err, errIndexUnavailable) {
+		slog.Warn("running cache index in memory", "error", err)
+		i.pending = true
+		i.dirty = true
+		persistence.Report("cache index", err)
+		return i, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+// load merges the stored entries into the index. Entries already in memory
+// are newer and win.
+func (i *cacheIndex) load() error {
+	entries, err := i.store.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if _, ok := i.entries[e.CID]; !ok {
+			i.entries[e.CID] = e
+		}
+	}
+
+	return nil
+}
+
+// Put adds or replaces the entry for e.CID and persists the index. Protection
+// of an existing entry is kept.
+func (i *cacheIndex) Put(e CacheEntry) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if old, ok := i.entries[e.CID]; ok && old.Protected {
+		e.Protected = true
+	}
+	i.entries[e.CID] = e
+	i.observe()
+	i.saveEntry(e.CID)
+}
+
+// Has reports whether cid is indexed.
+func (i *cacheIndex) Has(cid string) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	_, ok := i.entries[cid]
+	return ok
+}
+
+// Get returns the entry for cid.
+func (i *cacheIndex) Get(cid string) (CacheEntry, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	e, ok := i.entries[cid]
+	return e, ok
+}
+
+// Remove drops the entry for cid and reports whether it was indexed.
+func (i *cacheIndex) Remove(cid string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, ok := i.entries[cid]; !ok {
+		return false
+	}
+	delete(i.entries, cid)
+	i.observe()
+	i.saveEntry(cid)
+
+	return true
+}
+
+// SetProtected changes the protection of the entry for cid and reports
+// whether it was indexed.
+func (i *cacheIndex) SetProtected(cid string, protected bool) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	e, ok := i.entries[cid]
+	if !ok {
+		return false
+	}
+	e.Protected = protected
+	i.entries[cid] = e
+	i.saveEntry(cid)
+
+	return true
+}
+
+// OwnerExcess returns the oldest unprotected entries of owner that have to go
+// to bring the owner down to max entries, and how many protected entries the
+// owner has.
+func (i *cacheIndex) OwnerExcess(owner string, max int) ([]CacheEntry, int) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	total, protected := 0, 0
+	entries := []CacheEntry{}
+	for _, e := range i.entries {
+		if e.Owner != owner {
+			continue
+		}
+		total++
+		if e.Protected {
+			protected++
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if total <= max {
+		return nil, protected
+	}
+
+	sort.Slice(entries, func(a, b int) bool { return entries[a].CachedAt.Before(entries[b].CachedAt) })
+
+	n := total - max
+	if n > len(entries) {
+		n = len(entries)
+	}
+
+	return entries[:n], protected
+}
+
+// Touch updates the time the CID was last pinned.
+func (i *cacheIndex) Touch(cid string, at time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	e, ok := i.entries[cid]
+	if !ok {
+		return
+	}
+	e.PinnedAt = at
+	i.entries[cid] = e
+	i.saveEntry(cid)
+}
+
+// Verified records the outcome of a verification of cid.
+func (i *cacheIndex) Verified(cid string, at time.Time, degraded bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	e, ok := i.entries[cid]
+	if !ok {
+		return
+	}
+	e.VerifiedAt = at
+	e.Degraded = degraded
+	i.entries[cid] = e
+	i.saveEntry(cid)
+}
+
+// Served records that the proxy served cid. The change is only written with
+// the next save or flush, a lost serve time just makes eviction less precise.
+func (i *cacheIndex) Served(cid string, at time.Time) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	e, ok := i.entries[cid]
+	if !ok {
+		return
+	}
+	e.LastServedAt = at
+	i.entries[cid] = e
+	i.markChanged(cid)
+}
+
+// TotalBytes returns the summed dataset size of all entries.
+func (i *cacheIndex) TotalBytes() int64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var total int64
+	for _, e := range i.entries {
+		total += int64(e.Size)
+	}
+
+	return total
+}
+
+// ProtectedBytes returns the summed dataset size of the protected entries.
+func (i *cacheIndex) ProtectedBytes() int64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var total int64
+	for _, e := range i.entries {
+		if e.Protected {
+			total += int64(e.Size)
+		}
+	}
+
+	return total
+}
+
+// OwnerBytes returns the summed dataset size of the owner's entries.
+func (i *cacheIndex) OwnerBytes(owner string) int64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var total int64
+	for _, e := range i.entries {
+		if e.Owner == owner {
+			total += int64(e.Size)
+		}
+	}
+
+	return total
+}
+
+// ByHash returns an entry whose content hash is hash, ignoring case and the
+// 0x prefix.
+func (i *cacheIndex) ByHash(hash string) (CacheEntry, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	hash = normalizeHash(hash)
+	for _, e := range i.entries {
+		if e.Hash != "" && normalizeHash(e.Hash) == hash {
+			return e, true
+		}
+	}
+
+	return CacheEntry{}, false
+}
+
+// LeastRecentlyServed returns the unprotected entries not served since
+// cutoff, least recently served first. Entries never served count from when
+// they were cached.
+func (i *cacheIndex) LeastRecentlyServed(cutoff time.Time) []CacheEntry {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	lastUse := func(e CacheEntry) time.Time {
+		if e.LastServedAt.IsZero() {
+			return e.CachedAt
+		}
+		return e.LastServedAt
+	}
+
+	entries := []CacheEntry{}
+	for _, e := range i.entries {
+		if e.Protected || lastUse(e).After(cutoff) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return lastUse(entries[a]).Before(lastUse(entries[b])) })
+
+	return entries
+}
+
+// Expired returns the unprotected entries that expired at now.
+func (i *cacheIndex) Expired(now time.Time) []CacheEntry {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	entries := []CacheEntry{}
+	for _, e := range i.list() {
+		if !e.Protected && !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt) {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
+// Entries returns all entries ordered by CID.
+func (i *cacheIndex) Entries() []CacheEntry {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.list()
+}
+
+// entryQuery selects and orders entries for listing. A zero MaxSize means no
+// upper bound.
+type entryQuery struct {
+	MinSize    int
+	MaxSize    int
+	SortBySize bool
+	Desc       bool
+}
+
+// Query returns the entries within the size range, ordered by size if
+// requested and by CID otherwise.
+func (i *cacheIndex) Query(q entryQuery) []CacheEntry {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	entries := []CacheEntry{}
+	for _, e := range i.list() {
+		if e.Size < q.MinSize || (q.MaxSize > 0 && e.Size > q.MaxSize) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	if q.SortBySize {
+		sort.SliceStable(entries, func(a, b int) bool {
+			if q.Desc {
+				return entries[a].Size > entries[b].Size
+			}
+			return entries[a].Size < entries[b].Size
+		})
+	} else if q.Desc {
+		sort.SliceStable(entries, func(a, b int) bool { return entries[a].CID > entries[b].CID })
+	}
+
+	return entries
+}
+
+func (i *cacheIndex) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return len(i.entries)
+}
+
+// Flush writes the changes that are only kept in memory, like serve times
+// and saves that failed.
+func (i *cacheIndex) Flush() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if !i.dirty && len(i.changed) == 0 {
+		return nil
+	}
+
+	return i.persist()
+}
+
+func (i *cacheIndex) list() []CacheEntry {
+	entries := make([]CacheEntry, 0, len(i.entries))
+	for _, e := range i.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].CID < entries[b].CID })
+
+	return entries
+}
+
+// Close flushes pending changes and closes the store.
+func (i *cacheIndex) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.store == nil {
+		return nil
+	}
+	if i.dirty || len(i.changed) > 0 {
+		i.persist()
+	}
+
+	return i.store.Close()
+}
+
+// observe updates the occupancy gauges, the caller must hold the lock.
+func (i *cacheIndex) observe() {
+	var total int64
+	for _, e := range i.entries {
+		total += int64(e.Size)
+	}
+
+	cachedDatasets.Set(float64(len(i.entries)))
+	cachedBytes.Set(float64(total))
+
+	if i.ownerLabels == nil {
+		return
+	}
+	owners := make(map[string]int64)
+	for _, e := range i.entries {
+		owners[i.ownerLabels.Value(e.Owner)] += int64(e.Size)
+	}
+	for label := range i.ownerObserved {
+		if _, ok := owners[label]; !ok {
+			cachedOwnerBytes.DeleteLabelValues(label)
+		}
+	}
+	i.ownerObserved = make(map[string]struct{}, len(owners))
+	for label, size := range owners {
+		cachedOwnerBytes.WithLabelValues(label).Set(float64(size))
+		i.ownerObserved[label] = struct{}{}
+	}
+}
+
+// ObserveOwners enables the per-owner gauge for the first limit owners, the
+// others are summed up as "other".
+func (i *cacheIndex) ObserveOwners(limit int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.ownerLabels = newBoundedLabels(limit)
+	i.observe()
+}
+
+// markChanged records that the entry for cid has to be written, the caller
+// must hold the write lock. Stores that cannot write single entries save the
+// whole index.
+func (i *cacheIndex) markChanged(cid string) {
+	if i.store == nil {
+		return
+	}
+	if _, ok := i.store.(entryStore); ok {
+		i.changed[cid] = struct{}{}
+	} else {
+		i.dirty = true
+	}
+}
+
+// saveEntry persists the change to the entry for cid, the caller must hold
+// the write lock.
+func (i *cacheIndex) saveEntry(cid string) error {
+	i.markChanged(cid)
+	return i.persist()
+}
+
+// persist writes the pending changes, the caller must hold the write lock.
+// An entryStore only gets the changed entries unless the whole index has to
+// be saved, like when the entries kept in memory while the store was
+// unavailable are merged into it.
+func (i *cacheIndex) persist() error {
+	es, ok := i.store.(entryStore)
+	if ok && i.pending {
+		// Deletions are passed on anyway so the store can drop the entries
+		// before the stored index is merged in.
+		for cid := range i.changed {
+			if _, ok := i.entries[cid]; !ok {
+				es.DeleteEntry(cid)
+			}
+		}
+	}
+	if !ok || i.dirty || i.pending {
+		return i.save()
+	}
+
+	var errs []error
+	for cid := range i.changed {
+		var err error
+		if e, ok := i.entries[cid]; ok {
+			err = es.PutEntry(e)
+		} else {
+			err = es.DeleteEntry(cid)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(i.changed, cid)
+	}
+	err := errors.Join(errs...)
+	persistence.Report("cache index", err)
+
+	return err
+}
+
+// save writes the whole index to the store, the caller must hold the write
+// lock.
+func (i *cacheIndex) save() error {
+	if i.store == nil {
+		return nil
+	}
+
+	// Never overwrite an index we have not been able to read yet.
+	if i.pending {
+		err := i.load()
+		if err != nil {
+			i.dirty = true
+			persistence.Report("cache index", err)
+			return err
+		}
+		i.pending = false
+		i.observe()
+		slog.Info("cache index is available again", "entries", len(i.entries))
+	}
+
+	err := i.store.Save(i.list())
+	i.dirty = err != nil
+	if err == nil {
+		clear(i.changed)
+	}
+	persistence.Report("cache index", err)
+
+	return err
+}
+
+// fileIndexStore keeps the index in a JSON file, optionally gzip compressed.
+// Compression is detected on load so either format can be read.
+type fileIndexStore struct {
+	path     string
+	compress bool
+}
+
+func (f fileIndexStore) Load() ([]CacheEntry, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errIndexUnavailable, err)
+	}
+
+	if bytes.HasPrefix(data, gzipMagic) {
+		data, err = gunzip(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress cache index: %w", err)
+		}
+	}
+
+	entries := []CacheEntry{}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cache index: %w", err)
+	}
+
+	return entries, nil
+}
+
+func (f fileIndexStore) Save(entries []CacheEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	if f.compress {
+		data, err = gzipBytes(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp := f.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, f.path)
+}
+
+func (f fileIndexStore) Close() error {
+	return nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestIndex returns an in-memory index holding the entries.
+func newTestIndex(t *testing.T, entries ...CacheEntry) *cacheIndex {
+	t.Helper()
+
+	i, err := loadCacheIndex(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		i.Put(e)
+	}
+
+	return i
+}
+
+func entryCIDs(entries []CacheEntry) []string {
+	cids := []string{}
+	for _, e := range entries {
+		cids = append(cids, e.CID)
+	}
+
+	return cids
+}
+
+func TestIndexQuery(t *testing.T) {
+	i := newTestIndex(t,
+		CacheEntry{CID: "b", Size: 300},
+		CacheEntry{CID: "a", Size: 200},
+		CacheEntry{CID: "c", Size: 100},
+	)
+
+	tests := []struct {
+		name string
+		q    entryQuery
+		want []string
+	}{
+		{name: "by cid", q: entryQuery{}, want: []string{"a", "b", "c"}},
+		{name: "by cid desc", q: entryQuery{Desc: true}, want: []string{"c", "b", "a"}},
+		{name: "by size", q: entryQuery{SortBySize: true}, want: []string{"c", "a", "b"}},
+		{name: "by size desc", q: entryQuery{SortBySize: true, Desc: true}, want: []string{"b", "a", "c"}},
+		{name: "min size", q: entryQuery{MinSize: 200}, want: []string{"a", "b"}},
+		{name: "max size", q: entryQuery{MaxSize: 200}, want: []string{"a", "c"}},
+		{name: "range", q: entryQuery{MinSize: 150, MaxSize: 250}, want: []string{"a"}},
+		{name: "empty range", q: entryQuery{MinSize: 301}, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := entryCIDs(i.Query(tt.q)); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntriesEndpoint(t *testing.T) {
+	c := newTestCache(t)
+	now := time.Now()
+	for _, e := range []CacheEntry{{CID: "x", Size: 10, CachedAt: now}, {CID: "y", Size: 30, CachedAt: now}, {CID: "z", Size: 20, CachedAt: now}} {
+		c.index.Put(e)
+	}
+	h := newTestServer(t, c, testAdmin)
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		want       []string
+	}{
+		{query: "?sort=size&order=desc", wantStatus: 200, want: []string{"y", "z", "x"}},
+		{query: "?minSize=15&maxSize=25", wantStatus: 200, want: []string{"z"}},
+		{query: "?sort=owner", wantStatus: 400},
+		{query: "?minSize=-1", wantStatus: 400},
+		{query: "?minSize=30&maxSize=10", wantStatus: 400},
+	}
+
+	for _, tt := range tests {
+		w := get(h, "/api/qaku/v1/entries"+tt.query, adminHeader())
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.query, w.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+
+		var entries []CacheEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		if got := entryCIDs(entries); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+// flakyIndexStore is an indexStore that fails to load until it is brought
+// back up.
+type flakyIndexStore struct {
+	down    bool
+	entries []CacheEntry
+	saves   int
+}
+
+func (s *flakyIndexStore) Load() ([]CacheEntry, error) {
+	if s.down {
+		return nil, fmt.Errorf("%w: disk offline", errIndexUnavailable)
+	}
+	return s.entries, nil
+}
+
+func (s *flakyIndexStore) Save(entries []CacheEntry) error {
+	s.saves++
+	s.entries = entries
+	return nil
+}
+
+func (s *flakyIndexStore) Close() error {
+	return nil
+}
+
+func TestIndexFallsBackToMemory(t *testing.T) {
+	setGlobal(t, &persistence, &persistHealth{failing: make(map[string]string)})
+	store := &flakyIndexStore{down: true, entries: []CacheEntry{{CID: "stored", Size: 1}, {CID: "both", Size: 1}}}
+
+	i, err := loadCacheIndex(store)
+	if err != nil {
+		t.Fatalf("loadCacheIndex with an unavailable store = %v, want it to run in memory", err)
+	}
+	if _, ok := persistence.Status()["cache index"]; !ok {
+		t.Error("health does not report the unavailable cache index")
+	}
+
+	i.Put(CacheEntry{CID: "memory", Size: 2})
+	i.Put(CacheEntry{CID: "both", Size: 2})
+	if !i.Has("memory") {
+		t.Error("entry added while the store is down is missing")
+	}
+	if store.saves != 0 {
+		t.Fatalf("saved %d times over an index that was never read", store.saves)
+	}
+	if err := i.Flush(); err == nil {
+		t.Error("Flush succeeded while the store is down")
+	}
+
+	store.down = false
+	if err := i.Flush(); err != nil {
+		t.Fatalf("Flush after recovery: %v", err)
+	}
+	if _, ok := persistence.Status()["cache index"]; ok {
+		t.Error("health still reports the recovered cache index")
+	}
+
+	want := []string{"both", "memory", "stored"}
+	if got := entryCIDs(store.entries); !slices.Equal(got, want) {
+		t.Errorf("stored %v after recovery, want %v", got, want)
+	}
+	for _, e := range i.Entries() {
+		if e.CID == "both" && e.Size != 2 {
+			t.Errorf("entry both has size %d, want the newer in-memory size 2", e.Size)
+		}
+	}
+}
+
+func TestOccupancyGauges(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+
+	small, large := testCID("small"), testCID("large")
+	m.Add(small, []byte("small"))
+	m.Add(large, []byte("larger dataset"))
+	for _, cid := range []string{small, large} {
+		if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, ""))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, size := testutil.ToFloat64(cachedDatasets), testutil.ToFloat64(cachedBytes); n != 2 || size != 19 {
+		t.Errorf("gauges report %v datasets and %v bytes, want 2 and 19", n, size)
+	}
+
+	e, _ := indexedEntry(c, large)
+	if err := c.evict(context.Background(), e, evictAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if n, size := testutil.ToFloat64(cachedDatasets), testutil.ToFloat64(cachedBytes); n != 1 || size != 5 {
+		t.Errorf("after eviction gauges report %v datasets and %v bytes, want 1 and 5", n, size)
+	}
+
+	// A restart recomputes the gauges from the store.
+	cachedDatasets.Set(0)
+	cachedBytes.Set(0)
+	_, err := loadCacheIndex(&flakyIndexStore{entries: []CacheEntry{{CID: "a", Size: 3}, {CID: "b", Size: 4}, {CID: "c", Size: 5}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, size := testutil.ToFloat64(cachedDatasets), testutil.ToFloat64(cachedBytes); n != 3 || size != 12 {
+		t.Errorf("after loading gauges report %v datasets and %v bytes, want 3 and 12", n, size)
+	}
+}
+
+func TestOwnerBytesGauge(t *testing.T) {
+	b := newTestFSBackend(t)
+	c := newTestCache(t)
+	c.backend = b
+	c.index.ObserveOwners(2)
+	t.Cleanup(cachedOwnerBytes.Reset)
+
+	cids := map[string]string{}
+	for _, d := range []struct {
+		owner string
+		size  int
+	}{
+		{owner: "alice", size: 10},
+		{owner: "bob", size: 5},
+		{owner: "alice", size: 2},
+		{owner: "carol", size: 3},
+		{owner: "dave", size: 4},
+	} {
+		cid := testCID(fmt.Sprint(d.owner, d.size))
+		cids[d.owner] = cid
+		addDataset(t, b, cid, make([]byte, d.size))
+		if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, d.owner))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]float64{"alice": 12, "bob": 5, labelOther: 7}
+	for owner, size := range want {
+		if got := testutil.ToFloat64(cachedOwnerBytes.WithLabelValues(owner)); got != size {
+			t.Errorf("%s owns %v bytes, want %v", owner, got, size)
+		}
+	}
+	if got := testutil.CollectAndCount(cachedOwnerBytes); got != len(want) {
+		t.Errorf("reported %d owner labels, want %d", got, len(want))
+	}
+
+	// Evicting the only snapshot of an owner removes its label.
+	e, _ := c.index.Get(cids["bob"])
+	if err := c.evict(context.Background(), e, evictAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.CollectAndCount(cachedOwnerBytes); got != len(want)-1 {
+		t.Errorf("reported %d owner labels after the eviction, want %d", got, len(want)-1)
+	}
+}
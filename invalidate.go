@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+)
+
+const envInvalidateTopic = "QAKU_CACHE_INVALIDATE_TOPIC"
+
+// Outcomes of an invalidation message.
+const (
+	invalidateEvicted   = "evicted"
+	invalidateNotCached = "not_cached"
+	invalidateRejected  = "rejected"
+	invalidateFailed    = "failed"
+)
+
+var snapInvalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "qaku_cache_invalidations",
+	Help: "The number of invalidation messages received, by outcome",
+}, []string{"result"})
+
+// invalidateTopic returns the content topic carrying invalidations, empty if
+// none is configured.
+func invalidateTopic() (string, error) {
+	v := os.Getenv(envInvalidateTopic)
+	if v == "" {
+		return "", nil
+	}
+
+	ct, err := protocol.StringToContentTopic(v)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %w", envInvalidateTopic, err)
+	}
+
+	return ct.String(), nil
+}
+
+// onInvalidate evicts the CID of a signed invalidation message. The message
+// is verified like a cache request and only the owner of the cached entry may
+// invalidate it.
+func (c *Cache) onInvalidate(ctx context.Context, payload []byte) error {
+	logger := c.logger.With("request", requestIDFrom(ctx))
+
+	result := invalidateRejected
+	defer func() { snapInvalidations.WithLabelValues(result).Inc() }()
+
+	cr, err := decodeMessage(payload, c.strictJSON)
+	if err != nil {
+		logger.Warn("failed to unmarshal invalidation", "error", err)
+		return err
+	}
+
+	if !isValidCID(cr.Payload.CID) {
+		err = fmt.Errorf("invalid CID %q", cr.Payload.CID)
+		logger.Warn("rejecting invalidation", "owner", cr.Payload.Owner, "error", err)
+		return err
+	}
+
+	err = c.freshness.Check(cr.Timestamp, time.Now())
+	if err == nil {
+		err = verifySignature(cr)
+	}
+	if err == nil {
+		err = verifyOwner(cr, ownerDerivation)
+	}
+	if err != nil {
+		logger.Warn("rejecting invalidation", "cid", cr.Payload.CID, "owner", cr.Payload.Owner, "error", err)
+		return err
+	}
+
+	e, ok := c.index.Get(cr.Payload.CID)
+	if !ok {
+		result = invalidateNotCached
+		logger.Debug("invalidated snapshot not cached", "cid", cr.Payload.CID)
+		return nil
+	}
+	if e.Owner != cr.Payload.Owner {
+		err = fmt.Errorf("snapshot belongs to %s", e.Owner)
+		logger.Warn("rejecting invalidation", "cid", cr.Payload.CID, "owner", cr.Payload.Owner, "error", err)
+		return err
+	}
+
+	err = c.evict(ctx, e, evictInvalidated)
+	if err != nil {
+		result = invalidateFailed
+		logger.Error("failed to evict invalidated snapshot", "cid", e.CID, "error", err)
+		return err
+	}
+
+	result = invalidateEvicted
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testInvalidateTopic = "/qaku/1/invalidate/json"
+
+func TestInvalidation(t *testing.T) {
+	keccak := func(data []byte) []byte { return crypto.Keccak256(data) }
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	tests := []struct {
+		name        string
+		owner       string
+		message     func(t *testing.T, cid string) []byte
+		wantEvicted bool
+		wantResult  string
+	}{
+		{
+			name:  "signed",
+			owner: "alice",
+			message: func(t *testing.T, cid string) []byte {
+				return signedMessage(t, fmt.Sprintf(`{"cid":%q,"owner":"alice"}`, cid), now, keccak)
+			},
+			wantEvicted: true,
+			wantResult:  invalidateEvicted,
+		},
+		{
+			name:       "unsigned",
+			owner:      "alice",
+			message:    func(t *testing.T, cid string) []byte { return cacheMessage(t, cid, "alice") },
+			wantResult: invalidateRejected,
+		},
+		{
+			name:  "other owner",
+			owner: "bob",
+			message: func(t *testing.T, cid string) []byte {
+				return signedMessage(t, fmt.Sprintf(`{"cid":%q,"owner":"alice"}`, cid), now, keccak)
+			},
+			wantResult: invalidateRejected,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestFSBackend(t)
+			c := newTestCache(t)
+			c.backend = b
+			setGlobal(t, &signatureScheme, signatureSchemeKeccak)
+			topics, err := parseTopicMatcher(testInvalidateTopic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.invalidateTopic = topics
+			cid := testCID(tt.name)
+			addLocalDataset(t, b, cid, []byte("snapshot"))
+			c.index.Put(CacheEntry{CID: cid, Owner: tt.owner, Size: len("snapshot"), CachedAt: time.Now()})
+
+			results := testutil.ToFloat64(snapInvalidations.WithLabelValues(tt.wantResult))
+			err = c.OnNewEnvelope(testEnvelopeOn(testInvalidateTopic, tt.message(t, cid)))
+			if (err == nil) != tt.wantEvicted {
+				t.Errorf("got error %v, want error %t", err, !tt.wantEvicted)
+			}
+			if got := !c.index.Has(cid); got != tt.wantEvicted {
+				t.Errorf("evicted = %t, want %t", got, tt.wantEvicted)
+			}
+			if has := downloadStatus(t, b, cid) == http.StatusOK; has == tt.wantEvicted {
+				t.Errorf("dataset stored = %t, want %t", has, !tt.wantEvicted)
+			}
+			if got := testutil.ToFloat64(snapInvalidations.WithLabelValues(tt.wantResult)) - results; got != 1 {
+				t.Errorf("counted %v %s invalidations, want 1", got, tt.wantResult)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envKeepAliveInterval = "QAKU_CACHE_KEEPALIVE_INTERVAL"
+	envRepinConcurrency  = "QAKU_CACHE_REPIN_CONCURRENCY"
+	envRepinJitter       = "QAKU_CACHE_REPIN_JITTER"
+	envRepinMinAge       = "QAKU_CACHE_REPIN_MIN_AGE"
+
+	defaultRepinConcurrency = 4
+	defaultRepinJitter      = time.Second
+)
+
+var (
+	repinPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qaku_cache_repin_pending",
+		Help: "The number of entries left to re-pin in the current keep-alive pass",
+	})
+	repinCompleted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_repin_completed",
+		Help: "The total number of entries re-pinned by keep-alive",
+	})
+	repinFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_repin_failures",
+		Help: "The total number of failed keep-alive re-pins",
+	})
+	repinSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_repin_skipped",
+		Help: "The total number of entries skipped by keep-alive because they were pinned recently",
+	})
+	reannounced = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_reannounce_total",
+		Help: "The total number of datasets fetched again and re-announced by keep-alive",
+	})
+	reannounceFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_reannounce_failures_total",
+		Help: "The total number of keep-alive re-announcements that failed",
+	})
+)
+
+// keepAlive periodically asks the backend to fetch every indexed dataset
+// again so it stays in the local store and its providers stay announced.
+// Entries pinned less than minAge ago are skipped. The re-pins run on the
+// worker pool, at most concurrency of them and never more than there are
+// workers are submitted at a time so they do not crowd the Waku envelopes out
+// of the queue, and each one is delayed by a random amount up to jitter to
+// smooth the load.
+func keepAlive(ctx context.Context, interval time.Duration, minAge time.Duration, concurrency int, jitter time.Duration, pool *workerPool, backend Backend, index *cacheIndex, now func() time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			repinAll(ctx, minAge, concurrency, jitter, pool, backend, index, now)
+		}
+	}
+}
+
+func repinAll(ctx context.Context, minAge time.Duration, concurrency int, jitter time.Duration, pool *workerPool, backend Backend, index *cacheIndex, now func() time.Time) {
+	entries := []CacheEntry{}
+	for _, e := range index.Entries() {
+		if now().Sub(e.PinnedAt) < minAge {
+			repinSkipped.Inc()
+			continue
+		}
+		entries = append(entries, e)
+	}
+	repinPending.Set(float64(len(entries)))
+	defer repinPending.Set(0)
+
+	sem := make(chan struct{}, max(min(concurrency, pool.size), 1))
+	var wg sync.WaitGroup
+	for _, e := range entries {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(cid string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer repinPending.Dec()
+
+			if jitter > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(rand.Int63n(int64(jitter)))):
+				}
+			}
+
+			err := repin(ctx, pool, backend, cid)
+			if err != nil {
+				repinFailures.Inc()
+				reannounceFailures.Inc()
+				slog.Error("failed to re-pin", "cid", cid, "error", err)
+				return
+			}
+
+			repinCompleted.Inc()
+			reannounced.Inc()
+			index.Touch(cid, now())
+		}(e.CID)
+	}
+
+	wg.Wait()
+}
+
+// repin fetches cid again on a pool worker and waits for it.
+func repin(ctx context.Context, pool *workerPool, backend Backend, cid string) error {
+	done := make(chan error, 1)
+	queued := pool.SubmitJob(poolJob{
+		run:     func() { done <- backend.FetchToNetwork(ctx, cid) },
+		dropped: func() { done <- errQueueDropped },
+	}, sourceKeepAlive)
+	if !queued {
+		return errQueueFull
+	}
+
+	return <-done
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+)
+
+// newTestPool returns a worker pool for jobs only, stopped with the test.
+func newTestPool(t *testing.T, workers int) *workerPool {
+	t.Helper()
+
+	p := newWorkerPool(workers, 10, priorityNormal, dropNewest, nil)
+	t.Cleanup(func() { p.Stop(context.Background()) })
+
+	return p
+}
+
+func TestKeepAliveRepinsAfterInterval(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	start := time.Now()
+	cid := testCID("kept")
+	m.Add(cid, []byte("snapshot"))
+	index := newTestIndex(t, CacheEntry{CID: cid, Size: len("snapshot"), CachedAt: start, PinnedAt: start})
+
+	var offset atomic.Int64
+	now := func() time.Time { return start.Add(time.Duration(offset.Load())) }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	completed := testutil.ToFloat64(reannounced)
+	skipped := testutil.ToFloat64(repinSkipped)
+	pool := newTestPool(t, 1)
+	go func() {
+		defer close(done)
+		keepAlive(ctx, 5*time.Millisecond, time.Hour, 1, 0, pool, m.Backend(), index, now)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if m.Calls("network_pin") != 0 {
+		t.Fatal("re-pinned an entry pinned less than the minimum age ago")
+	}
+	if testutil.ToFloat64(repinSkipped) == skipped {
+		t.Error("did not count the skipped entry")
+	}
+
+	offset.Store(int64(2 * time.Hour))
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Calls("network_pin") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("did not re-pin the entry once the minimum age passed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keep-alive did not stop on shutdown")
+	}
+	if got := testutil.ToFloat64(reannounced) - completed; got < 1 {
+		t.Errorf("counted %v re-pins, want at least 1", got)
+	}
+	if e, _ := index.Get(cid); !e.PinnedAt.Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("entry pinned at %s, want the time of the re-pin", e.PinnedAt)
+	}
+}
+
+func TestKeepAliveCountsFailures(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	cid := testCID("gone")
+	index := newTestIndex(t, CacheEntry{CID: cid, Size: len("snapshot")})
+
+	failures := testutil.ToFloat64(reannounceFailures)
+	repinFailed := testutil.ToFloat64(repinFailures)
+	repinAll(context.Background(), 0, 1, 0, newTestPool(t, 1), m.Backend(), index, time.Now)
+	if got := testutil.ToFloat64(reannounceFailures) - failures; got != 1 {
+		t.Errorf("counted %v failed re-announcements, want 1", got)
+	}
+	if got := testutil.ToFloat64(repinFailures) - repinFailed; got != 1 {
+		t.Errorf("counted %v failed re-pins, want 1", got)
+	}
+	if e, _ := index.Get(cid); !e.PinnedAt.IsZero() {
+		t.Error("marked a failed re-pin as pinned")
+	}
+}
+
+func TestKeepAliveSharesWorkers(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	entries := []CacheEntry{}
+	for _, name := range []string{"a", "b", "c"} {
+		cid := testCID(name)
+		m.Add(cid, []byte("snapshot"))
+		entries = append(entries, CacheEntry{CID: cid, Size: len("snapshot")})
+	}
+	index := newTestIndex(t, entries...)
+
+	release := make(chan struct{})
+	busy := make(chan struct{})
+	p := newWorkerPool(1, 10, priorityNormal, dropNewest, func(e *protocol.Envelope) error {
+		close(busy)
+		<-release
+		return nil
+	})
+	defer p.Stop(context.Background())
+	p.Submit(testEnvelope([]byte("waku")), sourceWaku)
+	<-busy
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		repinAll(context.Background(), 0, 4, 0, p, m.Backend(), index, time.Now)
+	}()
+
+	// One worker fits one queued re-pin, none runs while it is busy.
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats().QueuedBySource[sourceKeepAlive] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("did not queue the re-pin on the worker pool")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := p.Stats().QueuedBySource[sourceKeepAlive]; got != 1 || m.Calls("network_pin") != 0 {
+		t.Fatalf("%d re-pins queued and %d run with the only worker busy, want 1 and none", got, m.Calls("network_pin"))
+	}
+
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("re-pins did not finish once the worker was free")
+	}
+	if got := m.Calls("network_pin"); got != len(entries) {
+		t.Errorf("re-pinned %d entries, want %d", got, len(entries))
+	}
+}
+
+func TestKeepAliveCapsConcurrency(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	m.Delay("network_pin", 20*time.Millisecond)
+	entries := []CacheEntry{}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		cid := testCID(name)
+		m.Add(cid, []byte("snapshot"))
+		entries = append(entries, CacheEntry{CID: cid, Size: len("snapshot")})
+	}
+	index := newTestIndex(t, entries...)
+	p := newTestPool(t, 4)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		repinAll(context.Background(), 0, 2, 0, p, m.Backend(), index, time.Now)
+	}()
+
+	busy := 0
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		case <-time.After(time.Millisecond):
+			busy = max(busy, p.Stats().Busy)
+		}
+	}
+	if busy == 0 || busy > 2 {
+		t.Errorf("%d re-pins ran at once on 4 workers, want at most the cap of 2", busy)
+	}
+	if got := m.Calls("network_pin"); got != len(entries) {
+		t.Errorf("re-pinned %d entries, want %d", got, len(entries))
+	}
+	if got := testutil.ToFloat64(repinPending); got != 0 {
+		t.Errorf("%v re-pins pending after the pass, want 0", got)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "sync"
+
+const labelOther = "other"
+
+// boundedLabels keeps metric label cardinality in check. Only the first limit
+// distinct values are used as labels, the rest are reported as "other".
+type boundedLabels struct {
+	limit int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newBoundedLabels(limit int) *boundedLabels {
+	return &boundedLabels{limit: limit, seen: make(map[string]struct{})}
+}
+
+// Value returns the label to use for v.
+func (b *boundedLabels) Value(v string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.seen[v]; ok {
+		return v
+	}
+	if len(b.seen) >= b.limit {
+		return labelOther
+	}
+	b.seen[v] = struct{}{}
+
+	return v
+}
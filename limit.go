@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+const (
+	envProxyMaxBytes = "QAKU_CACHE_PROXY_MAX_BYTES"
+
+	// proxySizeSlack is how far a stream may exceed the dataset size before
+	// it is cut off.
+	proxySizeSlack = 4096
+)
+
+var errSnapshotTooLarge = errors.New("snapshot exceeds proxy size limit")
+
+// cappedReader passes through at most limit bytes and fails with
+// errSnapshotTooLarge as soon as the underlying stream goes past it, so a
+// lying manifest cannot make the proxy move unbounded data.
+type cappedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func newCappedReader(r io.Reader, limit int64) *cappedReader {
+	return &cappedReader{r: r, limit: limit}
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	// Read at most one byte past the limit to detect the overflow without
+	// forwarding any of the excess.
+	if room := c.limit - c.read + 1; int64(len(p)) > room {
+		p = p[:room]
+	}
+
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	if c.read > c.limit {
+		return n - 1, errSnapshotTooLarge
+	}
+
+	return n, err
+}
+
+// snapshotSizeLimit returns how many bytes the backend may stream for cid:
+// the dataset size plus some slack, from the index or else the manifest. It
+// returns 0 if the size is unknown.
+func snapshotSizeLimit(ctx context.Context, cache *Cache, cid string) int64 {
+	if e, ok := cache.index.Get(cid); ok && e.Size > 0 {
+		return int64(e.Size) + proxySizeSlack
+	}
+
+	cdc, err := cache.backend.FetchManifest(ctx, cid)
+	if err != nil || cdc.Manifest.DatasetSize <= 0 {
+		return 0
+	}
+
+	return int64(cdc.Manifest.DatasetSize) + proxySizeSlack
+}
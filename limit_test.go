@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCappedReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		limit   int64
+		want    string
+		wantErr error
+	}{
+		{name: "under", data: "abc", limit: 5, want: "abc"},
+		{name: "exact", data: "abcde", limit: 5, want: "abcde"},
+		{name: "over", data: "abcdefgh", limit: 5, want: "abcde", wantErr: errSnapshotTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			_, err := io.Copy(&out, newCappedReader(strings.NewReader(tt.data), tt.limit))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if out.String() != tt.want {
+				t.Errorf("passed %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotProxyCutsOffLyingStream(t *testing.T) {
+	noRetries(t)
+	data := []byte("snapshot")
+	tests := []struct {
+		name     string
+		maxBytes int64
+		want     int
+	}{
+		// Without a hard cap the manifest size plus the slack is the limit.
+		{name: "manifest", want: len(data) + proxySizeSlack},
+		// The configured hard cap applies independent of the manifest.
+		{name: "hard cap", maxBytes: 4, want: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &proxyMaxBytes, tt.maxBytes)
+			m := newMockCodex(t)
+			cid := testCID("lying " + tt.name)
+			m.Add(cid, data)
+			c := newTestCache(t)
+			err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Serve(cid, bytes.Repeat([]byte("x"), len(data)+2*proxySizeSlack))
+
+			aborted := testutil.ToFloat64(snapProxyAborted)
+			w := get(newTestServer(t, c, nil), "/api/qaku/v1/snapshot/"+cid, nil)
+			if w.Body.Len() != tt.want {
+				t.Errorf("proxied %d bytes, want the stream cut off at %d", w.Body.Len(), tt.want)
+			}
+			if got := testutil.ToFloat64(snapProxyAborted) - aborted; got != 1 {
+				t.Errorf("counted %v aborts, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	envLogLevel     = "QAKU_CACHE_LOG_LEVEL"
+	envWakuLogLevel = "QAKU_CACHE_WAKU_LOG_LEVEL"
+)
+
+// newLogger returns a JSON logger writing to w at the named level (debug,
+// info, warn or error). An empty level means info.
+func newLogger(w io.Writer, level string) (*slog.Logger, error) {
+	var l slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		l = slog.LevelDebug
+	case "", "info":
+		l = slog.LevelInfo
+	case "warn", "warning":
+		l = slog.LevelWarn
+	case "error":
+		l = slog.LevelError
+	default:
+		return nil, fmt.Errorf("invalid %s %q, expected debug, info, warn or error", envLogLevel, level)
+	}
+
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})), nil
+}
+
+// wakuLogLevel parses the level of the go-waku logs, which are noisy below
+// info. An empty level means info, the go-waku default.
+func wakuLogLevel(level string) (zapcore.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return zapcore.DebugLevel, nil
+	case "", "info":
+		return zapcore.InfoLevel, nil
+	case "warn", "warning":
+		return zapcore.WarnLevel, nil
+	case "error":
+		return zapcore.ErrorLevel, nil
+	}
+
+	return zapcore.InfoLevel, fmt.Errorf("invalid %s %q, expected debug, info, warn or error", envWakuLogLevel, level)
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logRequests logs every API request once it completes, errors at warn level
+// so they stand out from the regular traffic.
+func logRequests(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		args := []any{
+			"request", requestIDFrom(c.Request.Context()),
+			"method", c.Request.Method,
+			"path", path,
+			"status", status,
+			"latency", time.Since(start),
+			"remote", c.ClientIP(),
+		}
+		if len(c.Errors) > 0 {
+			args = append(args, "error", c.Errors.String())
+		}
+		logger.Log(c.Request.Context(), level, "handled request", args...)
+	}
+}
+
+// recoverPanics turns a panicking handler into a 500 and logs the panic with
+// its stack.
+func recoverPanics(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// The client is gone, there is nobody to answer.
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			logger.Error("recovered from panic", "request", requestIDFrom(c.Request.Context()), "method", c.Request.Method, "path", c.Request.URL.Path, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		level   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{level: "", want: slog.LevelInfo},
+		{level: "debug", want: slog.LevelDebug},
+		{level: "INFO", want: slog.LevelInfo},
+		{level: "warning", want: slog.LevelWarn},
+		{level: "error", want: slog.LevelError},
+		{level: "verbose", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		logger, err := newLogger(io.Discard, tt.level)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newLogger(%q) = %v, want error %t", tt.level, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !logger.Enabled(context.Background(), tt.want) || logger.Enabled(context.Background(), tt.want-1) {
+			t.Errorf("newLogger(%q) does not log from %s up", tt.level, tt.want)
+		}
+	}
+
+	if _, err := wakuLogLevel("warn"); err != nil {
+		t.Error(err)
+	}
+	if l, err := wakuLogLevel(""); err != nil || l != zapcore.InfoLevel {
+		t.Errorf("wakuLogLevel(\"\") = %s, %v, want info", l, err)
+	}
+	if _, err := wakuLogLevel("verbose"); err == nil {
+		t.Error("wakuLogLevel accepted an unknown level")
+	}
+}
+
+// logLines decodes the JSON log lines written to buf.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var lines []map[string]any
+	s := bufio.NewScanner(buf)
+	for s.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(s.Bytes(), &line); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", s.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+func TestOnNewEnvelopeLogsStructuredFields(t *testing.T) {
+	for _, level := range []string{"info", "debug"} {
+		t.Run(level, func(t *testing.T) {
+			m := newMockCodex(t)
+			c := newTestCache(t)
+			var buf bytes.Buffer
+			logger, err := newLogger(&buf, level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.logger = logger
+
+			cid := testCID("logged")
+			m.Add(cid, []byte("snapshot"))
+			if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+				t.Fatal(err)
+			}
+
+			var processed map[string]any
+			payload := false
+			for _, line := range logLines(t, &buf) {
+				switch line["msg"] {
+				case "processed cache request":
+					processed = line
+				case "envelope payload":
+					payload = true
+					if !strings.Contains(line["payload"].(string), cid) {
+						t.Errorf("payload %q does not hold the request", line["payload"])
+					}
+				}
+			}
+
+			if processed == nil {
+				t.Fatal("did not log the processed request")
+			}
+			if processed["cid"] != cid || processed["owner"] != "alice" || processed["outcome"] != outcomeSuccess || processed["size"] != float64(len("snapshot")) {
+				t.Errorf("logged %v, want the cid, owner, size and outcome of the request", processed)
+			}
+			if processed["request"] == "" {
+				t.Error("did not log the request id")
+			}
+			if payload != (level == "debug") {
+				t.Errorf("logged the payload %t at %s level", payload, level)
+			}
+		})
+	}
+}
+
+func TestEnvelopeLogsShareRequestID(t *testing.T) {
+	b := newTestFSBackend(t)
+	c := newTestCache(t)
+	c.backend = b
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.logger = logger
+
+	ids := []string{}
+	for _, seed := range []string{"first", "second"} {
+		cid := testCID(seed)
+		addDataset(t, b, cid, []byte("snapshot"))
+		if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+			t.Fatal(err)
+		}
+
+		lines := logLines(t, &buf)
+		if len(lines) < 2 {
+			t.Fatalf("logged %d lines for an envelope, want several", len(lines))
+		}
+		id, _ := lines[0]["request"].(string)
+		if id == "" {
+			t.Fatalf("logged %v without a request id", lines[0])
+		}
+		for _, line := range lines {
+			if line["request"] != id {
+				t.Errorf("logged %v with request id %v, want %s", line["msg"], line["request"], id)
+			}
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("two envelopes share the request id %s", ids[0])
+	}
+}
+
+func TestRequestsLogged(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corsCfg, err := corsConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server("127.0.0.1:0", nil, corsCfg, 0, nil, logger, newTestCache(t), nil, nil, nil, nil)
+	t.Cleanup(func() { srv.Close() })
+
+	w := get(srv.Handler, "/healthz", nil)
+	lines := logLines(t, &buf)
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, want 1", len(lines))
+	}
+	line := lines[0]
+	if line["msg"] != "handled request" || line["level"] != "INFO" || line["method"] != http.MethodGet || line["path"] != "/healthz" || line["status"] != float64(http.StatusOK) {
+		t.Errorf("logged %v, want the method, path and status of the request", line)
+	}
+	if line["request"] != w.Header().Get(defaultRequestIDHeader) || line["latency"] == nil {
+		t.Errorf("logged %v, want the request id %s and the latency", line, w.Header().Get(defaultRequestIDHeader))
+	}
+}
+
+func TestPanicsRecoveredAndLogged(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(requestID(), logRequests(logger), recoverPanics(logger))
+	r.GET("/panic", func(c *gin.Context) { panic("handler bug") })
+
+	w := get(r, "/panic", nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want 500", w.Code)
+	}
+
+	msgs := map[string]map[string]any{}
+	for _, line := range logLines(t, &buf) {
+		msgs[line["msg"].(string)] = line
+	}
+	recovered := msgs["recovered from panic"]
+	if recovered == nil || recovered["level"] != "ERROR" || recovered["panic"] != "handler bug" || !strings.Contains(fmt.Sprint(recovered["stack"]), "logging_test.go") {
+		t.Errorf("logged %v, want the panic with its stack", recovered)
+	}
+	if handled := msgs["handled request"]; handled == nil || handled["status"] != float64(http.StatusInternalServerError) || handled["level"] != "WARN" {
+		t.Errorf("logged %v, want the request as a 500 warning", handled)
+	}
+}
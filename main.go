@@ -2,17 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/cipher"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -28,23 +37,55 @@ import (
 const (
 	envCodexApiUrl    = "CODEX_API_URL"
 	envMaxDatasetSize = "QAKU_CACHE_MAX_SIZE"
+	envAdminToken     = "QAKU_CACHE_ADMIN_TOKEN"
+	envMinBlockSize   = "QAKU_CACHE_MIN_BLOCK_SIZE"
+	envMaxBlockSize   = "QAKU_CACHE_MAX_BLOCK_SIZE"
+	envMaxBlockCount  = "QAKU_CACHE_MAX_BLOCK_COUNT"
+	envStartupJitter  = "QAKU_CACHE_STARTUP_JITTER"
+	envListenAddr     = "QAKU_CACHE_LISTEN_ADDR"
+	envMetricsAddr    = "QAKU_CACHE_METRICS_ADDR"
+	envWakuPort       = "QAKU_CACHE_WAKU_PORT"
+	envDiscV5Port     = "QAKU_CACHE_DISCV5_PORT"
+	envMessageType    = "QAKU_CACHE_MESSAGE_TYPE"
 
-	contentTopic   = "/0/qaku/1/persist/json"
-	defaultMaxSize = 5 * 1024 * 1024
+	envRequireProtected = "QAKU_CACHE_REQUIRE_PROTECTED"
+	envDryRun           = "QAKU_CACHE_DRY_RUN"
+
+	// messageTypePersist is the type of the messages asking for a snapshot
+	// to be cached.
+	messageTypePersist = "persist"
+
+	defaultMaxSize      = 5 * 1024 * 1024
+	defaultListenAddr   = "0.0.0.0:8080"
+	defaultMetricsAddr  = ":8003"
+	defaultDiscV5Port   = 9000
+	shutdownGracePeriod = 10 * time.Second
 )
 
 type QakuMessage struct {
 	Type      string       `json:"type"`
 	Payload   CacheRequest `json:"payload"`
-	Timestamp int          `json:"timestamp"`
+	Timestamp Timestamp    `json:"timestamp"`
 	Signature string       `json:"signature"`
 	Signer    string       `json:"signer"`
+
+	// rawPayload and rawTimestamp hold the signed fields exactly as
+	// received, set by decodeMessage.
+	rawPayload   json.RawMessage
+	rawTimestamp string
 }
 
 type CacheRequest struct {
 	CID   string `json:"cid"`
 	Owner string `json:"owner"`
 	Hash  string `json:"hash"`
+
+	// Encrypted is set by qaku for snapshots it uploaded AES-CTR encrypted.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// Batch lists the datasets of a batch request, which leaves CID and
+	// Hash empty.
+	Batch []BatchItem `json:"batch,omitempty"`
 }
 
 type CodexManifest struct {
@@ -60,257 +101,2241 @@ type CodexDataContent struct {
 	Manifest CodexManifest `json:"manifest"`
 }
 
-var maxDatasetSize = defaultMaxSize
+// cacheMessageType is the message type handled as a cache request, other
+// types are ignored.
+var cacheMessageType = messageTypePersist
+
+// snapshotCacheControl lets clients keep snapshots, they are addressed by
+// their content.
+const snapshotCacheControl = "public, max-age=31536000, immutable"
+
+// snapshotRoute serves the snapshot bytes.
+const snapshotRoute = "/api/qaku/v1/snapshot/:cid"
+
+// proxyMaxBytes caps the bytes streamed by the snapshot proxy, 0 disables it.
+var proxyMaxBytes int64 = 0
 
+// Acceptable manifest block size range, 0 disables the respective bound.
 var (
-	snapSuccess = promauto.NewCounter(prometheus.CounterOpts{
+	minBlockSize = 0
+	maxBlockSize = 0
+)
+
+// maxBlockCount caps the number of blocks of a dataset, 0 disables it.
+var maxBlockCount = 0
+
+var (
+	snapSuccess = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "qaku_cache_successes",
 		Help: "The total number successfully cached snapshot",
-	})
+	}, []string{"protected"})
 	snapFailure = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "qaku_cache_failures",
 		Help: "The total number failed attempts to cache a snapshot",
 	})
-	snapSizes = promauto.NewHistogram(prometheus.HistogramOpts{
+	snapFailureReason = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qaku_cache_failures_by_reason",
+		Help: "The total number failed attempts to cache a snapshot by reason",
+	}, []string{"reason"})
+	// snapSizes records KiB, deprecated in favour of snapSizeBytes.
+	snapSizes = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "qaku_cache_sizes",
-		Help:    "Histogram of sizes of cached snapshots",
+		Help:    "Histogram of sizes of cached snapshots in KiB, deprecated by qaku_cache_snapshot_size_bytes",
 		Buckets: []float64{100.0, 200.0, 500.0, 1000.0, 2000.0, 5000.0, 10000.0, 20000.0},
+	}, []string{"protected"})
+	snapSizeBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "qaku_cache_snapshot_size_bytes",
+		Help:    "Histogram of dataset sizes of all snapshots offered for caching, including rejected ones",
+		Buckets: prometheus.ExponentialBuckets(64*1024, 2, 12),
+	}, []string{"protected"})
+	snapDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "qaku_cache_duration_seconds",
+		Help:    "Time taken to process a cache request, by outcome",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60},
+	}, []string{"outcome"})
+	manifestFetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "qaku_cache_manifest_fetch_seconds",
+		Help:    "Time taken to fetch the manifest of a cache request, including retries",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30},
+	})
+	pinDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "qaku_cache_pin_seconds",
+		Help:    "Time taken to fetch a dataset into Codex",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60},
+	})
+	snapIgnoredType = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_ignored_type",
+		Help: "The total number of messages ignored because of their type",
+	})
+	snapAlreadyCached = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_already_cached",
+		Help: "The number of cache requests skipped because the CID was already cached",
+	})
+	snapInFlightDuplicate = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_inflight_duplicates",
+		Help: "The number of cache requests skipped because the CID was already being cached",
+	})
+	snapRejectedOversized = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_rejected_oversized",
+		Help: "The number of datasets rejected for exceeding the maximum dataset size",
+	})
+	snapCancelled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_cancelled",
+		Help: "The total number of cache jobs cancelled via the admin API",
+	})
+	snapProxyAborted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_proxy_aborted",
+		Help: "The total number of snapshot proxy transfers aborted for exceeding the size cap",
+	})
+	snapOwnerDenied = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_owner_denied",
+		Help: "The total number of cache requests skipped because the owner is not allowed",
+	})
+	codexBytesRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_codex_bytes_read",
+		Help: "The total number of bytes read from Codex responses",
+	})
+	proxyBytesServed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_proxy_bytes_served",
+		Help: "The total number of snapshot bytes served via the proxy",
+	})
+	snapOwnerMismatch = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_owner_mismatch",
+		Help: "The total number of messages rejected because the owner does not match the signer",
+	})
+	snapBlockSizeRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_rejected_block_size",
+		Help: "The total number of snapshots rejected due to an out-of-range manifest block size",
+	})
+	snapWouldCacheBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_would_cache_bytes",
+		Help: "The total dataset size that would have been cached in dry-run mode",
+	})
+	snapTooManyBlocks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_too_many_blocks",
+		Help: "The total number of snapshots rejected because their dataset has too many blocks",
+	})
+	snapUnprotectedRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_unprotected_rejected",
+		Help: "The total number of snapshots rejected because their dataset is not erasure coded",
 	})
 )
 
 func main() {
-	go prom()
+	logger, err := newLogger(os.Stderr, os.Getenv(envLogLevel))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
 
-	//log.Panicln(os.Getenv(envMaxDatasetSize))
-	maxSizeFromEnv, err := strconv.Atoi(os.Getenv(envMaxDatasetSize))
+	configPath := flag.String("config", "", "path to a YAML config file")
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
 	if err != nil {
-		log.Println(err)
+		fatal("failed to load config", "error", err)
+	}
+	codexURL = cfg.CodexAPIURL
+	if err := checkWakuConfig(cfg); err != nil {
+		fatal("invalid Waku config", "error", err)
 	}
+	clusterID = uint16(cfg.ClusterID)
 
-	if maxSizeFromEnv > 0 {
-		maxDatasetSize = maxSizeFromEnv
+	metricsSrv := prom(cfg.MetricsAddr)
+	observeBuildInfo()
+
+	if v := os.Getenv(envMessageType); v != "" {
+		cacheMessageType = v
 	}
 
-	hostAddr, _ := net.ResolveTCPAddr("tcp", "0.0.0.0:0")
+	if cfg.MaxSize <= 0 {
+		configError("%s must be positive, got %d", envMaxDatasetSize, cfg.MaxSize)
+		cfg.MaxSize = defaultMaxSize
+	}
+	maxDatasetSize.Store(int64(cfg.MaxSize))
+	maxBatchSize = envInt(envMaxBatchSize, defaultMaxBatchSize)
+	if maxBatchSize <= 0 {
+		configError("%s must be positive, got %d", envMaxBatchSize, maxBatchSize)
+		maxBatchSize = defaultMaxBatchSize
+	}
 
-	nodes := []string{
-		"enr:-QEkuEBIkb8q8_mrorHndoXH9t5N6ZfD-jehQCrYeoJDPHqT0l0wyaONa2-piRQsi3oVKAzDShDVeoQhy0uwN1xbZfPZAYJpZIJ2NIJpcIQiQlleim11bHRpYWRkcnO4bgA0Ni9ub2RlLTAxLmdjLXVzLWNlbnRyYWwxLWEud2FrdS5zYW5kYm94LnN0YXR1cy5pbQZ2XwA2Ni9ub2RlLTAxLmdjLXVzLWNlbnRyYWwxLWEud2FrdS5zYW5kYm94LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQKnGt-GSgqPSf3IAPM7bFgTlpczpMZZLF3geeoNNsxzSoN0Y3CCdl-DdWRwgiMohXdha3UyDw",
-		"enr:-QESuEB4Dchgjn7gfAvwB00CxTA-nGiyk-aALI-H4dYSZD3rUk7bZHmP8d2U6xDiQ2vZffpo45Jp7zKNdnwDUx6g4o6XAYJpZIJ2NIJpcIRA4VDAim11bHRpYWRkcnO4XAArNiZub2RlLTAxLmRvLWFtczMud2FrdS5zYW5kYm94LnN0YXR1cy5pbQZ2XwAtNiZub2RlLTAxLmRvLWFtczMud2FrdS5zYW5kYm94LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQOvD3S3jUNICsrOILlmhENiWAMmMVlAl6-Q8wRB7hidY4N0Y3CCdl-DdWRwgiMohXdha3UyDw",
-		"enr:-QEkuEBfEzJm_kigJ2HoSS_RBFJYhKHocGdkhhBr6jSUAWjLdFPp6Pj1l4yiTQp7TGHyu1kC6FyaU573VN8klLsEm-XuAYJpZIJ2NIJpcIQI2SVcim11bHRpYWRkcnO4bgA0Ni9ub2RlLTAxLmFjLWNuLWhvbmdrb25nLWMud2FrdS5zYW5kYm94LnN0YXR1cy5pbQZ2XwA2Ni9ub2RlLTAxLmFjLWNuLWhvbmdrb25nLWMud2FrdS5zYW5kYm94LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQOwsS69tgD7u1K50r5-qG5hweuTwa0W26aYPnvivpNlrYN0Y3CCdl-DdWRwgiMohXdha3UyDw",
-		"enr:-QEMuEDbayK340kH24XzK5FPIYNzWNYuH01NASNIb1skZfe_6l4_JSsG-vZ0LgN4Cgzf455BaP5zrxMQADHL5OQpbW6OAYJpZIJ2NIJpcISygI2rim11bHRpYWRkcnO4VgAoNiNub2RlLTAxLmRvLWFtczMud2FrdS50ZXN0LnN0YXR1cy5pbQZ2XwAqNiNub2RlLTAxLmRvLWFtczMud2FrdS50ZXN0LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQJATXRSRSUyTw_QLB6H_U3oziVQgNRgrXpK7wp2AMyNxYN0Y3CCdl-DdWRwgiMohXdha3UyDw",
-		"enr:-QEeuEBO08GSjWDOV13HTf6L7iFoPQhv4S0-_Bd7Of3lFCBNBmpB9j6pGLedkX88KAXm6BFCS4ViQ_rLeDQuzj9Q6fs9AYJpZIJ2NIJpcIQiEAFDim11bHRpYWRkcnO4aAAxNixub2RlLTAxLmdjLXVzLWNlbnRyYWwxLWEud2FrdS50ZXN0LnN0YXR1cy5pbQZ2XwAzNixub2RlLTAxLmdjLXVzLWNlbnRyYWwxLWEud2FrdS50ZXN0LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQMIJwesBVgUiBCi8yiXGx7RWylBQkYm1U9dvEy-neLG2YN0Y3CCdl-DdWRwgiMohXdha3UyDw",
-		"enr:-QEeuECvvBe6kIzHgMv_mD1YWQ3yfOfid2MO9a_A6ZZmS7E0FmAfntz2ZixAnPXvLWDJ81ARp4oV9UM4WXyc5D5USdEPAYJpZIJ2NIJpcIQI2ttrim11bHRpYWRkcnO4aAAxNixub2RlLTAxLmFjLWNuLWhvbmdrb25nLWMud2FrdS50ZXN0LnN0YXR1cy5pbQZ2XwAzNixub2RlLTAxLmFjLWNuLWhvbmdrb25nLWMud2FrdS50ZXN0LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQJIN4qwz3v4r2Q8Bv8zZD0eqBcKw6bdLvdkV7-JLjqIj4N0Y3CCdl-DdWRwgiMohXdha3UyDw",
+	proxyMaxBytes = int64(envInt(envProxyMaxBytes, 0))
+
+	minBlockSize = envInt(envMinBlockSize, minBlockSize)
+	maxBlockSize = envInt(envMaxBlockSize, maxBlockSize)
+	maxBlockCount = envInt(envMaxBlockCount, maxBlockCount)
+	if maxBlockCount < 0 {
+		configError("%s must not be negative, got %d", envMaxBlockCount, maxBlockCount)
+		maxBlockCount = 0
 	}
 
-	enodes := []*enode.Node{}
-	for _, n := range nodes {
-		e, err := enode.Parse(enode.ValidSchemes, n)
-		if err != nil {
-			log.Fatal(err)
+	workers := envInt(envWorkers, defaultWorkers)
+	if workers <= 0 {
+		configError("%s must be positive, got %d", envWorkers, workers)
+		workers = defaultWorkers
+	}
+	queueSize := envInt(envQueueSize, defaultQueueSize)
+	if queueSize <= 0 {
+		configError("%s must be positive, got %d", envQueueSize, queueSize)
+		queueSize = defaultQueueSize
+	}
+	manualPriority := os.Getenv(envManualPriority)
+	if manualPriority == "" {
+		manualPriority = priorityNormal
+	}
+	if !validPriority(manualPriority) {
+		configError("invalid value for %s: %q, expected high, normal or low", envManualPriority, manualPriority)
+		manualPriority = priorityNormal
+	}
+	manualRatio := envInt(envManualRatio, 0)
+	if manualRatio < 0 {
+		configError("%s must not be negative, got %d", envManualRatio, manualRatio)
+		manualRatio = 0
+	}
+	dropPolicy := os.Getenv(envDropPolicy)
+	if dropPolicy == "" {
+		dropPolicy = dropNewest
+	}
+	if !validDropPolicy(dropPolicy) {
+		configError("invalid value for %s: %q, expected newest or oldest", envDropPolicy, dropPolicy)
+		dropPolicy = dropNewest
+	}
+
+	ownerDerivation = os.Getenv(envOwnerDerivation)
+	if !validOwnerDerivation(ownerDerivation) {
+		// Falling back to no check would silently disable a security control.
+		fatal("invalid owner derivation", "env", envOwnerDerivation, "value", ownerDerivation, "allowed", []string{ownerDerivationEqual, ownerDerivationEthAddress, ""})
+	}
+
+	if v := os.Getenv(envSignatureScheme); v != "" {
+		signatureScheme = v
+	}
+	if !validSignatureScheme(signatureScheme) {
+		fatal("invalid signature scheme", "env", envSignatureScheme, "value", signatureScheme, "allowed", []string{signatureSchemeKeccak, signatureSchemePersonal, signatureSchemeNone})
+	}
+
+	metricsLogInterval := envDuration(envMetricsLogInterval, 0)
+	startupJitter := envDuration(envStartupJitter, 0)
+	memoryLimit := envInt(envMemoryLimit, 0)
+	memoryCheckInterval := envDuration(envMemoryCheckInterval, defaultMemoryCheckInterval)
+	if memoryCheckInterval <= 0 {
+		configError("%s must be positive, got %s", envMemoryCheckInterval, memoryCheckInterval)
+		memoryCheckInterval = defaultMemoryCheckInterval
+	}
+	memoryShedQueue := envBool(envMemoryShedQueue, false)
+	backendKind := os.Getenv(envBackend)
+	if backendKind == "" {
+		backendKind = backendCodex
+	}
+	if !validBackend(backendKind) {
+		fatal("invalid storage backend", "env", envBackend, "value", backendKind, "allowed", []string{backendCodex, backendFS})
+	}
+	pinConfirm := pinConfirmFromEnv()
+	deadLetterSize := envInt(envDeadLetterSize, 0)
+	var unmatched *unmatchedTopics
+	if envBool(envUnmatchedTopicMetric, false) {
+		limit := envInt(envUnmatchedTopicLimit, defaultUnmatchedTopicLimit)
+		if limit <= 0 {
+			configError("%s must be positive, got %d", envUnmatchedTopicLimit, limit)
+			limit = defaultUnmatchedTopicLimit
 		}
+		unmatched = newUnmatchedTopics(limit)
+	}
+	ownerBytesLimit := 0
+	if envBool(envOwnerBytesMetric, false) {
+		ownerBytesLimit = envInt(envOwnerBytesLimit, defaultOwnerBytesLimit)
+		if ownerBytesLimit <= 0 {
+			configError("%s must be positive, got %d", envOwnerBytesLimit, ownerBytesLimit)
+			ownerBytesLimit = defaultOwnerBytesLimit
+		}
+	}
+	maxVersions := envInt(envMaxVersions, 0)
+	if maxVersions < 0 {
+		configError("%s must not be negative, got %d", envMaxVersions, maxVersions)
+		maxVersions = 0
+	}
+	webhookURL := os.Getenv(envWebhookURL)
+	webhookRetries := envInt(envWebhookRetries, defaultWebhookRetries)
+	if webhookRetries < 0 {
+		configError("%s must not be negative, got %d", envWebhookRetries, webhookRetries)
+		webhookRetries = defaultWebhookRetries
+	}
+	webhookBackoff := envDuration(envWebhookBackoff, defaultWebhookBackoff)
+	webhookTimeout := envDuration(envWebhookTimeout, defaultWebhookTimeout)
+	webhookQueueSize := envInt(envWebhookQueueSize, defaultWebhookQueueSize)
+	if webhookQueueSize <= 0 {
+		configError("%s must be positive, got %d", envWebhookQueueSize, webhookQueueSize)
+		webhookQueueSize = defaultWebhookQueueSize
+	}
+	strictJSON := envBool(envStrictJSON, false)
+	payloadKey, err := parsePayloadKey(os.Getenv(envPayloadKey))
+	if err != nil {
+		fatal("failed to load payload key", "error", err)
+	}
+	requireProtected := envBool(envRequireProtected, false)
+	signers, err := parseSignerAllowlist(os.Getenv(envSignerAllowlist))
+	if err != nil {
+		// Falling back to no filter would process every tenant's messages.
+		fatal("invalid signer allowlist", "error", err)
+	}
+	dryRun := envBool(envDryRun, false)
+	contentHasher, err := contentHasherFor(os.Getenv(envHashAlgorithm))
+	if err != nil {
+		fatal("invalid hash algorithm", "error", err)
+	}
+	newContentHasher = contentHasher
+	codexTimeout := envDuration(envCodexTimeout, defaultCodexTimeout)
+	if codexTimeout <= 0 {
+		configError("%s must be positive, got %s", envCodexTimeout, codexTimeout)
+		codexTimeout = defaultCodexTimeout
+	}
+	codexClient = newCodexClient(codexTimeout)
+	codexToken = os.Getenv(envCodexToken)
+	codexRequestIDHeader = codexRequestIDHeaderFromEnv()
+	proxyPendingRetryAfter = envDuration(envProxyPendingRetryAfter, 0)
+	proxyRefetchTimeout = envDuration(envProxyRefetchTimeout, 0)
+	codexMaxRetries = envInt(envMaxRetries, defaultMaxRetries)
+	if codexMaxRetries < 0 {
+		configError("%s must not be negative, got %d", envMaxRetries, codexMaxRetries)
+		codexMaxRetries = defaultMaxRetries
+	}
+	codexRetryDelay = envDuration(envRetryDelay, defaultRetryDelay)
+	if codexRetryDelay <= 0 {
+		configError("%s must be positive, got %s", envRetryDelay, codexRetryDelay)
+		codexRetryDelay = defaultRetryDelay
+	}
+
+	storeLookback := envDuration(envStoreLookback, defaultStoreLookback)
+	if storeLookback < 0 {
+		configError("%s must not be negative, got %s", envStoreLookback, storeLookback)
+		storeLookback = defaultStoreLookback
+	}
 
-		enodes = append(enodes, e)
+	wakuHealthInterval := envDuration(envWakuHealthInterval, defaultWakuHealthInterval)
+	wakuMaxUnhealthy := envInt(envWakuMaxUnhealthy, defaultWakuMaxUnhealthy)
+	if wakuMaxUnhealthy < 1 {
+		configError("%s must be positive, got %d", envWakuMaxUnhealthy, wakuMaxUnhealthy)
+		wakuMaxUnhealthy = defaultWakuMaxUnhealthy
 	}
 
-	node, err := node.New(
-		node.WithHostAddress(hostAddr),
-		node.WithWakuFilterLightNode(),
-		node.WithDiscoveryV5(uint(9000), enodes, true),
-		//node.WithLogLevel(zap.DebugLevel),
-		node.WithClusterID(uint16(1)),
-	)
+	startRetries := envInt(envStartRetries, defaultStartRetries)
+	if startRetries < 0 {
+		configError("%s must not be negative, got %d", envStartRetries, startRetries)
+		startRetries = defaultStartRetries
+	}
+	startDelay := envDuration(envStartDelay, defaultStartDelay)
+	manifestRetries := envInt(envManifestRetries, 0)
+	if manifestRetries < 0 {
+		configError("%s must not be negative, got %d", envManifestRetries, manifestRetries)
+		manifestRetries = 0
+	}
+	manifestRetryDelay := envDuration(envManifestRetryDelay, defaultManifestRetryDelay)
+	ownerRateLimit := envInt(envOwnerRateLimit, 0)
+	if ownerRateLimit < 0 {
+		configError("%s must not be negative, got %d", envOwnerRateLimit, ownerRateLimit)
+		ownerRateLimit = 0
+	}
+	ownerRateWindow := envDuration(envOwnerRateWindow, defaultOwnerRateWindow)
+	if ownerRateWindow <= 0 {
+		configError("%s must be positive, got %s", envOwnerRateWindow, ownerRateWindow)
+		ownerRateWindow = defaultOwnerRateWindow
+	}
+	ownerRateBurst := envInt(envOwnerRateBurst, ownerRateLimit)
+	if ownerRateBurst < 1 && ownerRateLimit > 0 {
+		configError("%s must be positive, got %d", envOwnerRateBurst, ownerRateBurst)
+		ownerRateBurst = ownerRateLimit
+	}
+	ownerQuota := int64(envInt(envOwnerByteQuota, 0))
+	if ownerQuota < 0 {
+		configError("%s must not be negative, got %d", envOwnerByteQuota, ownerQuota)
+		ownerQuota = 0
+	}
+	allowanceURL := os.Getenv(envAllowanceURL)
+	allowanceCacheTTL := envDuration(envAllowanceCacheTTL, defaultAllowanceCacheTTL)
+	allowanceFailOpen := envBool(envAllowanceFailOpen, false)
+	validator, err := newSnapshotValidator(os.Getenv(envSnapshotValidation), os.Getenv(envSnapshotRequiredFields))
+	if err != nil {
+		configError("%s", err)
+	}
+	defaultTTL := envDuration(envTTL, 0)
+	if defaultTTL < 0 {
+		configError("%s must not be negative, got %s", envTTL, defaultTTL)
+		defaultTTL = 0
+	}
+	ttl, err := parseTTLPolicy(defaultTTL, os.Getenv(envOwnerTTLs))
+	if err != nil {
+		configError("%s: %s", envOwnerTTLs, err)
+	}
+	sizeLimits, err := parseSizePolicy(os.Getenv(envOwnerMaxSizes))
 	if err != nil {
-		log.Fatal(err)
+		configError("%s: %s", envOwnerMaxSizes, err)
+	}
+	bodyCacheMaxSize := envInt(envBodyCacheMaxSize, defaultBodyCacheMaxSize)
+	if bodyCacheMaxSize <= 0 {
+		configError("%s must be positive, got %d", envBodyCacheMaxSize, bodyCacheMaxSize)
+		bodyCacheMaxSize = defaultBodyCacheMaxSize
+	}
+	tlsConfig, err := loadTLSConfig(os.Getenv(envTLSCert), os.Getenv(envTLSKey))
+	if err != nil {
+		fatal("invalid TLS config", "error", err)
+	}
+	peerMetricsInterval := envDuration(envPeerMetricsInterval, defaultPeerMetricsInterval)
+	if peerMetricsInterval <= 0 {
+		configError("%s must be positive, got %s", envPeerMetricsInterval, peerMetricsInterval)
+		peerMetricsInterval = defaultPeerMetricsInterval
+	}
+	downloads := newDownloadLimiter(envInt(envMaxConcurrentDownloads, 0), envDuration(envDownloadQueueTimeout, 0))
+	gzipMinSize := envInt(envGzipMinSize, defaultGzipMinSize)
+	if gzipMinSize < 0 {
+		configError("%s must not be negative, got %d", envGzipMinSize, gzipMinSize)
+		gzipMinSize = defaultGzipMinSize
+	}
+	corsCfg, err := corsConfig(os.Getenv(envCORSOrigins))
+	if err != nil {
+		fatal("invalid CORS config", "error", err)
+	}
+	ttlPurgeInterval := envDuration(envTTLPurgeInterval, defaultTTLPurgeInterval)
+	if ttlPurgeInterval <= 0 {
+		configError("%s must be positive, got %s", envTTLPurgeInterval, ttlPurgeInterval)
+		ttlPurgeInterval = defaultTTLPurgeInterval
+	}
+	dedupWindow := envDuration(envDedupWindow, defaultDedupWindow)
+	dedupSize := envInt(envDedupSize, defaultDedupSize)
+	if dedupSize <= 0 {
+		configError("%s must be positive, got %d", envDedupSize, dedupSize)
+		dedupSize = defaultDedupSize
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	fresh := freshness{
+		maxAge: envDuration(envMaxMessageAge, defaultMaxMessageAge),
+		skew:   envDuration(envMaxClockSkew, defaultMaxClockSkew),
+	}
+	if fresh.maxAge > 0 {
+		// Exact replays within the freshness window are caught by the
+		// deduplicator, so it has to remember messages at least as long.
+		if window := fresh.maxAge + fresh.skew; dedupWindow > 0 && dedupWindow < window {
+			slog.Info("extending dedup window to cover the message age limit", "window", window)
+			dedupWindow = window
+		}
+		if dedupWindow <= 0 {
+			slog.Warn("dedup is disabled, replays within the message age limit are not dropped", "maxAge", fresh.maxAge)
+		}
+		if storeLookback > fresh.maxAge {
+			slog.Warn("store replay only picks up messages within the message age limit", "lookback", storeLookback, "maxAge", fresh.maxAge)
+		}
+	}
+	totalSize := int64(envInt(envTotalSize, 0))
+	if totalSize < 0 {
+		configError("%s must not be negative, got %d", envTotalSize, totalSize)
+		totalSize = 0
+	}
+	evictionGrace := envDuration(envEvictionGrace, defaultEvictionGrace)
+	keepAliveInterval := envDuration(envKeepAliveInterval, 0)
+	repinConcurrency := envInt(envRepinConcurrency, defaultRepinConcurrency)
+	if repinConcurrency <= 0 {
+		configError("%s must be positive, got %d", envRepinConcurrency, repinConcurrency)
+		repinConcurrency = defaultRepinConcurrency
+	}
+	repinJitter := envDuration(envRepinJitter, defaultRepinJitter)
+	repinMinAge := envDuration(envRepinMinAge, keepAliveInterval/2)
+	retryQueueMaxAge := envDuration(envRetryQueueMaxAge, 0)
+	retryQueueDelay := envDuration(envRetryQueueDelay, defaultRetryQueueDelay)
+	if retryQueueDelay <= 0 {
+		configError("%s must be positive, got %s", envRetryQueueDelay, retryQueueDelay)
+		retryQueueDelay = defaultRetryQueueDelay
+	}
+	verifyInterval := envDuration(envVerifyInterval, 0)
+	verifySample := envInt(envVerifySample, defaultVerifySample)
+	if verifySample <= 0 {
+		configError("%s must be positive, got %d", envVerifySample, verifySample)
+		verifySample = defaultVerifySample
+	}
+	verifyRehash := envBool(envVerifyRehash, false)
+	persistRetryInterval := envDuration(envPersistRetryInterval, defaultPersistRetryInterval)
+	if persistRetryInterval <= 0 {
+		configError("%s must be positive, got %s", envPersistRetryInterval, persistRetryInterval)
+		persistRetryInterval = defaultPersistRetryInterval
+	}
+	registryURL := os.Getenv(envRegistryURL)
+	registryInterval := envDuration(envRegistryInterval, defaultRegistryInterval)
+	if registryInterval <= 0 {
+		configError("%s must be positive, got %s", envRegistryInterval, registryInterval)
+		registryInterval = defaultRegistryInterval
+	}
 
-	err = node.Start(ctx)
+	auth, err := newAdminAuthenticator()
 	if err != nil {
-		log.Fatal(err)
+		configError("%s", err)
+	}
+
+	if path := os.Getenv(envAuditPath); path != "" {
+		auditLog, err = openAuditSink(path)
+		if err != nil {
+			fatal("failed to open audit log", "error", err)
+		}
 	}
 
-	err = node.DiscV5().Start(ctx)
+	owners, err := loadOwnerLists(os.Getenv(envOwnerListsPath), os.Getenv(envOwnerAllowlist), os.Getenv(envOwnerDenylist))
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to load owner lists", "error", err)
 	}
 
-	time.Sleep(5 * time.Second)
+	indexCompress := envBool(envIndexCompress, false)
 
-	contentTopic, err := protocol.NewContentTopic("qaku", "1", "persist", "json")
+	topics, err := parseTopicMatcher(configuredContentTopics())
 	if err != nil {
-		log.Fatal(err)
+		fatal("invalid content topics", "error", err)
 	}
-	pubsubTopic := protocol.GetShardFromContentTopic(contentTopic, 8)
 
-	cf := protocol.NewContentFilter(pubsubTopic.String(), contentTopic.String())
+	shardCount = envInt(envShardCount, defaultShardCount)
+	if shardCount <= 0 {
+		configError("%s must be positive, got %d", envShardCount, shardCount)
+		shardCount = defaultShardCount
+	}
+	for _, shard := range cfg.Shards {
+		if int(shard) >= shardCount {
+			configError("shard %d in %s is not below %s %d", shard, envShards, envShardCount, shardCount)
+			continue
+		}
+		extraShards = append(extraShards, shard)
+	}
 
-	c := &Cache{}
+	pubsubTopic, err := parsePubsubTopic(os.Getenv(envPubsubTopic))
+	if err != nil {
+		fatal("invalid pubsub topic", "error", err)
+	}
 
-	logger, _ := zap.NewDevelopment()
-	fm := filter.NewFilterManager(ctx, logger, 2, c, node.FilterLightnode())
-	fm.SubscribeFilter(uuid.NewString(), cf)
-	time.Sleep(3 * time.Second)
+	if len(topics.ContentTopics()) == 0 {
+		fatal("no content topic without wildcards configured", "env", envContentTopics)
+	}
 
-	log.Println("Starting main loop")
-	fm.SubscribeFilter(uuid.NewString(), cf)
+	invalidate, err := invalidateTopic()
+	if err != nil {
+		fatal("invalid invalidate topic", "error", err)
+	}
+	// Invalidations share the subscription and the worker pool with the
+	// cache requests, Cache.OnNewEnvelope tells them apart by content topic.
+	var invalidateMatcher topicMatcher
+	if invalidate != "" {
+		p, err := parseTopicPattern(invalidate)
+		if err != nil {
+			fatal("invalid invalidate topic", "error", err)
+		}
+		invalidateMatcher = topicMatcher{p}
+		topics = append(topics, p)
+	}
+	checkTopicShards(topics, pubsubTopic)
+	cfs := contentFilters(topics, pubsubTopic)
 
-	server()
-}
+	var announceTopic protocol.ContentTopic
+	if v := os.Getenv(envAnnounceTopic); v != "" {
+		announceTopic, err = protocol.StringToContentTopic(v)
+		if err != nil {
+			fatal("invalid announce topic", "env", envAnnounceTopic, "error", err)
+		}
+	}
+	announceMinPeers := envInt(envAnnounceMinPeers, defaultAnnounceMinPeers)
+	if announceMinPeers < 0 {
+		configError("%s must not be negative, got %d", envAnnounceMinPeers, announceMinPeers)
+		announceMinPeers = defaultAnnounceMinPeers
+	}
+
+	migration, err := parseTopicMigration(os.Getenv(envDeprecatedTopics), os.Getenv(envDeprecatedTopicsUntil), pubsubTopic, time.Now())
+	if err != nil {
+		fatal("invalid topic migration", "error", err)
+	}
+
+	extAddr, err := parseExternalAddr(os.Getenv(envExtIP), envInt(envExtTCPPort, 0), envInt(envExtUDPPort, 0), cfg.WakuPort, cfg.DiscV5Port)
+	if err != nil {
+		fatal("invalid external address", "error", err)
+	}
+	extOpts, err := extAddr.options()
+	if err != nil {
+		fatal("invalid external address", "error", err)
+	}
 
-func server() {
-	r := gin.Default()
+	staticNodes := validStaticNodes(cfg.StaticNodes)
 
-	r.Use(cors.New(cors.Config{
-		AllowOrigins:  []string{"http://localhost:3000", "https://qaku.app"},
-		AllowMethods:  []string{"GET", "OPTIONS"},
-		AllowHeaders:  []string{"Origin,DNT,User-Agent,X-Requested-With,If-Modified-Since,Cache-Control,Content-Type,Range"},
-		ExposeHeaders: []string{"Content-Length"},
-	}))
+	wakuLevel, err := wakuLogLevel(os.Getenv(envWakuLogLevel))
+	if err != nil {
+		fatal("invalid Waku log level", "error", err)
+	}
 
-	r.GET("/api/qaku/v1/info", func(c *gin.Context) {
-		url := getCodexUrl()
+	checkConfig()
 
-		type DebugInfo struct {
-			ID             string   `json:"id"`
-			AnnouncedAddrs []string `json:"announceAddresses"`
-		}
+	hostAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("0.0.0.0:%d", cfg.WakuPort))
+	if err != nil {
+		fatal("invalid Waku host address", "port", cfg.WakuPort, "error", err)
+	}
+
+	nodes := []string{
+		"enr:-QEkuEBIkb8q8_mrorHndoXH9t5N6ZfD-jehQCrYeoJDPHqT0l0wyaONa2-piRQsi3oVKAzDShDVeoQhy0uwN1xbZfPZAYJpZIJ2NIJpcIQiQlleim11bHRpYWRkcnO4bgA0Ni9ub2RlLTAxLmdjLXVzLWNlbnRyYWwxLWEud2FrdS5zYW5kYm94LnN0YXR1cy5pbQZ2XwA2Ni9ub2RlLTAxLmdjLXVzLWNlbnRyYWwxLWEud2FrdS5zYW5kYm94LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQKnGt-GSgqPSf3IAPM7bFgTlpczpMZZLF3geeoNNsxzSoN0Y3CCdl-DdWRwgiMohXdha3UyDw",
+		"enr:-QESuEB4Dchgjn7gfAvwB00CxTA-nGiyk-aALI-H4dYSZD3rUk7bZHmP8d2U6xDiQ2vZffpo45Jp7zKNdnwDUx6g4o6XAYJpZIJ2NIJpcIRA4VDAim11bHRpYWRkcnO4XAArNiZub2RlLTAxLmRvLWFtczMud2FrdS5zYW5kYm94LnN0YXR1cy5pbQZ2XwAtNiZub2RlLTAxLmRvLWFtczMud2FrdS5zYW5kYm94LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQOvD3S3jUNICsrOILlmhENiWAMmMVlAl6-Q8wRB7hidY4N0Y3CCdl-DdWRwgiMohXdha3UyDw",
+		"enr:-QEkuEBfEzJm_kigJ2HoSS_RBFJYhKHocGdkhhBr6jSUAWjLdFPp6Pj1l4yiTQp7TGHyu1kC6FyaU573VN8klLsEm-XuAYJpZIJ2NIJpcIQI2SVcim11bHRpYWRkcnO4bgA0Ni9ub2RlLTAxLmFjLWNuLWhvbmdrb25nLWMud2FrdS5zYW5kYm94LnN0YXR1cy5pbQZ2XwA2Ni9ub2RlLTAxLmFjLWNuLWhvbmdrb25nLWMud2FrdS5zYW5kYm94LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQOwsS69tgD7u1K50r5-qG5hweuTwa0W26aYPnvivpNlrYN0Y3CCdl-DdWRwgiMohXdha3UyDw",
+		"enr:-QEMuEDbayK340kH24XzK5FPIYNzWNYuH01NASNIb1skZfe_6l4_JSsG-vZ0LgN4Cgzf455BaP5zrxMQADHL5OQpbW6OAYJpZIJ2NIJpcISygI2rim11bHRpYWRkcnO4VgAoNiNub2RlLTAxLmRvLWFtczMud2FrdS50ZXN0LnN0YXR1cy5pbQZ2XwAqNiNub2RlLTAxLmRvLWFtczMud2FrdS50ZXN0LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQJATXRSRSUyTw_QLB6H_U3oziVQgNRgrXpK7wp2AMyNxYN0Y3CCdl-DdWRwgiMohXdha3UyDw",
+		"enr:-QEeuEBO08GSjWDOV13HTf6L7iFoPQhv4S0-_Bd7Of3lFCBNBmpB9j6pGLedkX88KAXm6BFCS4ViQ_rLeDQuzj9Q6fs9AYJpZIJ2NIJpcIQiEAFDim11bHRpYWRkcnO4aAAxNixub2RlLTAxLmdjLXVzLWNlbnRyYWwxLWEud2FrdS50ZXN0LnN0YXR1cy5pbQZ2XwAzNixub2RlLTAxLmdjLXVzLWNlbnRyYWwxLWEud2FrdS50ZXN0LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQMIJwesBVgUiBCi8yiXGx7RWylBQkYm1U9dvEy-neLG2YN0Y3CCdl-DdWRwgiMohXdha3UyDw",
+		"enr:-QEeuECvvBe6kIzHgMv_mD1YWQ3yfOfid2MO9a_A6ZZmS7E0FmAfntz2ZixAnPXvLWDJ81ARp4oV9UM4WXyc5D5USdEPAYJpZIJ2NIJpcIQI2ttrim11bHRpYWRkcnO4aAAxNixub2RlLTAxLmFjLWNuLWhvbmdrb25nLWMud2FrdS50ZXN0LnN0YXR1cy5pbQZ2XwAzNixub2RlLTAxLmFjLWNuLWhvbmdrb25nLWMud2FrdS50ZXN0LnN0YXR1cy5pbQYfQN4DgnJzkwABCAAAAAEAAgADAAQABQAGAAeJc2VjcDI1NmsxoQJIN4qwz3v4r2Q8Bv8zZD0eqBcKw6bdLvdkV7-JLjqIj4N0Y3CCdl-DdWRwgiMohXdha3UyDw",
+	}
+
+	if len(cfg.Bootnodes) > 0 {
+		nodes = cfg.Bootnodes
+	}
+	enodes, err := parseBootnodes(nodes)
+	if err != nil {
+		fatal("invalid discv5 bootstrap nodes", "error", err)
+	}
+	if len(enodes) == 0 {
+		fatal("no discv5 bootstrap nodes", "env", envDiscV5Bootnodes)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		var infoResp *http.Response
-		infoResp, err := http.Get(fmt.Sprintf("%s/api/codex/v1/debug/info", url))
+	waku := newWakuSupervisor(func(ctx context.Context) (*node.WakuNode, error) {
+		wn, err := startWakuNode(ctx, startRetries, startDelay, func() (*node.WakuNode, error) {
+			opts := []node.WakuNodeOption{
+				node.WithHostAddress(hostAddr),
+				node.WithWakuFilterLightNode(),
+				node.WithDiscoveryV5(uint(cfg.DiscV5Port), enodes, true),
+				node.WithLogLevel(wakuLevel),
+				node.WithClusterID(clusterID),
+			}
+			return node.New(append(opts, extOpts...)...)
+		})
 		if err != nil {
-			log.Println("failed to fetch manifest", err)
-			return
+			return nil, err
 		}
-		defer infoResp.Body.Close()
 
-		body, err := io.ReadAll(infoResp.Body)
+		err = wn.DiscV5().Start(ctx)
 		if err != nil {
-			log.Println("faild to read manifest data", err)
-			return
+			wn.Stop()
+			return nil, fmt.Errorf("failed to start discv5: %w", err)
 		}
 
-		info := &DebugInfo{}
-		err = json.Unmarshal(body, info)
-		if err != nil {
-			log.Println("failed to unmarshal manifest: ", err)
-			return
+		for _, addr := range staticNodes {
+			err := wn.DialPeer(ctx, addr)
+			if err != nil {
+				logger.Warn("failed to dial static node", "addr", addr, "error", err)
+			}
 		}
 
-		c.JSON(200, gin.H{"peerId": info.ID, "addr": info.AnnouncedAddrs[0]})
-	})
+		return wn, nil
+	}, wakuHealthInterval, wakuMaxUnhealthy, startDelay)
 
-	r.GET("/api/qaku/v1/snapshot/:cid", func(c *gin.Context) {
-		url := getCodexUrl()
-		cid := c.Param("cid")
-		log.Println(c.Params)
+	err = waku.Start(ctx)
+	if err != nil {
+		fatal("failed to start Waku node", "error", err)
+	}
 
-		if cid == "" {
-			c.Error(fmt.Errorf("empty CID param"))
-			c.String(500, "empty CID param")
-			return
-		}
+	time.Sleep(5 * time.Second)
 
-		var cidResp *http.Response
-		cidResp, err := http.Get(fmt.Sprintf("%s/api/codex/v1/data/%s", url, cid))
+	c, err := NewCache(os.Getenv(envDBPath))
+	if err != nil {
+		fatal("failed to open cache", "error", err)
+	}
+	if path := os.Getenv(envIndexPath); path != "" && os.Getenv(envDBPath) == "" {
+		c.index, err = loadCacheIndex(fileIndexStore{path: path, compress: indexCompress})
 		if err != nil {
-			c.Error(fmt.Errorf("failed to fetch manifest: %s", err))
-			return
+			fatal("failed to load cache index", "error", err)
 		}
-		defer cidResp.Body.Close()
+	}
+	if ownerBytesLimit > 0 {
+		c.index.ObserveOwners(ownerBytesLimit)
+	}
+	c.logger = logger
+	c.owners = owners
+	c.maxVersions = maxVersions
+	c.totalSize = totalSize
+	c.evictionGrace = evictionGrace
+	c.strictJSON = strictJSON
+	c.requireProtected = requireProtected
+	c.dryRun = dryRun
+	c.signers = signers
+	c.invalidateTopic = invalidateMatcher
+	if dryRun {
+		logger.Warn("dry-run mode, datasets are not cached")
+	}
+	c.payloadKey = payloadKey
+	c.freshness = fresh
+	c.ttl = ttl
+	c.sizeLimits = sizeLimits
+	c.manifestRetries = manifestRetries
+	c.validator = validator
+	c.ownerQuota = ownerQuota
+	if allowanceURL != "" {
+		c.allowance = newAllowanceChecker(allowanceURL, allowanceCacheTTL, allowanceFailOpen)
+	}
+	if ownerRateLimit > 0 {
+		c.rateLimiter = newOwnerRateLimiter(ownerRateLimit, ownerRateWindow, ownerRateBurst)
+	}
+	c.manifestRetryDelay = manifestRetryDelay
+	if retryQueueMaxAge > 0 {
+		c.retries, err = loadRetryQueue(c.retryDB, retryQueueDelay, retryQueueMaxAge)
+		if err != nil {
+			fatal("failed to load the retry queue", "error", err)
+		}
+	}
+	c.backend, err = newBackend(backendKind)
+	if err != nil {
+		fatal("failed to set up the storage backend", "error", err)
+	}
+	var bodies *bodyCache
+	if dir := os.Getenv(envBodyCacheDir); dir != "" {
+		bodies, err = newBodyCache(dir, int64(bodyCacheMaxSize))
+		if err != nil {
+			fatal("failed to open body cache", "error", err)
+		}
+		c.backend = &cachingBackend{Backend: c.backend, bodies: bodies}
+	}
+	if deadLetterSize > 0 {
+		c.deadLetters, err = newDeadLetterLog(deadLetterSize, os.Getenv(envDeadLetterPath))
+		if err != nil {
+			fatal("failed to open dead-letter log", "error", err)
+		}
+	}
+	if webhookURL != "" {
+		c.webhook = newWebhook(webhookURL, webhookRetries, webhookBackoff, webhookTimeout, webhookQueueSize)
+		go c.webhook.run(ctx)
+	}
+	if announceTopic != (protocol.ContentTopic{}) {
+		c.announcer = newAnnouncer(waku, announceTopic, pubsubTopic, announceMinPeers)
+		go c.announcer.run(ctx)
+	}
+	// Codex fetches in the background, the fs backend has the dataset as
+	// soon as FetchToNetwork returns and confirms on the first check.
+	c.confirmPins(ctx, pinConfirm)
+	pool := newWorkerPool(workers, queueSize, manualPriority, dropPolicy, c.OnNewEnvelope)
+	pool.manualRatio = manualRatio
 
-		io.Copy(c.Writer, cidResp.Body)
-		c.Status(cidResp.StatusCode)
+	zapLogger, _ := zap.NewDevelopment()
+	var next filter.EnevelopeProcessor = pool
+	var dedup *deduplicator
+	if dedupWindow > 0 {
+		dedup = newDeduplicator(dedupWindow, dedupSize, pool)
+		next = dedup
+	}
+	dispatcher := &topicDispatcher{
+		topics:      topics,
+		pubsubTopic: pubsubTopic,
+		unmatched:   unmatched,
+		migration:   migration,
+		next:        next,
+	}
 
-	})
+	if metricsLogInterval > 0 {
+		go logMetrics(ctx, metricsLogInterval, c)
+	}
 
-	log.Fatal(r.Run("0.0.0.0:8080"))
-}
+	if registryURL != "" {
+		go reportToRegistry(ctx, registryURL, registryInterval, waku, c)
+	}
 
-func prom() {
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":8003", nil)
-}
+	go retryFlushes(ctx, persistRetryInterval, owners, c)
+	go reloadOnHangup(ctx, owners)
+	go watchPeers(ctx, waku, peerMetricsInterval)
 
-func getCodexUrl() string {
-	url := os.Getenv(envCodexApiUrl)
-	if url == "" {
-		url = "http://codex:8080"
+	go c.purgeExpired(ctx, ttlPurgeInterval, time.Now)
+
+	if keepAliveInterval > 0 {
+		go keepAlive(ctx, keepAliveInterval, repinMinAge, repinConcurrency, repinJitter, pool, c.backend, c.index, time.Now)
 	}
 
-	return url
-}
+	if c.retries != nil {
+		go c.retryPending(ctx, retryQueueDelay, time.Now)
+	}
 
-type Cache struct {
-}
+	if verifyInterval > 0 {
+		go verifySnapshots(ctx, verifyInterval, verifySample, verifyRehash, c.backend, c.index, time.Now)
+	}
 
-func (c *Cache) OnNewEnvelope(envelope *protocol.Envelope) error {
-	log.Println(envelope)
-	var err error
-	defer func() {
-		if err != nil {
-			snapFailure.Inc()
+	if memoryLimit > 0 {
+		// Queued envelopes are lost for good once shed, so they only go
+		// after the rebuildable state and only if enabled.
+		var shedders []shedder
+		if c.allowance != nil {
+			shedders = append(shedders, shedder{kind: shedAllowances, shed: c.allowance.Shed})
 		}
-	}()
-	log.Println(string(envelope.Message().Payload))
-	cr := &QakuMessage{}
-	err = json.Unmarshal(envelope.Message().Payload, cr)
-	if err != nil {
-		log.Println("failed to unmarshal: ", err)
-		return err
+		if dedup != nil {
+			shedders = append(shedders, shedder{kind: shedDuplicates, shed: dedup.Shed})
+		}
+		if bodies != nil {
+			shedders = append(shedders, shedder{kind: shedBodies, shed: bodies.Shed})
+		}
+		if memoryShedQueue {
+			shedders = append(shedders, shedder{kind: shedEnvelopes, shed: pool.Shed})
+		}
+		go watchMemory(ctx, uint64(memoryLimit), memoryCheckInterval, heapAlloc, shedders...)
+	}
+
+	if startupJitter > 0 {
+		delay := time.Duration(rand.Int63n(int64(startupJitter)))
+		logger.Info("delaying subscription", "delay", delay)
+		time.Sleep(delay)
 	}
 
-	url := getCodexUrl()
+	go waku.run(ctx, func(ctx context.Context, wn *node.WakuNode) {
+		fm := filter.NewFilterManager(ctx, zapLogger, 2, dispatcher, wn.FilterLightnode())
+
+		for _, cf := range cfs {
+			fm.SubscribeFilter(uuid.NewString(), cf)
+		}
+		migration.Subscribe(fm)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(3 * time.Second):
+		}
+
+		logger.Info("starting main loop")
+		for _, cf := range cfs {
+			fm.SubscribeFilter(uuid.NewString(), cf)
+		}
+		migration.Subscribe(fm)
+		if migration != nil {
+			go migration.run(ctx, fm)
+		}
+		if storeLookback > 0 {
+			go bootstrapFromStore(ctx, wn, cfs, storeLookback, dispatcher)
+		}
+	})
 
-	var manifestResp *http.Response
-	manifestResp, err = http.Get(fmt.Sprintf("%s/api/codex/v1/data/%s/network/manifest", url, cr.Payload.CID))
+	apiSrv := server(cfg.ListenAddr, tlsConfig, corsCfg, gzipMinSize, downloads, logger, c, pool, auth, waku, cfs)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	logger.Info("shutting down")
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer shutdownCancel()
+	shutdown(shutdownCtx, logger, apiSrv, metricsSrv, pool, c, func() {
+		// Stops the background jobs and detaches the Waku subscriptions.
+		cancel()
+		waku.Node().Stop()
+	})
+	logger.Info("shut down")
+}
+
+// shutdown stops the API from taking requests, drains the queued envelopes,
+// calls stop to end the background jobs and the Waku node, and then writes
+// out and closes the cache. Errors are logged, the remaining steps still run.
+func shutdown(ctx context.Context, logger *slog.Logger, apiSrv *http.Server, metricsSrv *http.Server, pool *workerPool, c *Cache, stop func()) {
+	err := apiSrv.Shutdown(ctx)
 	if err != nil {
-		log.Println("failed to fetch manifest", err)
-		return err
+		logger.Error("failed to shut down server", "error", err)
 	}
-	defer manifestResp.Body.Close()
-
-	if manifestResp.StatusCode != 200 {
-		err = fmt.Errorf("failed to fetch manifest")
-		log.Println("failed to fetch manifest", manifestResp.Status)
-		return err
+	err = pool.Stop(ctx)
+	if err != nil {
+		logger.Error("failed to stop workers", "error", err)
 	}
-
-	body, err := io.ReadAll(manifestResp.Body)
+	stop()
+	err = metricsSrv.Shutdown(ctx)
 	if err != nil {
-		log.Println("faild to read manifest data", err)
-		return err
+		logger.Error("failed to shut down metrics server", "error", err)
 	}
-
-	cdc := &CodexDataContent{}
-	err = json.Unmarshal(body, cdc)
+	err = c.Flush()
 	if err != nil {
-		log.Println("failed to unmarshal manifest: ", err)
-		return err
+		logger.Error("failed to flush cache", "error", err)
 	}
-
-	if cdc.Manifest.DatasetSize > maxDatasetSize {
-		log.Printf("dataset too big %d > %d", cdc.Manifest.DatasetSize, maxDatasetSize)
-		return err
+	err = c.Close()
+	if err != nil {
+		logger.Error("failed to close cache", "error", err)
 	}
+}
 
-	snapSizes.Observe(float64(cdc.Manifest.DatasetSize) / 1024)
+// server starts the API on addr and returns it so it can be shut down.
+func server(addr string, tlsConfig *tls.Config, corsCfg cors.Config, gzipMinSize int, downloads *downloadLimiter, logger *slog.Logger, cache *Cache, pool *workerPool, auth AdminAuthenticator, waku wakuNodes, cfs []protocol.ContentFilter) *http.Server {
+	r := gin.New()
+	admin := adminAuth(auth)
 
-	var resp *http.Response
-	resp, err = http.Post(fmt.Sprintf("%s/api/codex/v1/data/%s/network", url, cr.Payload.CID), "", nil)
-	if err != nil {
-		log.Println("failed to send request: ", err)
-		return err
-	}
+	r.Use(requestID())
+	r.Use(logRequests(logger))
+	r.Use(recoverPanics(logger))
+	r.Use(handleErrors())
 
-	if resp.StatusCode != 200 {
-		err = fmt.Errorf("request to Codex failed")
-		log.Println("request to Codex failed: ", resp.Status)
-		return err
-	}
+	r.Use(cors.New(corsCfg))
+	r.Use(gzipJSON(gzipMinSize))
 
-	snapSuccess.Inc()
+	r.GET("/healthz", func(c *gin.Context) {
+		resp := gin.H{"status": "ok"}
+		if failing := persistence.Status(); len(failing) > 0 {
+			resp["persistence"] = gin.H{"status": "degraded", "errors": failing}
+		} else {
+			resp["persistence"] = gin.H{"status": "ok"}
+		}
 
-	return nil
+		c.JSON(200, resp)
+	})
+
+	r.GET("/readyz", func(c *gin.Context) {
+		err := ready(c.Request.Context(), waku, cache.backend)
+		if err != nil {
+			c.JSON(503, gin.H{"status": "unavailable", "error": err.Error()})
+			return
+		}
+
+		c.JSON(200, gin.H{"status": "ok"})
+	})
+
+	r.GET("/api/qaku/v1/version", func(c *gin.Context) {
+		c.JSON(200, versionInfo())
+	})
+
+	r.GET("/api/qaku/v1/stats", func(c *gin.Context) {
+		c.JSON(200, collectSummary(cache))
+	})
+
+	r.GET("/api/qaku/v1/info", func(c *gin.Context) {
+		info, err := cache.backend.DebugInfo(c.Request.Context())
+		if err != nil {
+			logger.Error("failed to fetch Codex info", "error", err)
+			apiError(c, 502, err.Error())
+			return
+		}
+
+		addrs := info.AnnouncedAddrs
+		if addrs == nil {
+			addrs = []string{}
+		}
+
+		resp := gin.H{"peerId": info.ID, "addrs": addrs}
+		if addr, ok := selectAnnounceAddr(addrs, os.Getenv(envInfoAddrMatch)); ok {
+			resp["addr"] = addr
+		}
+
+		c.JSON(200, resp)
+	})
+
+	r.GET(snapshotRoute, func(c *gin.Context) {
+		cid := c.Param("cid")
+		logger.Debug("proxying snapshot", "cid", cid)
+
+		if !isValidCID(cid) {
+			apiError(c, 400, "invalid CID")
+			return
+		}
+
+		// Ranges of the encrypted data are useless for decryption, so
+		// encrypted snapshots are always served in full. The key is ignored
+		// for snapshots not cached as encrypted.
+		var snapshotKey cipher.Block
+		if keyHex := c.GetHeader(snapshotKeyHeader); keyHex != "" {
+			if e, ok := cache.index.Get(cid); ok && e.Encrypted {
+				block, err := parseSnapshotKey(keyHex)
+				if err != nil {
+					apiError(c, 400, err.Error())
+					return
+				}
+				snapshotKey = block
+			}
+		}
+		// Decrypted snapshots differ per key, only the stored bytes get a
+		// validator.
+		etag := snapshotETag(cid)
+		if snapshotKey == nil && etagMatches(c.GetHeader("If-None-Match"), etag) {
+			c.Header("ETag", etag)
+			c.Header("Cache-Control", snapshotCacheControl)
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		if !downloads.Acquire(c.Request.Context()) {
+			c.Header("Retry-After", retryAfterSeconds(downloadRetryAfter))
+			apiError(c, http.StatusServiceUnavailable, "too many concurrent downloads")
+			return
+		}
+		defer downloads.Release()
+
+		header := http.Header{}
+		if rng := c.GetHeader("Range"); rng != "" && snapshotKey == nil {
+			header.Set("Range", rng)
+		}
+
+		var cidResp *http.Response
+		cidResp, err := cache.backend.Download(c.Request.Context(), cid, header)
+		if err != nil {
+			logger.Error("failed to download snapshot", "cid", cid, "error", err)
+			apiError(c, 502, err.Error())
+			return
+		}
+		defer cidResp.Body.Close()
+
+		if cidResp.StatusCode == http.StatusNotFound && proxyRefetchTimeout > 0 && cache.index.Has(cid) {
+			cidResp.Body.Close()
+			logger.Warn("cached snapshot missing from the store, fetching it again", "cid", cid)
+			cidResp, err = refetchSnapshot(c.Request.Context(), cache.backend, cid, header)
+			if errors.Is(err, errSnapshotGone) {
+				logger.Error("cached snapshot is gone", "cid", cid, "error", err)
+				apiError(c, http.StatusNotFound, "snapshot is no longer available")
+				return
+			}
+			if err != nil {
+				logger.Warn("failed to fetch cached snapshot again", "cid", cid, "error", err)
+				c.Header("Retry-After", retryAfterSeconds(proxyRefetchTimeout))
+				apiError(c, http.StatusServiceUnavailable, "snapshot is being fetched again")
+				return
+			}
+			defer cidResp.Body.Close()
+		}
+
+		if cidResp.StatusCode == http.StatusNotFound && proxyPendingRetryAfter > 0 && snapshotPending(cache, cid) {
+			c.Header("Retry-After", retryAfterSeconds(proxyPendingRetryAfter))
+			c.JSON(http.StatusAccepted, gin.H{"cid": cid, "status": "fetching"})
+			return
+		}
+
+		var body io.Reader = countingReader{cidResp.Body}
+		if cidResp.Header.Get(bodyCacheHeader) != "" {
+			body = cidResp.Body
+		}
+		// The stored bytes are capped, decryption only makes them shorter.
+		sizeLimit := snapshotSizeLimit(c.Request.Context(), cache, cid)
+		if sizeLimit > 0 {
+			body = newCappedReader(body, sizeLimit)
+		}
+		if snapshotKey != nil {
+			body, err = decryptSnapshot(snapshotKey, body)
+			if err != nil {
+				logger.Error("failed to decrypt snapshot", "cid", cid, "error", err)
+				apiError(c, 502, err.Error())
+				return
+			}
+		}
+
+		if proxyMaxBytes > 0 {
+			body = newCappedReader(body, proxyMaxBytes)
+		}
+
+		// The headers have to be set before the status and the body are
+		// written. The length only holds while the body is passed through
+		// unchanged.
+		contentType := cidResp.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		c.Header("Content-Type", contentType)
+		if snapshotKey == nil {
+			for _, h := range []string{"Accept-Ranges", "Content-Range"} {
+				if v := cidResp.Header.Get(h); v != "" {
+					c.Header(h, v)
+				}
+			}
+			if l := cidResp.ContentLength; l >= 0 && (proxyMaxBytes == 0 || l <= proxyMaxBytes) && (sizeLimit == 0 || l <= sizeLimit) {
+				c.Header("Content-Length", strconv.FormatInt(l, 10))
+			}
+			if cidResp.StatusCode == 200 || cidResp.StatusCode == http.StatusPartialContent {
+				c.Header("ETag", etag)
+				c.Header("Cache-Control", snapshotCacheControl)
+			}
+		}
+		c.Status(cidResp.StatusCode)
+
+		n, err := io.Copy(c.Writer, body)
+		proxyBytesServed.Add(float64(n))
+		if err == nil && (cidResp.StatusCode == 200 || cidResp.StatusCode == http.StatusPartialContent) {
+			cache.index.Served(cid, time.Now())
+		}
+		if err != nil && c.Request.Context().Err() != nil {
+			logger.Debug("client went away while proxying snapshot", "cid", cid, "bytes", n)
+			c.Abort()
+			return
+		}
+		if errors.Is(err, errSnapshotTooLarge) {
+			snapProxyAborted.Inc()
+			logger.Error("aborted proxying snapshot", "cid", cid, "error", err, "limit", proxyMaxBytes, "sizeLimit", sizeLimit)
+			c.Abort()
+			return
+		}
+	})
+
+	r.HEAD("/api/qaku/v1/snapshot/:cid", func(c *gin.Context) {
+		e, ok := cache.index.Get(c.Param("cid"))
+		if !ok {
+			c.Status(404)
+			return
+		}
+
+		c.Header("Content-Type", "application/octet-stream")
+		c.Header("Content-Length", strconv.Itoa(e.Size))
+		c.Header("ETag", snapshotETag(e.CID))
+		c.Header("Cache-Control", snapshotCacheControl)
+		c.Status(200)
+	})
+
+	r.DELETE("/api/qaku/v1/snapshot/:cid", admin, func(c *gin.Context) {
+		e, ok := cache.index.Get(c.Param("cid"))
+		if !ok {
+			apiError(c, 404, "snapshot not cached")
+			return
+		}
+
+		err := cache.evict(c.Request.Context(), e, evictAdmin)
+		if err != nil {
+			logger.Error("failed to delete snapshot", "cid", e.CID, "error", err)
+			apiError(c, 502, err.Error())
+			return
+		}
+
+		c.Status(204)
+	})
+
+	r.GET("/api/qaku/v1/snapshots", func(c *gin.Context) {
+		limit, offset, err := parsePage(c)
+		if err != nil {
+			apiError(c, 400, err.Error())
+			return
+		}
+
+		c.JSON(200, listSnapshots(cache.index.Entries(), c.Query("owner"), limit, offset))
+	})
+
+	r.GET("/api/qaku/v1/exists", func(c *gin.Context) {
+		cid, hash := c.Query("cid"), c.Query("hash")
+		if cid == "" && hash == "" {
+			apiError(c, 400, "cid or hash is required")
+			return
+		}
+		if cid != "" && !isValidCID(cid) {
+			apiError(c, 400, "invalid CID")
+			return
+		}
+
+		c.JSON(200, snapshotExists(cache.index, cid, hash))
+	})
+
+	r.GET("/api/qaku/v1/snapshot/:cid/info", func(c *gin.Context) {
+		meta, err := snapshotMeta(c.Request.Context(), cache.backend, cache.index, c.Param("cid"))
+		if err != nil {
+			logger.Debug("snapshot not found", "cid", c.Param("cid"), "error", err)
+			apiError(c, 404, "snapshot not found")
+			return
+		}
+
+		c.JSON(200, meta)
+	})
+
+	r.GET("/api/qaku/v1/manifest/:cid", func(c *gin.Context) {
+		cdc, err := cache.backend.FetchManifest(c.Request.Context(), c.Param("cid"))
+		if err != nil {
+			logger.Error("failed to fetch manifest", "cid", c.Param("cid"), "error", err)
+			apiError(c, 502, err.Error())
+			return
+		}
+
+		if manifestFormat(c.Query("format"), c.GetHeader("Accept")) == mimeCBOR {
+			data, err := encodeCBOR(cdc)
+			if err != nil {
+				apiError(c, 500, err.Error())
+				return
+			}
+
+			c.Data(200, mimeCBOR, data)
+			return
+		}
+
+		c.JSON(200, cdc)
+	})
+
+	r.POST("/api/qaku/v1/selftest", admin, func(c *gin.Context) {
+		res := selfTest(c.Request.Context(), cache.backend, time.Now)
+		if !res.OK {
+			logger.Warn("self-test failed", "steps", res.Steps)
+			c.JSON(502, res)
+			return
+		}
+
+		c.JSON(200, res)
+	})
+
+	r.GET("/api/qaku/v1/debug/node", admin, func(c *gin.Context) {
+		c.JSON(200, nodeInfo(waku.Node(), cfs))
+	})
+
+	r.GET("/api/qaku/v1/workers", admin, func(c *gin.Context) {
+		type WorkersResponse struct {
+			PoolStats
+			InFlight []InFlightJob `json:"inFlight"`
+		}
+
+		c.JSON(200, WorkersResponse{PoolStats: pool.Stats(), InFlight: cache.InFlight()})
+	})
+
+	r.POST("/api/qaku/v1/cache", admin, func(c *gin.Context) {
+		req := CacheRequest{}
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			apiError(c, 400, err.Error())
+			return
+		}
+		if !isValidCID(req.CID) {
+			apiError(c, 400, "invalid CID")
+			return
+		}
+
+		// The job would bypass the check in OnNewEnvelope.
+		if cache.maintenance.On() {
+			snapMaintenanceSkipped.Inc()
+			apiError(c, 503, "maintenance mode is on")
+			return
+		}
+
+		audit("cache_manual", map[string]any{"cid": req.CID, "owner": req.Owner, "remote": c.ClientIP()})
+		cr := &QakuMessage{Type: cacheMessageType, Payload: req}
+		// Manual requests queue with the Waku envelopes in the worker pool,
+		// so the worker limit and the manual priority apply to them too. The
+		// job keeps running if the client goes away, like an envelope would.
+		type outcome struct {
+			result string
+			err    error
+		}
+		ctx := context.WithoutCancel(c.Request.Context())
+		done := make(chan outcome, 1)
+		queued := pool.SubmitJob(poolJob{
+			run: func() {
+				result, err := cache.process(ctx, cr, time.Now(), 0)
+				done <- outcome{result, err}
+			},
+			dropped: func() { done <- outcome{err: errQueueDropped} },
+		}, sourceManual)
+		if !queued {
+			apiError(c, 503, errQueueFull.Error())
+			return
+		}
+
+		var o outcome
+		select {
+		case o = <-done:
+		case <-c.Request.Context().Done():
+			// Only the client stopped waiting, the job still runs.
+			apiError(c, 503, c.Request.Context().Err().Error())
+			return
+		}
+		if errors.Is(o.err, errQueueDropped) {
+			apiError(c, 503, o.err.Error())
+			return
+		}
+		if o.err != nil {
+			c.AbortWithStatusJSON(502, gin.H{"error": newAPIError(c, 502, o.err.Error()), "cid": req.CID, "result": o.result})
+			return
+		}
+
+		c.JSON(200, gin.H{"cid": req.CID, "result": o.result})
+	})
+
+	r.POST("/api/qaku/v1/cancel/:cid", admin, func(c *gin.Context) {
+		cid := c.Param("cid")
+		cancelled := cache.Cancel(cid)
+		if cancelled {
+			logger.Info("cancelled in-flight cache", "cid", cid)
+			audit("cache_cancel", map[string]any{"cid": cid, "remote": c.ClientIP()})
+		}
+
+		c.JSON(200, gin.H{"cid": cid, "cancelled": cancelled})
+	})
+
+	r.GET("/api/qaku/v1/owners", admin, func(c *gin.Context) {
+		c.JSON(200, ownerSummaries(cache.activity.LastSeen(), cache.index.Entries()))
+	})
+
+	r.GET("/api/qaku/v1/owners/lists", admin, func(c *gin.Context) {
+		c.JSON(200, cache.owners.Snapshot())
+	})
+
+	r.POST("/api/qaku/v1/owners/lists/:list/:owner", admin, func(c *gin.Context) {
+		list, owner := c.Param("list"), c.Param("owner")
+
+		err := cache.owners.Add(list, owner)
+		if err != nil {
+			apiError(c, 400, err.Error())
+			return
+		}
+
+		audit("owner_list_add", map[string]any{"list": list, "owner": owner, "remote": c.ClientIP()})
+		c.JSON(200, cache.owners.Snapshot())
+	})
+
+	r.DELETE("/api/qaku/v1/owners/lists/:list/:owner", admin, func(c *gin.Context) {
+		list, owner := c.Param("list"), c.Param("owner")
+
+		removed, err := cache.owners.Remove(list, owner)
+		if errors.Is(err, errOwnerFixed) {
+			apiError(c, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			apiError(c, 400, err.Error())
+			return
+		}
+		if !removed {
+			apiError(c, 404, "owner not listed")
+			return
+		}
+
+		audit("owner_list_remove", map[string]any{"list": list, "owner": owner, "remote": c.ClientIP()})
+		c.JSON(200, cache.owners.Snapshot())
+	})
+
+	r.GET("/api/qaku/v1/metrics", admin, func(c *gin.Context) {
+		snap, err := metricsSnapshot()
+		if err != nil {
+			apiError(c, 500, err.Error())
+			return
+		}
+
+		c.JSON(200, snap)
+	})
+
+	r.GET("/api/qaku/v1/entries", admin, func(c *gin.Context) {
+		q, err := parseEntryQuery(c)
+		if err != nil {
+			apiError(c, 400, err.Error())
+			return
+		}
+
+		c.JSON(200, cache.index.Query(q))
+	})
+
+	protect := func(protected bool) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			cid := c.Param("cid")
+			if !cache.index.SetProtected(cid, protected) {
+				apiError(c, 404, "entry not found")
+				return
+			}
+
+			audit("entry_protect", map[string]any{"cid": cid, "protected": protected, "remote": c.ClientIP()})
+			c.JSON(200, gin.H{"cid": cid, "protected": protected})
+		}
+	}
+	r.POST("/api/qaku/v1/entries/:cid/protect", admin, protect(true))
+	r.DELETE("/api/qaku/v1/entries/:cid/protect", admin, protect(false))
+
+	r.PUT("/api/qaku/v1/config/max-size", admin, func(c *gin.Context) {
+		req := MaxSizeRequest{}
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			apiError(c, 400, err.Error())
+			return
+		}
+		if req.Bytes <= 0 {
+			apiError(c, 400, fmt.Sprintf("bytes must be positive, got %d", req.Bytes))
+			return
+		}
+
+		previous := datasetSizeLimit()
+		maxDatasetSize.Store(int64(req.Bytes))
+		audit("max_size", map[string]any{"bytes": req.Bytes, "previous": previous, "remote": c.ClientIP()})
+		logger.Info("max dataset size changed", "bytes", req.Bytes, "previous", previous)
+		c.JSON(200, gin.H{"bytes": req.Bytes})
+	})
+
+	r.POST("/api/qaku/v1/maintenance", admin, func(c *gin.Context) {
+		req := MaintenanceRequest{}
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			apiError(c, 400, err.Error())
+			return
+		}
+
+		persistence.Report("maintenance mode", cache.maintenance.Set(req.Enabled))
+
+		audit("maintenance", map[string]any{"enabled": req.Enabled, "remote": c.ClientIP()})
+		logger.Info("maintenance mode switched", "enabled", req.Enabled)
+		c.JSON(200, gin.H{"maintenance": req.Enabled})
+	})
+
+	r.GET("/api/qaku/v1/deadletters", admin, func(c *gin.Context) {
+		if cache.deadLetters == nil {
+			apiError(c, 404, "dead-letter log disabled")
+			return
+		}
+
+		c.JSON(200, cache.deadLetters.List(c.Query("reason")))
+	})
+
+	srv := &http.Server{Addr: addr, Handler: r, TLSConfig: tlsConfig}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("API server failed", "error", err)
+		}
+	}()
+
+	return srv
+}
+
+// parseEntryQuery reads the entry listing parameters: sort (cid or size),
+// order (asc or desc), minSize and maxSize in bytes.
+func parseEntryQuery(c *gin.Context) (entryQuery, error) {
+	q := entryQuery{}
+
+	switch c.DefaultQuery("sort", "cid") {
+	case "cid":
+	case "size":
+		q.SortBySize = true
+	default:
+		return q, fmt.Errorf("invalid sort %q, expected cid or size", c.Query("sort"))
+	}
+
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("invalid order %q, expected asc or desc", c.Query("order"))
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"minSize", &q.MinSize}, {"maxSize", &q.MaxSize}} {
+		v := c.Query(p.name)
+		if v == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid %s %q", p.name, v)
+		}
+		*p.dst = n
+	}
+
+	if q.MaxSize > 0 && q.MinSize > q.MaxSize {
+		return q, fmt.Errorf("minSize %d is larger than maxSize %d", q.MinSize, q.MaxSize)
+	}
+
+	return q, nil
+}
+
+// ready reports why the cache cannot serve yet: no envelopes are dispatched,
+// the Waku node has no connected peers or Codex does not answer its debug
+// info endpoint.
+func ready(ctx context.Context, waku wakuNodes, backend Backend) error {
+	if !waku.Up() {
+		return fmt.Errorf("not dispatching Waku envelopes")
+	}
+	if waku.Node().PeerCount() == 0 {
+		return fmt.Errorf("no connected Waku peers")
+	}
+
+	_, err := backend.DebugInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("Codex unhealthy: %w", err)
+	}
+
+	return nil
+}
+
+// SnapshotInfo is the public view of a cached snapshot.
+type SnapshotInfo struct {
+	CID      string    `json:"cid"`
+	Owner    string    `json:"owner"`
+	Hash     string    `json:"hash"`
+	Size     int       `json:"size"`
+	CachedAt time.Time `json:"cachedAt"`
+	Degraded bool      `json:"degraded,omitempty"`
+}
+
+// SnapshotMeta describes a snapshot without downloading it. Protected is the
+// eviction protection of a cached entry, or the manifest flag otherwise.
+type SnapshotMeta struct {
+	CID       string     `json:"cid"`
+	Size      int        `json:"size"`
+	Cached    bool       `json:"cached"`
+	CachedAt  *time.Time `json:"cachedAt,omitempty"`
+	Protected bool       `json:"protected"`
+}
+
+// snapshotMeta answers from the index and falls back to the Codex manifest
+// for CIDs we do not cache.
+func snapshotMeta(ctx context.Context, backend Backend, index *cacheIndex, cid string) (SnapshotMeta, error) {
+	if e, ok := index.Get(cid); ok {
+		return SnapshotMeta{CID: e.CID, Size: e.Size, Cached: true, CachedAt: &e.CachedAt, Protected: e.Protected}, nil
+	}
+
+	cdc, err := backend.FetchManifest(ctx, cid)
+	if err != nil {
+		return SnapshotMeta{}, err
+	}
+
+	return SnapshotMeta{CID: cid, Size: cdc.Manifest.DatasetSize, Protected: cdc.Manifest.Protected}, nil
+}
+
+// SnapshotExists answers whether a snapshot is cached, CID and CachedAt are
+// only set if it is.
+type SnapshotExists struct {
+	Cached   bool       `json:"cached"`
+	CID      string     `json:"cid,omitempty"`
+	CachedAt *time.Time `json:"cachedAt,omitempty"`
+}
+
+// snapshotExists looks the snapshot up by CID and then by content hash, it
+// only consults the index.
+func snapshotExists(index *cacheIndex, cid string, hash string) SnapshotExists {
+	e, ok := index.Get(cid)
+	if !ok && hash != "" {
+		e, ok = index.ByHash(hash)
+	}
+	if !ok {
+		return SnapshotExists{}
+	}
+
+	return SnapshotExists{Cached: true, CID: e.CID, CachedAt: &e.CachedAt}
+}
+
+// listSnapshots returns a page of the entries, optionally only those of
+// owner. A zero limit returns all remaining entries.
+func listSnapshots(entries []CacheEntry, owner string, limit int, offset int) []SnapshotInfo {
+	snapshots := []SnapshotInfo{}
+	for _, e := range entries {
+		if owner != "" && e.Owner != owner {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if limit > 0 && len(snapshots) == limit {
+			break
+		}
+
+		snapshots = append(snapshots, SnapshotInfo{CID: e.CID, Owner: e.Owner, Hash: e.Hash, Size: e.Size, CachedAt: e.CachedAt, Degraded: e.Degraded})
+	}
+
+	return snapshots
+}
+
+// parsePage reads the limit and offset pagination parameters.
+func parsePage(c *gin.Context) (int, int, error) {
+	page := [2]int{}
+	for i, name := range []string{"limit", "offset"} {
+		v := c.Query(name)
+		if v == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid %s %q", name, v)
+		}
+		page[i] = n
+	}
+
+	return page[0], page[1], nil
+}
+
+// requestID attaches the caller's X-Request-ID (or a fresh one) to the request
+// context so it is forwarded to Codex, and echoes it in the response. The
+// inbound header is always X-Request-ID, QAKU_CACHE_CODEX_REQUEST_ID_HEADER
+// only names the one sent to Codex.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(defaultRequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), id))
+		c.Header(defaultRequestIDHeader, id)
+
+		c.Next()
+	}
+}
+
+// adminAuth guards operator endpoints with the configured authenticator. A
+// nil authenticator means no admin credentials are set and the endpoints are
+// disabled.
+func adminAuth(auth AdminAuthenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if auth == nil {
+			apiError(c, 403, "admin API disabled")
+			return
+		}
+
+		err := auth.Authenticate(c.Request)
+		if err != nil {
+			audit("admin_auth_failure", map[string]any{"path": c.Request.URL.Path, "error": err.Error(), "remote": c.ClientIP()})
+			apiError(c, 401, err.Error())
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// prom starts the Prometheus endpoint on addr and returns it so it can be
+// shut down.
+func prom(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "error", err)
+		}
+	}()
+
+	return srv
+}
+
+// codexURL is the base URL of the Codex REST API.
+var codexURL = defaultCodexURL
+
+func getCodexUrl() string {
+	return codexURL
+}
+
+type Cache struct {
+	mu       sync.Mutex
+	inFlight map[string]*InFlightJob
+	owners   *ownerLists
+	index    *cacheIndex
+	activity *ownerActivity
+	// maintenance pauses caching of new datasets.
+	maintenance *maintenanceMode
+	// retries holds requests that failed because Codex was unreachable, nil
+	// if they are not retried.
+	retries *retryQueue
+	retryDB retryStore
+
+	maxVersions int
+	strictJSON  bool
+	freshness   freshness
+	// requireProtected rejects datasets without erasure coding.
+	requireProtected bool
+	// dryRun accepts requests without fetching or indexing the datasets.
+	dryRun bool
+	// signers drops messages of other signers before any verification.
+	signers signerAllowlist
+	// invalidateTopic matches the content topic of invalidation messages,
+	// nil if disabled.
+	invalidateTopic topicMatcher
+	// payloadKey decrypts symmetrically encrypted messages, nil if they are
+	// plaintext.
+	payloadKey []byte
+	ttl        ttlPolicy
+	sizeLimits sizePolicy
+
+	// totalSize caps the summed size of all cached datasets, 0 disables it.
+	totalSize     int64
+	evictionGrace time.Duration
+	budgetMu      sync.Mutex
+	// reserved counts bytes handed out by makeRoom that are not indexed yet.
+	reserved int64
+	// evicting holds the entries makeRoom is unpinning, which still count in
+	// the index but are already promised to a reservation.
+	evicting      map[string]bool
+	evictingBytes int64
+
+	validator   SnapshotValidator
+	rateLimiter *ownerRateLimiter
+	allowance   *allowanceChecker
+	// ownerQuota caps the cached bytes per owner, 0 disables it.
+	ownerQuota int64
+	quotaMu    sync.Mutex
+	// ownerReserved counts bytes per owner handed out by reserveOwnerQuota
+	// that are not indexed yet.
+	ownerReserved map[string]int64
+
+	manifestRetries    int
+	manifestRetryDelay time.Duration
+
+	backend Backend
+
+	deadLetters    *deadLetterLog
+	webhook        *webhook
+	announcer      *announcer
+	confirmer      *pinConfirmer
+	confirmTimeout time.Duration
+
+	logger *slog.Logger
+}
+
+type InFlightJob struct {
+	CID       string    `json:"cid"`
+	Owner     string    `json:"owner"`
+	StartedAt time.Time `json:"startedAt"`
+
+	cancel context.CancelFunc
+}
+
+// NewCache returns a cache that records cached CIDs in a bbolt database at
+// path, or only in memory if path is empty. A database that cannot be opened
+// does not fail the cache, it runs in memory until the database opens.
+func NewCache(path string) (*Cache, error) {
+	var store indexStore
+	var activityDB activityStore
+	var settingsDB maintenanceStore
+	var retryDB retryStore
+	if path != "" {
+		bs, err := openBoltIndexStore(path)
+		if err != nil {
+			// The index picks the database up once it opens, the rest of
+			// the state stays in memory until the next start.
+			slog.Warn("cache database unavailable, running in memory", "path", path, "error", err)
+			store = &reopeningBoltStore{path: path}
+		} else {
+			store = bs
+			activityDB = bs
+			settingsDB = bs
+			retryDB = bs
+		}
+	}
+
+	index, err := loadCacheIndex(store)
+	if err != nil {
+		if store != nil {
+			store.Close()
+		}
+		return nil, err
+	}
+
+	activity, err := loadOwnerActivity(activityDB)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+
+	maintenance, err := loadMaintenanceMode(settingsDB)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+
+	return &Cache{
+		inFlight:    make(map[string]*InFlightJob),
+		index:       index,
+		activity:    activity,
+		maintenance: maintenance,
+		retryDB:     retryDB,
+		logger:      slog.Default(),
+		backend:     newCodexBackend(getCodexUrl()),
+	}, nil
+}
+
+// Flush writes the index changes that are only kept in memory, like serve
+// times and saves that failed, and syncs the dead-letter file.
+func (c *Cache) Flush() error {
+	return errors.Join(c.index.Flush(), c.deadLetters.Sync())
+}
+
+// Close flushes and closes the persistent store.
+func (c *Cache) Close() error {
+	return c.index.Close()
+}
+
+// begin registers an in-flight job for the CID and returns a context which
+// is cancelled when the job is cancelled via the admin API. It returns false
+// without registering anything if the CID is already being processed.
+func (c *Cache) begin(ctx context.Context, cr CacheRequest) (context.Context, *InFlightJob, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.inFlight[cr.CID]; ok {
+		return ctx, nil, false
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	job := &InFlightJob{CID: cr.CID, Owner: cr.Owner, StartedAt: time.Now(), cancel: cancel}
+	c.inFlight[cr.CID] = job
+
+	return ctx, job, true
+}
+
+func (c *Cache) end(job *InFlightJob) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	job.cancel()
+	if c.inFlight[job.CID] == job {
+		delete(c.inFlight, job.CID)
+	}
+}
+
+// Cancel aborts the in-flight job for the CID and reports whether there was one.
+func (c *Cache) Cancel(cid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	job, ok := c.inFlight[cid]
+	if !ok {
+		return false
+	}
+
+	job.cancel()
+	delete(c.inFlight, cid)
+
+	return true
+}
+
+// InFlight returns the jobs currently being processed, oldest first.
+func (c *Cache) InFlight() []InFlightJob {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	jobs := []InFlightJob{}
+	for _, j := range c.inFlight {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].StartedAt.Before(jobs[k].StartedAt) })
+
+	return jobs
+}
+
+func (c *Cache) OnNewEnvelope(envelope *protocol.Envelope) error {
+	start := time.Now()
+	ctx := withRequestID(context.Background(), newRequestID())
+	logger := c.logger.With("request", requestIDFrom(ctx))
+	logger.Debug("received envelope", "envelope", envelope.Hash(), "pubsubTopic", envelope.PubsubTopic(), "contentTopic", envelope.Message().ContentTopic)
+	var err error
+	// reason labels the failure metric, set by each step that fails.
+	reason := "other"
+	defer func() { countFailure(err, false, reason) }()
+	if c.maintenance.On() {
+		snapMaintenanceSkipped.Inc()
+		logger.Debug("skipping message in maintenance mode")
+		return nil
+	}
+	var data []byte
+	data, err = messagePayload(envelope.Message(), c.payloadKey)
+	if err != nil {
+		snapPayloadDecryptFailed.Inc()
+		logger.Warn("rejecting message", "error", err)
+		reason = "decrypt"
+		c.deadLetters.Add("decrypt", nil, err)
+		return err
+	}
+	logger.Debug("envelope payload", "payload", string(data))
+	if c.invalidateTopic.Match(envelope.Message().ContentTopic) {
+		// Invalidations count their own outcomes.
+		return c.onInvalidate(ctx, data)
+	}
+	var cr *QakuMessage
+	cr, err = decodeMessage(data, c.strictJSON)
+	if errors.Is(err, errStrictJSON) {
+		snapStrictRejected.Inc()
+		logger.Warn("rejecting message", "error", err)
+		reason = "strict_json"
+		c.deadLetters.Add("strict_json", nil, err)
+		return err
+	}
+	if err != nil {
+		snapUnmarshalErrors.Inc()
+		logger.Warn("failed to unmarshal message", "error", err)
+		reason = "unmarshal"
+		c.deadLetters.Add("unmarshal", nil, err)
+		return err
+	}
+
+	if cr.Type != cacheMessageType {
+		snapIgnoredType.Inc()
+		logger.Debug("ignoring message", "type", cr.Type, "cid", cr.Payload.CID)
+		return nil
+	}
+
+	if !c.signers.Allowed(cr.Signer) {
+		snapSignerFiltered.Inc()
+		logger.Debug("ignoring message of unlisted signer", "signer", cr.Signer, "cid", cr.Payload.CID)
+		return nil
+	}
+
+	if cr.Payload.CID == "" && len(cr.Payload.Batch) == 0 {
+		err = errMissingCID
+		snapInvalidRequest.Inc()
+		logger.Warn("rejecting message", "owner", cr.Payload.Owner, "error", err)
+		reason = "invalid_request"
+		c.deadLetters.Add("invalid_request", cr, err)
+		return err
+	}
+
+	err = checkCIDs(cr.Payload)
+	if err != nil {
+		snapInvalidCID.Inc()
+		logger.Warn("rejecting message", "owner", cr.Payload.Owner, "error", err)
+		reason = "invalid_cid"
+		c.deadLetters.Add("invalid_cid", cr, err)
+		return err
+	}
+
+	err = c.freshness.Check(cr.Timestamp, time.Now())
+	if err != nil {
+		snapStale.Inc()
+		logger.Warn("rejecting message", "cid", cr.Payload.CID, "owner", cr.Payload.Owner, "error", err)
+		reason = "stale"
+		c.deadLetters.Add("stale", cr, err)
+		return err
+	}
+
+	err = verifySignature(cr)
+	if err != nil {
+		logger.Warn("rejecting message", "cid", cr.Payload.CID, "owner", cr.Payload.Owner, "error", err)
+		audit("signature_failure", map[string]any{"cid": cr.Payload.CID, "owner": cr.Payload.Owner, "signer": cr.Signer, "error": err.Error()})
+		reason = "signature"
+		c.deadLetters.Add("signature", cr, err)
+		return err
+	}
+
+	err = verifyOwner(cr, ownerDerivation)
+	if err != nil {
+		snapOwnerMismatch.Inc()
+		logger.Warn("rejecting message", "cid", cr.Payload.CID, "owner", cr.Payload.Owner, "error", err)
+		audit("owner_mismatch", map[string]any{"cid": cr.Payload.CID, "owner": cr.Payload.Owner, "signer": cr.Signer, "error": err.Error()})
+		reason = "owner_mismatch"
+		c.deadLetters.Add("owner_mismatch", cr, err)
+		return err
+	}
+
+	seenAt := time.UnixMilli(int64(cr.Timestamp))
+	if cr.Timestamp == 0 {
+		seenAt = time.Now()
+	}
+	c.activity.Seen(cr.Payload.Owner, seenAt)
+
+	// The caching steps count their own failures.
+	if len(cr.Payload.Batch) > 0 {
+		return c.processBatch(ctx, cr, start)
+	}
+	_, perr := c.process(ctx, cr, start, 0)
+	return perr
+}
+
+// Results of processing a cache request.
+const (
+	resultCached        = "cached"
+	resultOwnerDenied   = "owner_denied"
+	resultAlreadyCached = "already_cached"
+	resultRateLimited   = "rate_limited"
+	resultInFlight      = "in_flight"
+	resultFailed        = "failed"
+	resultDryRun        = "dry_run"
+)
+
+// countFailure updates the failure metrics if err is set, cancellations are
+// counted on their own.
+func countFailure(err error, cancelled bool, reason string) {
+	if err == nil {
+		return
+	}
+	if cancelled {
+		snapCancelled.Inc()
+		return
+	}
+	snapFailureReason.WithLabelValues(reason).Inc()
+	// Malformed messages have their own counters and would drown the
+	// failures to cache a valid request.
+	if reason == "unmarshal" || reason == "invalid_request" {
+		return
+	}
+	snapFailure.Inc()
+}
+
+// process caches the dataset of an accepted request: it checks the manifest
+// against the limits, has Codex fetch the dataset and verifies it. A positive
+// budget additionally caps the dataset size for batch requests.
+func (c *Cache) process(ctx context.Context, cr *QakuMessage, start time.Time, budget int) (string, error) {
+	logger := c.logger.With("request", requestIDFrom(ctx))
+	var err error
+	// cancelled is recorded before end cancels the job context.
+	cancelled := false
+	// reason labels the failure metric, set by each step that fails.
+	reason := "other"
+	defer func() { countFailure(err, cancelled, reason) }()
+
+	if !c.owners.Allowed(cr.Payload.Owner) {
+		snapOwnerDenied.Inc()
+		audit("owner_denied", map[string]any{"cid": cr.Payload.CID, "owner": cr.Payload.Owner})
+		logger.Info("owner not allowed, skipping", "cid", cr.Payload.CID, "owner", cr.Payload.Owner)
+		return resultOwnerDenied, nil
+	}
+
+	if c.index.Has(cr.Payload.CID) {
+		snapAlreadyCached.Inc()
+		logger.Info("already cached, skipping", "cid", cr.Payload.CID)
+		return resultAlreadyCached, nil
+	}
+
+	// Stored hashes were verified when hashing is enabled, so a request for
+	// the same content under another CID would only pin it twice.
+	if newContentHasher != nil && cr.Payload.Hash != "" {
+		if e, ok := c.index.ByHash(cr.Payload.Hash); ok {
+			snapDedupByHash.Inc()
+			logger.Info("same content already cached, skipping", "cid", cr.Payload.CID, "cachedCid", e.CID, "hash", cr.Payload.Hash)
+			return resultAlreadyCached, nil
+		}
+	}
+
+	if !c.rateLimiter.Allow(cr.Payload.Owner, time.Now()) {
+		logger.Debug("owner is over the rate limit, skipping", "cid", cr.Payload.CID, "owner", cr.Payload.Owner)
+		return resultRateLimited, nil
+	}
+
+	ctx, job, ok := c.begin(ctx, cr.Payload)
+	if !ok {
+		snapInFlightDuplicate.Inc()
+		logger.Info("already being cached, skipping", "cid", cr.Payload.CID)
+		return resultInFlight, nil
+	}
+	defer func() {
+		cancelled = errors.Is(ctx.Err(), context.Canceled)
+		c.end(job)
+	}()
+
+	logger.Info("processing cache request", "cid", cr.Payload.CID, "owner", cr.Payload.Owner)
+
+	var cdc *CodexDataContent
+	defer func() {
+		e := WebhookEvent{CID: cr.Payload.CID, Owner: cr.Payload.Owner, Outcome: outcomeSuccess}
+		if cdc != nil {
+			e.Size = cdc.Manifest.DatasetSize
+		}
+		if err != nil {
+			e.Outcome = outcomeFailure
+			if errors.Is(ctx.Err(), context.Canceled) {
+				e.Outcome = outcomeCancelled
+			}
+			e.Error = err.Error()
+			e.Reason = reason
+		}
+		snapDuration.WithLabelValues(e.Outcome).Observe(time.Since(start).Seconds())
+		c.logger.Info("processed cache request", "request", requestIDFrom(ctx), "cid", e.CID, "owner", e.Owner, "size", e.Size, "outcome", e.Outcome)
+		c.webhook.Notify(e)
+	}()
+
+	manifestStart := time.Now()
+	cdc, err = fetchCompleteManifest(ctx, c.backend, cr.Payload.CID, c.manifestRetries, c.manifestRetryDelay)
+	manifestFetchDuration.Observe(time.Since(manifestStart).Seconds())
+	if errors.Is(err, errIncompleteManifest) {
+		logger.Warn("incomplete manifest", "cid", cr.Payload.CID, "error", err)
+		reason = "incomplete_manifest"
+		c.deadLetters.Add("incomplete_manifest", cr, err)
+		return resultFailed, err
+	}
+	if err != nil {
+		reason = "manifest"
+		logger.Error("failed to fetch manifest", "cid", cr.Payload.CID, "error", err)
+		if unreachable(err) {
+			c.retries.Failed(cr, err, time.Now())
+		}
+		return resultFailed, err
+	}
+
+	protected := strconv.FormatBool(cdc.Manifest.Protected)
+	snapSizeBytes.WithLabelValues(protected).Observe(float64(cdc.Manifest.DatasetSize))
+
+	maxSize := c.sizeLimits.For(cr.Payload.Owner)
+	if cdc.Manifest.DatasetSize > maxSize {
+		err = fmt.Errorf("dataset too big: %d > %d", cdc.Manifest.DatasetSize, maxSize)
+		snapRejectedOversized.Inc()
+		logger.Warn("rejecting oversized dataset", "cid", cr.Payload.CID, "size", cdc.Manifest.DatasetSize, "error", err)
+		reason = "oversized"
+		c.deadLetters.Add("oversized", cr, err)
+		return resultFailed, err
+	}
+
+	if c.requireProtected && !cdc.Manifest.Protected {
+		err = fmt.Errorf("dataset is not protected")
+		snapUnprotectedRejected.Inc()
+		logger.Warn("rejecting unprotected dataset", "cid", cr.Payload.CID, "error", err)
+		reason = "unprotected"
+		c.deadLetters.Add("unprotected", cr, err)
+		return resultFailed, err
+	}
+
+	if budget > 0 && cdc.Manifest.DatasetSize > budget {
+		err = fmt.Errorf("%w: %d > %d remaining", errBatchCap, cdc.Manifest.DatasetSize, budget)
+		logger.Warn("rejecting batch item", "cid", cr.Payload.CID, "size", cdc.Manifest.DatasetSize, "error", err)
+		reason = "batch_cap"
+		c.deadLetters.Add("batch_cap", cr, err)
+		return resultFailed, err
+	}
+
+	err = c.allowance.Check(ctx, cr.Payload.Owner, cdc.Manifest.DatasetSize)
+	if err != nil {
+		logger.Warn("owner allowance exceeded", "cid", cr.Payload.CID, "owner", cr.Payload.Owner, "size", cdc.Manifest.DatasetSize, "error", err)
+		reason = "allowance"
+		c.deadLetters.Add("allowance", cr, err)
+		return resultFailed, err
+	}
+
+	releaseQuota, err := c.reserveOwnerQuota(cr.Payload.Owner, cdc.Manifest.DatasetSize)
+	if err != nil {
+		snapOwnerQuotaExceeded.Inc()
+		logger.Warn("owner quota exceeded", "cid", cr.Payload.CID, "owner", cr.Payload.Owner, "size", cdc.Manifest.DatasetSize, "error", err)
+		reason = "owner_quota"
+		c.deadLetters.Add("owner_quota", cr, err)
+		return resultFailed, err
+	}
+	defer releaseQuota()
+
+	err = validateBlockSize(cdc.Manifest.BlockSize)
+	if err != nil {
+		snapBlockSizeRejected.Inc()
+		logger.Warn("rejecting manifest", "cid", cr.Payload.CID, "error", err)
+		reason = "block_size"
+		c.deadLetters.Add("block_size", cr, err)
+		return resultFailed, err
+	}
+
+	err = validateBlockCount(cdc.Manifest.DatasetSize, cdc.Manifest.BlockSize)
+	if err != nil {
+		snapTooManyBlocks.Inc()
+		logger.Warn("rejecting manifest", "cid", cr.Payload.CID, "error", err)
+		reason = "block_count"
+		c.deadLetters.Add("block_count", cr, err)
+		return resultFailed, err
+	}
+
+	if c.dryRun {
+		snapWouldCacheBytes.Add(float64(cdc.Manifest.DatasetSize))
+		logger.Info("would cache dataset", "cid", cr.Payload.CID, "owner", cr.Payload.Owner, "size", cdc.Manifest.DatasetSize)
+		return resultDryRun, nil
+	}
+
+	release, err := c.makeRoom(ctx, cdc.Manifest.DatasetSize)
+	if err != nil {
+		logger.Warn("no room in the cache budget", "cid", cr.Payload.CID, "size", cdc.Manifest.DatasetSize, "error", err)
+		reason = "budget"
+		c.deadLetters.Add("budget", cr, err)
+		return resultFailed, err
+	}
+	defer release()
+
+	snapSizes.WithLabelValues(protected).Observe(float64(cdc.Manifest.DatasetSize) / 1024)
+
+	pinStart := time.Now()
+	err = c.backend.FetchToNetwork(ctx, cr.Payload.CID)
+	pinDuration.Observe(time.Since(pinStart).Seconds())
+	if err != nil {
+		reason = "network"
+		logger.Error("failed to fetch dataset into Codex", "cid", cr.Payload.CID, "error", err)
+		if unreachable(err) {
+			c.retries.Failed(cr, err, time.Now())
+		}
+		return resultFailed, err
+	}
+
+	if c.confirmer != nil {
+		confirmCtx, cancel := context.WithTimeout(ctx, c.confirmTimeout)
+		defer cancel()
+
+		err = c.confirmer.Wait(confirmCtx, cr.Payload.CID)
+		if errors.Is(err, context.DeadlineExceeded) {
+			reason = "confirm_timeout"
+			logger.Warn("dataset did not arrive in time", "cid", cr.Payload.CID, "timeout", c.confirmTimeout, "error", err)
+			c.deadLetters.Add("confirm_timeout", cr, err)
+			return resultFailed, err
+		}
+		if err != nil {
+			reason = "confirm"
+			logger.Error("pin was not confirmed", "cid", cr.Payload.CID, "error", err)
+			return resultFailed, err
+		}
+	}
+
+	wantHash := ""
+	if newContentHasher != nil {
+		wantHash = cr.Payload.Hash
+	}
+	validator := c.validator
+	if validator != nil && cr.Payload.Encrypted {
+		logger.Info("skipping validation of encrypted snapshot", "cid", cr.Payload.CID)
+		validator = nil
+	}
+	if wantHash != "" || validator != nil {
+		err = inspectSnapshot(ctx, c.backend, cr.Payload.CID, maxSize, wantHash, validator)
+		if err != nil {
+			reason = "validation"
+			switch {
+			case errors.Is(err, errHashMismatch):
+				snapHashMismatch.Inc()
+				reason = "hash_mismatch"
+				c.deadLetters.Add("hash_mismatch", cr, err)
+			case errors.Is(err, errInvalidSnapshot):
+				snapInvalid.Inc()
+				reason = "invalid_snapshot"
+				c.deadLetters.Add("invalid_snapshot", cr, err)
+			}
+			logger.Warn("rejecting snapshot", "cid", cr.Payload.CID, "error", err)
+			if uerr := c.backend.Unpin(ctx, cr.Payload.CID); uerr != nil {
+				logger.Error("failed to unpin rejected snapshot", "cid", cr.Payload.CID, "error", uerr)
+			}
+			return resultFailed, err
+		}
+	}
+
+	snapSuccess.WithLabelValues(protected).Inc()
+
+	now := time.Now()
+	c.index.Put(CacheEntry{
+		CID:       cr.Payload.CID,
+		Owner:     cr.Payload.Owner,
+		Hash:      cr.Payload.Hash,
+		Encrypted: cr.Payload.Encrypted,
+		Size:      cdc.Manifest.DatasetSize,
+		CachedAt:  now,
+		PinnedAt:  now,
+		ExpiresAt: c.ttl.ExpiresAt(cr.Payload.Owner, now),
+	})
+	c.pruneVersions(ctx, cr.Payload.Owner)
+	c.announcer.Announce(cr.Payload)
+
+	return resultCached, nil
+}
+
+// validateBlockSize rejects manifests whose block size falls outside the
+// configured range, which usually means a malformed or adversarial manifest.
+func validateBlockSize(blockSize int) error {
+	if minBlockSize > 0 && blockSize < minBlockSize {
+		return fmt.Errorf("block size too small: %d < %d", blockSize, minBlockSize)
+	}
+
+	if maxBlockSize > 0 && blockSize > maxBlockSize {
+		return fmt.Errorf("block size too big: %d > %d", blockSize, maxBlockSize)
+	}
+
+	return nil
+}
+
+// validateBlockCount rejects datasets split into more blocks than
+// maxBlockCount, each of which Codex has to fetch separately.
+func validateBlockCount(datasetSize int, blockSize int) error {
+	if maxBlockCount <= 0 {
+		return nil
+	}
+	if blockSize <= 0 {
+		return fmt.Errorf("invalid block size %d", blockSize)
+	}
+
+	blocks := (datasetSize + blockSize - 1) / blockSize
+	if blocks > maxBlockCount {
+		return fmt.Errorf("too many blocks: %d > %d", blocks, maxBlockCount)
+	}
+
+	return nil
+}
+
+// snapshotETag is the strong validator of a snapshot, its content never
+// changes for a CID.
+func snapshotETag(cid string) string {
+	return `"` + cid + `"`
+}
+
+// etagMatches reports whether the If-None-Match header value matches etag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,1786 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+	"github.com/waku-org/go-waku/waku/v2/protocol/pb"
+)
+
+const (
+	testContentTopic = "/qaku/1/persist/json"
+	testPubsubTopic  = "/waku/2/rs/1/0"
+
+	// mockBlockSize is the block size the mock Codex reports in manifests.
+	mockBlockSize = 64 * 1024
+)
+
+// testCID returns a valid CIDv1 derived from seed.
+func testCID(seed string) string {
+	h, err := multihash.Sum([]byte(seed), multihash.SHA2_256, -1)
+	if err != nil {
+		panic(err)
+	}
+
+	return cid.NewCidV1(cid.Raw, h).String()
+}
+
+// setGlobal sets *p to v for the duration of the test.
+func setGlobal[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// cacheMessage encodes a cache request for cid by owner, timestamped now.
+func cacheMessage(t *testing.T, cid string, owner string) []byte {
+	t.Helper()
+
+	return encodeMessage(t, QakuMessage{
+		Type:      cacheMessageType,
+		Payload:   CacheRequest{CID: cid, Owner: owner},
+		Timestamp: Timestamp(time.Now().UnixMilli()),
+	})
+}
+
+func encodeMessage(t *testing.T, msg QakuMessage) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// testEnvelope wraps payload in an envelope on the persist topic.
+func testEnvelope(payload []byte) *protocol.Envelope {
+	return testEnvelopeOn(testContentTopic, payload)
+}
+
+func testEnvelopeOn(contentTopic string, payload []byte) *protocol.Envelope {
+	msg := &pb.WakuMessage{Payload: payload, ContentTopic: contentTopic}
+	return protocol.NewEnvelope(msg, time.Now().UnixNano(), testPubsubTopic)
+}
+
+// discardLogger drops all log output.
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// newTestCache returns an in-memory cache. Signature checks are off so tests
+// can build messages without a key.
+func newTestCache(t *testing.T) *Cache {
+	t.Helper()
+
+	c, err := NewCache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.logger = discardLogger()
+	setGlobal(t, &signatureScheme, signatureSchemeNone)
+
+	return c
+}
+
+// newTestFSBackend returns a filesystem backend in a temporary directory.
+func newTestFSBackend(t *testing.T) *fsBackend {
+	t.Helper()
+
+	b, err := newFSBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// addDataset makes data fetchable from the network of b under cid.
+func addDataset(t *testing.T, b *fsBackend, cid string, data []byte) {
+	t.Helper()
+
+	err := os.WriteFile(filepath.Join(b.network, cid), data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addLocalDataset adds data to the network of b and fetches it into the local
+// store, as if it had been cached.
+func addLocalDataset(t *testing.T, b *fsBackend, cid string, data []byte) {
+	t.Helper()
+
+	addDataset(t, b, cid, data)
+	err := b.FetchToNetwork(context.Background(), cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// indexedEntry looks cid up in the index of c.
+func indexedEntry(c *Cache, cid string) (CacheEntry, bool) {
+	for _, e := range c.index.Entries() {
+		if e.CID == cid {
+			return e, true
+		}
+	}
+
+	return CacheEntry{}, false
+}
+
+// noRetries makes failed Codex requests fail right away.
+func noRetries(t *testing.T) {
+	setGlobal(t, &codexMaxRetries, 0)
+	setGlobal(t, &codexRetryDelay, time.Millisecond)
+}
+
+// mockCodex serves the parts of the Codex REST API the cache uses from
+// memory. Datasets added with Add can be fetched from the network, fetched
+// and uploaded ones are local.
+type mockCodex struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	network map[string][]byte
+	local   map[string]bool
+	// served replaces the downloaded bytes of a dataset.
+	served map[string][]byte
+	// incomplete counts the manifests of a dataset still reported without
+	// a tree CID.
+	incomplete map[string]int
+	delay      map[string]time.Duration
+	status     map[string][]int
+	calls      map[string]int
+}
+
+// newMockCodex starts a mock Codex and points the cache at it for the
+// duration of the test.
+func newMockCodex(t *testing.T) *mockCodex {
+	t.Helper()
+
+	m := &mockCodex{
+		network:    make(map[string][]byte),
+		local:      make(map[string]bool),
+		served:     make(map[string][]byte),
+		incomplete: make(map[string]int),
+		delay:      make(map[string]time.Duration),
+		status:     make(map[string][]int),
+		calls:      make(map[string]int),
+	}
+	m.Server = httptest.NewServer(m)
+	t.Cleanup(m.Close)
+	setGlobal(t, &codexURL, m.URL)
+
+	return m
+}
+
+// Add makes data fetchable from the network under cid.
+func (m *mockCodex) Add(cid string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.network[cid] = data
+}
+
+// AddLocal adds the dataset to the network and the local store, as if it had
+// been cached.
+func (m *mockCodex) AddLocal(cid string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.network[cid] = data
+	m.local[cid] = true
+}
+
+// Remove makes cid unknown to the network, like a dataset that was lost.
+func (m *mockCodex) Remove(cid string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.network, cid)
+	delete(m.local, cid)
+}
+
+// Serve makes downloads of cid return body instead of the dataset, like a
+// misbehaving node.
+func (m *mockCodex) Serve(cid string, body []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.served[cid] = body
+}
+
+// Incomplete reports the next n manifests of cid with an empty tree CID, as
+// Codex does while it is still ingesting an upload.
+func (m *mockCodex) Incomplete(cid string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.incomplete[cid] = n
+}
+
+// Fail answers the next requests of the operation with the statuses, in
+// order.
+func (m *mockCodex) Fail(op string, statuses ...int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.status[op] = append(m.status[op], statuses...)
+}
+
+// Delay holds every request of the operation back by d.
+func (m *mockCodex) Delay(op string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.delay[op] = d
+}
+
+// Calls returns the number of requests of the operation so far.
+func (m *mockCodex) Calls(op string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.calls[op]
+}
+
+// Local reports whether the dataset was fetched into the local store.
+func (m *mockCodex) Local(cid string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.local[cid]
+}
+
+// Backend returns a Codex backend talking to the mock.
+func (m *mockCodex) Backend() *codexBackend {
+	return newCodexBackend(m.URL)
+}
+
+func (m *mockCodex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op := codexOperation(r.Method, r.URL.Path)
+	cid := strings.TrimPrefix(r.URL.Path, "/api/codex/v1/data/")
+	cid, _, _ = strings.Cut(cid, "/")
+
+	m.mu.Lock()
+	m.calls[op]++
+	delay := m.delay[op]
+	status := 0
+	if s := m.status[op]; len(s) > 0 {
+		status, m.status[op] = s[0], s[1:]
+	}
+	data, known := m.network[cid]
+	local := m.local[cid]
+	served, lying := m.served[cid]
+	treeCid := cid
+	if op == "manifest" && m.incomplete[cid] > 0 {
+		m.incomplete[cid]--
+		treeCid = ""
+	}
+	m.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	switch op {
+	case "debug_info":
+		json.NewEncoder(w).Encode(DebugInfo{ID: "mock", AnnouncedAddrs: []string{"/ip4/127.0.0.1/tcp/8070"}})
+	case "manifest":
+		if !known {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(CodexDataContent{Cid: cid, Manifest: CodexManifest{
+			DatasetSize: len(data),
+			BlockSize:   mockBlockSize,
+			TreeCid:     treeCid,
+		}})
+	case "network_pin":
+		if !known {
+			http.NotFound(w, r)
+			return
+		}
+		m.mu.Lock()
+		m.local[cid] = true
+		m.mu.Unlock()
+	case "download":
+		if !known || !local {
+			http.NotFound(w, r)
+			return
+		}
+		if lying {
+			w.Write(served)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(string(data)))
+	case "stream":
+		if !known {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	case "list":
+		list := codexDataList{}
+		m.mu.Lock()
+		for cid := range m.local {
+			list.Content = append(list.Content, CodexDataContent{Cid: cid})
+		}
+		m.mu.Unlock()
+		json.NewEncoder(w).Encode(list)
+	case "unpin":
+		m.mu.Lock()
+		delete(m.local, cid)
+		m.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case "upload":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cid := testCID(string(data))
+		m.mu.Lock()
+		m.network[cid] = data
+		m.local[cid] = true
+		m.mu.Unlock()
+		io.WriteString(w, cid)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestServer returns the API handler of the cache. A nil auth disables
+// the admin API like in production.
+func newTestServer(t *testing.T, cache *Cache, auth AdminAuthenticator) http.Handler {
+	t.Helper()
+
+	corsCfg, err := corsConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := newWorkerPool(1, 10, priorityNormal, dropNewest, cache.OnNewEnvelope)
+	// server also listens, on a free port the tests do not use.
+	srv := server("127.0.0.1:0", nil, corsCfg, 0, nil, discardLogger(), cache, pool, auth, nil, nil)
+	t.Cleanup(func() {
+		srv.Close()
+		pool.Stop(context.Background())
+	})
+
+	return srv.Handler
+}
+
+// get sends a GET request with the header to h and records the response.
+func get(h http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	return do(h, http.MethodGet, path, header, nil)
+}
+
+func do(h http.Handler, method string, path string, header http.Header, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestOnNewEnvelopeCachesDataset(t *testing.T) {
+	m := newMockCodex(t)
+	cid := testCID("snapshot")
+	m.Add(cid, []byte("snapshot"))
+	c := newTestCache(t)
+
+	err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Local(cid) {
+		t.Error("dataset was not fetched")
+	}
+}
+
+func TestValidateBlockSize(t *testing.T) {
+	setGlobal(t, &minBlockSize, 1024)
+	setGlobal(t, &maxBlockSize, 1024*1024)
+
+	tests := []struct {
+		blockSize int
+		wantErr   bool
+	}{
+		{blockSize: 0, wantErr: true},
+		{blockSize: 1023, wantErr: true},
+		{blockSize: 1024},
+		{blockSize: 64 * 1024},
+		{blockSize: 1024 * 1024},
+		{blockSize: 1024*1024 + 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := validateBlockSize(tt.blockSize)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateBlockSize(%d) = %v, want error %t", tt.blockSize, err, tt.wantErr)
+		}
+	}
+}
+
+func TestProcessRejectsOutOfRangeBlockSize(t *testing.T) {
+	setGlobal(t, &minBlockSize, 2*mockBlockSize)
+
+	m := newMockCodex(t)
+	cid := testCID("small blocks")
+	m.Add(cid, []byte("snapshot"))
+	c := newTestCache(t)
+
+	err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice")))
+	if err == nil {
+		t.Fatal("dataset with too small blocks was accepted")
+	}
+	if m.Calls("network_pin") != 0 {
+		t.Error("rejected dataset was fetched")
+	}
+}
+
+// testAdmin authenticates admin requests carrying adminHeader.
+var testAdmin = &staticTokenAuth{token: "admin"}
+
+func adminHeader() http.Header {
+	return http.Header{"Authorization": {"Bearer admin"}}
+}
+
+func TestConcurrentRequestsFetchOnce(t *testing.T) {
+	cid := testCID("concurrent")
+	m := newMockCodex(t)
+	m.Add(cid, []byte("snapshot"))
+	// Keep the first fetch in flight while the others arrive.
+	m.Delay("network_pin", 100*time.Millisecond)
+	c := newTestCache(t)
+
+	const n = 10
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "")))
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if got := m.Calls("network_pin"); got != 1 {
+		t.Errorf("%d fetches reached Codex, want 1", got)
+	}
+	if !c.index.Has(cid) {
+		t.Error("dataset was not cached")
+	}
+	if c.IsFetching(cid) {
+		t.Error("dataset is still marked in flight")
+	}
+}
+
+func TestFailedRequestClearsInFlight(t *testing.T) {
+	noRetries(t)
+	cid := testCID("failing")
+	m := newMockCodex(t)
+	m.Add(cid, []byte("snapshot"))
+	m.Fail("network_pin", http.StatusInternalServerError)
+	c := newTestCache(t)
+
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, ""))); err == nil {
+		t.Fatal("caching succeeded against a failing Codex")
+	}
+	if c.IsFetching(cid) {
+		t.Fatal("failed dataset is still marked in flight")
+	}
+
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, ""))); err != nil {
+		t.Fatalf("retry after the failure = %v", err)
+	}
+	if got := m.Calls("network_pin"); got != 2 {
+		t.Errorf("%d fetches reached Codex, want the failed one and the retry", got)
+	}
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	noRetries(t)
+	cached, uncached := testCID("cached"), testCID("uncached")
+
+	tests := []struct {
+		name       string
+		auth       AdminAuthenticator
+		header     http.Header
+		cid        string
+		unpinFails bool
+		wantStatus int
+		wantCached bool
+	}{
+		{name: "authorized", auth: testAdmin, header: adminHeader(), cid: cached, wantStatus: http.StatusNoContent},
+		{name: "wrong token", auth: testAdmin, header: http.Header{"Authorization": {"Bearer guess"}}, cid: cached, wantStatus: http.StatusUnauthorized, wantCached: true},
+		{name: "no token", auth: testAdmin, cid: cached, wantStatus: http.StatusUnauthorized, wantCached: true},
+		{name: "admin disabled", auth: nil, header: adminHeader(), cid: cached, wantStatus: http.StatusForbidden, wantCached: true},
+		{name: "not cached", auth: testAdmin, header: adminHeader(), cid: uncached, wantStatus: http.StatusNotFound, wantCached: true},
+		{name: "unpin fails", auth: testAdmin, header: adminHeader(), cid: cached, unpinFails: true, wantStatus: http.StatusBadGateway, wantCached: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			m.Add(cached, []byte("snapshot"))
+			c := newTestCache(t)
+			if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cached, ""))); err != nil {
+				t.Fatal(err)
+			}
+			if tt.unpinFails {
+				m.Fail("unpin", http.StatusInternalServerError)
+			}
+
+			w := do(newTestServer(t, c, tt.auth), http.MethodDelete, "/api/qaku/v1/snapshot/"+tt.cid, tt.header, nil)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := c.index.Has(cached); got != tt.wantCached {
+				t.Errorf("indexed = %t, want %t", got, tt.wantCached)
+			}
+			if got := m.Local(cached); got != tt.wantCached {
+				t.Errorf("pinned in Codex = %t, want %t", got, tt.wantCached)
+			}
+		})
+	}
+}
+
+// codexInfoServer answers the Codex debug info request with status and body
+// and returns its URL.
+func codexInfoServer(t *testing.T, status int, body string) string {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL
+}
+
+func TestInfoHandlerErrors(t *testing.T) {
+	noRetries(t)
+
+	tests := []struct {
+		name       string
+		codexURL   string
+		wantStatus int
+	}{
+		{name: "ok", codexURL: codexInfoServer(t, http.StatusOK, `{"id":"peer","announceAddresses":["/ip4/1.2.3.4/tcp/8070"]}`), wantStatus: http.StatusOK},
+		{name: "codex error", codexURL: codexInfoServer(t, http.StatusInternalServerError, "boom"), wantStatus: http.StatusBadGateway},
+		{name: "malformed", codexURL: codexInfoServer(t, http.StatusOK, "<html>"), wantStatus: http.StatusBadGateway},
+		{name: "unreachable", codexURL: "http://127.0.0.1:1", wantStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &codexURL, tt.codexURL)
+			w := get(newTestServer(t, newTestCache(t), nil), "/api/qaku/v1/info", nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			var body map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not JSON: %v", w.Body, err)
+			}
+			if tt.wantStatus != http.StatusOK && body["error"] == nil {
+				t.Errorf("error response %s has no error message", w.Body)
+			}
+		})
+	}
+}
+
+func TestInfoHandlerAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantAddrs []string
+		wantAddr  string
+	}{
+		{name: "none", body: `{"id":"peer","announceAddresses":[]}`, wantAddrs: []string{}},
+		{name: "missing", body: `{"id":"peer"}`, wantAddrs: []string{}},
+		{name: "several", body: `{"id":"peer","announceAddresses":["/ip4/127.0.0.1/tcp/8070","/ip4/8.8.8.8/tcp/8070"]}`,
+			wantAddrs: []string{"/ip4/127.0.0.1/tcp/8070", "/ip4/8.8.8.8/tcp/8070"}, wantAddr: "/ip4/8.8.8.8/tcp/8070"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &codexURL, codexInfoServer(t, http.StatusOK, tt.body))
+			w := get(newTestServer(t, newTestCache(t), nil), "/api/qaku/v1/info", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+
+			var body struct {
+				PeerID string   `json:"peerId"`
+				Addrs  []string `json:"addrs"`
+				Addr   *string  `json:"addr"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Addrs == nil || !slices.Equal(body.Addrs, tt.wantAddrs) {
+				t.Errorf("got addrs %v, want %v", body.Addrs, tt.wantAddrs)
+			}
+			switch {
+			case tt.wantAddr == "" && body.Addr != nil:
+				t.Errorf("got addr %q without announced addresses", *body.Addr)
+			case tt.wantAddr != "" && (body.Addr == nil || *body.Addr != tt.wantAddr):
+				t.Errorf("got addr %v, want %q", body.Addr, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestSnapshotRanges(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	cid := testCID("ranges")
+	m.Add(cid, []byte("snapshot"))
+	c := newTestCache(t)
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, c, nil)
+
+	tests := []struct {
+		name             string
+		rng              string
+		wantStatus       int
+		wantBody         string
+		wantContentRange string
+	}{
+		{name: "full", wantStatus: http.StatusOK, wantBody: "snapshot"},
+		{name: "range", rng: "bytes=4-7", wantStatus: http.StatusPartialContent, wantBody: "shot", wantContentRange: "bytes 4-7/8"},
+		{name: "unsatisfiable", rng: "bytes=100-", wantStatus: http.StatusRequestedRangeNotSatisfiable, wantContentRange: "bytes */8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.rng != "" {
+				header.Set("Range", tt.rng)
+			}
+			w := get(h, "/api/qaku/v1/snapshot/"+cid, header)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("got body %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.wantContentRange {
+				t.Errorf("got Content-Range %q, want %q", got, tt.wantContentRange)
+			}
+			if got := w.Header().Get("Accept-Ranges"); tt.wantStatus != http.StatusRequestedRangeNotSatisfiable && got != "bytes" {
+				t.Errorf("got Accept-Ranges %q, want bytes", got)
+			}
+		})
+	}
+
+	// The filesystem backend has no ranges, the full snapshot is served.
+	b := newTestFSBackend(t)
+	addLocalDataset(t, b, cid, []byte("snapshot"))
+	c.backend = b
+	w := get(h, "/api/qaku/v1/snapshot/"+cid, http.Header{"Range": {"bytes=4-7"}})
+	if w.Code != http.StatusOK || w.Body.String() != "snapshot" || w.Header().Get("Content-Range") != "" {
+		t.Errorf("got %d %q, want the full snapshot without ranges", w.Code, w.Body.String())
+	}
+}
+
+// untypedHandler drops the content type of the responses of Handler.
+type untypedHandler struct{ http.Handler }
+
+func (h untypedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// A nil value stops the content type from being sniffed.
+	w.Header()["Content-Type"] = nil
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestSnapshotHeaders(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	cid := testCID("headers")
+	m.Add(cid, []byte("snapshot"))
+	c := newTestCache(t)
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, c, nil)
+
+	untyped := httptest.NewServer(untypedHandler{m})
+	t.Cleanup(untyped.Close)
+
+	tests := []struct {
+		name        string
+		backend     Backend
+		contentType string
+	}{
+		{name: "relayed", backend: c.backend, contentType: "text/plain; charset=utf-8"},
+		{name: "default", backend: newCodexBackend(untyped.URL), contentType: "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.backend = tt.backend
+			w := get(h, "/api/qaku/v1/snapshot/"+cid, nil)
+			if w.Code != http.StatusOK || w.Body.String() != "snapshot" {
+				t.Fatalf("got %d %q, want the snapshot", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got Content-Type %q, want %q", got, tt.contentType)
+			}
+			if got := w.Header().Get("Content-Length"); got != "8" {
+				t.Errorf("got Content-Length %q, want 8", got)
+			}
+		})
+	}
+}
+
+func TestOnNewEnvelopeDispatchesOnType(t *testing.T) {
+	tests := []struct {
+		name       string
+		known      string
+		msgType    string
+		wantCached bool
+	}{
+		{name: "recognized", known: messageTypePersist, msgType: messageTypePersist, wantCached: true},
+		{name: "unknown", known: messageTypePersist, msgType: "chat"},
+		{name: "configured", known: "cache", msgType: "cache", wantCached: true},
+		{name: "default when configured", known: "cache", msgType: messageTypePersist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &cacheMessageType, tt.known)
+			m := newMockCodex(t)
+			c := newTestCache(t)
+			cid := testCID(tt.name)
+			m.Add(cid, []byte("snapshot"))
+
+			ignored := testutil.ToFloat64(snapIgnoredType)
+			err := c.OnNewEnvelope(testEnvelope(encodeMessage(t, QakuMessage{
+				Type:      tt.msgType,
+				Payload:   CacheRequest{CID: cid},
+				Timestamp: Timestamp(time.Now().UnixMilli()),
+			})))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := c.index.Has(cid); got != tt.wantCached {
+				t.Errorf("cached = %t, want %t", got, tt.wantCached)
+			}
+			wantIgnored := 1.0
+			if tt.wantCached {
+				wantIgnored = 0
+			}
+			if got := testutil.ToFloat64(snapIgnoredType) - ignored; got != wantIgnored {
+				t.Errorf("counted %v ignored messages, want %v", got, wantIgnored)
+			}
+		})
+	}
+}
+
+func TestWorkersEndpoint(t *testing.T) {
+	h := newTestServer(t, newTestCache(t), testAdmin)
+
+	w := get(h, "/api/qaku/v1/workers", adminHeader())
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var got struct {
+		PoolStats
+		InFlight []InFlightJob `json:"inFlight"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Size != 1 || got.QueueCapacity != 10 || got.Busy != 0 || got.Queued != 0 || got.InFlight == nil {
+		t.Errorf("got %s, want the idle pool of the test server and no jobs", w.Body.String())
+	}
+}
+
+// protectedBackend reports every manifest of Backend as protected.
+type protectedBackend struct{ Backend }
+
+func (p protectedBackend) FetchManifest(ctx context.Context, cid string) (*CodexDataContent, error) {
+	cdc, err := p.Backend.FetchManifest(ctx, cid)
+	if err == nil {
+		cdc.Manifest.Protected = true
+	}
+	return cdc, err
+}
+
+func TestSnapshotInfo(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	c.backend = protectedBackend{c.backend}
+	h := newTestServer(t, c, nil)
+
+	cached, known := testCID("cached"), testCID("known")
+	m.Add(known, []byte("snapshot"))
+	cachedAt := time.Now().Truncate(time.Second)
+	c.index.Put(CacheEntry{CID: cached, Owner: "alice", Size: 4, CachedAt: cachedAt})
+
+	tests := []struct {
+		name       string
+		cid        string
+		wantStatus int
+		want       SnapshotMeta
+	}{
+		{name: "cached", cid: cached, wantStatus: http.StatusOK, want: SnapshotMeta{CID: cached, Size: 4, Cached: true, CachedAt: &cachedAt}},
+		{name: "known to Codex", cid: known, wantStatus: http.StatusOK, want: SnapshotMeta{CID: known, Size: len("snapshot"), Protected: true}},
+		{name: "unknown", cid: testCID("unknown"), wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(h, "/api/qaku/v1/snapshot/"+tt.cid+"/info", nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var got SnapshotMeta
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.CID != tt.want.CID || got.Size != tt.want.Size || got.Cached != tt.want.Cached || got.Protected != tt.want.Protected {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if (got.CachedAt == nil) != (tt.want.CachedAt == nil) || (got.CachedAt != nil && !got.CachedAt.Equal(*tt.want.CachedAt)) {
+				t.Errorf("got cachedAt %v, want %v", got.CachedAt, tt.want.CachedAt)
+			}
+		})
+	}
+
+	if got := m.Calls("manifest"); got != 2 {
+		t.Errorf("made %d manifest requests, want none for the cached snapshot", got)
+	}
+}
+
+func TestFailuresCountedByReason(t *testing.T) {
+	noRetries(t)
+	old := maxDatasetSize.Swap(1000)
+	t.Cleanup(func() { maxDatasetSize.Store(old) })
+
+	tests := []struct {
+		name    string
+		setup   func(m *mockCodex, cid string)
+		payload func(t *testing.T, cid string) []byte
+		reason  string
+		// wantFailure is whether the failure also counts as a failed cache.
+		wantFailure bool
+	}{
+		{
+			name:        "manifest",
+			setup:       func(m *mockCodex, cid string) {},
+			reason:      "manifest",
+			wantFailure: true,
+		},
+		{
+			name:        "network",
+			setup:       func(m *mockCodex, cid string) { m.Add(cid, []byte("snapshot")); m.Fail("network_pin", 500) },
+			reason:      "network",
+			wantFailure: true,
+		},
+		{
+			name:        "oversized",
+			setup:       func(m *mockCodex, cid string) { m.Add(cid, make([]byte, 2000)) },
+			reason:      "oversized",
+			wantFailure: true,
+		},
+		{
+			name:    "unmarshal",
+			payload: func(t *testing.T, cid string) []byte { return []byte("not json") },
+			reason:  "unmarshal",
+		},
+		{
+			name:        "invalid cid",
+			payload:     func(t *testing.T, cid string) []byte { return cacheMessage(t, "not-a-cid", "alice") },
+			reason:      "invalid_cid",
+			wantFailure: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			c := newTestCache(t)
+			cid := testCID(tt.name)
+			if tt.setup != nil {
+				tt.setup(m, cid)
+			}
+			payload := cacheMessage(t, cid, "alice")
+			if tt.payload != nil {
+				payload = tt.payload(t, cid)
+			}
+
+			byReason := testutil.ToFloat64(snapFailureReason.WithLabelValues(tt.reason))
+			failures := testutil.ToFloat64(snapFailure)
+			if err := c.OnNewEnvelope(testEnvelope(payload)); err == nil {
+				t.Fatal("the request did not fail")
+			}
+
+			if got := testutil.ToFloat64(snapFailureReason.WithLabelValues(tt.reason)) - byReason; got != 1 {
+				t.Errorf("counted %v failures for reason %s, want 1", got, tt.reason)
+			}
+			wantFailures := 0.0
+			if tt.wantFailure {
+				wantFailures = 1
+			}
+			if got := testutil.ToFloat64(snapFailure) - failures; got != wantFailures {
+				t.Errorf("counted %v failures in total, want %v", got, wantFailures)
+			}
+		})
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	etag := snapshotETag("cid")
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: `"cid"`, want: true},
+		{header: `W/"cid"`, want: true},
+		{header: `"other", "cid"`, want: true},
+		{header: `*`, want: true},
+		{header: `"other"`},
+		{header: `cid`},
+		{header: ``},
+	}
+
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %t, want %t", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotConditionalGet(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	cid := testCID("conditional")
+	m.Add(cid, []byte("snapshot"))
+	c := newTestCache(t)
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, c, nil)
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantStatus  int
+		wantBody    string
+	}{
+		{name: "no validator", wantStatus: http.StatusOK, wantBody: "snapshot"},
+		{name: "matching", ifNoneMatch: snapshotETag(cid), wantStatus: http.StatusNotModified},
+		{name: "mismatched", ifNoneMatch: snapshotETag(testCID("other")), wantStatus: http.StatusOK, wantBody: "snapshot"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloads := m.Calls("download")
+			header := http.Header{}
+			if tt.ifNoneMatch != "" {
+				header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := get(h, "/api/qaku/v1/snapshot/"+cid, header)
+			if w.Code != tt.wantStatus || w.Body.String() != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if got := w.Header().Get("ETag"); got != snapshotETag(cid) {
+				t.Errorf("got ETag %q, want %q", got, snapshotETag(cid))
+			}
+			if got := w.Header().Get("Cache-Control"); !strings.Contains(got, "immutable") {
+				t.Errorf("got Cache-Control %q, want immutable", got)
+			}
+			wantDownloads := 1
+			if tt.wantStatus == http.StatusNotModified {
+				wantDownloads = 0
+			}
+			if got := m.Calls("download") - downloads; got != wantDownloads {
+				t.Errorf("downloaded %d times, want %d", got, wantDownloads)
+			}
+		})
+	}
+}
+
+func TestManualCache(t *testing.T) {
+	noRetries(t)
+	old := maxDatasetSize.Swap(1000)
+	t.Cleanup(func() { maxDatasetSize.Store(old) })
+	small, big := testCID("small"), testCID("big")
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		body       string
+		wantStatus int
+		wantResult string
+		wantCached bool
+	}{
+		{name: "cached", header: adminHeader(), body: `{"cid":"` + small + `","owner":"alice"}`, wantStatus: http.StatusOK, wantResult: resultCached, wantCached: true},
+		{name: "oversized", header: adminHeader(), body: `{"cid":"` + big + `","owner":"alice"}`, wantStatus: http.StatusBadGateway, wantResult: resultFailed},
+		{name: "invalid cid", header: adminHeader(), body: `{"cid":"not-a-cid"}`, wantStatus: http.StatusBadRequest},
+		{name: "no token", body: `{"cid":"` + small + `","owner":"alice"}`, wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", header: http.Header{"Authorization": {"Bearer guess"}}, body: `{"cid":"` + small + `","owner":"alice"}`, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			m.Add(small, []byte("snapshot"))
+			m.Add(big, make([]byte, 2000))
+			c := newTestCache(t)
+
+			w := do(newTestServer(t, c, testAdmin), http.MethodPost, "/api/qaku/v1/cache", tt.header, strings.NewReader(tt.body))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantResult != "" {
+				var resp struct {
+					Result string `json:"result"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Result != tt.wantResult {
+					t.Errorf("got result %q, want %q", resp.Result, tt.wantResult)
+				}
+			}
+			if tt.wantStatus == http.StatusBadGateway {
+				if got := decodeAPIError(t, w.Body.Bytes()); got.Code != "bad_gateway" || got.Message == "" || got.RequestID == "" {
+					t.Errorf("got %+v, want the error envelope next to the result", got)
+				}
+			}
+			if got := c.index.Has(small) || c.index.Has(big); got != tt.wantCached {
+				t.Errorf("cached = %t, want %t", got, tt.wantCached)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && m.Calls("manifest") != 0 {
+				t.Error("reached Codex for an unauthorized request")
+			}
+		})
+	}
+}
+
+func TestManualCacheQueued(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	cid := testCID("manual")
+	m.Add(cid, []byte("snapshot"))
+	c := newTestCache(t)
+	corsCfg, err := corsConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without workers the queued Waku envelope fills the queue.
+	pool := newWorkerPool(0, 1, priorityHigh, dropNewest, c.OnNewEnvelope)
+	srv := server("127.0.0.1:0", nil, corsCfg, 0, nil, discardLogger(), c, pool, testAdmin, nil, nil)
+	t.Cleanup(func() { srv.Close() })
+	body := `{"cid":"` + cid + `","owner":"alice"}`
+
+	pool.Submit(testEnvelope(cacheMessage(t, testCID("waku"), "alice")), sourceWaku)
+	if w := do(srv.Handler, http.MethodPost, "/api/qaku/v1/cache", adminHeader(), strings.NewReader(body)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d with a full queue, want 503", w.Code)
+	} else if got := decodeAPIError(t, w.Body.Bytes()); got.Message != errQueueFull.Error() {
+		t.Errorf("got %+v, want the queue full error", got)
+	}
+	if m.Calls("manifest") != 0 {
+		t.Error("processed a manual request the queue had no room for")
+	}
+
+	pool.capacity = 2
+	res := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		res <- do(srv.Handler, http.MethodPost, "/api/qaku/v1/cache", adminHeader(), strings.NewReader(body))
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Stats().QueuedBySource[sourceManual] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the manual request did not queue in the worker pool")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	pool.workers.Add(1)
+	go pool.work()
+	if w := <-res; w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	if !c.index.Has(cid) {
+		t.Error("did not cache the manual request")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pool.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManualCacheOutlivesClient(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	cid := testCID("abandoned")
+	m.Add(cid, []byte("snapshot"))
+	c := newTestCache(t)
+	corsCfg, err := corsConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without workers the request stays queued until the client is gone.
+	pool := newWorkerPool(0, 1, priorityNormal, dropNewest, c.OnNewEnvelope)
+	srv := server("127.0.0.1:0", nil, corsCfg, 0, nil, discardLogger(), c, pool, testAdmin, nil, nil)
+	t.Cleanup(func() { srv.Close() })
+
+	reqCtx, disconnect := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/api/qaku/v1/cache", strings.NewReader(`{"cid":"`+cid+`","owner":"alice"}`)).WithContext(reqCtx)
+	req.Header = adminHeader()
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		srv.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Stats().QueuedBySource[sourceManual] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the manual request did not queue in the worker pool")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	disconnect()
+	<-handled
+
+	pool.workers.Add(1)
+	go pool.work()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pool.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !c.index.Has(cid) {
+		t.Error("dropped the manual request when the client went away")
+	}
+}
+
+func TestSnapshotHead(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	cid := testCID("head")
+	m.Add(cid, []byte("snapshot"))
+	c := newTestCache(t)
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestServer(t, c, nil)
+
+	w := do(h, http.MethodHead, "/api/qaku/v1/snapshot/"+cid, nil, nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("got %d with %d body bytes, want 200 without a body", w.Code, w.Body.Len())
+	}
+	if w.Header().Get("Content-Length") != "8" || w.Header().Get("ETag") != snapshotETag(cid) {
+		t.Errorf("got Content-Length %q and ETag %q, want 8 and %s", w.Header().Get("Content-Length"), w.Header().Get("ETag"), snapshotETag(cid))
+	}
+	if w := do(h, http.MethodHead, "/api/qaku/v1/snapshot/"+testCID("uncached"), nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("got %d for an uncached snapshot, want 404", w.Code)
+	}
+	if got := m.Calls("download") + m.Calls("manifest"); got != 1 {
+		t.Errorf("made %d Codex requests, want only the manifest fetch while caching", got)
+	}
+
+	preflight := http.Header{"Origin": {"https://qaku.app"}, "Access-Control-Request-Method": {http.MethodHead}}
+	w = do(h, http.MethodOptions, "/api/qaku/v1/snapshot/"+cid, preflight, nil)
+	if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, http.MethodHead) {
+		t.Errorf("got Access-Control-Allow-Methods %q, want HEAD allowed", got)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c, err := NewCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestFSBackend(t)
+	c.backend = b
+	c.logger = discardLogger()
+	setGlobal(t, &signatureScheme, signatureSchemeNone)
+
+	freeAddr := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		return l.Addr().String()
+	}
+	corsCfg, err := corsConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiAddr, metricsAddr := freeAddr(), freeAddr()
+	apiSrv := server(apiAddr, nil, corsCfg, 0, nil, discardLogger(), c, nil, nil, nil, nil)
+	metricsSrv := prom(metricsAddr)
+	for _, url := range []string{"http://" + apiAddr + "/api/qaku/v1/info", "http://" + metricsAddr + "/metrics"} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp, err := http.Get(url)
+			if err == nil {
+				resp.Body.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The worker is still busy with the envelope when the shutdown starts.
+	cid := testCID("queued")
+	addDataset(t, b, cid, []byte("snapshot"))
+	started := make(chan struct{})
+	pool := newWorkerPool(1, 1, priorityNormal, dropNewest, func(e *protocol.Envelope) error {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		return c.OnNewEnvelope(e)
+	})
+	if !pool.Submit(testEnvelope(cacheMessage(t, cid, "alice")), sourceWaku) {
+		t.Fatal("the pool rejected the envelope")
+	}
+	<-started
+
+	stopped := false
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown(ctx, discardLogger(), apiSrv, metricsSrv, pool, c, func() {
+		stopped = true
+		if !c.index.Has(cid) {
+			t.Error("stopped the node before the queued envelope was processed")
+		}
+	})
+	if !stopped {
+		t.Error("did not stop the background jobs")
+	}
+
+	for _, addr := range []string{apiAddr, metricsAddr} {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections", addr)
+		}
+	}
+
+	// The store is only unlocked once it is closed.
+	reopened, err := NewCache(path)
+	if err != nil {
+		t.Fatalf("reopening the store: %v", err)
+	}
+	defer reopened.Close()
+	if !reopened.index.Has(cid) {
+		t.Error("the processed snapshot was not written to the store")
+	}
+}
+
+func TestClientCancelAbortsCodexRequest(t *testing.T) {
+	noRetries(t)
+	// The upstream answers slowly and reports when its request is cancelled.
+	started := make(chan string, 1)
+	cancelled := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := codexOperation(r.Method, r.URL.Path)
+		if op != "download" && op != "debug_info" {
+			http.NotFound(w, r)
+			return
+		}
+		if op == "download" {
+			w.Write([]byte("first block"))
+			w.(http.Flusher).Flush()
+		}
+		started <- op
+		select {
+		case <-r.Context().Done():
+			cancelled <- op
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	c := newTestCache(t)
+	c.backend = newCodexBackend(upstream.URL)
+	h := newTestServer(t, c, nil)
+
+	for _, tt := range []struct{ op, path string }{
+		{op: "download", path: "/api/qaku/v1/snapshot/" + testCID("slow")},
+		{op: "debug_info", path: "/api/qaku/v1/info"},
+	} {
+		t.Run(tt.op, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil).WithContext(ctx))
+			}()
+
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the upstream request never started")
+			}
+			cancel()
+			select {
+			case op := <-cancelled:
+				if op != tt.op {
+					t.Errorf("cancelled %s, want %s", op, tt.op)
+				}
+			case <-time.After(time.Second):
+				t.Error("the upstream request outlived the client")
+			}
+			<-done
+		})
+	}
+}
+
+func TestRequireProtected(t *testing.T) {
+	tests := []struct {
+		name       string
+		require    bool
+		protected  bool
+		wantCached bool
+	}{
+		{name: "protected required", require: true, protected: true, wantCached: true},
+		{name: "unprotected required", require: true},
+		{name: "unprotected allowed", wantCached: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestFSBackend(t)
+			var backend Backend = b
+			if tt.protected {
+				backend = protectedBackend{b}
+			}
+			c := newTestCache(t)
+			c.backend = backend
+			c.requireProtected = tt.require
+			cid := testCID(tt.name)
+			addDataset(t, b, cid, []byte("snapshot"))
+
+			rejected := testutil.ToFloat64(snapUnprotectedRejected)
+			err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice")))
+			if (err == nil) != tt.wantCached || c.index.Has(cid) != tt.wantCached {
+				t.Errorf("cached %t with error %v, want cached %t", c.index.Has(cid), err, tt.wantCached)
+			}
+			wantRejected := 1.0
+			if tt.wantCached {
+				wantRejected = 0
+			}
+			if got := testutil.ToFloat64(snapUnprotectedRejected) - rejected; got != wantRejected {
+				t.Errorf("counted %v unprotected rejections, want %v", got, wantRejected)
+			}
+		})
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	var forwarded []string
+	var mu sync.Mutex
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		forwarded = append(forwarded, r.Header.Get(defaultRequestIDHeader))
+		mu.Unlock()
+		json.NewEncoder(w).Encode(DebugInfo{ID: "mock"})
+	}))
+	t.Cleanup(upstream.Close)
+	c := newTestCache(t)
+	c.backend = newCodexBackend(upstream.URL)
+	h := newTestServer(t, c, nil)
+
+	header := http.Header{}
+	header.Set(defaultRequestIDHeader, "caller-id")
+	w := get(h, "/api/qaku/v1/info", header)
+	if got := w.Header().Get(defaultRequestIDHeader); got != "caller-id" {
+		t.Errorf("echoed %s %q, want the caller's", defaultRequestIDHeader, got)
+	}
+	w = get(h, "/api/qaku/v1/info", nil)
+	fresh := w.Header().Get(defaultRequestIDHeader)
+	if fresh == "" || fresh == "caller-id" {
+		t.Errorf("echoed %s %q, want a fresh id", defaultRequestIDHeader, fresh)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(forwarded, []string{"caller-id", fresh}) {
+		t.Errorf("forwarded the ids %q to Codex, want %q", forwarded, []string{"caller-id", fresh})
+	}
+}
+
+func TestCodexRequestIDHeader(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{env: "", want: defaultRequestIDHeader},
+		{env: "X-Trace-ID", want: "X-Trace-ID"},
+		{env: "-", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Setenv(envCodexRequestIDHeader, tt.env)
+		if got := codexRequestIDHeaderFromEnv(); got != tt.want {
+			t.Errorf("%s=%q: header = %q, want %q", envCodexRequestIDHeader, tt.env, got, tt.want)
+		}
+	}
+
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("X-Trace-ID")
+		json.NewEncoder(w).Encode(DebugInfo{ID: "mock"})
+	}))
+	t.Cleanup(upstream.Close)
+	old := codexRequestIDHeader
+	codexRequestIDHeader = "X-Trace-ID"
+	t.Cleanup(func() { codexRequestIDHeader = old })
+	c := newTestCache(t)
+	c.backend = newCodexBackend(upstream.URL)
+	h := newTestServer(t, c, nil)
+
+	header := http.Header{}
+	header.Set(defaultRequestIDHeader, "caller-id")
+	w := get(h, "/api/qaku/v1/info", header)
+	if got := w.Header().Get(defaultRequestIDHeader); got != "caller-id" {
+		t.Errorf("echoed %s %q, want the caller's", defaultRequestIDHeader, got)
+	}
+	if forwarded != "caller-id" {
+		t.Errorf("forwarded X-Trace-ID %q to Codex, want the caller's id", forwarded)
+	}
+}
+
+// histogramSamples returns the sample count and sum of the histogram.
+func histogramSamples(t *testing.T, o prometheus.Observer) (uint64, float64) {
+	t.Helper()
+
+	samples := collectorSamples(o.(prometheus.Histogram))
+	if len(samples) != 1 {
+		t.Fatalf("gathered %d samples of the histogram, want 1", len(samples))
+	}
+
+	return samples[0].Count, samples[0].Value
+}
+
+func TestSnapshotSizeHistogram(t *testing.T) {
+	old := maxDatasetSize.Swap(1000)
+	t.Cleanup(func() { maxDatasetSize.Store(old) })
+	b := newTestFSBackend(t)
+	c := newTestCache(t)
+	c.backend = b
+	cached, oversized := testCID("cached"), testCID("oversized")
+	addDataset(t, b, cached, make([]byte, 512))
+	addDataset(t, b, oversized, make([]byte, 2000))
+
+	count, sum := histogramSamples(t, snapSizeBytes.WithLabelValues("false"))
+	kibCount, kibSum := histogramSamples(t, snapSizes.WithLabelValues("false"))
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cached, ""))); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, oversized, ""))); err == nil {
+		t.Fatal("cached the oversized dataset")
+	}
+
+	gotCount, gotSum := histogramSamples(t, snapSizeBytes.WithLabelValues("false"))
+	if gotCount-count != 2 || gotSum-sum != 2512 {
+		t.Errorf("observed %d sizes of %v bytes, want both datasets with 2512 bytes", gotCount-count, gotSum-sum)
+	}
+	// The deprecated histogram keeps recording cached snapshots in KiB.
+	gotCount, gotSum = histogramSamples(t, snapSizes.WithLabelValues("false"))
+	if gotCount-kibCount != 1 || gotSum-kibSum != 0.5 {
+		t.Errorf("observed %d sizes of %v KiB in qaku_cache_sizes, want the cached 0.5 KiB", gotCount-kibCount, gotSum-kibSum)
+	}
+}
+
+func TestDryRunNeverPins(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	c.dryRun = true
+	cid := testCID("dry run")
+	m.Add(cid, []byte("snapshot"))
+
+	would := testutil.ToFloat64(snapWouldCacheBytes)
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+	if m.Calls("manifest") == 0 {
+		t.Error("did not fetch the manifest")
+	}
+	if got := m.Calls("network_pin"); got != 0 || m.Local(cid) {
+		t.Errorf("pinned the dataset %d times in dry-run mode", got)
+	}
+	if c.index.Has(cid) {
+		t.Error("indexed the dataset in dry-run mode")
+	}
+	if got := testutil.ToFloat64(snapWouldCacheBytes) - would; got != float64(len("snapshot")) {
+		t.Errorf("counted %v bytes that would be cached, want %d", got, len("snapshot"))
+	}
+}
+
+func TestMalformedMessages(t *testing.T) {
+	noRetries(t)
+	tests := []struct {
+		name            string
+		payload         func(t *testing.T, cid string) []byte
+		wantUnmarshal   float64
+		wantInvalid     float64
+		wantCodexCalled bool
+	}{
+		{name: "not JSON", payload: func(t *testing.T, cid string) []byte { return []byte("not json") }, wantUnmarshal: 1},
+		{name: "empty CID", payload: func(t *testing.T, cid string) []byte { return cacheMessage(t, "", "alice") }, wantInvalid: 1},
+		{name: "well-formed", payload: func(t *testing.T, cid string) []byte { return cacheMessage(t, cid, "alice") }, wantCodexCalled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			c := newTestCache(t)
+			cid := testCID(tt.name)
+			m.Add(cid, []byte("snapshot"))
+
+			unmarshal := testutil.ToFloat64(snapUnmarshalErrors)
+			invalid := testutil.ToFloat64(snapInvalidRequest)
+			err := c.OnNewEnvelope(testEnvelope(tt.payload(t, cid)))
+			if (err == nil) != tt.wantCodexCalled {
+				t.Errorf("got error %v, want error %t", err, !tt.wantCodexCalled)
+			}
+			if got := testutil.ToFloat64(snapUnmarshalErrors) - unmarshal; got != tt.wantUnmarshal {
+				t.Errorf("counted %v unmarshal errors, want %v", got, tt.wantUnmarshal)
+			}
+			if got := testutil.ToFloat64(snapInvalidRequest) - invalid; got != tt.wantInvalid {
+				t.Errorf("counted %v invalid requests, want %v", got, tt.wantInvalid)
+			}
+			if got := m.Calls("manifest") > 0; got != tt.wantCodexCalled {
+				t.Errorf("asked Codex %t, want %t", got, tt.wantCodexCalled)
+			}
+		})
+	}
+}
+
+func TestValidateBlockCount(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		size      int
+		blockSize int
+		wantErr   bool
+	}{
+		{name: "disabled", size: 1 << 30, blockSize: 1},
+		{name: "normal", max: 100, size: 5 << 20, blockSize: 64 << 10},
+		{name: "partial last block", max: 2, size: 2*1024 + 1, blockSize: 1024, wantErr: true},
+		{name: "abusive", max: 100, size: 5 << 20, blockSize: 16, wantErr: true},
+		{name: "no block size", max: 100, size: 1024, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		setGlobal(t, &maxBlockCount, tt.max)
+		if err := validateBlockCount(tt.size, tt.blockSize); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateBlockCount = %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestProcessRejectsTooManyBlocks(t *testing.T) {
+	setGlobal(t, &maxBlockCount, 2)
+	b := newTestFSBackend(t)
+	c := newTestCache(t)
+	c.backend = b
+	normal, abusive := testCID("normal"), testCID("abusive")
+	addDataset(t, b, normal, make([]byte, 2*fsBackendBlockSize))
+	addDataset(t, b, abusive, make([]byte, 2*fsBackendBlockSize+1))
+
+	rejected := testutil.ToFloat64(snapTooManyBlocks)
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, normal, ""))); err != nil || !c.index.Has(normal) {
+		t.Errorf("rejected a dataset of two blocks: %v", err)
+	}
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, abusive, ""))); err == nil || c.index.Has(abusive) {
+		t.Error("cached a dataset of three blocks")
+	}
+	if got := testutil.ToFloat64(snapTooManyBlocks) - rejected; got != 1 {
+		t.Errorf("counted %v block count rejections, want 1", got)
+	}
+}
+
+func TestPhaseDurationsObserved(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	m.Delay("manifest", 20*time.Millisecond)
+	m.Delay("network_pin", 40*time.Millisecond)
+	c := newTestCache(t)
+	cid := testCID("timed")
+	m.Add(cid, []byte("snapshot"))
+
+	manifests, manifestSum := histogramSamples(t, manifestFetchDuration)
+	pins, pinSum := histogramSamples(t, pinDuration)
+	totals, totalSum := histogramSamples(t, snapDuration.WithLabelValues(outcomeSuccess))
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+
+	gotManifests, gotManifestSum := histogramSamples(t, manifestFetchDuration)
+	if gotManifests-manifests != 1 || gotManifestSum-manifestSum < 0.02 {
+		t.Errorf("observed %d manifest fetches taking %vs, want 1 taking at least 20ms", gotManifests-manifests, gotManifestSum-manifestSum)
+	}
+	gotPins, gotPinSum := histogramSamples(t, pinDuration)
+	if gotPins-pins != 1 || gotPinSum-pinSum < 0.04 {
+		t.Errorf("observed %d pins taking %vs, want 1 taking at least 40ms", gotPins-pins, gotPinSum-pinSum)
+	}
+	gotTotals, gotTotalSum := histogramSamples(t, snapDuration.WithLabelValues(outcomeSuccess))
+	if gotTotals-totals != 1 || gotTotalSum-totalSum < 0.06 {
+		t.Errorf("observed %d requests taking %vs, want 1 taking at least 60ms", gotTotals-totals, gotTotalSum-totalSum)
+	}
+}
+
+func TestExistsEndpoint(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	h := newTestServer(t, c, nil)
+	cid, unknown := testCID("cached"), testCID("unknown")
+	cachedAt := time.UnixMilli(time.Now().UnixMilli()).UTC()
+	c.index.Put(CacheEntry{CID: cid, Hash: "abcd", Size: 8, CachedAt: cachedAt})
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		want       SnapshotExists
+	}{
+		{name: "by cid", query: "cid=" + cid, wantStatus: http.StatusOK, want: SnapshotExists{Cached: true, CID: cid, CachedAt: &cachedAt}},
+		{name: "by hash", query: "cid=" + unknown + "&hash=abcd", wantStatus: http.StatusOK, want: SnapshotExists{Cached: true, CID: cid, CachedAt: &cachedAt}},
+		{name: "hash only", query: "hash=abcd", wantStatus: http.StatusOK, want: SnapshotExists{Cached: true, CID: cid, CachedAt: &cachedAt}},
+		{name: "unknown", query: "cid=" + unknown + "&hash=ffff", wantStatus: http.StatusOK},
+		{name: "invalid cid", query: "cid=nope", wantStatus: http.StatusBadRequest},
+		{name: "neither", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		w := get(h, "/api/qaku/v1/exists?"+tt.query, nil)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.wantStatus)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var got SnapshotExists
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Cached != tt.want.Cached || got.CID != tt.want.CID || (got.CachedAt == nil) != (tt.want.CachedAt == nil) ||
+			(got.CachedAt != nil && !got.CachedAt.Equal(*tt.want.CachedAt)) {
+			t.Errorf("%s: got %s, want %+v", tt.name, w.Body, tt.want)
+		}
+	}
+	if m.Calls("manifest")+m.Calls("download")+m.Calls("debug_info") != 0 {
+		t.Error("the exists endpoint called Codex")
+	}
+}
+
+func TestFlushSurvivesUncleanExit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.db")
+	c, err := NewCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	served := time.UnixMilli(time.Now().UnixMilli()).UTC()
+	cids := []string{testCID("first"), testCID("second")}
+	for _, cid := range cids {
+		c.index.Put(CacheEntry{CID: cid, Owner: "alice", Size: 8, CachedAt: served})
+	}
+	c.index.Served(cids[0], served)
+
+	// A copy of the open database is what a killed process leaves behind.
+	reopen := func(name string) *Cache {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied := filepath.Join(dir, name)
+		if err := os.WriteFile(copied, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewCache(copied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	if e, _ := reopen("unflushed.db").index.Get(cids[0]); !e.LastServedAt.IsZero() {
+		t.Fatal("the serve time was written before the flush")
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	flushed := reopen("flushed.db")
+	for _, cid := range cids {
+		if !flushed.index.Has(cid) {
+			t.Errorf("%s is missing after a reopen", cid)
+		}
+	}
+	if e, _ := flushed.index.Get(cids[0]); !e.LastServedAt.Equal(served) {
+		t.Errorf("served at %s after a reopen, want %s", e.LastServedAt, served)
+	}
+}
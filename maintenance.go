@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var snapMaintenanceSkipped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qaku_cache_maintenance_skipped",
+	Help: "The total number of messages skipped because maintenance mode was on",
+})
+
+// maintenanceStore persists the maintenance mode across restarts.
+type maintenanceStore interface {
+	LoadMaintenance() (bool, error)
+	SaveMaintenance(on bool) error
+}
+
+// MaintenanceRequest switches maintenance mode on or off.
+type MaintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// maintenanceMode pauses caching of new datasets while the HTTP API keeps
+// serving cached snapshots. A nil store keeps it in memory only.
+type maintenanceMode struct {
+	on    atomic.Bool
+	store maintenanceStore
+}
+
+func loadMaintenanceMode(store maintenanceStore) (*maintenanceMode, error) {
+	m := &maintenanceMode{store: store}
+	if store == nil {
+		return m, nil
+	}
+
+	on, err := store.LoadMaintenance()
+	if err != nil {
+		return nil, err
+	}
+	m.on.Store(on)
+
+	return m, nil
+}
+
+func (m *maintenanceMode) On() bool {
+	return m.on.Load()
+}
+
+// Set switches the mode and persists it.
+func (m *maintenanceMode) Set(on bool) error {
+	m.on.Store(on)
+	if m.store == nil {
+		return nil
+	}
+
+	return m.store.SaveMaintenance(on)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	b := newTestFSBackend(t)
+	c := newTestCache(t)
+	c.backend = b
+	corsCfg, err := corsConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newWorkerPool(0, 1, priorityNormal, dropNewest, c.OnNewEnvelope)
+	srv := server("127.0.0.1:0", nil, corsCfg, 0, nil, discardLogger(), c, pool, testAdmin, nil, nil)
+	t.Cleanup(func() { srv.Close() })
+	h := srv.Handler
+
+	cached, skippedCID := testCID("cached"), testCID("skipped")
+	addDataset(t, b, cached, []byte("snapshot"))
+	addDataset(t, b, skippedCID, []byte("snapshot"))
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cached, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+
+	toggle := func(enabled string) {
+		t.Helper()
+		w := do(h, http.MethodPost, "/api/qaku/v1/maintenance", adminHeader(), strings.NewReader(`{"enabled":`+enabled+`}`))
+		if w.Code != http.StatusOK || w.Body.String() != `{"maintenance":`+enabled+`}` {
+			t.Fatalf("switching maintenance answered %d %s", w.Code, w.Body)
+		}
+	}
+	inStats := func() bool {
+		t.Helper()
+		var stats StatsSummary
+		if err := json.Unmarshal(get(h, "/api/qaku/v1/stats", nil).Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats.Maintenance
+	}
+
+	if w := do(h, http.MethodPost, "/api/qaku/v1/maintenance", nil, strings.NewReader(`{"enabled":true}`)); w.Code != http.StatusUnauthorized {
+		t.Errorf("switched maintenance without a token: %d", w.Code)
+	}
+
+	toggle("true")
+	if !inStats() {
+		t.Error("stats do not report maintenance mode")
+	}
+	skipped := testutil.ToFloat64(snapMaintenanceSkipped)
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, skippedCID, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+	manual := do(h, http.MethodPost, "/api/qaku/v1/cache", adminHeader(), strings.NewReader(`{"cid":"`+skippedCID+`","owner":"alice"}`))
+	if manual.Code != http.StatusServiceUnavailable || pool.Stats().Queued != 0 {
+		t.Errorf("manual request answered %d and queued %d jobs in maintenance mode, want 503 and none", manual.Code, pool.Stats().Queued)
+	}
+	if got := decodeAPIError(t, manual.Body.Bytes()); got.Code != "service_unavailable" {
+		t.Errorf("got %+v, want the error envelope", got)
+	}
+	if c.index.Has(skippedCID) {
+		t.Error("cached a dataset in maintenance mode")
+	}
+	if got := testutil.ToFloat64(snapMaintenanceSkipped) - skipped; got != 2 {
+		t.Errorf("counted %v skipped requests, want 2", got)
+	}
+	if w := get(h, "/api/qaku/v1/snapshot/"+cached, nil); w.Code != http.StatusOK || w.Body.String() != "snapshot" {
+		t.Errorf("got %d %q in maintenance mode, want the cached snapshot", w.Code, w.Body.String())
+	}
+
+	toggle("false")
+	if inStats() {
+		t.Error("stats still report maintenance mode")
+	}
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, skippedCID, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+	if !c.index.Has(skippedCID) {
+		t.Error("caching did not resume after maintenance")
+	}
+}
+
+func TestMaintenanceModePersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c, err := NewCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.maintenance.Set(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.maintenance.On() {
+		t.Error("maintenance mode was lost on a restart")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	mimeJSON = "application/json"
+	mimeCBOR = "application/cbor"
+)
+
+// cborHandle encodes with the json field names so both formats share a
+// schema.
+var cborHandle = &codec.CborHandle{}
+
+// manifestFormat picks the response encoding from the format query param,
+// falling back to the Accept header. JSON is the default.
+func manifestFormat(query string, accept string) string {
+	switch strings.ToLower(query) {
+	case "cbor":
+		return mimeCBOR
+	case "json":
+		return mimeJSON
+	}
+
+	if strings.Contains(accept, mimeCBOR) {
+		return mimeCBOR
+	}
+
+	return mimeJSON
+}
+
+func encodeCBOR(v any) ([]byte, error) {
+	var out []byte
+	err := codec.NewEncoderBytes(&out, cborHandle).Encode(v)
+
+	return out, err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestManifestFormat(t *testing.T) {
+	tests := []struct {
+		query  string
+		accept string
+		want   string
+	}{
+		{want: mimeJSON},
+		{query: "cbor", want: mimeCBOR},
+		{query: "CBOR", accept: mimeJSON, want: mimeCBOR},
+		{query: "json", accept: mimeCBOR, want: mimeJSON},
+		{accept: "application/cbor, application/json;q=0.5", want: mimeCBOR},
+		{accept: "text/html", want: mimeJSON},
+		{query: "xml", want: mimeJSON},
+	}
+
+	for _, tt := range tests {
+		if got := manifestFormat(tt.query, tt.accept); got != tt.want {
+			t.Errorf("manifestFormat(%q, %q) = %s, want %s", tt.query, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestManifestEndpointCBOR(t *testing.T) {
+	m := newMockCodex(t)
+	cid := testCID("manifest")
+	m.Add(cid, []byte("manifest data"))
+	h := newTestServer(t, newTestCache(t), nil)
+
+	jw := get(h, "/api/qaku/v1/manifest/"+cid, nil)
+	if jw.Code != http.StatusOK || jw.Header().Get("Content-Type") != mimeJSON+"; charset=utf-8" {
+		t.Fatalf("got %d %s, want JSON by default", jw.Code, jw.Header().Get("Content-Type"))
+	}
+	var fromJSON CodexDataContent
+	if err := json.Unmarshal(jw.Body.Bytes(), &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	cw := get(h, "/api/qaku/v1/manifest/"+cid, http.Header{"Accept": {mimeCBOR}})
+	if cw.Code != http.StatusOK || cw.Header().Get("Content-Type") != mimeCBOR {
+		t.Fatalf("got %d %s, want CBOR", cw.Code, cw.Header().Get("Content-Type"))
+	}
+	if cw.Body.Len() >= jw.Body.Len() {
+		t.Errorf("CBOR manifest is %d bytes, JSON %d", cw.Body.Len(), jw.Body.Len())
+	}
+
+	var fromCBOR CodexDataContent
+	if err := codec.NewDecoderBytes(cw.Body.Bytes(), cborHandle).Decode(&fromCBOR); err != nil {
+		t.Fatal(err)
+	}
+	if fromCBOR != fromJSON {
+		t.Errorf("CBOR manifest decodes to %+v, JSON to %+v", fromCBOR, fromJSON)
+	}
+
+	// Clients decoding into a map see the JSON field names.
+	fields := map[string]any{}
+	if err := codec.NewDecoderBytes(cw.Body.Bytes(), cborHandle).Decode(&fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["manifest"]; !ok {
+		t.Errorf("CBOR manifest has fields %v, want the JSON names", fields)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envMemoryLimit         = "QAKU_CACHE_MEMORY_LIMIT"
+	envMemoryCheckInterval = "QAKU_CACHE_MEMORY_CHECK_INTERVAL"
+	envMemoryShedQueue     = "QAKU_CACHE_MEMORY_SHED_QUEUE"
+
+	defaultMemoryCheckInterval = 30 * time.Second
+
+	shedAllowances = "allowances"
+	shedDuplicates = "duplicates"
+	shedBodies     = "bodies"
+	shedEnvelopes  = "envelopes"
+)
+
+var memoryPressureShed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "qaku_cache_memory_pressure_shed_items",
+	Help: "The total number of in-memory items shed because the Go heap crossed the memory limit, by kind",
+}, []string{"kind"})
+
+// shedder releases in-memory state under memory pressure and returns the
+// number of items it dropped.
+type shedder struct {
+	kind string
+	shed func() int
+}
+
+// heapAlloc returns the bytes of allocated heap objects.
+func heapAlloc() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	return ms.HeapAlloc
+}
+
+// watchMemory relieves memory pressure whenever the Go heap grows beyond
+// limit bytes.
+func watchMemory(ctx context.Context, limit uint64, interval time.Duration, heap func() uint64, shedders ...shedder) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			relieveMemory(limit, heap, shedders)
+		}
+	}
+}
+
+// relieveMemory runs the shedders in order until the heap is back below
+// limit, so the later ones are only a last resort.
+func relieveMemory(limit uint64, heap func() uint64, shedders []shedder) {
+	h := heap()
+	for _, s := range shedders {
+		if h < limit {
+			return
+		}
+
+		n := s.shed()
+		if n == 0 {
+			continue
+		}
+		memoryPressureShed.WithLabelValues(s.kind).Add(float64(n))
+
+		// The shed state only leaves the heap once it is collected.
+		runtime.GC()
+		after := heap()
+		slog.Warn("memory pressure, shedding", "kind", s.kind, "heap", h, "heapAfter", after, "limit", limit, "shed", n)
+		h = after
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRelieveMemory(t *testing.T) {
+	bodies, err := newBodyCache(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cid := range []string{testCID("old"), testCID("older"), testCID("recent")} {
+		tmp, err := bodies.Create(cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmp.WriteString("snapshot")
+		tmp.Close()
+		if err := bodies.Commit(cid, tmp.Name(), int64(len("snapshot"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool := newWorkerPool(0, 10, priorityNormal, dropNewest, nil)
+	for i := 0; i < 4; i++ {
+		pool.Submit(testEnvelope([]byte{byte(i)}), sourceWaku)
+	}
+
+	// The heap drops below the limit once the given number of shedders ran.
+	heapAfter := func(shedders int, calls *int) func() uint64 {
+		return func() uint64 {
+			*calls++
+			if *calls > shedders {
+				return 0
+			}
+			return 100
+		}
+	}
+	// Nothing to shed is skipped without collecting or counting.
+	dedup := newDeduplicator(time.Minute, 10, nil)
+	shedders := []shedder{{kind: shedDuplicates, shed: dedup.Shed}, {kind: shedBodies, shed: bodies.Shed}, {kind: shedEnvelopes, shed: pool.Shed}}
+	shedDuplicateCount := testutil.ToFloat64(memoryPressureShed.WithLabelValues(shedDuplicates))
+	shedBodyCount := testutil.ToFloat64(memoryPressureShed.WithLabelValues(shedBodies))
+	shedEnvelopeCount := testutil.ToFloat64(memoryPressureShed.WithLabelValues(shedEnvelopes))
+	dropped := testutil.ToFloat64(snapQueueDropped.WithLabelValues(sourceWaku))
+
+	calls := 0
+	relieveMemory(100, heapAfter(0, &calls), shedders)
+	if len(bodies.items) != 3 || pool.Stats().Queued != 4 {
+		t.Fatal("shed state below the memory limit")
+	}
+
+	calls = 0
+	relieveMemory(100, heapAfter(1, &calls), shedders)
+	if len(bodies.items) != 1 {
+		t.Errorf("%d bodies left, want the older half shed", len(bodies.items))
+	}
+	if _, _, ok := bodies.Open(testCID("recent")); !ok {
+		t.Error("shed the most recently served body")
+	}
+	if entries, _ := os.ReadDir(bodies.dir); len(entries) != 1 {
+		t.Errorf("%d body files left, want 1", len(entries))
+	}
+	if pool.Stats().Queued != 4 {
+		t.Error("shed queued envelopes although the bodies relieved the pressure")
+	}
+
+	calls = 0
+	relieveMemory(100, heapAfter(2, &calls), shedders)
+	if got := pool.Stats().Queued; got != 2 {
+		t.Errorf("%d envelopes queued, want the older half shed as a last resort", got)
+	}
+
+	if got := testutil.ToFloat64(memoryPressureShed.WithLabelValues(shedDuplicates)) - shedDuplicateCount; got != 0 {
+		t.Errorf("counted %v shed duplicates, want none from an empty window", got)
+	}
+	if got := testutil.ToFloat64(memoryPressureShed.WithLabelValues(shedBodies)) - shedBodyCount; got != 3 {
+		t.Errorf("counted %v shed bodies, want 3", got)
+	}
+	if got := testutil.ToFloat64(memoryPressureShed.WithLabelValues(shedEnvelopes)) - shedEnvelopeCount; got != 2 {
+		t.Errorf("counted %v shed envelopes, want 2", got)
+	}
+	if got := testutil.ToFloat64(snapQueueDropped.WithLabelValues(sourceWaku)) - dropped; got != 2 {
+		t.Errorf("counted %v dropped envelopes, want the shed ones", got)
+	}
+	if _, err := os.Stat(filepath.Join(bodies.dir, testCID("old"))); !os.IsNotExist(err) {
+		t.Errorf("body of a shed entry: %v, want it removed", err)
+	}
+}
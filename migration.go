@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/waku-org/go-waku/waku/v2/api/filter"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+)
+
+const (
+	envDeprecatedTopics      = "QAKU_CACHE_DEPRECATED_CONTENT_TOPICS"
+	envDeprecatedTopicsUntil = "QAKU_CACHE_DEPRECATED_TOPICS_UNTIL"
+
+	migrationProgressInterval = time.Hour
+)
+
+// topicMigration keeps the node subscribed to deprecated content topics next
+// to the primary ones until a deadline, after which they are unsubscribed and
+// their envelopes no longer accepted.
+type topicMigration struct {
+	topics  topicMatcher
+	until   time.Time
+	filters []protocol.ContentFilter
+
+	mu  sync.Mutex
+	ids []string
+}
+
+// parseTopicMigration reads the deprecated topics and their expiry, given as
+// an RFC 3339 time or as a duration from now. It returns nil if no deprecated
+// topics are configured.
+func parseTopicMigration(topics string, until string, pubsubTopic string, now time.Time) (*topicMigration, error) {
+	if topics == "" {
+		return nil, nil
+	}
+
+	m, err := parseTopicMatcher(topics)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", envDeprecatedTopics, err)
+	}
+
+	var deadline time.Time
+	if d, err := time.ParseDuration(until); err == nil {
+		deadline = now.Add(d)
+	} else if deadline, err = time.Parse(time.RFC3339, until); err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 time or a duration, got %q", envDeprecatedTopicsUntil, until)
+	}
+
+	checkTopicShards(m, pubsubTopic)
+
+	return &topicMigration{
+		topics:  m,
+		until:   deadline,
+		filters: contentFilters(m, pubsubTopic),
+	}, nil
+}
+
+// Match reports whether topic is a deprecated topic that is still accepted.
+func (m *topicMigration) Match(topic string) bool {
+	if m == nil || !time.Now().Before(m.until) {
+		return false
+	}
+
+	return m.topics.Match(topic)
+}
+
+// Subscribe subscribes the deprecated topics unless they already expired.
+func (m *topicMigration) Subscribe(fm *filter.FilterManager) {
+	if m == nil || !time.Now().Before(m.until) {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, cf := range m.filters {
+		id := uuid.NewString()
+		fm.SubscribeFilter(id, cf)
+		m.ids = append(m.ids, id)
+	}
+}
+
+// run logs the remaining transition time and unsubscribes the deprecated
+// topics once it is over.
+func (m *topicMigration) run(ctx context.Context, fm *filter.FilterManager) {
+	ticker := time.NewTicker(migrationProgressInterval)
+	defer ticker.Stop()
+
+	expire := time.NewTimer(time.Until(m.until))
+	defer expire.Stop()
+
+	slog.Info("migrating from deprecated content topics", "topics", m.topics, "until", m.until.Format(time.RFC3339))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			slog.Info("deprecated content topics expire soon", "topics", m.topics, "in", time.Until(m.until).Round(time.Minute))
+		case <-expire.C:
+			m.mu.Lock()
+			for _, id := range m.ids {
+				fm.UnsubscribeFilter(id)
+			}
+			m.ids = nil
+			m.mu.Unlock()
+
+			slog.Info("migration finished, unsubscribed deprecated content topics", "topics", m.topics)
+			return
+		}
+	}
+}
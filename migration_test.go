@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/waku-org/go-waku/waku/v2/api/filter"
+	"github.com/waku-org/go-waku/waku/v2/node"
+	"go.uber.org/zap"
+)
+
+func TestParseTopicMigration(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		topics  string
+		until   string
+		want    time.Time
+		wantNil bool
+		wantErr bool
+	}{
+		{topics: "", until: "24h", wantNil: true},
+		{topics: "/0/qaku/0/persist/json", until: "24h", want: now.Add(24 * time.Hour)},
+		{topics: "/0/qaku/0/persist/json", until: "2024-02-01T00:00:00Z", want: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{topics: "/0/qaku/0/persist/json", until: "next week", wantErr: true},
+		{topics: "/0/qaku/0/persist/json", until: "", wantErr: true},
+		{topics: "/0/qa*/0/persist/json", until: "24h", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		m, err := parseTopicMigration(tt.topics, tt.until, "", now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTopicMigration(%q, %q) = %v, want error %t", tt.topics, tt.until, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if (m == nil) != tt.wantNil {
+			t.Errorf("parseTopicMigration(%q, %q) = %v, want nil %t", tt.topics, tt.until, m, tt.wantNil)
+			continue
+		}
+		if m != nil && !m.until.Equal(tt.want) {
+			t.Errorf("parseTopicMigration(%q, %q) expires at %s, want %s", tt.topics, tt.until, m.until, tt.want)
+		}
+	}
+}
+
+func TestTopicMigrationExpires(t *testing.T) {
+	wn, err := node.New(node.WithHostAddress(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}), node.WithWakuFilterLightNode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := wn.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer wn.Stop()
+	fm := filter.NewFilterManager(ctx, zap.NewNop(), 1, &countingProcessor{}, wn.FilterLightnode())
+
+	const deprecated = "/qaku/0/persist/json"
+	m, err := parseTopicMigration("/0"+deprecated, "200ms", "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Subscribe(fm)
+	if len(m.ids) != 1 {
+		t.Fatalf("subscribed %d deprecated filters, want 1", len(m.ids))
+	}
+	if !m.Match(deprecated) || m.Match(testContentTopic) {
+		t.Error("the deprecated topic is not matched before the deadline")
+	}
+
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		m.run(ctx, fm)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the deprecated topics were not unsubscribed")
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("unsubscribed after %s, before the deadline", elapsed)
+	}
+	if len(m.ids) != 0 {
+		t.Errorf("%d deprecated subscriptions left", len(m.ids))
+	}
+	if m.Match(deprecated) {
+		t.Error("the deprecated topic is still matched after the deadline")
+	}
+
+	// Resubscribing after a node restart must not bring them back.
+	m.Subscribe(fm)
+	if len(m.ids) != 0 {
+		t.Error("expired deprecated topics were subscribed again")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/multiformats/go-multiaddr"
+	"github.com/waku-org/go-waku/waku/v2/node"
+)
+
+// Overrides of the announced Waku addresses for nodes behind NAT.
+const (
+	envExtIP      = "QAKU_CACHE_EXT_IP"
+	envExtTCPPort = "QAKU_CACHE_EXT_TCP_PORT"
+	envExtUDPPort = "QAKU_CACHE_EXT_UDP_PORT"
+)
+
+// externalAddr is the publicly reachable address of the node, the zero value
+// keeps announcing the addresses the node detects itself.
+type externalAddr struct {
+	// IP is QAKU_CACHE_EXT_IP, announced in the ENR and the multiaddrs.
+	IP net.IP
+	// TCPPort is QAKU_CACHE_EXT_TCP_PORT, the libp2p port, defaults to the
+	// Waku port.
+	TCPPort int
+	// UDPPort is QAKU_CACHE_EXT_UDP_PORT, the discv5 port. go-waku announces
+	// the port discv5 listens on, so it has to match the discv5 port.
+	UDPPort int
+}
+
+// parseExternalAddr validates the external address overrides against the
+// local Waku and discv5 ports.
+func parseExternalAddr(ip string, tcpPort int, udpPort int, wakuPort int, discV5Port int) (externalAddr, error) {
+	if ip == "" {
+		if tcpPort != 0 || udpPort != 0 {
+			return externalAddr{}, fmt.Errorf("%s and %s require %s", envExtTCPPort, envExtUDPPort, envExtIP)
+		}
+		return externalAddr{}, nil
+	}
+
+	ext := externalAddr{IP: net.ParseIP(ip), TCPPort: tcpPort, UDPPort: udpPort}
+	if ext.IP == nil {
+		return externalAddr{}, fmt.Errorf("invalid %s %q", envExtIP, ip)
+	}
+
+	if ext.TCPPort == 0 {
+		ext.TCPPort = wakuPort
+	}
+	if ext.TCPPort <= 0 || ext.TCPPort > 65535 {
+		return externalAddr{}, fmt.Errorf("%s must be a port number, got %d", envExtTCPPort, ext.TCPPort)
+	}
+
+	if ext.UDPPort == 0 {
+		ext.UDPPort = discV5Port
+	}
+	if ext.UDPPort != discV5Port {
+		return externalAddr{}, fmt.Errorf("%s must equal %s (%d), the announced discv5 port is the listening one", envExtUDPPort, envDiscV5Port, discV5Port)
+	}
+
+	return ext, nil
+}
+
+// options returns the node options announcing the external address.
+func (e externalAddr) options() ([]node.WakuNodeOption, error) {
+	if e.IP == nil {
+		return nil, nil
+	}
+
+	proto := "ip4"
+	if e.IP.To4() == nil {
+		proto = "ip6"
+	}
+	addr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/%s/%s/tcp/%s", proto, e.IP, strconv.Itoa(e.TCPPort)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid external address: %w", err)
+	}
+
+	return []node.WakuNodeOption{node.WithAdvertiseAddresses(addr)}, nil
+}
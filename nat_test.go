@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/waku-org/go-waku/waku/v2/node"
+	"go.uber.org/zap"
+)
+
+func TestParseExternalAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      string
+		tcpPort int
+		udpPort int
+		want    externalAddr
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "ip only", ip: "203.0.113.7", want: externalAddr{IP: net.ParseIP("203.0.113.7"), TCPPort: 60000, UDPPort: 9000}},
+		{name: "tcp port", ip: "203.0.113.7", tcpPort: 30303, want: externalAddr{IP: net.ParseIP("203.0.113.7"), TCPPort: 30303, UDPPort: 9000}},
+		{name: "ipv6", ip: "2001:db8::1", want: externalAddr{IP: net.ParseIP("2001:db8::1"), TCPPort: 60000, UDPPort: 9000}},
+		{name: "ports without ip", tcpPort: 30303, wantErr: true},
+		{name: "invalid ip", ip: "example.com", wantErr: true},
+		{name: "invalid tcp port", ip: "203.0.113.7", tcpPort: 70000, wantErr: true},
+		{name: "other udp port", ip: "203.0.113.7", udpPort: 9001, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseExternalAddr(tt.ip, tt.tcpPort, tt.udpPort, 60000, 9000)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseExternalAddr = %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !got.IP.Equal(tt.want.IP) || got.TCPPort != tt.want.TCPPort || got.UDPPort != tt.want.UDPPort {
+			t.Errorf("%s: parseExternalAddr = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExternalAddrAnnounced(t *testing.T) {
+	if opts, err := (externalAddr{}).options(); err != nil || opts != nil {
+		t.Errorf("options of the zero address = %v, %v, want none", opts, err)
+	}
+
+	ext, err := parseExternalAddr("203.0.113.7", 30303, 0, 60000, 9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, err := ext.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append(opts, node.WithHostAddress(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}), node.WithLogger(zap.NewNop()))
+	wn, err := node.New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wn.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer wn.Stop()
+
+	if enr := wn.ENR(); !enr.IP().Equal(ext.IP) || enr.TCP() != 30303 {
+		t.Errorf("announced %s:%d in the ENR, want %s:30303", enr.IP(), enr.TCP(), ext.IP)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/waku-org/go-waku/waku/v2/node"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+)
+
+type NodeInfo struct {
+	PeerID        string              `json:"peerId"`
+	ListenAddrs   []string            `json:"listenAddrs"`
+	ENR           string              `json:"enr"`
+	ClusterID     uint16              `json:"clusterId"`
+	Shards        []string            `json:"shards"`
+	ContentTopics map[string][]string `json:"contentTopics"`
+}
+
+// nodeInfo describes this node's own Waku identity and the shards it is
+// subscribed to through cfs.
+func nodeInfo(wn *node.WakuNode, cfs []protocol.ContentFilter) NodeInfo {
+	info := NodeInfo{
+		PeerID:        wn.ID(),
+		ListenAddrs:   []string{},
+		ClusterID:     wn.ClusterID(),
+		Shards:        []string{},
+		ContentTopics: make(map[string][]string),
+	}
+
+	for _, addr := range wn.ListenAddresses() {
+		info.ListenAddrs = append(info.ListenAddrs, addr.String())
+	}
+
+	if enr := wn.ENR(); enr != nil {
+		info.ENR = enr.String()
+	}
+
+	for _, cf := range cfs {
+		info.Shards = append(info.Shards, cf.PubsubTopic)
+		info.ContentTopics[cf.PubsubTopic] = cf.ContentTopicsList()
+	}
+	sort.Strings(info.Shards)
+
+	return info
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	envOwnerListsPath = "QAKU_CACHE_OWNER_LISTS_PATH"
+	envOwnerAllowlist = "QAKU_CACHE_OWNER_ALLOWLIST"
+	envOwnerDenylist  = "QAKU_CACHE_OWNER_DENYLIST"
+
+	listAllow = "allow"
+	listDeny  = "deny"
+)
+
+// ownerLists holds the owner allowlist and denylist. When the allowlist is
+// non-empty only listed owners are cached, the denylist always wins. Changes
+// are written to path (if set) so they survive restarts. Owners configured
+// via env are fixed: they always apply and are never written to path.
+type ownerLists struct {
+	mu    sync.RWMutex
+	path  string
+	dirty bool
+	allow map[string]struct{}
+	deny  map[string]struct{}
+
+	fixedAllow map[string]struct{}
+	fixedDeny  map[string]struct{}
+}
+
+// errOwnerFixed is returned when removing an owner configured via env.
+var errOwnerFixed = errors.New("owner is configured via env and cannot be removed")
+
+type OwnerListsSnapshot struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// loadOwnerLists reads the lists from path and adds the fixed owners, given
+// as comma separated lists.
+func loadOwnerLists(path string, fixedAllow string, fixedDeny string) (*ownerLists, error) {
+	l := &ownerLists{
+		path:       path,
+		fixedAllow: ownerSet(fixedAllow),
+		fixedDeny:  ownerSet(fixedDeny),
+	}
+	if path == "" {
+		slog.Warn("owner list changes made through the admin API are lost on restart", "env", envOwnerListsPath)
+	}
+
+	snap, err := readOwnerLists(path)
+	if err != nil {
+		return nil, err
+	}
+	l.set(snap)
+
+	return l, nil
+}
+
+func readOwnerLists(path string) (OwnerListsSnapshot, error) {
+	snap := OwnerListsSnapshot{}
+	if path == "" {
+		return snap, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return snap, nil
+	}
+	if err != nil {
+		return snap, err
+	}
+
+	err = json.Unmarshal(data, &snap)
+	if err != nil {
+		return snap, fmt.Errorf("failed to parse owner lists %s: %w", path, err)
+	}
+
+	return snap, nil
+}
+
+func ownerSet(s string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, o := range strings.Split(s, ",") {
+		o = strings.TrimSpace(o)
+		if o != "" {
+			set[o] = struct{}{}
+		}
+	}
+
+	return set
+}
+
+// set replaces the persisted lists, the caller must hold the write lock or
+// own l exclusively.
+func (l *ownerLists) set(snap OwnerListsSnapshot) {
+	l.allow = make(map[string]struct{})
+	l.deny = make(map[string]struct{})
+	for _, o := range snap.Allow {
+		l.allow[o] = struct{}{}
+	}
+	for _, o := range snap.Deny {
+		l.deny[o] = struct{}{}
+	}
+}
+
+// Reload rereads the lists from path. Changes not yet written to disk are
+// lost.
+func (l *ownerLists) Reload() error {
+	snap, err := readOwnerLists(l.path)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.dirty {
+		slog.Warn("reloading owner lists drops changes that were not saved yet")
+	}
+	l.set(snap)
+	l.dirty = false
+
+	return nil
+}
+
+// reloadOnHangup reloads the owner lists whenever the process receives
+// SIGHUP.
+func reloadOnHangup(ctx context.Context, l *ownerLists) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		err := l.Reload()
+		if err != nil {
+			slog.Error("failed to reload owner lists", "error", err)
+			continue
+		}
+
+		snap := l.Snapshot()
+		slog.Info("reloaded owner lists", "allowed", len(snap.Allow), "denied", len(snap.Deny))
+	}
+}
+
+// Allowed reports whether requests from owner may be cached. A nil list allows
+// everyone.
+func (l *ownerLists) Allowed(owner string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if _, ok := l.deny[owner]; ok {
+		return false
+	}
+	if _, ok := l.fixedDeny[owner]; ok {
+		return false
+	}
+
+	if len(l.allow) == 0 && len(l.fixedAllow) == 0 {
+		return true
+	}
+
+	_, ok := l.allow[owner]
+	if !ok {
+		_, ok = l.fixedAllow[owner]
+	}
+	return ok
+}
+
+func (l *ownerLists) list(name string) (map[string]struct{}, error) {
+	switch name {
+	case listAllow:
+		return l.allow, nil
+	case listDeny:
+		return l.deny, nil
+	}
+
+	return nil, fmt.Errorf("unknown list %q", name)
+}
+
+func (l *ownerLists) fixed(name string) map[string]struct{} {
+	if name == listDeny {
+		return l.fixedDeny
+	}
+
+	return l.fixedAllow
+}
+
+// Add puts owner on the named list and persists the change. The change takes
+// effect even if it cannot be written to disk, the write is retried by Flush.
+func (l *ownerLists) Add(name string, owner string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list, err := l.list(name)
+	if err != nil {
+		return err
+	}
+
+	list[owner] = struct{}{}
+	l.save()
+
+	return nil
+}
+
+// Remove takes owner off the named list, persists the change and reports
+// whether the owner was listed. Owners configured via env cannot be removed,
+// errOwnerFixed is returned for them. As with Add, persistence failures are
+// retried by Flush rather than returned.
+func (l *ownerLists) Remove(name string, owner string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list, err := l.list(name)
+	if err != nil {
+		return false, err
+	}
+
+	if _, ok := l.fixed(name)[owner]; ok {
+		return false, errOwnerFixed
+	}
+	if _, ok := list[owner]; !ok {
+		return false, nil
+	}
+	delete(list, owner)
+	l.save()
+
+	return true, nil
+}
+
+// Flush writes the lists to disk if a previous save failed.
+func (l *ownerLists) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.dirty {
+		return nil
+	}
+
+	return l.save()
+}
+
+// Snapshot returns the effective lists, including the fixed owners.
+func (l *ownerLists) Snapshot() OwnerListsSnapshot {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return listSnapshot(union(l.allow, l.fixedAllow), union(l.deny, l.fixedDeny))
+}
+
+// snapshot returns the lists to persist.
+func (l *ownerLists) snapshot() OwnerListsSnapshot {
+	return listSnapshot(l.allow, l.deny)
+}
+
+func listSnapshot(allow map[string]struct{}, deny map[string]struct{}) OwnerListsSnapshot {
+	snap := OwnerListsSnapshot{Allow: []string{}, Deny: []string{}}
+	for o := range allow {
+		snap.Allow = append(snap.Allow, o)
+	}
+	for o := range deny {
+		snap.Deny = append(snap.Deny, o)
+	}
+	sort.Strings(snap.Allow)
+	sort.Strings(snap.Deny)
+
+	return snap
+}
+
+func union(a map[string]struct{}, b map[string]struct{}) map[string]struct{} {
+	u := make(map[string]struct{}, len(a)+len(b))
+	for o := range a {
+		u[o] = struct{}{}
+	}
+	for o := range b {
+		u[o] = struct{}{}
+	}
+
+	return u
+}
+
+// save writes the lists to disk, the caller must hold the write lock.
+func (l *ownerLists) save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	err := l.write()
+	l.dirty = err != nil
+	persistence.Report("owner lists", err)
+
+	return err
+}
+
+func (l *ownerLists) write() error {
+	data, err := json.MarshalIndent(l.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := l.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, l.path)
+}
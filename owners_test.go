@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeOwnerLists stores the lists at a fresh path and returns it.
+func writeOwnerLists(t *testing.T, path string, data string) string {
+	t.Helper()
+
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "owners.json")
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestOwnerListsAllowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string
+		fixedAllow string
+		fixedDeny  string
+		allowed    []string
+		denied     []string
+	}{
+		{name: "no lists", allowed: []string{"alice", "bob"}},
+		{name: "allowlist", file: `{"allow":["alice"]}`, allowed: []string{"alice"}, denied: []string{"bob"}},
+		{name: "denylist", file: `{"deny":["bob"]}`, allowed: []string{"alice"}, denied: []string{"bob"}},
+		{name: "deny wins", file: `{"allow":["alice","bob"],"deny":["bob"]}`, allowed: []string{"alice"}, denied: []string{"bob", "carol"}},
+		{name: "env allowlist", fixedAllow: "alice, carol", allowed: []string{"alice", "carol"}, denied: []string{"bob"}},
+		{name: "env denylist", file: `{"allow":["alice"]}`, fixedDeny: "alice", denied: []string{"alice", "bob"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = writeOwnerLists(t, "", tt.file)
+			}
+			l, err := loadOwnerLists(path, tt.fixedAllow, tt.fixedDeny)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, o := range tt.allowed {
+				if !l.Allowed(o) {
+					t.Errorf("%s is denied", o)
+				}
+			}
+			for _, o := range tt.denied {
+				if l.Allowed(o) {
+					t.Errorf("%s is allowed", o)
+				}
+			}
+		})
+	}
+
+	var nilLists *ownerLists
+	if !nilLists.Allowed("anyone") {
+		t.Error("nil lists deny an owner")
+	}
+}
+
+func TestOwnerListsFixedOwnersCannotBeRemoved(t *testing.T) {
+	l, err := loadOwnerLists("", "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Remove(listAllow, "alice"); !errors.Is(err, errOwnerFixed) {
+		t.Errorf("Remove = %v, want %v", err, errOwnerFixed)
+	}
+	if err := l.Add(listDeny, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := l.Remove(listDeny, "bob"); !removed || err != nil {
+		t.Errorf("Remove = %t, %v, want the added owner removed", removed, err)
+	}
+}
+
+func TestOwnerListsReloadOnHangup(t *testing.T) {
+	path := writeOwnerLists(t, "", `{"allow":["alice"]}`)
+	l, err := loadOwnerLists(path, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Catch SIGHUP here too, so a signal sent before reloadOnHangup has
+	// installed its handler does not end the test binary.
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, syscall.SIGHUP)
+	defer signal.Stop(guard)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloadOnHangup(ctx, l)
+
+	writeOwnerLists(t, path, `{"allow":["bob"]}`)
+	// The handler may not be installed yet, keep signalling until it is.
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !l.Allowed("bob") {
+		if time.Now().After(deadline) {
+			t.Fatal("owner lists were not reloaded on SIGHUP")
+		}
+		self.Signal(syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l.Allowed("alice") {
+		t.Error("alice is still allowed after the reload")
+	}
+}
+
+func TestProcessSkipsDeniedOwner(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	var err error
+	c.owners, err = loadOwnerLists("", "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denied := testutil.ToFloat64(snapOwnerDenied)
+	for _, owner := range []string{"alice", "mallory"} {
+		cid := testCID(owner)
+		m.Add(cid, []byte("snapshot"))
+		if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, owner))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !c.index.Has(testCID("alice")) || c.index.Has(testCID("mallory")) {
+		t.Error("want only the allowed owner cached")
+	}
+	if got := testutil.ToFloat64(snapOwnerDenied) - denied; got != 1 {
+		t.Errorf("counted %v denied owners, want 1", got)
+	}
+	if got := m.Calls("manifest"); got != 1 {
+		t.Errorf("made %d manifest requests, want none for the denied owner", got)
+	}
+}
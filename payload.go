@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/waku-org/go-waku/waku/v2/payload"
+	"github.com/waku-org/go-waku/waku/v2/protocol/pb"
+)
+
+const envPayloadKey = "QAKU_CACHE_PAYLOAD_KEY"
+
+// payloadKeySize is the AES-256 key size used by Waku symmetric encryption.
+const payloadKeySize = 32
+
+var snapPayloadDecryptFailed = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qaku_cache_payload_decrypt_failures",
+	Help: "The number of messages whose payload could not be decrypted",
+})
+
+// parsePayloadKey decodes the hex encoded symmetric key, an empty value
+// disables payload decryption.
+func parsePayloadKey(keyHex string) ([]byte, error) {
+	if keyHex == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(strings.TrimPrefix(keyHex, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s encoding", envPayloadKey)
+	}
+	if len(key) != payloadKeySize {
+		return nil, fmt.Errorf("invalid %s: expected %d bytes, got %d", envPayloadKey, payloadKeySize, len(key))
+	}
+
+	return key, nil
+}
+
+// messagePayload returns the payload of msg, decrypted with the symmetric key
+// if one is set. Unencrypted (version 0) messages are passed through so
+// plaintext publishers keep working.
+func messagePayload(msg *pb.WakuMessage, key []byte) ([]byte, error) {
+	if key == nil {
+		return msg.Payload, nil
+	}
+
+	decoded, err := payload.DecodePayload(msg, &payload.KeyInfo{Kind: payload.Symmetric, SymKey: key})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+
+	return decoded.Data, nil
+}
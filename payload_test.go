@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/waku-org/go-waku/waku/v2/payload"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+	"github.com/waku-org/go-waku/waku/v2/protocol/pb"
+)
+
+func TestParsePayloadKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, payloadKeySize)
+
+	tests := []struct {
+		keyHex  string
+		want    []byte
+		wantErr bool
+	}{
+		{keyHex: ""},
+		{keyHex: hex.EncodeToString(key), want: key},
+		{keyHex: "0x" + hex.EncodeToString(key), want: key},
+		{keyHex: hex.EncodeToString(key[:16]), wantErr: true},
+		{keyHex: "not hex", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePayloadKey(tt.keyHex)
+		if (err != nil) != tt.wantErr || !bytes.Equal(got, tt.want) {
+			t.Errorf("parsePayloadKey(%q) = %x, %v, want %x with error %t", tt.keyHex, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// encryptedEnvelope wraps data in a version 1 message encrypted with key.
+func encryptedEnvelope(t *testing.T, data []byte, key []byte) *protocol.Envelope {
+	t.Helper()
+
+	version := uint32(1)
+	msg := &pb.WakuMessage{Payload: data, ContentTopic: testContentTopic, Version: &version}
+	if err := payload.EncodeWakuMessage(msg, &payload.KeyInfo{Kind: payload.Symmetric, SymKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	return protocol.NewEnvelope(msg, time.Now().UnixNano(), testPubsubTopic)
+}
+
+func TestPayloadDecryption(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, payloadKeySize)
+	tests := []struct {
+		name       string
+		envelope   func(t *testing.T, data []byte) *protocol.Envelope
+		wantCached bool
+	}{
+		{name: "encrypted", wantCached: true, envelope: func(t *testing.T, data []byte) *protocol.Envelope {
+			return encryptedEnvelope(t, data, key)
+		}},
+		{name: "plaintext", wantCached: true, envelope: func(t *testing.T, data []byte) *protocol.Envelope {
+			return testEnvelope(data)
+		}},
+		{name: "tampered", envelope: func(t *testing.T, data []byte) *protocol.Envelope {
+			e := encryptedEnvelope(t, data, key)
+			e.Message().Payload[len(e.Message().Payload)-1] ^= 0xff
+			return e
+		}},
+		{name: "other key", envelope: func(t *testing.T, data []byte) *protocol.Envelope {
+			return encryptedEnvelope(t, data, bytes.Repeat([]byte{8}, payloadKeySize))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestFSBackend(t)
+			c := newTestCache(t)
+			c.backend = b
+			c.payloadKey = key
+			cid := testCID(tt.name)
+			addDataset(t, b, cid, []byte("snapshot"))
+
+			failures := testutil.ToFloat64(snapPayloadDecryptFailed)
+			err := c.OnNewEnvelope(tt.envelope(t, cacheMessage(t, cid, "alice")))
+			if (err == nil) != tt.wantCached || c.index.Has(cid) != tt.wantCached {
+				t.Errorf("cached %t with error %v, want cached %t", c.index.Has(cid), err, tt.wantCached)
+			}
+			wantFailures := 1.0
+			if tt.wantCached {
+				wantFailures = 0
+			}
+			if got := testutil.ToFloat64(snapPayloadDecryptFailed) - failures; got != wantFailures {
+				t.Errorf("counted %v decryption failures, want %v", got, wantFailures)
+			}
+		})
+	}
+}
+
+func TestPayloadWithoutKey(t *testing.T) {
+	msg := &pb.WakuMessage{Payload: []byte("plain")}
+	if got, err := messagePayload(msg, nil); err != nil || string(got) != "plain" {
+		t.Errorf("messagePayload = %q, %v, want the payload unchanged", got, err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/waku-org/go-waku/waku/v2/node"
+	"github.com/waku-org/go-waku/waku/v2/protocol/filter"
+	"github.com/waku-org/go-waku/waku/v2/protocol/lightpush"
+	"github.com/waku-org/go-waku/waku/v2/protocol/relay"
+	"github.com/waku-org/go-waku/waku/v2/protocol/store"
+)
+
+const (
+	envPeerMetricsInterval = "QAKU_CACHE_PEER_METRICS_INTERVAL"
+
+	defaultPeerMetricsInterval = 15 * time.Second
+)
+
+var (
+	wakuPeers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qaku_cache_waku_peers",
+		Help: "The number of peers the Waku node is connected to",
+	})
+	wakuProtocolPeers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qaku_cache_waku_protocol_peers",
+		Help: "The number of connected Waku peers supporting a protocol",
+	}, []string{"protocol"})
+)
+
+// peerProtocols are the protocols whose peers are counted, by metric label.
+var peerProtocols = map[string]string{
+	"relay":     string(relay.WakuRelayID_v200),
+	"filter":    string(filter.FilterSubscribeID_v20beta1),
+	"lightpush": string(lightpush.LightPushID_v20beta1),
+	"store":     string(store.StoreQueryID_v300),
+}
+
+// watchPeers publishes the peer counts of the current Waku node every
+// interval until ctx is done.
+func watchPeers(ctx context.Context, nodes wakuNodes, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		observePeers(nodes.Node().PeerStats())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func observePeers(stats node.PeerStats) {
+	wakuPeers.Set(float64(len(stats)))
+
+	counts := make(map[string]int, len(peerProtocols))
+	for _, protocols := range stats {
+		for _, p := range protocols {
+			for label, id := range peerProtocols {
+				if string(p) == id {
+					counts[label]++
+				}
+			}
+		}
+	}
+	for label := range peerProtocols {
+		wakuProtocolPeers.WithLabelValues(label).Set(float64(counts[label]))
+	}
+}
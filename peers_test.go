@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/waku-org/go-waku/waku/v2/node"
+	"github.com/waku-org/go-waku/waku/v2/protocol/relay"
+	"github.com/waku-org/go-waku/waku/v2/protocol/store"
+)
+
+func TestObservePeers(t *testing.T) {
+	observePeers(node.PeerStats{
+		"relay-and-store": {relay.WakuRelayID_v200, store.StoreQueryID_v300},
+		"relay":           {relay.WakuRelayID_v200},
+		"other":           {"/ipfs/id/1.0.0"},
+	})
+
+	if got := testutil.ToFloat64(wakuPeers); got != 3 {
+		t.Errorf("qaku_cache_waku_peers = %v, want 3", got)
+	}
+	for label, want := range map[string]float64{"relay": 2, "store": 1, "filter": 0, "lightpush": 0} {
+		if got := testutil.ToFloat64(wakuProtocolPeers.WithLabelValues(label)); got != want {
+			t.Errorf("%s peers = %v, want %v", label, got, want)
+		}
+	}
+}
+
+// staticNodes always returns the same Waku node.
+type staticNodes struct{ wn *node.WakuNode }
+
+func (s staticNodes) Node() *node.WakuNode { return s.wn }
+
+func (s staticNodes) Up() bool { return true }
+
+func TestWatchPeersStopsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wn, err := startTestNode(t, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wakuPeers.Set(42)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchPeers(ctx, staticNodes{wn}, time.Millisecond)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(wakuPeers) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("did not publish the peer count of the node")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer watcher did not stop on shutdown")
+	}
+}
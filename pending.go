@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envProxyPendingRetryAfter = "QAKU_CACHE_PROXY_PENDING_RETRY_AFTER"
+	envProxyRefetchTimeout    = "QAKU_CACHE_PROXY_REFETCH_TIMEOUT"
+
+	refetchPollInterval = 500 * time.Millisecond
+)
+
+// proxyPendingRetryAfter is the Retry-After sent when the proxy is asked for
+// a dataset Codex is still fetching, 0 disables the 202 response.
+var proxyPendingRetryAfter time.Duration
+
+// proxyRefetchTimeout is how long the proxy waits for a cached dataset that
+// went missing from the local store to be fetched again, 0 disables it.
+var proxyRefetchTimeout time.Duration
+
+var snapRefetches = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "qaku_cache_proxy_refetches",
+	Help: "The number of cached datasets the proxy found missing and fetched again, by result",
+}, []string{"result"})
+
+// errSnapshotGone marks cached datasets that can no longer be fetched from
+// the network.
+var errSnapshotGone = errors.New("snapshot is no longer available")
+
+// IsFetching reports whether the CID is currently being cached.
+func (c *Cache) IsFetching(cid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.inFlight[cid]
+	return ok
+}
+
+// snapshotPending reports whether a CID that is not in the local store is on
+// its way there: either we are caching it right now or it is queued for a
+// retry once Codex is reachable again.
+func snapshotPending(cache *Cache, cid string) bool {
+	return cache.IsFetching(cid) || cache.retries.Has(cid)
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	secs := int(d.Round(time.Second) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+
+	return strconv.Itoa(secs)
+}
+
+// refetchSnapshot fetches a dataset that is indexed but missing from the local
+// store again and waits up to proxyRefetchTimeout for it to be downloadable.
+// Only the fetch and the wait are bounded by the timeout, the returned body
+// is tied to ctx. It returns errSnapshotGone if the network does not know the
+// dataset any more.
+func refetchSnapshot(ctx context.Context, backend Backend, cid string, header http.Header) (*http.Response, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, proxyRefetchTimeout)
+	defer cancel()
+
+	err := backend.FetchToNetwork(waitCtx, cid)
+	if errors.Is(err, errDatasetNotFound) {
+		snapRefetches.WithLabelValues("gone").Inc()
+		return nil, fmt.Errorf("%w: %s", errSnapshotGone, err)
+	}
+	if err != nil {
+		snapRefetches.WithLabelValues("failed").Inc()
+		return nil, fmt.Errorf("failed to fetch %s again: %w", cid, err)
+	}
+
+	for {
+		resp, err := downloadUntil(waitCtx, ctx, backend, cid, header)
+		if err == nil && resp.StatusCode != http.StatusNotFound {
+			snapRefetches.WithLabelValues("recovered").Inc()
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-waitCtx.Done():
+			snapRefetches.WithLabelValues("timeout").Inc()
+			return nil, waitCtx.Err()
+		case <-time.After(refetchPollInterval):
+		}
+	}
+}
+
+// downloadUntil starts a download whose body lives as long as ctx, but gives
+// up if waitCtx is done before the response headers arrive.
+func downloadUntil(waitCtx context.Context, ctx context.Context, backend Backend, cid string, header http.Header) (*http.Response, error) {
+	dlCtx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(waitCtx, cancel)
+
+	resp, err := backend.Download(dlCtx, cid, header)
+	if !stop() {
+		// waitCtx is done, dlCtx is cancelled already.
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, waitCtx.Err()
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the download context once the body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
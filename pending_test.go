@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProxyPendingSnapshot(t *testing.T) {
+	tests := []struct {
+		name        string
+		retryAfter  time.Duration
+		state       func(c *Cache, cid string)
+		wantPending bool
+	}{
+		{
+			name:        "being cached",
+			retryAfter:  5 * time.Second,
+			state:       func(c *Cache, cid string) { c.begin(context.Background(), CacheRequest{CID: cid}) },
+			wantPending: true,
+		},
+		{
+			name:       "queued for retry",
+			retryAfter: 5 * time.Second,
+			state: func(c *Cache, cid string) {
+				c.retries.Failed(&QakuMessage{Payload: CacheRequest{CID: cid}}, errors.New("codex unreachable"), time.Now())
+			},
+			wantPending: true,
+		},
+		{
+			name:       "unknown",
+			retryAfter: 5 * time.Second,
+			state:      func(c *Cache, cid string) {},
+		},
+		{
+			name:  "disabled",
+			state: func(c *Cache, cid string) { c.begin(context.Background(), CacheRequest{CID: cid}) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &proxyPendingRetryAfter, tt.retryAfter)
+			m := newMockCodex(t)
+			c := newTestCache(t)
+			var err error
+			c.retries, err = loadRetryQueue(nil, time.Minute, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The manifest is known, but nothing is in the local store.
+			cid := testCID("pending")
+			m.Add(cid, []byte("data"))
+			tt.state(c, cid)
+
+			w := get(newTestServer(t, c, nil), "/api/qaku/v1/snapshot/"+cid, nil)
+			if (w.Code == http.StatusAccepted) != tt.wantPending {
+				t.Fatalf("got status %d, want pending %t: %s", w.Code, tt.wantPending, w.Body)
+			}
+			if got := w.Header().Get("Retry-After"); (got != "") != tt.wantPending {
+				t.Errorf("got Retry-After %q with status %d", got, w.Code)
+			}
+			if tt.wantPending && w.Header().Get("Retry-After") != "5" {
+				t.Errorf("got Retry-After %q, want 5", w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestProxyRefetchesLostSnapshot(t *testing.T) {
+	noRetries(t)
+	setGlobal(t, &proxyRefetchTimeout, 2*time.Second)
+
+	tests := []struct {
+		name       string
+		state      func(t *testing.T, m *mockCodex, c *Cache, cid string)
+		wantStatus int
+		wantResult string
+	}{
+		{
+			name:       "available",
+			state:      func(t *testing.T, m *mockCodex, c *Cache, cid string) {},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "recoverable",
+			state: func(t *testing.T, m *mockCodex, c *Cache, cid string) {
+				if err := m.Backend().Unpin(context.Background(), cid); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantStatus: http.StatusOK,
+			wantResult: "recovered",
+		},
+		{
+			name: "unreachable",
+			state: func(t *testing.T, m *mockCodex, c *Cache, cid string) {
+				m.Backend().Unpin(context.Background(), cid)
+				m.Fail("network_pin", http.StatusInternalServerError)
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantResult: "failed",
+		},
+		{
+			name: "gone",
+			state: func(t *testing.T, m *mockCodex, c *Cache, cid string) {
+				m.Backend().Unpin(context.Background(), cid)
+				m.Fail("network_pin", http.StatusNotFound)
+			},
+			wantStatus: http.StatusNotFound,
+			wantResult: "gone",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			c := newTestCache(t)
+			cid := testCID("lost")
+			m.Add(cid, []byte("snapshot"))
+			if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+				t.Fatal(err)
+			}
+			tt.state(t, m, c, cid)
+
+			var results float64
+			if tt.wantResult != "" {
+				results = testutil.ToFloat64(snapRefetches.WithLabelValues(tt.wantResult))
+			}
+			pins := m.Calls("network_pin")
+			w := get(newTestServer(t, c, nil), "/api/qaku/v1/snapshot/"+cid, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK && w.Body.String() != "snapshot" {
+				t.Errorf("served %q, want the snapshot", w.Body.String())
+			}
+			if tt.wantResult == "" {
+				if got := m.Calls("network_pin") - pins; got != 0 {
+					t.Errorf("fetched an available snapshot %d times", got)
+				}
+				return
+			}
+			if got := testutil.ToFloat64(snapRefetches.WithLabelValues(tt.wantResult)) - results; got != 1 {
+				t.Errorf("counted %v %s refetches, want 1", got, tt.wantResult)
+			}
+			if tt.wantStatus == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+				t.Error("did not suggest when to retry")
+			}
+		})
+	}
+}
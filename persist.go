@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envPersistRetryInterval = "QAKU_CACHE_PERSIST_RETRY_INTERVAL"
+
+	defaultPersistRetryInterval = 30 * time.Second
+)
+
+var persistErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qaku_cache_persist_errors",
+	Help: "The total number of failed attempts to write state to disk",
+})
+
+// persistHealth tracks which pieces of durable state currently fail to reach
+// disk. The service keeps running from memory while a flush is failing.
+type persistHealth struct {
+	mu      sync.Mutex
+	failing map[string]string
+}
+
+var persistence = &persistHealth{failing: make(map[string]string)}
+
+// Report records the outcome of a write of the named state.
+func (h *persistHealth) Report(name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err == nil {
+		if _, ok := h.failing[name]; ok {
+			slog.Info("persistence recovered", "name", name)
+		}
+		delete(h.failing, name)
+		return
+	}
+
+	persistErrors.Inc()
+	slog.Error("failed to persist, continuing in memory", "name", name, "error", err)
+	h.failing[name] = err.Error()
+}
+
+// Status returns the last error for every state that is failing to persist.
+func (h *persistHealth) Status() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := make(map[string]string, len(h.failing))
+	for k, v := range h.failing {
+		status[k] = v
+	}
+
+	return status
+}
+
+// flusher is state that can be written to disk again after a failed save.
+type flusher interface {
+	Flush() error
+}
+
+// retryFlushes periodically retries flushing state whose last save failed
+// and writes the changes only kept in memory, so an unclean exit loses at most
+// one interval of them.
+func retryFlushes(ctx context.Context, interval time.Duration, flushers ...flusher) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, f := range flushers {
+				f.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+)
+
+const (
+	envWorkers        = "QAKU_CACHE_WORKERS"
+	envQueueSize      = "QAKU_CACHE_QUEUE_SIZE"
+	envManualPriority = "QAKU_CACHE_MANUAL_PRIORITY"
+	envManualRatio    = "QAKU_CACHE_MANUAL_RATIO"
+	envDropPolicy     = "QAKU_CACHE_QUEUE_DROP_POLICY"
+
+	defaultWorkers   = 4
+	defaultQueueSize = 100
+
+	sourceWaku      = "waku"
+	sourceManual    = "manual"
+	sourceKeepAlive = "keepalive"
+
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+
+	dropNewest = "newest"
+	dropOldest = "oldest"
+)
+
+var (
+	snapQueueDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qaku_cache_queue_dropped",
+		Help: "The number of envelopes dropped because the worker queue was full, by source",
+	}, []string{"source"})
+	snapQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qaku_cache_queue_depth",
+		Help: "The number of envelopes waiting for a worker",
+	})
+)
+
+func validPriority(p string) bool {
+	return p == priorityHigh || p == priorityNormal || p == priorityLow
+}
+
+func validDropPolicy(p string) bool {
+	return p == dropNewest || p == dropOldest
+}
+
+var (
+	// errQueueFull is reported for jobs the queue had no room for,
+	// errQueueDropped to jobs dropped before a worker took them.
+	errQueueFull    = errors.New("worker queue is full")
+	errQueueDropped = errors.New("dropped from the worker queue")
+)
+
+// poolJob is queued work other than an envelope, like a manual cache
+// request. The worker calls run, or dropped if the job leaves the queue
+// without running.
+type poolJob struct {
+	run     func()
+	dropped func()
+}
+
+type queuedEnvelope struct {
+	envelope *protocol.Envelope
+	job      *poolJob
+	source   string
+	queuedAt time.Time
+}
+
+// drop counts the dropped envelope and tells a dropped job, the caller must
+// hold the pool lock.
+func (q queuedEnvelope) drop() {
+	snapQueueDropped.WithLabelValues(q.source).Inc()
+	if q.job != nil {
+		q.job.dropped()
+	}
+}
+
+// workerPool decouples the Waku subscription loop from envelope processing so
+// a single slow Codex request does not block every message behind it.
+type workerPool struct {
+	size     int
+	capacity int
+	handler  func(*protocol.Envelope) error
+
+	// manualPriority decides whether manually submitted envelopes are taken
+	// before (high), after (low) or in arrival order with (normal) the ones
+	// received from Waku.
+	manualPriority string
+	// manualRatio bounds a high or low priority: after that many envelopes
+	// of the preferred source in a row one of the other source is taken.
+	// Zero always takes the preferred source first.
+	manualRatio int
+
+	// dropPolicy decides whether a full queue rejects the new envelope
+	// (newest) or makes room by dropping the longest queued one (oldest).
+	dropPolicy string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []queuedEnvelope
+	busy    int
+	streak  int
+	stopped bool
+	workers sync.WaitGroup
+}
+
+type PoolStats struct {
+	Size            int            `json:"size"`
+	Busy            int            `json:"busy"`
+	Queued          int            `json:"queued"`
+	QueuedBySource  map[string]int `json:"queuedBySource"`
+	QueueCapacity   int            `json:"queueCapacity"`
+	OldestQueuedAge float64        `json:"oldestQueuedAge"`
+}
+
+func newWorkerPool(size int, capacity int, manualPriority string, dropPolicy string, handler func(*protocol.Envelope) error) *workerPool {
+	p := &workerPool{
+		size:           size,
+		capacity:       capacity,
+		handler:        handler,
+		manualPriority: manualPriority,
+		dropPolicy:     dropPolicy,
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.workers.Add(size)
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// OnNewEnvelope implements filter.EnevelopeProcessor by queueing the envelope
+// for the next free worker.
+func (p *workerPool) OnNewEnvelope(envelope *protocol.Envelope) error {
+	p.Submit(envelope, sourceWaku)
+	return nil
+}
+
+// Submit queues the envelope from the given source and reports whether it
+// was queued. Nothing is queued once the pool is stopped.
+func (p *workerPool) Submit(envelope *protocol.Envelope, source string) bool {
+	return p.submit(queuedEnvelope{envelope: envelope, source: source})
+}
+
+// SubmitJob queues the job like an envelope from the given source, so it
+// shares the queue limit, the drop policy and the workers with them.
+func (p *workerPool) SubmitJob(job poolJob, source string) bool {
+	return p.submit(queuedEnvelope{job: &job, source: source})
+}
+
+func (p *workerPool) submit(q queuedEnvelope) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return false
+	}
+
+	if len(p.queue) >= p.capacity {
+		if p.dropPolicy != dropOldest || len(p.queue) == 0 {
+			snapQueueDropped.WithLabelValues(q.source).Inc()
+			slog.Warn("worker queue full, dropping envelope", "capacity", p.capacity, "source", q.source)
+			return false
+		}
+
+		dropped := p.queue[0]
+		p.queue = p.queue[1:]
+		dropped.drop()
+		slog.Warn("worker queue full, dropping oldest envelope", "capacity", p.capacity, "source", dropped.source)
+	}
+
+	q.queuedAt = time.Now()
+	p.queue = append(p.queue, q)
+	snapQueueDepth.Set(float64(len(p.queue)))
+	p.cond.Signal()
+
+	return true
+}
+
+// next returns the index of the envelope to process next, the caller must
+// hold the lock and the queue must not be empty.
+func (p *workerPool) next() int {
+	if p.manualPriority == priorityNormal {
+		return 0
+	}
+
+	manual := p.manualPriority == priorityHigh
+	if p.manualRatio > 0 && p.streak >= p.manualRatio {
+		manual = !manual
+	}
+	for i, q := range p.queue {
+		if (q.source == sourceManual) == manual {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// took counts the envelopes of the preferred source taken in a row, the
+// caller must hold the lock.
+func (p *workerPool) took(q queuedEnvelope) {
+	if (q.source == sourceManual) == (p.manualPriority == priorityHigh) {
+		p.streak++
+	} else {
+		p.streak = 0
+	}
+}
+
+func (p *workerPool) work() {
+	defer p.workers.Done()
+
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.stopped {
+			p.cond.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		i := p.next()
+		next := p.queue[i]
+		if i == 0 {
+			p.queue = p.queue[1:]
+		} else {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+		}
+		p.took(next)
+		snapQueueDepth.Set(float64(len(p.queue)))
+		p.busy++
+		p.mu.Unlock()
+
+		if next.job != nil {
+			next.job.run()
+		} else if err := p.handler(next.envelope); err != nil {
+			slog.Debug("failed to process envelope", "error", err)
+		}
+
+		p.mu.Lock()
+		p.busy--
+		p.mu.Unlock()
+	}
+}
+
+// Stop stops accepting envelopes and waits until the queued ones have been
+// processed or ctx is done.
+func (p *workerPool) Stop(ctx context.Context) error {
+	p.mu.Lock()
+	p.stopped = true
+	queued := len(p.queue)
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("worker pool did not drain %d queued envelopes: %w", queued, ctx.Err())
+	}
+}
+
+// Shed drops the older half of the queued envelopes to relieve memory
+// pressure and returns how many were dropped.
+func (p *workerPool) Shed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := (len(p.queue) + 1) / 2
+	for _, q := range p.queue[:n] {
+		q.drop()
+	}
+	// Copy the remainder so the dropped envelopes are no longer referenced by
+	// the backing array.
+	p.queue = append([]queuedEnvelope(nil), p.queue[n:]...)
+	snapQueueDepth.Set(float64(len(p.queue)))
+
+	return n
+}
+
+func (p *workerPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := PoolStats{
+		Size:           p.size,
+		Busy:           p.busy,
+		Queued:         len(p.queue),
+		QueuedBySource: map[string]int{sourceWaku: 0, sourceManual: 0, sourceKeepAlive: 0},
+		QueueCapacity:  p.capacity,
+	}
+	for _, q := range p.queue {
+		stats.QueuedBySource[q.source]++
+	}
+	if len(p.queue) > 0 {
+		stats.OldestQueuedAge = time.Since(p.queue[0].queuedAt).Seconds()
+	}
+
+	return stats
+}
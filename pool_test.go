@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+)
+
+func TestWorkerPoolStats(t *testing.T) {
+	started := make(chan struct{}, 6)
+	release := make(chan struct{})
+	defer close(release)
+	p := newWorkerPool(2, 10, priorityNormal, dropNewest, func(e *protocol.Envelope) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	if stats := p.Stats(); stats.Size != 2 || stats.Busy != 0 || stats.Queued != 0 || stats.OldestQueuedAge != 0 {
+		t.Errorf("idle stats = %+v, want 2 idle workers and nothing queued", stats)
+	}
+
+	for i := 0; i < 6; i++ {
+		p.OnNewEnvelope(testEnvelope([]byte{byte(i)}))
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("workers did not pick up the envelopes")
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	stats := p.Stats()
+	if stats.Size != 2 || stats.Busy != 2 || stats.Queued != 4 {
+		t.Errorf("stats = %+v, want 2 of 2 workers busy and 4 queued", stats)
+	}
+	if stats.OldestQueuedAge <= 0 {
+		t.Errorf("oldest queued age = %v, want the time the envelope waited", stats.OldestQueuedAge)
+	}
+}
+
+func TestWorkerPoolBoundsConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running, most, handled := 0, 0, 0
+	started := make(chan struct{}, 6)
+	release := make(chan struct{})
+	p := newWorkerPool(2, 10, priorityNormal, dropNewest, func(e *protocol.Envelope) error {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+
+		started <- struct{}{}
+		<-release
+
+		mu.Lock()
+		running--
+		handled++
+		mu.Unlock()
+		return nil
+	})
+
+	// The dispatcher hands off slow fetches without waiting for them, while
+	// every handler is still blocked.
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		for i := 0; i < 6; i++ {
+			p.OnNewEnvelope(testEnvelope([]byte{byte(i)}))
+		}
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatching blocked on the busy workers")
+	}
+
+	// Only as many fetches as there are workers start, the rest wait queued.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("workers did not pick up the envelopes")
+		}
+	}
+	select {
+	case <-started:
+		t.Error("started more fetches than there are workers")
+	default:
+	}
+	if stats := p.Stats(); stats.Size != 2 || stats.Busy != 2 || stats.Queued != 4 || stats.QueueCapacity != 10 {
+		t.Errorf("stats = %+v, want 2 of 2 workers busy and 4 of 10 queued", stats)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if most != 2 || handled != 6 {
+		t.Errorf("ran %d handlers at once and %d in total, want 2 and 6", most, handled)
+	}
+	if p.Submit(testEnvelope([]byte("late")), sourceWaku) {
+		t.Error("queued an envelope after the pool stopped")
+	}
+}
+
+func TestWorkerPoolDropPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{policy: dropNewest, want: []string{"a", "b"}},
+		{policy: dropOldest, want: []string{"b", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			got := []string{}
+			// Without workers the queue fills up.
+			p := newWorkerPool(0, 2, priorityNormal, tt.policy, func(e *protocol.Envelope) error {
+				got = append(got, string(e.Message().Payload))
+				return nil
+			})
+
+			dropped := testutil.ToFloat64(snapQueueDropped.WithLabelValues(sourceWaku))
+			for _, payload := range []string{"a", "b", "c"} {
+				p.OnNewEnvelope(testEnvelope([]byte(payload)))
+			}
+			if got := testutil.ToFloat64(snapQueueDropped.WithLabelValues(sourceWaku)) - dropped; got != 1 {
+				t.Errorf("counted %v dropped envelopes, want 1", got)
+			}
+
+			p.workers.Add(1)
+			go p.work()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := p.Stop(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("processed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolShed(t *testing.T) {
+	got := []string{}
+	// Without workers the envelopes stay queued until they are shed.
+	p := newWorkerPool(0, 10, priorityNormal, dropNewest, func(e *protocol.Envelope) error {
+		got = append(got, string(e.Message().Payload))
+		return nil
+	})
+	for _, payload := range []string{"a", "b", "c", "d", "e"} {
+		p.OnNewEnvelope(testEnvelope([]byte(payload)))
+	}
+
+	if n := p.Shed(); n != 3 {
+		t.Errorf("shed %d envelopes, want the older half of 3", n)
+	}
+	if queued := p.Stats().Queued; queued != 2 {
+		t.Errorf("%d envelopes queued after shedding, want 2", queued)
+	}
+
+	p.workers.Add(1)
+	go p.work()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{"d", "e"}) {
+		t.Errorf("processed %v, want the most recent envelopes", got)
+	}
+}
+
+func TestWorkerPoolManualPriority(t *testing.T) {
+	submissions := []struct {
+		source  string
+		payload string
+	}{
+		{source: sourceWaku, payload: "w1"},
+		{source: sourceManual, payload: "m1"},
+		{source: sourceWaku, payload: "w2"},
+		{source: sourceManual, payload: "m2"},
+	}
+
+	tests := []struct {
+		priority string
+		want     []string
+	}{
+		{priority: priorityHigh, want: []string{"m1", "m2", "w1", "w2"}},
+		{priority: priorityNormal, want: []string{"w1", "m1", "w2", "m2"}},
+		{priority: priorityLow, want: []string{"w1", "w2", "m1", "m2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.priority, func(t *testing.T) {
+			var mu sync.Mutex
+			got := []string{}
+			// Without workers everything stays queued until one is started.
+			p := newWorkerPool(0, len(submissions), tt.priority, dropNewest, func(e *protocol.Envelope) error {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, string(e.Message().Payload))
+				return nil
+			})
+
+			for _, s := range submissions {
+				if !p.Submit(testEnvelope([]byte(s.payload)), s.source) {
+					t.Fatalf("Submit(%s) rejected the envelope", s.payload)
+				}
+			}
+			stats := p.Stats()
+			if stats.QueuedBySource[sourceWaku] != 2 || stats.QueuedBySource[sourceManual] != 2 {
+				t.Errorf("QueuedBySource = %v, want 2 of each", stats.QueuedBySource)
+			}
+
+			p.workers.Add(1)
+			go p.work()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := p.Stop(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("processed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolManualRatio(t *testing.T) {
+	tests := []struct {
+		priority string
+		want     []string
+	}{
+		{priority: priorityHigh, want: []string{"m1", "m2", "w1", "m3", "m4", "w2", "w3", "w4"}},
+		{priority: priorityLow, want: []string{"w1", "w2", "m1", "w3", "w4", "m2", "m3", "m4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.priority, func(t *testing.T) {
+			var mu sync.Mutex
+			got := []string{}
+			record := func(payload string) {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, payload)
+			}
+			p := newWorkerPool(0, 8, tt.priority, dropNewest, func(e *protocol.Envelope) error {
+				record(string(e.Message().Payload))
+				return nil
+			})
+			p.manualRatio = 2
+
+			// Manual cache requests arrive as jobs, the others as envelopes.
+			for i := 1; i <= 4; i++ {
+				w, m := fmt.Sprintf("w%d", i), fmt.Sprintf("m%d", i)
+				p.Submit(testEnvelope([]byte(w)), sourceWaku)
+				if i%2 == 0 {
+					p.Submit(testEnvelope([]byte(m)), sourceManual)
+				} else if !p.SubmitJob(poolJob{run: func() { record(m) }, dropped: func() {}}, sourceManual) {
+					t.Fatalf("SubmitJob(%s) rejected the job", m)
+				}
+			}
+
+			p.workers.Add(1)
+			go p.work()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := p.Stop(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("processed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkerPoolDroppedJob(t *testing.T) {
+	p := newWorkerPool(0, 1, priorityNormal, dropOldest, nil)
+	dropped := make(chan struct{}, 1)
+	p.SubmitJob(poolJob{run: func() { t.Error("ran a dropped job") }, dropped: func() { dropped <- struct{}{} }}, sourceManual)
+	p.Submit(testEnvelope([]byte("newer")), sourceWaku)
+
+	select {
+	case <-dropped:
+	default:
+		t.Error("did not tell the job it was dropped")
+	}
+}
+
+func TestWorkerPoolStalledWorker(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	p := newWorkerPool(1, 2, priorityNormal, dropNewest, func(e *protocol.Envelope) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	})
+	p.OnNewEnvelope(testEnvelope([]byte("busy")))
+	<-started
+
+	dropped := testutil.ToFloat64(snapQueueDropped.WithLabelValues(sourceWaku))
+	submitted := make(chan struct{})
+	go func() {
+		defer close(submitted)
+		for _, payload := range []string{"a", "b", "c", "d"} {
+			p.OnNewEnvelope(testEnvelope([]byte(payload)))
+		}
+	}()
+	select {
+	case <-submitted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the full queue blocked the Waku consumer")
+	}
+
+	if got := testutil.ToFloat64(snapQueueDepth); got != 2 {
+		t.Errorf("queue depth = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(snapQueueDropped.WithLabelValues(sourceWaku)) - dropped; got != 2 {
+		t.Errorf("counted %v dropped envelopes, want 2", got)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(snapQueueDepth); got != 0 {
+		t.Errorf("queue depth = %v after draining, want 0", got)
+	}
+}
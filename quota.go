@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const envOwnerByteQuota = "QAKU_CACHE_OWNER_BYTE_QUOTA"
+
+var snapOwnerQuotaExceeded = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qaku_cache_owner_quota_exceeded",
+	Help: "The number of cache requests rejected because the owner's cached bytes would exceed the quota",
+})
+
+// reserveOwnerQuota returns an error if caching size more bytes would take
+// the owner's cached and reserved bytes above the quota. Otherwise the bytes
+// stay reserved until release is called, so snapshots of one owner cached in
+// parallel cannot together exceed the quota before they reach the index.
+// release must be called once the entry is indexed or caching failed. A zero
+// quota disables the check.
+func (c *Cache) reserveOwnerQuota(owner string, size int) (release func(), err error) {
+	if c.ownerQuota <= 0 {
+		return func() {}, nil
+	}
+
+	c.quotaMu.Lock()
+	defer c.quotaMu.Unlock()
+
+	used := c.index.OwnerBytes(owner) + c.ownerReserved[owner]
+	if used+int64(size) > c.ownerQuota {
+		return nil, fmt.Errorf("owner %s uses or reserved %d of %d bytes, dataset needs %d", owner, used, c.ownerQuota, size)
+	}
+
+	if c.ownerReserved == nil {
+		c.ownerReserved = make(map[string]int64)
+	}
+	c.ownerReserved[owner] += int64(size)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.quotaMu.Lock()
+			defer c.quotaMu.Unlock()
+
+			c.ownerReserved[owner] -= int64(size)
+			if c.ownerReserved[owner] == 0 {
+				delete(c.ownerReserved, owner)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOwnerQuota(t *testing.T) {
+	b := newTestFSBackend(t)
+	c := newTestCache(t)
+	c.backend = b
+	c.ownerQuota = 16
+
+	cache := func(seed string, owner string) (string, error) {
+		cid := testCID(seed)
+		addDataset(t, b, cid, []byte("snapshot"))
+		return cid, c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, owner)))
+	}
+
+	// Two snapshots of eight bytes fill the quota.
+	first, err := cache("first", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache("second", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	exceeded := testutil.ToFloat64(snapOwnerQuotaExceeded)
+	third, err := cache("third", "alice")
+	if err == nil || c.index.Has(third) {
+		t.Errorf("cached past the quota: %v", err)
+	}
+	if got := testutil.ToFloat64(snapOwnerQuotaExceeded) - exceeded; got != 1 {
+		t.Errorf("counted %v quota rejections, want 1", got)
+	}
+	// Other owners have their own quota.
+	if _, err := cache("other owner", "bob"); err != nil {
+		t.Errorf("rejected another owner: %v", err)
+	}
+
+	// Evicting a snapshot frees its bytes.
+	e, _ := c.index.Get(first)
+	if err := c.evict(context.Background(), e, evictAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.index.OwnerBytes("alice"); got != 8 {
+		t.Errorf("alice uses %d bytes after the eviction, want 8", got)
+	}
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, third, "alice"))); err != nil || !c.index.Has(third) {
+		t.Errorf("rejected a snapshot after space was freed: %v", err)
+	}
+}
+
+func TestOwnerQuotaDisabled(t *testing.T) {
+	c := newTestCache(t)
+	c.index.Put(CacheEntry{CID: testCID("big"), Owner: "alice", Size: 1 << 30})
+	if _, err := c.reserveOwnerQuota("alice", 1<<30); err != nil {
+		t.Errorf("a zero quota rejected a dataset: %v", err)
+	}
+}
+
+func TestOwnerQuotaReservesBytes(t *testing.T) {
+	c := newTestCache(t)
+	c.ownerQuota = 16
+
+	// Only two of the snapshots cached at once fit, however they interleave.
+	results := make(chan func(), 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := c.reserveOwnerQuota("alice", 8)
+			if err == nil {
+				results <- release
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	var releases []func()
+	for release := range results {
+		releases = append(releases, release)
+	}
+	if len(releases) != 2 {
+		t.Fatalf("reserved %d snapshots of 8 bytes in a quota of 16, want 2", len(releases))
+	}
+	if _, err := c.reserveOwnerQuota("bob", 16); err != nil {
+		t.Errorf("rejected another owner: %v", err)
+	}
+
+	releases[0]()
+	releases[0]()
+	if _, err := c.reserveOwnerQuota("alice", 8); err != nil {
+		t.Errorf("rejected a snapshot after a reservation was released: %v", err)
+	}
+	if _, err := c.reserveOwnerQuota("alice", 1); err == nil {
+		t.Error("reserved past the quota after releasing the same reservation twice")
+	}
+}
+
+func TestOwnerQuotaParallelSnapshots(t *testing.T) {
+	m := newMockCodex(t)
+	m.Delay("network_pin", 100*time.Millisecond)
+	c := newTestCache(t)
+	c.ownerQuota = 16
+
+	var wg sync.WaitGroup
+	for _, seed := range []string{"first", "second", "third"} {
+		cid := testCID(seed)
+		m.Add(cid, []byte("snapshot"))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice")))
+		}()
+	}
+	wg.Wait()
+
+	if got := c.index.OwnerBytes("alice"); got != 16 {
+		t.Errorf("alice uses %d bytes after caching in parallel, want the quota of 16", got)
+	}
+	if len(c.ownerReserved) != 0 {
+		t.Errorf("still reserved %v", c.ownerReserved)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envOwnerRateLimit  = "QAKU_CACHE_OWNER_RATE_LIMIT"
+	envOwnerRateWindow = "QAKU_CACHE_OWNER_RATE_WINDOW"
+	envOwnerRateBurst  = "QAKU_CACHE_OWNER_RATE_BURST"
+
+	defaultOwnerRateWindow = time.Minute
+	ownerRateLabelLimit    = 50
+
+	// ownerBucketPruneSize is the number of tracked owners above which idle
+	// buckets are dropped.
+	ownerBucketPruneSize = 10000
+)
+
+var (
+	snapOwnerThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qaku_cache_owner_throttled",
+		Help: "The number of cache requests rejected by the per-owner rate limit",
+	}, []string{"owner"})
+	snapRateLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_ratelimited",
+		Help: "The total number of cache requests rejected by the per-owner rate limit",
+	})
+)
+
+// ownerRateLimiter keeps a token bucket per owner which refills at limit
+// tokens per window and holds at most burst tokens.
+type ownerRateLimiter struct {
+	rate   float64 // tokens per second
+	burst  float64
+	labels *boundedLabels
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newOwnerRateLimiter(limit int, window time.Duration, burst int) *ownerRateLimiter {
+	return &ownerRateLimiter{
+		rate:    float64(limit) / window.Seconds(),
+		burst:   float64(burst),
+		labels:  newBoundedLabels(ownerRateLabelLimit),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token from the bucket of owner and reports whether there was
+// one. A nil limiter allows everything.
+func (l *ownerRateLimiter) Allow(owner string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[owner]
+	if !ok {
+		if len(l.buckets) >= ownerBucketPruneSize {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[owner] = b
+	}
+	l.refill(b, now)
+
+	if b.tokens < 1 {
+		snapRateLimited.Inc()
+		snapOwnerThrottled.WithLabelValues(l.labels.Value(owner)).Inc()
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+func (l *ownerRateLimiter) refill(b *tokenBucket, now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+	}
+	b.last = now
+}
+
+// prune drops the buckets that have refilled completely, they behave the same
+// as a fresh bucket.
+func (l *ownerRateLimiter) prune(now time.Time) {
+	for owner, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, owner)
+		}
+	}
+}
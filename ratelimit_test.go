@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOwnerRateLimiter(t *testing.T) {
+	// One request per second with bursts of two.
+	l := newOwnerRateLimiter(60, time.Minute, 2)
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		owner string
+		at    time.Duration
+		want  bool
+	}{
+		{name: "burst 1", owner: "alice", at: 0, want: true},
+		{name: "burst 2", owner: "alice", at: 0, want: true},
+		{name: "over burst", owner: "alice", at: 0, want: false},
+		{name: "other owner", owner: "bob", at: 0, want: true},
+		{name: "partly refilled", owner: "alice", at: 500 * time.Millisecond, want: false},
+		{name: "refilled", owner: "alice", at: 1000 * time.Millisecond, want: true},
+		{name: "refill capped at burst 1", owner: "bob", at: time.Hour, want: true},
+		{name: "refill capped at burst 2", owner: "bob", at: time.Hour, want: true},
+		{name: "refill capped at burst 3", owner: "bob", at: time.Hour, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := l.Allow(tt.owner, now.Add(tt.at)); got != tt.want {
+			t.Errorf("%s: Allow(%s) = %t, want %t", tt.name, tt.owner, got, tt.want)
+		}
+	}
+
+	var nilLimiter *ownerRateLimiter
+	if !nilLimiter.Allow("alice", now) {
+		t.Error("a nil limiter throttled a request")
+	}
+}
+
+func TestProcessThrottlesOwner(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	c.rateLimiter = newOwnerRateLimiter(1, time.Hour, 1)
+
+	throttled := testutil.ToFloat64(snapOwnerThrottled.WithLabelValues("throttled"))
+	first, second := testCID("first"), testCID("second")
+	for _, cid := range []string{first, second} {
+		m.Add(cid, []byte("data"))
+		err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "throttled")))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !c.index.Has(first) || c.index.Has(second) {
+		t.Errorf("cached first %t and second %t, want only the first", c.index.Has(first), c.index.Has(second))
+	}
+	if got := testutil.ToFloat64(snapOwnerThrottled.WithLabelValues("throttled")) - throttled; got != 1 {
+		t.Errorf("counted %v throttled requests for the owner, want 1", got)
+	}
+}
+
+func TestOwnerRateLimiterBurst(t *testing.T) {
+	l := newOwnerRateLimiter(1, time.Hour, 5)
+	now := time.Now()
+	limited := testutil.ToFloat64(snapRateLimited)
+
+	// Concurrent envelopes share the bucket, exactly burst get through.
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.Allow("alice", now) {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed.Load() != 5 {
+		t.Errorf("allowed %d requests of a burst of 20, want 5", allowed.Load())
+	}
+	if l.Allow("alice", now.Add(time.Minute)) {
+		t.Error("allowed a request after the burst before the bucket refilled")
+	}
+	if got := testutil.ToFloat64(snapRateLimited) - limited; got != 16 {
+		t.Errorf("counted %v rate limited requests, want 16", got)
+	}
+}
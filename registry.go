@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	envRegistryURL      = "QAKU_CACHE_REGISTRY_URL"
+	envRegistryInterval = "QAKU_CACHE_REGISTRY_INTERVAL"
+
+	defaultRegistryInterval = time.Minute
+	registryTimeout         = 10 * time.Second
+)
+
+type RegistryReport struct {
+	PeerID     string    `json:"peerId"`
+	WakuPeers  int       `json:"wakuPeers"`
+	Healthy    bool      `json:"healthy"`
+	ReportedAt time.Time `json:"reportedAt"`
+	Stats
+}
+
+// reportToRegistry periodically POSTs this node's identity and summary stats
+// to a central registry. Failed reports are logged and retried on the next tick.
+func reportToRegistry(ctx context.Context, url string, interval time.Duration, nodes wakuNodes, cache *Cache) {
+	client := &http.Client{Timeout: registryTimeout}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wn := nodes.Node()
+			peers := wn.PeerCount()
+			report := RegistryReport{
+				PeerID:     wn.ID(),
+				WakuPeers:  peers,
+				Healthy:    peers > 0,
+				ReportedAt: time.Now(),
+				Stats:      collectStats(cache),
+			}
+
+			err := postReport(ctx, client, url, report)
+			if err != nil {
+				slog.Error("failed to report to registry", "error", err)
+			}
+		}
+	}
+}
+
+func postReport(ctx context.Context, client *http.Client, url string, report RegistryReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
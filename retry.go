@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envMaxRetries = "QAKU_CACHE_MAX_RETRIES"
+	envRetryDelay = "QAKU_CACHE_RETRY_DELAY"
+
+	defaultMaxRetries = 3
+	defaultRetryDelay = 500 * time.Millisecond
+)
+
+var snapCodexRetries = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qaku_cache_codex_retries",
+	Help: "The number of Codex requests retried after a transient failure",
+})
+
+// codexMaxRetries and codexRetryDelay control how transient Codex failures
+// are retried.
+var (
+	codexMaxRetries = defaultMaxRetries
+	codexRetryDelay = defaultRetryDelay
+)
+
+// codexRetry calls do until it succeeds, fails permanently or runs out of
+// retries. Network errors and 5xx responses are retried with a doubling,
+// jittered delay; any other response, including a 404, is returned as is.
+func codexRetry(ctx context.Context, do func() (*http.Response, error)) (*http.Response, error) {
+	delay := codexRetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := do()
+		if !retryable(ctx, resp, err) || attempt >= codexMaxRetries {
+			return resp, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			resp.Body.Close()
+		}
+
+		wait := delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+		snapCodexRetries.Inc()
+		slog.Warn("Codex request failed, retrying", "reason", reason, "attempt", attempt+1, "attempts", codexMaxRetries+1, "delay", wait)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil
+	}
+
+	return resp.StatusCode >= 500
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCodexRetryCachesAfterTransientFailures(t *testing.T) {
+	setGlobal(t, &codexMaxRetries, 3)
+	setGlobal(t, &codexRetryDelay, time.Millisecond)
+
+	tests := []struct {
+		name         string
+		op           string
+		statuses     []int
+		wantCached   bool
+		wantRetries  float64
+		wantAttempts int
+	}{
+		{name: "manifest", op: "manifest", statuses: []int{503, 502}, wantCached: true, wantRetries: 2, wantAttempts: 3},
+		{name: "network fetch", op: "network_pin", statuses: []int{500, 504}, wantCached: true, wantRetries: 2, wantAttempts: 3},
+		{name: "not found", op: "manifest", statuses: []int{404}, wantRetries: 0, wantAttempts: 1},
+		{name: "exhausted", op: "network_pin", statuses: []int{503, 503, 503, 503}, wantRetries: 3, wantAttempts: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cid := testCID(tt.name)
+			m := newMockCodex(t)
+			m.Add(cid, []byte("snapshot"))
+			m.Fail(tt.op, tt.statuses...)
+			c := newTestCache(t)
+
+			retries := testutil.ToFloat64(snapCodexRetries)
+			c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "")))
+
+			if got := c.index.Has(cid); got != tt.wantCached {
+				t.Errorf("cached = %t, want %t", got, tt.wantCached)
+			}
+			if got := testutil.ToFloat64(snapCodexRetries) - retries; got != tt.wantRetries {
+				t.Errorf("counted %v retries, want %v", got, tt.wantRetries)
+			}
+			if got := m.Calls(tt.op); got != tt.wantAttempts {
+				t.Errorf("%s reached Codex %d times, want %d", tt.op, got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		status int
+		want   bool
+	}{{200, false}, {404, false}, {429, false}, {500, true}, {503, true}} {
+		if got := retryable(context.Background(), &http.Response{StatusCode: tt.status}, nil); got != tt.want {
+			t.Errorf("retryable(%d) = %t, want %t", tt.status, got, tt.want)
+		}
+	}
+
+	if !retryable(context.Background(), nil, errors.New("connection refused")) {
+		t.Error("a network error is not retried")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if retryable(ctx, nil, ctx.Err()) {
+		t.Error("a cancelled request is retried")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envRetryQueueMaxAge = "QAKU_CACHE_RETRY_QUEUE_MAX_AGE"
+	envRetryQueueDelay  = "QAKU_CACHE_RETRY_QUEUE_DELAY"
+
+	defaultRetryQueueDelay = 30 * time.Second
+	maxRetryQueueDelay     = 30 * time.Minute
+)
+
+var pendingRetries = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "qaku_cache_pending_retries",
+	Help: "The number of cache requests waiting to be retried once Codex is reachable",
+})
+
+// errCodexUnavailable marks Codex answering with a server error.
+var errCodexUnavailable = errors.New("Codex is unavailable")
+
+// unreachable reports whether err means Codex could not be reached or could
+// not serve the request, as opposed to the request being rejected.
+func unreachable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.Is(err, errCodexUnavailable) || errors.As(err, &netErr)
+}
+
+// PendingRetry is a cache request that failed because Codex was unreachable.
+type PendingRetry struct {
+	Message  *QakuMessage `json:"message"`
+	FailedAt time.Time    `json:"failedAt"`
+	Attempts int          `json:"attempts"`
+	NextAt   time.Time    `json:"nextAt"`
+	Error    string       `json:"error"`
+}
+
+// retryStore persists the pending retries, keyed by CID.
+type retryStore interface {
+	LoadRetries() (map[string]PendingRetry, error)
+	SaveRetry(cid string, r PendingRetry) error
+	DeleteRetry(cid string) error
+}
+
+// retryQueue holds the requests to retry, each one with a doubling delay
+// until it succeeds or maxAge has passed since it first failed. A nil store
+// keeps the queue in memory only.
+type retryQueue struct {
+	delay  time.Duration
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	store   retryStore
+	pending map[string]PendingRetry
+}
+
+func loadRetryQueue(store retryStore, delay time.Duration, maxAge time.Duration) (*retryQueue, error) {
+	q := &retryQueue{delay: delay, maxAge: maxAge, store: store, pending: make(map[string]PendingRetry)}
+	if store != nil {
+		pending, err := store.LoadRetries()
+		if err != nil {
+			return nil, err
+		}
+		q.pending = pending
+	}
+	pendingRetries.Set(float64(len(q.pending)))
+
+	return q, nil
+}
+
+// Failed queues the request, or schedules the next attempt if it is queued
+// already. It is a no-op on a nil queue.
+func (q *retryQueue) Failed(cr *QakuMessage, err error, now time.Time) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cid := cr.Payload.CID
+	r, ok := q.pending[cid]
+	if !ok {
+		r = PendingRetry{Message: cr, FailedAt: now}
+	}
+
+	delay := q.delay << r.Attempts
+	if delay > maxRetryQueueDelay || delay <= 0 {
+		delay = maxRetryQueueDelay
+	}
+	r.Attempts++
+	r.NextAt = now.Add(delay)
+	r.Error = err.Error()
+	q.pending[cid] = r
+	pendingRetries.Set(float64(len(q.pending)))
+
+	if q.store != nil {
+		persistence.Report("retry queue", q.store.SaveRetry(cid, r))
+	}
+}
+
+// Has reports whether a request for cid is queued. It is false on a nil
+// queue.
+func (q *retryQueue) Has(cid string) bool {
+	if q == nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	_, ok := q.pending[cid]
+	return ok
+}
+
+// Remove drops the request for cid from the queue.
+func (q *retryQueue) Remove(cid string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.remove(cid)
+}
+
+// remove drops the request, the caller must hold the lock.
+func (q *retryQueue) remove(cid string) {
+	if _, ok := q.pending[cid]; !ok {
+		return
+	}
+	delete(q.pending, cid)
+	pendingRetries.Set(float64(len(q.pending)))
+
+	if q.store != nil {
+		persistence.Report("retry queue", q.store.DeleteRetry(cid))
+	}
+}
+
+// Due returns the requests whose next attempt is due, oldest first, and
+// drops and returns the ones older than maxAge.
+func (q *retryQueue) Due(now time.Time) ([]PendingRetry, []PendingRetry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	due, expired := []PendingRetry{}, []PendingRetry{}
+	for cid, r := range q.pending {
+		if now.Sub(r.FailedAt) > q.maxAge {
+			expired = append(expired, r)
+			q.remove(cid)
+			continue
+		}
+		if !now.Before(r.NextAt) {
+			due = append(due, r)
+		}
+	}
+	sort.Slice(due, func(a, b int) bool { return due[a].FailedAt.Before(due[b].FailedAt) })
+
+	return due, expired
+}
+
+// retryPending retries the due requests every interval, one at a time so
+// the retries do not compete with the worker pool for Codex. Nothing is
+// retried in maintenance mode.
+func (c *Cache) retryPending(ctx context.Context, interval time.Duration, now func() time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		due, expired := c.retries.Due(now())
+		for _, r := range expired {
+			c.logger.Warn("giving up on cache request, Codex stayed unreachable", "cid", r.Message.Payload.CID, "owner", r.Message.Payload.Owner, "attempts", r.Attempts, "error", r.Error)
+			c.deadLetters.Add("retry_expired", r.Message, errors.New(r.Error))
+		}
+		if c.maintenance.On() {
+			continue
+		}
+
+		for _, r := range due {
+			rctx := withRequestID(ctx, newRequestID())
+			c.logger.Info("retrying cache request", "request", requestIDFrom(rctx), "cid", r.Message.Payload.CID, "attempt", r.Attempts+1)
+
+			// A request that is still unreachable was rescheduled by
+			// process, any other outcome is final.
+			_, err := c.process(rctx, r.Message, time.Now(), 0)
+			if ctx.Err() != nil {
+				return
+			}
+			if !unreachable(err) {
+				c.retries.Remove(r.Message.Payload.CID)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRetryQueueCachesOnceCodexRecovers(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	retries, err := loadRetryQueue(nil, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.retries = retries
+	queued, rejected := testCID("queued"), testCID("rejected")
+	m.Add(queued, []byte("snapshot"))
+
+	// Codex is down for the first request, the unknown dataset is rejected.
+	m.Fail("manifest", http.StatusServiceUnavailable)
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, queued, "alice"))); err == nil {
+		t.Fatal("cached a dataset while Codex is down")
+	}
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, rejected, "alice"))); err == nil {
+		t.Fatal("cached an unknown dataset")
+	}
+	if !c.retries.Has(queued) || c.retries.Has(rejected) {
+		t.Fatal("want only the request that failed on an unreachable Codex queued")
+	}
+	if got := testutil.ToFloat64(pendingRetries); got != 1 {
+		t.Errorf("pending retries gauge = %v, want 1", got)
+	}
+
+	start := time.Now()
+	var offset atomic.Int64
+	now := func() time.Time { return start.Add(time.Duration(offset.Load())) }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.retryPending(ctx, 5*time.Millisecond, now)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if m.Calls("manifest") != 2 {
+		t.Fatal("retried the request before its delay passed")
+	}
+
+	offset.Store(int64(2 * time.Minute))
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.index.Has(queued) {
+		if time.Now().After(deadline) {
+			t.Fatal("did not cache the queued request once Codex recovered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry worker did not stop on shutdown")
+	}
+	if c.retries.Has(queued) || testutil.ToFloat64(pendingRetries) != 0 {
+		t.Error("the cached request is still queued")
+	}
+}
+
+func TestRetryQueueBackoffAndExpiry(t *testing.T) {
+	q, err := loadRetryQueue(nil, time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	cid := testCID("backoff")
+	msg := &QakuMessage{Type: cacheMessageType, Payload: CacheRequest{CID: cid}}
+	down := errors.New("connection refused")
+
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		q.Failed(msg, down, start)
+		if due, _ := q.Due(start.Add(want - time.Millisecond)); len(due) != 0 {
+			t.Errorf("attempt %d due before %s", i+1, want)
+		}
+		if due, _ := q.Due(start.Add(want)); len(due) != 1 || due[0].Attempts != i+1 {
+			t.Errorf("attempt %d not due after %s: %+v", i+1, want, due)
+		}
+	}
+
+	due, expired := q.Due(start.Add(2 * time.Hour))
+	if len(due) != 0 || len(expired) != 1 || q.Has(cid) {
+		t.Errorf("got %d due and %d expired requests, want the request dropped after the max age", len(due), len(expired))
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	selfTestTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_selftest_total",
+		Help: "The number of backend self-tests run",
+	})
+	selfTestFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_selftest_failures",
+		Help: "The number of backend self-tests that failed a step",
+	})
+)
+
+type SelfTestStep struct {
+	Name       string  `json:"name"`
+	OK         bool    `json:"ok"`
+	DurationMs float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type SelfTestResult struct {
+	OK    bool           `json:"ok"`
+	CID   string         `json:"cid,omitempty"`
+	Steps []SelfTestStep `json:"steps"`
+}
+
+// selfTest uploads a small blob to the backend, pins it, reads it back and
+// removes it again. It stops at the first failing step but always cleans up
+// an uploaded blob.
+func selfTest(ctx context.Context, backend Backend, now func() time.Time) (res SelfTestResult) {
+	selfTestTotal.Inc()
+
+	res = SelfTestResult{OK: true, Steps: []SelfTestStep{}}
+	step := func(name string, f func() error) bool {
+		start := time.Now()
+		err := f()
+		s := SelfTestStep{Name: name, OK: err == nil, DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			s.Error = err.Error()
+			res.OK = false
+		}
+		res.Steps = append(res.Steps, s)
+		return err == nil
+	}
+	defer func() {
+		if !res.OK {
+			selfTestFailures.Inc()
+		}
+	}()
+
+	// The timestamp keeps runs from sharing a CID.
+	blob := []byte(fmt.Sprintf("qaku-cache self-test %d", now().UnixNano()))
+
+	ok := step("upload", func() error {
+		cid, err := backend.Upload(ctx, blob)
+		res.CID = cid
+		return err
+	})
+	if !ok {
+		return res
+	}
+	defer step("cleanup", func() error { return backend.Unpin(ctx, res.CID) })
+
+	ok = step("pin", func() error { return backend.FetchToNetwork(ctx, res.CID) })
+	if !ok {
+		return res
+	}
+
+	step("read", func() error {
+		resp, err := backend.Download(ctx, res.CID, http.Header{})
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, int64(len(blob))+1))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, blob) {
+			return fmt.Errorf("read back %d bytes that do not match the %d uploaded", len(data), len(blob))
+		}
+		return nil
+	})
+
+	return res
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSelfTest(t *testing.T) {
+	noRetries(t)
+	tests := []struct {
+		name       string
+		fail       string
+		wantStatus int
+		wantSteps  []string
+		wantFailed string
+	}{
+		{name: "healthy", wantStatus: http.StatusOK, wantSteps: []string{"upload", "pin", "read", "cleanup"}},
+		{name: "unreadable", fail: "download", wantStatus: http.StatusBadGateway, wantSteps: []string{"upload", "pin", "read", "cleanup"}, wantFailed: "read"},
+		{name: "upload fails", fail: "upload", wantStatus: http.StatusBadGateway, wantSteps: []string{"upload"}, wantFailed: "upload"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			if tt.fail != "" {
+				m.Fail(tt.fail, http.StatusInternalServerError)
+			}
+			h := newTestServer(t, newTestCache(t), testAdmin)
+
+			if w := do(h, http.MethodPost, "/api/qaku/v1/selftest", nil, nil); w.Code == http.StatusOK {
+				t.Error("ran the self-test without admin credentials")
+			}
+			total, failures := testutil.ToFloat64(selfTestTotal), testutil.ToFloat64(selfTestFailures)
+			w := do(h, http.MethodPost, "/api/qaku/v1/selftest", adminHeader(), nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var res SelfTestResult
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+
+			steps := []string{}
+			for _, s := range res.Steps {
+				steps = append(steps, s.Name)
+				if s.OK != (s.Name != tt.wantFailed) {
+					t.Errorf("step %s ok = %t: %s", s.Name, s.OK, s.Error)
+				}
+			}
+			if !slices.Equal(steps, tt.wantSteps) {
+				t.Errorf("ran the steps %v, want %v", steps, tt.wantSteps)
+			}
+			if res.OK != (tt.wantFailed == "") {
+				t.Errorf("self-test ok = %t, want %t", res.OK, tt.wantFailed == "")
+			}
+			if res.CID != "" && m.Local(res.CID) {
+				t.Error("left the self-test blob in the store")
+			}
+
+			if got := testutil.ToFloat64(selfTestTotal) - total; got != 1 {
+				t.Errorf("counted %v self-tests, want 1", got)
+			}
+			wantFailures := 0.0
+			if tt.wantFailed != "" {
+				wantFailures = 1
+			}
+			if got := testutil.ToFloat64(selfTestFailures) - failures; got != wantFailures {
+				t.Errorf("counted %v failed self-tests, want %v", got, wantFailures)
+			}
+		})
+	}
+}
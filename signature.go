@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	envOwnerDerivation = "QAKU_CACHE_OWNER_DERIVATION"
+	envSignatureScheme = "QAKU_CACHE_SIGNATURE_SCHEME"
+
+	// signatureSchemeNone skips signature verification.
+	signatureSchemeNone = "none"
+	// signatureSchemeKeccak expects a secp256k1 signature over the keccak256
+	// hash of the signed payload.
+	signatureSchemeKeccak = "keccak"
+	// signatureSchemePersonal expects an EIP-191 personal_sign signature, the
+	// scheme used by browser wallets.
+	signatureSchemePersonal = "eth-personal"
+
+	// ownerDerivationEqual requires Owner and Signer to be the same string.
+	ownerDerivationEqual = "equal"
+	// ownerDerivationEthAddress requires Owner to be the Ethereum address of
+	// the Signer public key (or the Signer itself when it is an address).
+	ownerDerivationEthAddress = "eth-address"
+)
+
+// ownerDerivation selects how verifyOwner relates Owner and Signer, empty
+// disables the check.
+var ownerDerivation = ""
+
+// signatureScheme selects how verifySignature checks message signatures.
+var signatureScheme = signatureSchemeKeccak
+
+func validSignatureScheme(s string) bool {
+	switch s {
+	case signatureSchemeNone, signatureSchemeKeccak, signatureSchemePersonal:
+		return true
+	}
+
+	return false
+}
+
+func validOwnerDerivation(d string) bool {
+	switch d {
+	case "", ownerDerivationEqual, ownerDerivationEthAddress:
+		return true
+	}
+
+	return false
+}
+
+// signerAddress returns the Ethereum address for a hex encoded signer, which
+// may be an address or a compressed/uncompressed secp256k1 public key.
+func signerAddress(signer string) (common.Address, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(signer, "0x"))
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid signer encoding: %w", err)
+	}
+
+	switch len(b) {
+	case common.AddressLength:
+		return common.BytesToAddress(b), nil
+	case 33:
+		pub, err := crypto.DecompressPubkey(b)
+		if err != nil {
+			return common.Address{}, fmt.Errorf("invalid signer public key: %w", err)
+		}
+		return crypto.PubkeyToAddress(*pub), nil
+	case 65:
+		pub, err := crypto.UnmarshalPubkey(b)
+		if err != nil {
+			return common.Address{}, fmt.Errorf("invalid signer public key: %w", err)
+		}
+		return crypto.PubkeyToAddress(*pub), nil
+	}
+
+	return common.Address{}, fmt.Errorf("invalid signer length %d", len(b))
+}
+
+// verifyOwner checks the message Owner corresponds to its Signer according to
+// the configured derivation.
+func verifyOwner(msg *QakuMessage, derivation string) error {
+	switch derivation {
+	case "":
+		return nil
+	case ownerDerivationEqual:
+		if !strings.EqualFold(msg.Payload.Owner, msg.Signer) {
+			return fmt.Errorf("owner %s does not match signer %s", msg.Payload.Owner, msg.Signer)
+		}
+		return nil
+	case ownerDerivationEthAddress:
+		addr, err := signerAddress(msg.Signer)
+		if err != nil {
+			return err
+		}
+		if !common.IsHexAddress(msg.Payload.Owner) || common.HexToAddress(msg.Payload.Owner) != addr {
+			return fmt.Errorf("owner %s does not match signer address %s", msg.Payload.Owner, addr.Hex())
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown owner derivation %q", derivation)
+}
+
+// signedPayload returns the bytes the signer signed: the JSON payload as
+// received followed by the timestamp as sent, quotes removed. The decoded and
+// normalized fields are never used, a re-encoding may differ from what was
+// signed.
+func signedPayload(msg *QakuMessage) ([]byte, error) {
+	if len(msg.rawPayload) == 0 {
+		return nil, errors.New("message has no received payload")
+	}
+
+	data := append([]byte{}, msg.rawPayload...)
+	return append(data, msg.rawTimestamp...), nil
+}
+
+// verifySignature recovers the public key from the message signature and
+// checks it belongs to the Signer.
+func verifySignature(msg *QakuMessage) error {
+	var hash []byte
+	switch signatureScheme {
+	case signatureSchemeNone:
+		return nil
+	case signatureSchemeKeccak, signatureSchemePersonal:
+		data, err := signedPayload(msg)
+		if err != nil {
+			return fmt.Errorf("failed to encode signed payload: %w", err)
+		}
+		if signatureScheme == signatureSchemePersonal {
+			hash = accounts.TextHash(data)
+		} else {
+			hash = crypto.Keccak256(data)
+		}
+	default:
+		return fmt.Errorf("unknown signature scheme %q", signatureScheme)
+	}
+
+	sig, err := hex.DecodeString(strings.TrimPrefix(msg.Signature, "0x"))
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if len(sig) != crypto.SignatureLength {
+		return fmt.Errorf("invalid signature length %d", len(sig))
+	}
+	// Wallets encode the recovery id as 27/28.
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return fmt.Errorf("failed to recover signer: %w", err)
+	}
+
+	signer, err := signerAddress(msg.Signer)
+	if err != nil {
+		return err
+	}
+	if recovered := crypto.PubkeyToAddress(*pub); recovered != signer {
+		return fmt.Errorf("signature by %s does not match signer %s", recovered.Hex(), signer.Hex())
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestVerifyOwner(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := "0x" + hex.EncodeToString(crypto.CompressPubkey(&key.PublicKey))
+	addr := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	otherAddr := crypto.PubkeyToAddress(other.PublicKey).Hex()
+
+	tests := []struct {
+		name       string
+		derivation string
+		owner      string
+		signer     string
+		wantErr    bool
+	}{
+		{name: "disabled", derivation: "", owner: "anyone", signer: pub},
+		{name: "equal", derivation: ownerDerivationEqual, owner: "0xABC", signer: "0xabc"},
+		{name: "not equal", derivation: ownerDerivationEqual, owner: "0xabc", signer: "0xabd", wantErr: true},
+		{name: "address of key", derivation: ownerDerivationEthAddress, owner: addr, signer: pub},
+		{name: "address of address", derivation: ownerDerivationEthAddress, owner: addr, signer: addr},
+		{name: "address of other key", derivation: ownerDerivationEthAddress, owner: otherAddr, signer: pub, wantErr: true},
+		{name: "owner not an address", derivation: ownerDerivationEthAddress, owner: "alice", signer: pub, wantErr: true},
+		{name: "malformed signer", derivation: ownerDerivationEthAddress, owner: addr, signer: "0xzz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &QakuMessage{Payload: CacheRequest{Owner: tt.owner}, Signer: tt.signer}
+			err := verifyOwner(msg, tt.derivation)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyOwner = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// testSignerKey is a fixed keypair so failures are reproducible.
+const testSignerKey = "b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291"
+
+// signedMessage builds a message whose payload and timestamp are signed
+// exactly as given, hashed with hash.
+func signedMessage(t *testing.T, payload string, timestamp string, hash func([]byte) []byte) []byte {
+	t.Helper()
+
+	key, err := crypto.HexToECDSA(testSignerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := crypto.Sign(hash([]byte(payload+strings.Trim(timestamp, `"`))), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := hex.EncodeToString(crypto.CompressPubkey(&key.PublicKey))
+
+	return []byte(fmt.Sprintf(`{"type":%q,"payload":%s,"timestamp":%s,"signature":"0x%x","signer":"0x%s"}`, cacheMessageType, payload, timestamp, sig, pub))
+}
+
+func TestVerifySignature(t *testing.T) {
+	keccak := func(data []byte) []byte { return crypto.Keccak256(data) }
+	payload := `{"cid":"zDvZRwzm","owner":"alice"}`
+
+	tests := []struct {
+		name    string
+		scheme  string
+		message func(t *testing.T) []byte
+		wantErr bool
+	}{
+		{
+			name:    "keccak",
+			scheme:  signatureSchemeKeccak,
+			message: func(t *testing.T) []byte { return signedMessage(t, payload, "1700000000000", keccak) },
+		},
+		{
+			name:    "personal",
+			scheme:  signatureSchemePersonal,
+			message: func(t *testing.T) []byte { return signedMessage(t, payload, "1700000000000", accounts.TextHash) },
+		},
+		{
+			// The signed bytes are kept as received, including whitespace
+			// and key order a re-encoding would change.
+			name:   "raw payload",
+			scheme: signatureSchemeKeccak,
+			message: func(t *testing.T) []byte {
+				return signedMessage(t, `{ "owner": "alice", "cid": "zDvZRwzm" }`, "1700000000000", keccak)
+			},
+		},
+		{
+			name:    "seconds timestamp",
+			scheme:  signatureSchemeKeccak,
+			message: func(t *testing.T) []byte { return signedMessage(t, payload, "1700000000", keccak) },
+		},
+		{
+			name:    "string timestamp",
+			scheme:  signatureSchemeKeccak,
+			message: func(t *testing.T) []byte { return signedMessage(t, payload, `"1700000000000"`, keccak) },
+		},
+		{
+			name:   "wallet recovery id",
+			scheme: signatureSchemeKeccak,
+			message: func(t *testing.T) []byte {
+				msg := signedMessage(t, payload, "1700000000000", keccak)
+				var m map[string]any
+				json.Unmarshal(msg, &m)
+				sig, _ := hex.DecodeString(strings.TrimPrefix(m["signature"].(string), "0x"))
+				sig[crypto.RecoveryIDOffset] += 27
+				return bytes.Replace(msg, []byte(m["signature"].(string)), []byte(fmt.Sprintf("0x%x", sig)), 1)
+			},
+		},
+		{
+			name:    "wrong scheme",
+			scheme:  signatureSchemePersonal,
+			message: func(t *testing.T) []byte { return signedMessage(t, payload, "1700000000000", keccak) },
+			wantErr: true,
+		},
+		{
+			name:   "tampered payload",
+			scheme: signatureSchemeKeccak,
+			message: func(t *testing.T) []byte {
+				return bytes.Replace(signedMessage(t, payload, "1700000000000", keccak), []byte("alice"), []byte("mallory"), 1)
+			},
+			wantErr: true,
+		},
+		{
+			name:   "tampered timestamp",
+			scheme: signatureSchemeKeccak,
+			message: func(t *testing.T) []byte {
+				return bytes.Replace(signedMessage(t, payload, "1700000000000", keccak), []byte("1700000000000"), []byte("1800000000000"), 1)
+			},
+			wantErr: true,
+		},
+		{
+			name:   "other signer",
+			scheme: signatureSchemeKeccak,
+			message: func(t *testing.T) []byte {
+				other, _ := crypto.GenerateKey()
+				msg := signedMessage(t, payload, "1700000000000", keccak)
+				i := bytes.Index(msg, []byte(`"signer":"0x`)) + len(`"signer":"0x`)
+				return append(append(msg[:i:i], hex.EncodeToString(crypto.CompressPubkey(&other.PublicKey))...), `"}`...)
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unsigned",
+			scheme:  signatureSchemeKeccak,
+			message: func(t *testing.T) []byte { return []byte(`{"type":"cache","payload":` + payload + `}`) },
+			wantErr: true,
+		},
+		{
+			name:    "unsigned without verification",
+			scheme:  signatureSchemeNone,
+			message: func(t *testing.T) []byte { return []byte(`{"type":"cache","payload":` + payload + `}`) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &signatureScheme, tt.scheme)
+			msg, err := decodeMessage(tt.message(t), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = verifySignature(msg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifySignature = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
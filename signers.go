@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const envSignerAllowlist = "QAKU_CACHE_SIGNER_ALLOWLIST"
+
+var snapSignerFiltered = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qaku_cache_signer_filtered",
+	Help: "The number of messages dropped because their signer is not allowlisted",
+})
+
+// signerAllowlist holds the addresses of the signers whose messages are
+// processed. Keys and addresses compare by address, so either form may be
+// listed or sent. A nil allowlist accepts every signer.
+type signerAllowlist map[common.Address]struct{}
+
+// parseSignerAllowlist parses a comma separated list of signer addresses or
+// public keys, an empty list disables the filter.
+func parseSignerAllowlist(s string) (signerAllowlist, error) {
+	var l signerAllowlist
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		addr, err := signerAddress(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signer %q in %s: %w", raw, envSignerAllowlist, err)
+		}
+		if l == nil {
+			l = make(signerAllowlist)
+		}
+		l[addr] = struct{}{}
+	}
+
+	return l, nil
+}
+
+// Allowed reports whether messages of signer are processed. It only decodes
+// the signer, the signature is verified later.
+func (l signerAllowlist) Allowed(signer string) bool {
+	if l == nil {
+		return true
+	}
+
+	addr, err := signerAddress(signer)
+	if err != nil {
+		return false
+	}
+	_, ok := l[addr]
+
+	return ok
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSignerAllowlist(t *testing.T) {
+	key, err := crypto.HexToECDSA(testSignerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	pub := "0x" + hex.EncodeToString(crypto.CompressPubkey(&key.PublicKey))
+
+	tests := []struct {
+		list    string
+		signer  string
+		want    bool
+		wantErr bool
+	}{
+		{list: "", signer: "anyone", want: true},
+		{list: addr, signer: pub, want: true},
+		{list: pub, signer: addr, want: true},
+		{list: " 0x0000000000000000000000000000000000000001 , " + addr, signer: pub, want: true},
+		{list: "0x0000000000000000000000000000000000000001", signer: pub},
+		{list: addr, signer: "not a key"},
+		{list: "not a key", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		l, err := parseSignerAllowlist(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSignerAllowlist(%q) = %v, want error %t", tt.list, err, tt.wantErr)
+			continue
+		}
+		if err == nil && l.Allowed(tt.signer) != tt.want {
+			t.Errorf("%q: Allowed(%s) = %t, want %t", tt.list, tt.signer, !tt.want, tt.want)
+		}
+	}
+}
+
+func TestProcessFiltersSigners(t *testing.T) {
+	noRetries(t)
+	key, err := crypto.HexToECDSA(testSignerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keccak := func(data []byte) []byte { return crypto.Keccak256(data) }
+
+	tests := []struct {
+		name       string
+		list       string
+		wantCached bool
+	}{
+		{name: "allowed", list: crypto.PubkeyToAddress(key.PublicKey).Hex(), wantCached: true},
+		{name: "filtered", list: "0x0000000000000000000000000000000000000001"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			c := newTestCache(t)
+			setGlobal(t, &signatureScheme, signatureSchemeKeccak)
+			c.signers, err = parseSignerAllowlist(tt.list)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cid := testCID(tt.name)
+			m.Add(cid, []byte("snapshot"))
+
+			filtered := testutil.ToFloat64(snapSignerFiltered)
+			msg := signedMessage(t, fmt.Sprintf(`{"cid":%q,"owner":"alice"}`, cid), strconv.FormatInt(time.Now().UnixMilli(), 10), keccak)
+			if err := c.OnNewEnvelope(testEnvelope(msg)); err != nil {
+				t.Fatal(err)
+			}
+			if c.index.Has(cid) != tt.wantCached {
+				t.Errorf("cached = %t, want %t", c.index.Has(cid), tt.wantCached)
+			}
+			if called := m.Calls("manifest") > 0; called != tt.wantCached {
+				t.Errorf("asked Codex %t, want %t", called, tt.wantCached)
+			}
+			wantFiltered := 1.0
+			if tt.wantCached {
+				wantFiltered = 0
+			}
+			if got := testutil.ToFloat64(snapSignerFiltered) - filtered; got != wantFiltered {
+				t.Errorf("counted %v filtered messages, want %v", got, wantFiltered)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const envOwnerMaxSizes = "QAKU_CACHE_OWNER_MAX_SIZES"
+
+// maxDatasetSize is the limit of owners without an override, zero means
+// defaultMaxSize. The admin API changes it while envelopes are processed, so
+// it is only accessed atomically.
+var maxDatasetSize atomic.Int64
+
+func datasetSizeLimit() int {
+	if n := maxDatasetSize.Load(); n > 0 {
+		return int(n)
+	}
+
+	return defaultMaxSize
+}
+
+// MaxSizeRequest changes the default dataset size limit.
+type MaxSizeRequest struct {
+	Bytes int `json:"bytes"`
+}
+
+// sizePolicy resolves the largest dataset an owner may cache. Owners listed
+// in the overrides get their own limit, everyone else the current default.
+type sizePolicy struct {
+	owners map[string]int
+}
+
+// parseSizePolicy parses the overrides as a comma separated list of
+// owner=bytes pairs.
+func parseSizePolicy(overrides string) (sizePolicy, error) {
+	p := sizePolicy{owners: make(map[string]int)}
+
+	for _, pair := range strings.Split(overrides, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		owner, size, ok := strings.Cut(pair, "=")
+		if !ok || owner == "" {
+			return p, fmt.Errorf("invalid owner max size %q, expected owner=bytes", pair)
+		}
+
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 {
+			return p, fmt.Errorf("invalid max size for owner %s: %q", owner, size)
+		}
+		p.owners[owner] = n
+	}
+
+	return p, nil
+}
+
+func (p sizePolicy) For(owner string) int {
+	if n, ok := p.owners[owner]; ok {
+		return n
+	}
+
+	return datasetSizeLimit()
+}
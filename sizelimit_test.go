@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSizePolicy(t *testing.T) {
+	old := maxDatasetSize.Swap(1000)
+	t.Cleanup(func() { maxDatasetSize.Store(old) })
+
+	tests := []struct {
+		overrides string
+		owner     string
+		want      int
+		wantErr   bool
+	}{
+		{overrides: "", owner: "alice", want: 1000},
+		{overrides: "alice=10", owner: "alice", want: 10},
+		{overrides: "alice=10, bob=20", owner: "bob", want: 20},
+		{overrides: "alice=10", owner: "carol", want: 1000},
+		{overrides: "alice", wantErr: true},
+		{overrides: "=10", wantErr: true},
+		{overrides: "alice=0", wantErr: true},
+		{overrides: "alice=big", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		p, err := parseSizePolicy(tt.overrides)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSizePolicy(%q) = %v, want error %t", tt.overrides, err, tt.wantErr)
+			continue
+		}
+		if err == nil && p.For(tt.owner) != tt.want {
+			t.Errorf("%q: limit of %s = %d, want %d", tt.overrides, tt.owner, p.For(tt.owner), tt.want)
+		}
+	}
+}
+
+func TestProcessRejectsOversizedDataset(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	old := maxDatasetSize.Swap(4)
+	t.Cleanup(func() { maxDatasetSize.Store(old) })
+
+	oversized := testutil.ToFloat64(snapRejectedOversized)
+	failures := testutil.ToFloat64(snapFailure)
+	cancelled := testutil.ToFloat64(snapCancelled)
+
+	cid := testCID("oversized")
+	m.Add(cid, []byte("too big"))
+	err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice")))
+	if err == nil || !strings.Contains(err.Error(), "dataset too big") {
+		t.Errorf("got error %v, want dataset too big", err)
+	}
+	if c.index.Has(cid) {
+		t.Error("cached the oversized dataset")
+	}
+	if got := testutil.ToFloat64(snapRejectedOversized) - oversized; got != 1 {
+		t.Errorf("counted %v oversized rejections, want 1", got)
+	}
+	if got := testutil.ToFloat64(snapFailure) - failures; got != 1 {
+		t.Errorf("counted %v failures, want 1", got)
+	}
+	if got := testutil.ToFloat64(snapCancelled) - cancelled; got != 0 {
+		t.Errorf("counted %v cancellations, want none", got)
+	}
+}
+
+func TestOwnerSizeOverride(t *testing.T) {
+	old := maxDatasetSize.Swap(defaultMaxSize)
+	t.Cleanup(func() { maxDatasetSize.Store(old) })
+	if got := (sizePolicy{}).For("default"); got != 5*1024*1024 {
+		t.Fatalf("default limit = %d, want 5 MiB", got)
+	}
+
+	b := newTestFSBackend(t)
+	c := newTestCache(t)
+	c.backend = b
+	var err error
+	c.sizeLimits, err = parseSizePolicy("trusted=8388608")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 6*1024*1024)
+	for _, tt := range []struct {
+		owner      string
+		wantCached bool
+	}{
+		{owner: "trusted", wantCached: true},
+		{owner: "default"},
+	} {
+		cid := testCID(tt.owner)
+		addDataset(t, b, cid, data)
+		err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, tt.owner)))
+		if (err == nil) != tt.wantCached || c.index.Has(cid) != tt.wantCached {
+			t.Errorf("%s: cached %t with error %v, want cached %t", tt.owner, c.index.Has(cid), err, tt.wantCached)
+		}
+	}
+}
+
+func TestMaxSizeEndpoint(t *testing.T) {
+	old := maxDatasetSize.Swap(1000)
+	t.Cleanup(func() { maxDatasetSize.Store(old) })
+	b := newTestFSBackend(t)
+	c := newTestCache(t)
+	c.backend = b
+	corsCfg, err := corsConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newWorkerPool(0, 1, priorityNormal, dropNewest, c.OnNewEnvelope)
+	srv := server("127.0.0.1:0", nil, corsCfg, 0, nil, discardLogger(), c, pool, testAdmin, nil, nil)
+	t.Cleanup(func() { srv.Close() })
+	h := srv.Handler
+
+	statsLimit := func() int {
+		t.Helper()
+		var stats StatsSummary
+		if err := json.Unmarshal(get(h, "/api/qaku/v1/stats", nil).Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats.MaxDatasetSize
+	}
+	setLimit := func(header http.Header, body string) int {
+		t.Helper()
+		return do(h, http.MethodPut, "/api/qaku/v1/config/max-size", header, strings.NewReader(body)).Code
+	}
+
+	before, after := testCID("before"), testCID("after")
+	addDataset(t, b, before, make([]byte, 2000))
+	addDataset(t, b, after, make([]byte, 2000))
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, before, "alice"))); err == nil || c.index.Has(before) {
+		t.Fatal("cached a dataset over the limit")
+	}
+
+	for _, body := range []string{`{"bytes":0}`, `{"bytes":-1}`, `{"bytes":"big"}`} {
+		if code := setLimit(adminHeader(), body); code != http.StatusBadRequest {
+			t.Errorf("setting %s answered %d, want 400", body, code)
+		}
+	}
+	if code := setLimit(nil, `{"bytes":4096}`); code != http.StatusUnauthorized {
+		t.Errorf("setting the limit without a token answered %d, want 401", code)
+	}
+	if got := statsLimit(); got != 1000 {
+		t.Fatalf("limit = %d after rejected updates, want 1000", got)
+	}
+
+	if code := setLimit(adminHeader(), `{"bytes":4096}`); code != http.StatusOK {
+		t.Fatalf("setting the limit answered %d", code)
+	}
+	if got := statsLimit(); got != 4096 {
+		t.Errorf("stats report a limit of %d, want 4096", got)
+	}
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, after, "alice"))); err != nil || !c.index.Has(after) {
+		t.Errorf("the next request was not cached under the new limit: %v", err)
+	}
+}
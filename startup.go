@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/waku-org/go-waku/waku/v2/node"
+)
+
+const (
+	envStartRetries = "QAKU_CACHE_START_RETRIES"
+	envStartDelay   = "QAKU_CACHE_START_DELAY"
+
+	defaultStartRetries = 5
+	defaultStartDelay   = 2 * time.Second
+)
+
+// startWakuNode creates and starts a node with factory, retrying up to
+// retries times with a doubling delay so transient network issues do not
+// turn into a crash loop.
+func startWakuNode(ctx context.Context, retries int, delay time.Duration, factory func() (*node.WakuNode, error)) (*node.WakuNode, error) {
+	for attempt := 0; ; attempt++ {
+		wn, err := factory()
+		if err == nil {
+			err = wn.Start(ctx)
+			if err == nil {
+				return wn, nil
+			}
+			err = fmt.Errorf("failed to start Waku node: %w", err)
+		} else {
+			err = fmt.Errorf("failed to create Waku node: %w", err)
+		}
+
+		if attempt >= retries {
+			return nil, err
+		}
+
+		slog.Warn("Waku node did not start, retrying", "error", err, "attempt", attempt+1, "attempts", retries+1, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/waku-org/go-waku/waku/v2/node"
+)
+
+// flakyNodeFactory fails the first failures calls and creates a node on
+// a random local port afterwards.
+func flakyNodeFactory(t *testing.T, failures int, calls *int) func() (*node.WakuNode, error) {
+	return func() (*node.WakuNode, error) {
+		*calls++
+		if *calls <= failures {
+			return nil, errors.New("network is unreachable")
+		}
+
+		wn, err := node.New(node.WithHostAddress(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+		if err == nil {
+			t.Cleanup(wn.Stop)
+		}
+		return wn, err
+	}
+}
+
+func TestStartWakuNodeRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		retries   int
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "first try", failures: 0, retries: 2, wantCalls: 1},
+		{name: "after retries", failures: 2, retries: 2, wantCalls: 3},
+		{name: "gives up", failures: 3, retries: 2, wantErr: true, wantCalls: 3},
+		{name: "no retries", failures: 1, retries: 0, wantErr: true, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			wn, err := startWakuNode(context.Background(), tt.retries, time.Millisecond, flakyNodeFactory(t, tt.failures, &calls))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("startWakuNode = %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && wn == nil {
+				t.Error("startWakuNode returned no node")
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("called the factory %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestStartWakuNodeStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	calls := 0
+	_, err := startWakuNode(ctx, 10, time.Hour, flakyNodeFactory(t, 10, &calls))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("startWakuNode = %v, want context.Canceled during the backoff", err)
+	}
+	if calls != 1 {
+		t.Errorf("called the factory %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const envMetricsLogInterval = "QAKU_CACHE_METRICS_LOG_INTERVAL"
+
+// startedAt is when the process started, reported as the uptime.
+var startedAt = time.Now()
+
+type Stats struct {
+	Successes         float64 `json:"successes"`
+	Failures          float64 `json:"failures"`
+	Cancelled         float64 `json:"cancelled"`
+	RejectedBlockSize float64 `json:"rejectedBlockSize"`
+	InFlight          int     `json:"inFlight"`
+	Datasets          int     `json:"datasets"`
+	TotalBytes        int64   `json:"totalBytes"`
+	// FailuresByReason splits Failures by the step that failed.
+	FailuresByReason map[string]float64 `json:"failuresByReason"`
+}
+
+// collectorSamples reads the current samples of c through a private
+// registry, the same way the metrics endpoint gathers them.
+func collectorSamples(c prometheus.Collector) []MetricSample {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		return nil
+	}
+
+	snap, err := gatherSamples(reg, "")
+	if err != nil {
+		return nil
+	}
+	for _, f := range snap {
+		return f.Samples
+	}
+
+	return nil
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	samples := collectorSamples(c)
+	if len(samples) == 0 {
+		return 0
+	}
+
+	return samples[0].Value
+}
+
+func gaugeValue(g prometheus.Gauge) float64 {
+	samples := collectorSamples(g)
+	if len(samples) == 0 {
+		return 0
+	}
+
+	return samples[0].Value
+}
+
+// failuresByReason returns the failed cache attempts keyed by reason.
+func failuresByReason() map[string]float64 {
+	reasons := make(map[string]float64)
+	for _, s := range collectorSamples(snapFailureReason) {
+		reasons[s.Labels["reason"]] = s.Value
+	}
+
+	return reasons
+}
+
+// StatsSummary is the health overview served by the stats endpoint.
+type StatsSummary struct {
+	Stats
+	WakuPeers     int     `json:"wakuPeers"`
+	UptimeSeconds float64 `json:"uptimeSeconds"`
+	Maintenance   bool    `json:"maintenance"`
+	// MaxDatasetSize is the limit of owners without an override.
+	MaxDatasetSize int `json:"maxDatasetSize"`
+}
+
+// collectSummary only reads the metrics and the index, it never calls the
+// backend so it stays cheap to poll.
+func collectSummary(cache *Cache) StatsSummary {
+	return StatsSummary{
+		Stats:          collectStats(cache),
+		WakuPeers:      int(gaugeValue(wakuPeers)),
+		UptimeSeconds:  time.Since(startedAt).Seconds(),
+		Maintenance:    cache.maintenance.On(),
+		MaxDatasetSize: datasetSizeLimit(),
+	}
+}
+
+func collectStats(cache *Cache) Stats {
+	return Stats{
+		Successes:         counterValue(snapSuccess.WithLabelValues("true")) + counterValue(snapSuccess.WithLabelValues("false")),
+		Failures:          counterValue(snapFailure),
+		Cancelled:         counterValue(snapCancelled),
+		RejectedBlockSize: counterValue(snapBlockSizeRejected),
+		InFlight:          len(cache.InFlight()),
+		Datasets:          cache.index.Len(),
+		TotalBytes:        cache.index.TotalBytes(),
+		FailuresByReason:  failuresByReason(),
+	}
+}
+
+// logMetrics periodically writes a JSON snapshot of the key metrics to the log
+// as a fallback for deployments without a Prometheus scraper.
+func logMetrics(ctx context.Context, interval time.Duration, cache *Cache) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			data, err := json.Marshal(collectStats(cache))
+			if err != nil {
+				slog.Error("failed to marshal metrics", "error", err)
+				continue
+			}
+			slog.Info("metrics", "stats", json.RawMessage(data))
+		}
+	}
+}
+
+type MetricSample struct {
+	Labels  map[string]string  `json:"labels,omitempty"`
+	Value   float64            `json:"value"`
+	Count   uint64             `json:"count,omitempty"`
+	Buckets map[string]float64 `json:"buckets,omitempty"`
+}
+
+type MetricFamily struct {
+	Type    string         `json:"type"`
+	Help    string         `json:"help"`
+	Samples []MetricSample `json:"samples"`
+}
+
+// metricsSnapshot gathers the current values of all qaku_cache metrics from
+// the default registry.
+func metricsSnapshot() (map[string]MetricFamily, error) {
+	return gatherSamples(prometheus.DefaultGatherer, "qaku_cache_")
+}
+
+// gatherSamples gathers the metrics of g whose name starts with prefix.
+// Histograms report their sum as value plus the cumulative bucket counts
+// keyed by upper bound.
+func gatherSamples(g prometheus.Gatherer, prefix string) (map[string]MetricFamily, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	snap := make(map[string]MetricFamily)
+	for _, f := range families {
+		if !strings.HasPrefix(f.GetName(), prefix) {
+			continue
+		}
+
+		mf := MetricFamily{
+			Type:    strings.ToLower(f.GetType().String()),
+			Help:    f.GetHelp(),
+			Samples: []MetricSample{},
+		}
+		for _, m := range f.GetMetric() {
+			sample := MetricSample{}
+			for _, l := range m.GetLabel() {
+				if sample.Labels == nil {
+					sample.Labels = make(map[string]string)
+				}
+				sample.Labels[l.GetName()] = l.GetValue()
+			}
+
+			switch {
+			case m.GetCounter() != nil:
+				sample.Value = m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				sample.Value = m.GetGauge().GetValue()
+			case m.GetHistogram() != nil:
+				h := m.GetHistogram()
+				sample.Value = h.GetSampleSum()
+				sample.Count = h.GetSampleCount()
+				sample.Buckets = make(map[string]float64)
+				for _, b := range h.GetBucket() {
+					sample.Buckets[strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)] = float64(b.GetCumulativeCount())
+				}
+			case m.GetUntyped() != nil:
+				sample.Value = m.GetUntyped().GetValue()
+			}
+			mf.Samples = append(mf.Samples, sample)
+		}
+		snap[f.GetName()] = mf
+	}
+
+	return snap, nil
+}
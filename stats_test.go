@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsEndpoint(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	corsCfg, err := corsConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newWorkerPool(0, 1, priorityNormal, dropNewest, c.OnNewEnvelope)
+	srv := server("127.0.0.1:0", nil, corsCfg, 0, nil, discardLogger(), c, pool, nil, nil, nil)
+	t.Cleanup(func() { srv.Close() })
+
+	before := collectStats(c)
+	for _, data := range []string{"first", "second snapshot"} {
+		cid := testCID(data)
+		m.Add(cid, []byte(data))
+		if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wakuPeers.Set(3)
+
+	calls := m.Calls("debug_info") + m.Calls("manifest") + m.Calls("download")
+	w := get(srv.Handler, "/api/qaku/v1/stats", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if m.Calls("debug_info")+m.Calls("manifest")+m.Calls("download") != calls {
+		t.Error("the stats endpoint called Codex")
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"datasets", "totalBytes", "successes", "failures", "wakuPeers", "uptimeSeconds"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("stats lack %q: %s", key, w.Body)
+		}
+	}
+
+	var got StatsSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Datasets != 2 || got.TotalBytes != int64(len("first")+len("second snapshot")) {
+		t.Errorf("got %d datasets of %d bytes, want 2 of %d", got.Datasets, got.TotalBytes, len("first")+len("second snapshot"))
+	}
+	if got.Successes-before.Successes != 2 || got.Failures != before.Failures {
+		t.Errorf("counted %v successes and %v failures, want 2 and 0", got.Successes-before.Successes, got.Failures-before.Failures)
+	}
+	if got.WakuPeers != 3 || got.UptimeSeconds <= 0 {
+		t.Errorf("got %d peers after %vs, want 3 peers and a positive uptime", got.WakuPeers, got.UptimeSeconds)
+	}
+}
+
+func TestLogMetricsFailuresByReason(t *testing.T) {
+	var logs lockedBuffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	c := newTestCache(t)
+	c.backend = newTestFSBackend(t)
+	before := collectStats(c).FailuresByReason["manifest"]
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, testCID("unknown"), "alice"))); err == nil {
+		t.Fatal("cached an unknown dataset")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go logMetrics(ctx, 5*time.Millisecond, c)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), `"msg":"metrics"`) {
+		if time.Now().After(deadline) {
+			t.Fatal("did not log the metrics")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+
+	for _, line := range strings.Split(logs.String(), "\n") {
+		var logged struct {
+			Msg   string `json:"msg"`
+			Stats Stats  `json:"stats"`
+		}
+		if json.Unmarshal([]byte(line), &logged) != nil || logged.Msg != "metrics" {
+			continue
+		}
+		if got := logged.Stats.FailuresByReason["manifest"] - before; got != 1 {
+			t.Errorf("logged %v manifest failures, want 1: %s", got, line)
+		}
+		return
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const envDBPath = "QAKU_CACHE_DB_PATH"
+
+var (
+	entriesBucket  = []byte("entries")
+	ownersBucket   = []byte("owners")
+	settingsBucket = []byte("settings")
+	retriesBucket  = []byte("retries")
+
+	maintenanceKey = []byte("maintenance")
+)
+
+// boltIndexStore keeps the index in an embedded bbolt database, one key per
+// CID.
+type boltIndexStore struct {
+	db *bolt.DB
+}
+
+func openBoltIndexStore(path string) (*boltIndexStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to open cache database: %w", errIndexUnavailable, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{entriesBucket, ownersBucket, settingsBucket, retriesBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%w: failed to initialise cache database: %w", errIndexUnavailable, err)
+	}
+
+	return &boltIndexStore{db: db}, nil
+}
+
+// Load reads the stored entries. Failures to read the database are
+// errIndexUnavailable, entries that cannot be parsed are not.
+func (s *boltIndexStore) Load() ([]CacheEntry, error) {
+	entries := []CacheEntry{}
+	var parseErr error
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			e := CacheEntry{}
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				parseErr = fmt.Errorf("failed to parse cache entry %s: %w", k, err)
+				return parseErr
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errIndexUnavailable, err)
+	}
+
+	return entries, nil
+}
+
+// Save replaces the stored entries in a single transaction. Single changes
+// go through PutEntry and DeleteEntry.
+func (s *boltIndexStore) Save(entries []CacheEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(entriesBucket)
+		if err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucket(entriesBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+
+			err = b.Put([]byte(e.CID), data)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// PutEntry stores e under its CID.
+func (s *boltIndexStore) PutEntry(e CacheEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Put([]byte(e.CID), data)
+	})
+}
+
+// DeleteEntry removes the entry stored under cid.
+func (s *boltIndexStore) DeleteEntry(cid string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Delete([]byte(cid))
+	})
+}
+
+// LoadActivity returns the last time each owner was seen.
+func (s *boltIndexStore) LoadActivity() (map[string]time.Time, error) {
+	seen := make(map[string]time.Time)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(ownersBucket).ForEach(func(k, v []byte) error {
+			t := time.Time{}
+			err := t.UnmarshalText(v)
+			if err != nil {
+				return fmt.Errorf("failed to parse last seen time of %s: %w", k, err)
+			}
+			seen[string(k)] = t
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return seen, nil
+}
+
+// SaveActivity stores the last time the owner was seen.
+func (s *boltIndexStore) SaveActivity(owner string, at time.Time) error {
+	data, err := at.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(ownersBucket).Put([]byte(owner), data)
+	})
+}
+
+// LoadMaintenance returns whether maintenance mode was left on.
+func (s *boltIndexStore) LoadMaintenance() (bool, error) {
+	on := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		on = string(tx.Bucket(settingsBucket).Get(maintenanceKey)) == "on"
+		return nil
+	})
+
+	return on, err
+}
+
+func (s *boltIndexStore) SaveMaintenance(on bool) error {
+	value := []byte("off")
+	if on {
+		value = []byte("on")
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(settingsBucket).Put(maintenanceKey, value)
+	})
+}
+
+// LoadRetries returns the cache requests waiting for a retry by CID.
+func (s *boltIndexStore) LoadRetries() (map[string]PendingRetry, error) {
+	pending := make(map[string]PendingRetry)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(retriesBucket).ForEach(func(k, v []byte) error {
+			r := PendingRetry{}
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return fmt.Errorf("failed to parse pending retry %s: %w", k, err)
+			}
+			pending[string(k)] = r
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pending, nil
+}
+
+func (s *boltIndexStore) SaveRetry(cid string, r PendingRetry) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(retriesBucket).Put([]byte(cid), data)
+	})
+}
+
+func (s *boltIndexStore) DeleteRetry(cid string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(retriesBucket).Delete([]byte(cid))
+	})
+}
+
+func (s *boltIndexStore) Close() error {
+	return s.db.Close()
+}
+
+// reopeningBoltStore keeps the index in the database at path once it can be
+// opened. Until then Load and Save fail like openBoltIndexStore, with
+// errIndexUnavailable, so the index runs in memory and is merged into the
+// database once it opens. Entries deleted in the meantime are kept as
+// tombstones and deleted from the database before it is read, so the merge
+// does not bring them back.
+type reopeningBoltStore struct {
+	path string
+
+	mu      sync.Mutex
+	store   *boltIndexStore
+	deleted map[string]struct{}
+}
+
+func (s *reopeningBoltStore) open() (*boltIndexStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.store != nil {
+		return s.store, nil
+	}
+
+	bs, err := openBoltIndexStore(s.path)
+	if err != nil {
+		return nil, err
+	}
+	for cid := range s.deleted {
+		if err := bs.DeleteEntry(cid); err != nil {
+			bs.Close()
+			return nil, err
+		}
+		delete(s.deleted, cid)
+	}
+	s.store = bs
+
+	return bs, nil
+}
+
+func (s *reopeningBoltStore) Load() ([]CacheEntry, error) {
+	bs, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return bs.Load()
+}
+
+func (s *reopeningBoltStore) Save(entries []CacheEntry) error {
+	bs, err := s.open()
+	if err != nil {
+		return err
+	}
+
+	return bs.Save(entries)
+}
+
+func (s *reopeningBoltStore) PutEntry(e CacheEntry) error {
+	bs, err := s.open()
+	if err != nil {
+		return err
+	}
+
+	return bs.PutEntry(e)
+}
+
+// DeleteEntry keeps a tombstone for cid if the database cannot be opened.
+func (s *reopeningBoltStore) DeleteEntry(cid string) error {
+	bs, err := s.open()
+	if err != nil {
+		s.mu.Lock()
+		if s.deleted == nil {
+			s.deleted = make(map[string]struct{})
+		}
+		s.deleted[cid] = struct{}{}
+		s.mu.Unlock()
+		return err
+	}
+
+	return bs.DeleteEntry(cid)
+}
+
+func (s *reopeningBoltStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.store == nil {
+		return nil
+	}
+
+	return s.store.Close()
+}
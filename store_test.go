@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewCacheWithUnreadableDB(t *testing.T) {
+	setGlobal(t, &persistence, &persistHealth{failing: make(map[string]string)})
+	// The directory of the database does not exist yet.
+	dir := filepath.Join(t.TempDir(), "missing")
+	path := filepath.Join(dir, "cache.db")
+	c, err := NewCache(path)
+	if err != nil {
+		t.Fatalf("NewCache with an unreadable database = %v, want it to run in memory", err)
+	}
+	if _, ok := persistence.Status()["cache index"]; !ok {
+		t.Error("health does not report the unavailable database")
+	}
+
+	cid := testCID("in memory")
+	c.index.Put(CacheEntry{CID: cid, Size: 8, CachedAt: time.Now()})
+	if !c.index.Has(cid) {
+		t.Fatal("the in-memory index lost the entry")
+	}
+
+	// Once the database can be opened the index is written to it.
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Flush once the database is available = %v", err)
+	}
+	if _, ok := persistence.Status()["cache index"]; ok {
+		t.Error("health still reports the database unavailable")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.index.Has(cid) {
+		t.Error("the entry cached while the database was unavailable is missing after a restart")
+	}
+}
+
+func TestDeletionsWhileDBUnavailable(t *testing.T) {
+	setGlobal(t, &persistence, &persistHealth{failing: make(map[string]string)})
+	dir := filepath.Join(t.TempDir(), "db")
+	path := filepath.Join(dir, "cache.db")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := openBoltIndexStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, kept := testCID("removed"), testCID("kept")
+	if err := bs.PutEntry(CacheEntry{CID: removed, Size: 8, CachedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	bs.Close()
+
+	// The database becomes unavailable before the index is loaded.
+	moved := dir + ".moved"
+	if err := os.Rename(dir, moved); err != nil {
+		t.Fatal(err)
+	}
+	i, err := loadCacheIndex(&reopeningBoltStore{path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.Put(CacheEntry{CID: removed, Size: 8, CachedAt: time.Now()})
+	if !i.Remove(removed) {
+		t.Fatal("the entry cached while the database was unavailable is not indexed")
+	}
+	i.Put(CacheEntry{CID: kept, Size: 8, CachedAt: time.Now()})
+
+	if err := os.Rename(moved, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Flush(); err != nil {
+		t.Fatalf("Flush once the database is available = %v", err)
+	}
+	if i.Has(removed) {
+		t.Error("merging the database brought back the removed entry")
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err = openBoltIndexStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	entries, err := bs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].CID != kept {
+		t.Errorf("stored %v, want only the kept entry", entryCIDs(entries))
+	}
+}
+
+// countingBoltStore counts the full rewrites of the index.
+type countingBoltStore struct {
+	*boltIndexStore
+	saves int
+}
+
+func (s *countingBoltStore) Save(entries []CacheEntry) error {
+	s.saves++
+	return s.boltIndexStore.Save(entries)
+}
+
+func TestBoltIndexWritesSingleEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	bs, err := openBoltIndexStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingBoltStore{boltIndexStore: bs}
+	i, err := loadCacheIndex(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept, removed := testCID("kept"), testCID("removed")
+	now := time.Now().UTC().Truncate(time.Second)
+	i.Put(CacheEntry{CID: kept, Size: 8, CachedAt: now})
+	i.Put(CacheEntry{CID: removed, Size: 8, CachedAt: now})
+	i.SetProtected(kept, true)
+	i.Touch(kept, now.Add(time.Minute))
+	i.Verified(kept, now.Add(2*time.Minute), true)
+	i.Served(kept, now.Add(3*time.Minute))
+	i.Remove(removed)
+	if err := i.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 0 {
+		t.Errorf("rewrote the whole index %d times for single changes", store.saves)
+	}
+
+	entries, err := bs.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].CID != kept {
+		t.Fatalf("stored %v, want only the kept entry", entryCIDs(entries))
+	}
+	e := entries[0]
+	if !e.Protected || !e.PinnedAt.Equal(now.Add(time.Minute)) || !e.VerifiedAt.Equal(now.Add(2*time.Minute)) || !e.Degraded || !e.LastServedAt.Equal(now.Add(3*time.Minute)) {
+		t.Errorf("stored %+v, want every change written", e)
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
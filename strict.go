@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const envStrictJSON = "QAKU_CACHE_STRICT_JSON"
+
+var (
+	snapStrictRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_strict_json_rejected",
+		Help: "The number of messages rejected by strict JSON decoding",
+	})
+	snapUnmarshalErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_unmarshal_errors",
+		Help: "The number of messages whose payload is not a valid JSON message",
+	})
+	snapInvalidRequest = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_invalid_request",
+		Help: "The number of valid JSON messages rejected for missing required fields",
+	})
+)
+
+// errMissingCID marks cache requests that name neither a CID nor a batch.
+var errMissingCID = errors.New("cache request has no CID")
+
+// errStrictJSON marks payloads that are valid JSON but rejected by strict
+// decoding.
+var errStrictJSON = errors.New("payload rejected by strict decoding")
+
+// decodeMessage unmarshals a cache message. In strict mode unknown fields and
+// anything after the JSON object are rejected.
+func decodeMessage(payload []byte, strict bool) (*QakuMessage, error) {
+	msg := &QakuMessage{}
+	if !strict {
+		err := json.Unmarshal(payload, msg)
+		if err != nil {
+			return nil, err
+		}
+		return msg, keepSignedFields(payload, msg)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(msg)
+	if err != nil {
+		// Plain syntax and type errors are not strict rejections.
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s", errStrictJSON, err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("%w: trailing data after message", errStrictJSON)
+	}
+	// More does not report a stray closing delimiter, Token does.
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: trailing data after message", errStrictJSON)
+	}
+
+	return msg, keepSignedFields(payload, msg)
+}
+
+// keepSignedFields stores the payload and timestamp of the message as they
+// were received, so signatures are checked over the bytes the signer signed
+// rather than over a re-encoding of the decoded values.
+func keepSignedFields(payload []byte, msg *QakuMessage) error {
+	var raw struct {
+		Payload   json.RawMessage `json:"payload"`
+		Timestamp json.RawMessage `json:"timestamp"`
+	}
+	err := json.Unmarshal(payload, &raw)
+	if err != nil {
+		return err
+	}
+
+	msg.rawPayload = raw.Payload
+	msg.rawTimestamp = string(raw.Timestamp)
+	if len(raw.Timestamp) > 0 && raw.Timestamp[0] == '"' {
+		err = json.Unmarshal(raw.Timestamp, &msg.rawTimestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    string
+		wantLax    bool
+		wantStrict error
+	}{
+		{name: "valid", payload: `{"type":"cache","payload":{"cid":"x"},"timestamp":1}`, wantLax: true},
+		{name: "unknown field", payload: `{"type":"cache","payload":{"cid":"x"},"extra":1}`, wantLax: true, wantStrict: errStrictJSON},
+		{name: "unknown payload field", payload: `{"type":"cache","payload":{"cid":"x","extra":1}}`, wantLax: true, wantStrict: errStrictJSON},
+		{name: "trailing object", payload: `{"type":"cache","payload":{"cid":"x"}}{"type":"cache"}`, wantStrict: errStrictJSON},
+		{name: "trailing delimiter", payload: `{"type":"cache","payload":{"cid":"x"}}]`, wantStrict: errStrictJSON},
+		{name: "trailing whitespace", payload: "{\"type\":\"cache\",\"payload\":{\"cid\":\"x\"}}\n", wantLax: true},
+		{name: "syntax error", payload: `{"type":`},
+		{name: "type error", payload: `{"type":1}`},
+		{name: "empty", payload: ``},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeMessage([]byte(tt.payload), false)
+			if (err == nil) != tt.wantLax {
+				t.Errorf("lax decoding = %v, want success %t", err, tt.wantLax)
+			}
+
+			_, err = decodeMessage([]byte(tt.payload), true)
+			switch {
+			case tt.wantStrict != nil:
+				if !errors.Is(err, tt.wantStrict) {
+					t.Errorf("strict decoding = %v, want %v", err, tt.wantStrict)
+				}
+			case tt.wantLax:
+				if err != nil {
+					t.Errorf("strict decoding = %v", err)
+				}
+			default:
+				if err == nil || errors.Is(err, errStrictJSON) {
+					t.Errorf("strict decoding = %v, want a plain decoding error", err)
+				}
+			}
+		})
+	}
+}
+
+func TestStrictRejectionsCounted(t *testing.T) {
+	c := newTestCache(t)
+	c.strictJSON = true
+
+	rejected := testutil.ToFloat64(snapStrictRejected)
+	for _, payload := range []string{`{"type":"cache","payload":{"cid":"x"}} trailing`, `not json`} {
+		c.OnNewEnvelope(testEnvelope([]byte(payload)))
+	}
+
+	if got := testutil.ToFloat64(snapStrictRejected) - rejected; got != 1 {
+		t.Errorf("counted %v strict rejections, want 1", got)
+	}
+}
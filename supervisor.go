@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/waku-org/go-waku/waku/v2/node"
+)
+
+const (
+	envWakuHealthInterval = "QAKU_CACHE_WAKU_HEALTH_INTERVAL"
+	envWakuMaxUnhealthy   = "QAKU_CACHE_WAKU_MAX_UNHEALTHY"
+
+	defaultWakuHealthInterval = 30 * time.Second
+	defaultWakuMaxUnhealthy   = 10
+	maxWakuRestartDelay       = 5 * time.Minute
+)
+
+var (
+	snapWakuRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_waku_restarts",
+		Help: "The number of times the Waku node was restarted after it stopped working",
+	})
+	dispatcherUp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qaku_cache_dispatcher_up",
+		Help: "Whether envelopes from a Waku node are currently dispatched (1) or not (0)",
+	})
+)
+
+// wakuNodes hands out the current Waku node, which changes when the
+// supervisor restarts it.
+type wakuNodes interface {
+	Node() *node.WakuNode
+	// Up reports whether the subscriptions of the current node are attached.
+	Up() bool
+}
+
+// wakuSupervisor owns the Waku node. A node without any peer for
+// maxUnhealthy consecutive checks is considered dead: it is stopped and
+// replaced by a fresh one from start, retrying with a doubling delay.
+type wakuSupervisor struct {
+	start        func(ctx context.Context) (*node.WakuNode, error)
+	interval     time.Duration
+	maxUnhealthy int
+	delay        time.Duration
+
+	mu sync.RWMutex
+	wn *node.WakuNode
+	up atomic.Bool
+}
+
+func newWakuSupervisor(start func(ctx context.Context) (*node.WakuNode, error), interval time.Duration, maxUnhealthy int, delay time.Duration) *wakuSupervisor {
+	return &wakuSupervisor{
+		start:        start,
+		interval:     interval,
+		maxUnhealthy: maxUnhealthy,
+		delay:        delay,
+	}
+}
+
+// Start creates the first node.
+func (s *wakuSupervisor) Start(ctx context.Context) error {
+	wn, err := s.start(ctx)
+	if err != nil {
+		return err
+	}
+	s.set(wn)
+
+	return nil
+}
+
+func (s *wakuSupervisor) Node() *node.WakuNode {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.wn
+}
+
+func (s *wakuSupervisor) Up() bool {
+	return s.up.Load()
+}
+
+func (s *wakuSupervisor) setUp(up bool) {
+	s.up.Store(up)
+	if up {
+		dispatcherUp.Set(1)
+	} else {
+		dispatcherUp.Set(0)
+	}
+}
+
+func (s *wakuSupervisor) set(wn *node.WakuNode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.wn = wn
+}
+
+// run attaches the current node and replaces it whenever it dies. attach sets
+// up the subscriptions for a node and must stop using it once its context is
+// cancelled. A zero interval disables the health checks.
+func (s *wakuSupervisor) run(ctx context.Context, attach func(ctx context.Context, wn *node.WakuNode)) {
+	for {
+		attachCtx, detach := context.WithCancel(ctx)
+		go attach(attachCtx, s.Node())
+		s.setUp(true)
+
+		s.watch(ctx)
+		detach()
+		s.setUp(false)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("stopped dispatching envelopes, replacing the Waku node")
+
+		s.Node().Stop()
+		wn, err := s.restart(ctx)
+		if err != nil {
+			return
+		}
+		s.set(wn)
+		snapWakuRestarts.Inc()
+	}
+}
+
+// watch returns once the current node has had no peers for maxUnhealthy
+// consecutive checks or ctx is done.
+func (s *wakuSupervisor) watch(ctx context.Context) {
+	if s.interval <= 0 {
+		<-ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	unhealthy := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if s.Node().PeerCount() > 0 {
+			unhealthy = 0
+			continue
+		}
+
+		unhealthy++
+		if unhealthy >= s.maxUnhealthy {
+			slog.Warn("Waku node has no peers, restarting it", "checks", unhealthy, "interval", s.interval)
+			return
+		}
+	}
+}
+
+// restart starts a new node, retrying until it succeeds or ctx is done.
+func (s *wakuSupervisor) restart(ctx context.Context) (*node.WakuNode, error) {
+	delay := s.delay
+	for {
+		wn, err := s.start(ctx)
+		if err == nil {
+			return wn, nil
+		}
+
+		slog.Error("failed to restart Waku node", "error", err, "delay", delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxWakuRestartDelay {
+			delay = maxWakuRestartDelay
+		}
+	}
+}
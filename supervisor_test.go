@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/waku-org/go-waku/waku/v2/node"
+	"go.uber.org/zap"
+)
+
+// startTestNode starts a Waku node without peers on a random local port.
+func startTestNode(t *testing.T, ctx context.Context) (*node.WakuNode, error) {
+	wn, err := node.New(node.WithHostAddress(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}), node.WithLogger(zap.NewNop()))
+	if err != nil {
+		return nil, err
+	}
+	if err := wn.Start(ctx); err != nil {
+		return nil, err
+	}
+	t.Cleanup(wn.Stop)
+	return wn, nil
+}
+
+func TestWakuSupervisorReplacesDeadNode(t *testing.T) {
+	// The second start fails, the supervisor has to retry the restart.
+	var starts atomic.Int32
+	start := func(ctx context.Context) (*node.WakuNode, error) {
+		if starts.Add(1) == 2 {
+			return nil, errors.New("network is unreachable")
+		}
+		return startTestNode(t, ctx)
+	}
+
+	// The nodes never have peers, so each is replaced after two checks.
+	s := newWakuSupervisor(start, 10*time.Millisecond, 2, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := s.Node()
+
+	restarts := testutil.ToFloat64(snapWakuRestarts)
+	attached := make(chan *node.WakuNode, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx, func(ctx context.Context, wn *node.WakuNode) {
+			attached <- wn
+			<-ctx.Done()
+		})
+	}()
+
+	var nodes []*node.WakuNode
+	for len(nodes) < 3 {
+		select {
+		case wn := <-attached:
+			nodes = append(nodes, wn)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("attached %d nodes, want the node replaced twice", len(nodes))
+		}
+	}
+	if nodes[0] != first || nodes[1] == first || nodes[2] == nodes[1] {
+		t.Error("did not attach a fresh node after each restart")
+	}
+	if got := testutil.ToFloat64(snapWakuRestarts) - restarts; got < 2 {
+		t.Errorf("counted %v restarts, want at least 2", got)
+	}
+	if got := starts.Load(); got < 4 {
+		t.Errorf("started %d nodes, want the failed restart retried", got)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not stop on shutdown")
+	}
+	if s.Up() || testutil.ToFloat64(dispatcherUp) != 0 {
+		t.Error("dispatcher still reported up after shutdown")
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent logging.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestDispatcherDownWhileReplacingNode(t *testing.T) {
+	var logs lockedBuffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	// The replacement node only starts once released.
+	var starts atomic.Int32
+	release := make(chan struct{})
+	start := func(ctx context.Context) (*node.WakuNode, error) {
+		if starts.Add(1) == 2 {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return startTestNode(t, ctx)
+	}
+
+	s := newWakuSupervisor(start, 10*time.Millisecond, 1, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	go s.run(ctx, func(ctx context.Context, wn *node.WakuNode) { <-ctx.Done() })
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitFor("the dispatcher to come up", s.Up)
+	waitFor("the node to be replaced", func() bool { return starts.Load() == 2 })
+	if s.Up() || testutil.ToFloat64(dispatcherUp) != 0 {
+		t.Error("dispatcher reported up while the node is replaced")
+	}
+	if err := ready(ctx, s, newCodexBackend(newMockCodex(t).URL)); err == nil || !strings.Contains(err.Error(), "not dispatching") {
+		t.Errorf("ready = %v, want not dispatching", err)
+	}
+	if got := logs.String(); !strings.Contains(got, `"level":"ERROR","msg":"stopped dispatching envelopes`) {
+		t.Errorf("logged %s, want an error that dispatching stopped", got)
+	}
+
+	close(release)
+	waitFor("the dispatcher to come back up", s.Up)
+	if testutil.ToFloat64(dispatcherUp) != 1 {
+		t.Error("dispatcher gauge did not recover")
+	}
+}
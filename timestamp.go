@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// secondsCutoff separates timestamps in seconds from ones in milliseconds;
+// millisecond timestamps passed it in 1973.
+const secondsCutoff = 1e11
+
+// Timestamp is a unix time in milliseconds. It accepts integers, floats and
+// numeric strings, in seconds or milliseconds, since clients disagree on the
+// format.
+type Timestamp int64
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	raw := data
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		err := json.Unmarshal(data, &s)
+		if err != nil {
+			return err
+		}
+		raw = []byte(s)
+	}
+
+	f, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f < 0 || f*1000 > math.MaxInt64 {
+		return fmt.Errorf("invalid timestamp %s", data)
+	}
+
+	if f < secondsCutoff {
+		f *= 1000
+	}
+	*t = Timestamp(f)
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTimestampUnmarshal(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    Timestamp
+		wantErr bool
+	}{
+		{json: `1700000000000`, want: 1700000000000},
+		{json: `1700000000`, want: 1700000000000},
+		{json: `1700000000000.75`, want: 1700000000000},
+		{json: `1700000000.5`, want: 1700000000500},
+		{json: `"1700000000000"`, want: 1700000000000},
+		{json: `"1700000000.25"`, want: 1700000000250},
+		{json: `null`, want: 0},
+		{json: `0`, want: 0},
+		{json: `"yesterday"`, wantErr: true},
+		{json: `""`, wantErr: true},
+		{json: `-1`, wantErr: true},
+		{json: `"NaN"`, wantErr: true},
+		{json: `"Inf"`, wantErr: true},
+		{json: `1e300`, wantErr: true},
+		{json: `true`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var got Timestamp
+		err := json.Unmarshal([]byte(tt.json), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("unmarshal %s = %v, want error %t", tt.json, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("unmarshal %s = %d, want %d", tt.json, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeMessageTimestamp(t *testing.T) {
+	payload := []byte(`{"type":"cache","payload":{"cid":"x"},"timestamp":"1700000000"}`)
+
+	for _, strict := range []bool{false, true} {
+		msg, err := decodeMessage(payload, strict)
+		if err != nil {
+			t.Fatalf("strict %t: %v", strict, err)
+		}
+		if msg.Timestamp != 1700000000000 {
+			t.Errorf("strict %t: Timestamp = %d, want the string seconds in milliseconds", strict, msg.Timestamp)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+const (
+	envTLSCert = "QAKU_CACHE_TLS_CERT"
+	envTLSKey  = "QAKU_CACHE_TLS_KEY"
+)
+
+// loadTLSConfig loads the API server certificate. It returns nil if neither
+// file is configured, in which case the API is served over plain HTTP.
+func loadTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both %s and %s must be set", envTLSCert, envTLSKey)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
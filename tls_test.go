@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to a
+// temporary directory and returns their paths.
+func writeSelfSignedCert(t *testing.T) (certFile string, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "qaku-cache test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile, cert
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	certFile, keyFile, _ := writeSelfSignedCert(t)
+
+	tests := []struct {
+		name    string
+		cert    string
+		key     string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "plain", wantNil: true},
+		{name: "both", cert: certFile, key: keyFile},
+		{name: "only cert", cert: certFile, wantErr: true},
+		{name: "only key", key: keyFile, wantErr: true},
+		{name: "missing file", cert: certFile + ".missing", key: keyFile, wantErr: true},
+		{name: "key as cert", cert: keyFile, key: keyFile, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := loadTLSConfig(tt.cert, tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: loadTLSConfig = %v, want error %t", tt.name, err, tt.wantErr)
+		}
+		if err == nil && (cfg == nil) != tt.wantNil {
+			t.Errorf("%s: config is nil %t, want %t", tt.name, cfg == nil, tt.wantNil)
+		}
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	noRetries(t)
+	certFile, keyFile, cert := writeSelfSignedCert(t)
+	tlsConfig, err := loadTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corsCfg, err := corsConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reserve a free port for the server to listen on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	newMockCodex(t)
+	c := newTestCache(t)
+	srv := server(addr, tlsConfig, corsCfg, 0, nil, discardLogger(), c, nil, nil, nil, nil)
+	t.Cleanup(func() { srv.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	var resp *http.Response
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err = client.Get("https://" + addr + "/api/qaku/v1/info")
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil {
+		t.Errorf("got %d over TLS %t, want 200 over TLS", resp.StatusCode, resp.TLS != nil)
+	}
+
+	if resp, err := http.Get("http://" + addr + "/api/qaku/v1/info"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Error("answered a plain HTTP request")
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/waku-org/go-waku/waku/v2/api/filter"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+)
+
+const (
+	envContentTopics = "QAKU_CACHE_CONTENT_TOPICS"
+	envContentTopic  = "QAKU_CONTENT_TOPIC"
+	envAppName       = "QAKU_APP_NAME"
+	envAppVersion    = "QAKU_APP_VERSION"
+	envPubsubTopic   = "QAKU_CACHE_PUBSUB_TOPIC"
+	envShardCount    = "QAKU_CACHE_SHARD_COUNT"
+
+	defaultAppName    = "qaku"
+	defaultAppVersion = "1"
+	defaultShardCount = protocol.GenerationZeroShardsCount
+
+	envUnmatchedTopicMetric = "QAKU_CACHE_UNMATCHED_TOPIC_METRIC"
+	envUnmatchedTopicLimit  = "QAKU_CACHE_UNMATCHED_TOPIC_LIMIT"
+
+	defaultUnmatchedTopicLimit = 20
+
+	topicWildcard = "*"
+)
+
+// shardCount is the number of shards content topics are auto-sharded over.
+var shardCount = defaultShardCount
+
+// clusterID is the Waku cluster the shard pubsub topics belong to, set from
+// Config.ClusterID.
+var clusterID uint16 = defaultClusterID
+
+// extraShards are the shards from Config.Shards, which every content topic is
+// subscribed on besides its derived shard.
+var extraShards []uint16
+
+var (
+	snapUnmatchedTopic = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qaku_cache_unmatched_envelopes",
+		Help: "The number of envelopes received on content topics that match no configured topic",
+	}, []string{"topic"})
+	envelopesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_envelopes_received_total",
+		Help: "The total number of envelopes received on a configured topic, before any filtering",
+	})
+	envelopesNonMatching = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_envelopes_nonmatching_total",
+		Help: "The total number of envelopes received on other topics",
+	})
+)
+
+// configuredContentTopics returns the content topics to cache from.
+// QAKU_CACHE_CONTENT_TOPICS wins, then QAKU_CONTENT_TOPIC, otherwise the
+// persist topic is built from QAKU_APP_NAME and QAKU_APP_VERSION.
+func configuredContentTopics() string {
+	if v := os.Getenv(envContentTopics); v != "" {
+		return v
+	}
+	if v := os.Getenv(envContentTopic); v != "" {
+		return v
+	}
+
+	app := os.Getenv(envAppName)
+	if app == "" {
+		app = defaultAppName
+	}
+	appVersion := os.Getenv(envAppVersion)
+	if appVersion == "" {
+		appVersion = defaultAppVersion
+	}
+
+	return fmt.Sprintf("/0/%s/%s/persist/json", app, appVersion)
+}
+
+// topicPattern matches content topics component by component (application,
+// version, name, encoding); a "*" component matches any value. The generation
+// prefix is ignored since go-waku drops it when formatting topics.
+type topicPattern struct {
+	raw   string
+	parts [4]string
+}
+
+func parseTopicPattern(s string) (topicPattern, error) {
+	// Validate with the wildcards replaced by a placeholder so the usual
+	// content topic format rules still apply to the literal components.
+	_, err := protocol.StringToContentTopic(strings.ReplaceAll(s, topicWildcard, "x"))
+	if err != nil {
+		return topicPattern{}, fmt.Errorf("invalid content topic pattern %q: %w", s, err)
+	}
+
+	p := topicPattern{raw: s}
+	segments := strings.Split(s, "/")
+	copy(p.parts[:], segments[len(segments)-4:])
+	for _, part := range p.parts {
+		if strings.Contains(part, topicWildcard) && part != topicWildcard {
+			return topicPattern{}, fmt.Errorf("invalid content topic pattern %q: wildcard must be a whole component", s)
+		}
+	}
+
+	return p, nil
+}
+
+func (p topicPattern) IsWildcard() bool {
+	return strings.Contains(p.raw, topicWildcard)
+}
+
+// ContentTopic returns the concrete topic for a pattern without wildcards.
+func (p topicPattern) ContentTopic() (protocol.ContentTopic, error) {
+	return protocol.NewContentTopic(p.parts[0], p.parts[1], p.parts[2], p.parts[3])
+}
+
+func (p topicPattern) Match(topic string) bool {
+	ct, err := protocol.StringToContentTopic(topic)
+	if err != nil {
+		return false
+	}
+
+	values := [4]string{ct.ApplicationName, ct.ApplicationVersion, ct.ContentTopicName, ct.Encoding}
+	for i, part := range p.parts {
+		if part != topicWildcard && part != values[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p topicPattern) String() string {
+	return p.raw
+}
+
+type topicMatcher []topicPattern
+
+// parseTopicMatcher parses a comma separated list of content topics and
+// patterns.
+func parseTopicMatcher(s string) (topicMatcher, error) {
+	m := topicMatcher{}
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		p, err := parseTopicPattern(raw)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, p)
+	}
+
+	if len(m) == 0 {
+		return nil, fmt.Errorf("no content topics configured")
+	}
+
+	return m, nil
+}
+
+func (m topicMatcher) Match(topic string) bool {
+	for _, p := range m {
+		if p.Match(topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ContentTopics returns the concrete topics to subscribe to. Filter
+// subscriptions need exact topics, so wildcard patterns only widen which
+// delivered envelopes are accepted.
+func (m topicMatcher) ContentTopics() []protocol.ContentTopic {
+	topics := []protocol.ContentTopic{}
+	for _, p := range m {
+		if p.IsWildcard() {
+			continue
+		}
+
+		ct, err := p.ContentTopic()
+		if err != nil {
+			slog.Warn("skipping content topic", "topic", p.String(), "error", err)
+			continue
+		}
+		topics = append(topics, ct)
+	}
+
+	return topics
+}
+
+// getShardsFromContentTopic returns every shard the topics of the app version
+// are published on: the shard auto-sharding derives over shardCount shards,
+// followed by the extra shards, without duplicates.
+func getShardsFromContentTopic(app, version string, shardCount int) []uint16 {
+	ct := protocol.ContentTopic{ApplicationName: app, ApplicationVersion: version}
+	shards := []uint16{protocol.GetShardFromContentTopic(ct, shardCount).Shard()}
+	for _, s := range extraShards {
+		if !slices.Contains(shards, s) {
+			shards = append(shards, s)
+		}
+	}
+
+	return shards
+}
+
+// getShardFromContentTopic returns the derived shard of the app version
+// topics.
+func getShardFromContentTopic(app, version string, shardCount int) uint16 {
+	return getShardsFromContentTopic(app, version, shardCount)[0]
+}
+
+// shardPubsubTopic returns the pubsub topic of an auto-sharding shard.
+func shardPubsubTopic(shard uint16) string {
+	return protocol.NewStaticShardingPubsubTopic(clusterID, shard).String()
+}
+
+// contentTopicShard returns the pubsub topic of the shard ct is auto-sharded
+// to.
+func contentTopicShard(ct protocol.ContentTopic) string {
+	return shardPubsubTopic(getShardFromContentTopic(ct.ApplicationName, ct.ApplicationVersion, shardCount))
+}
+
+// parsePubsubTopic validates an explicitly configured pubsub topic. An empty
+// topic means the shard is derived from each content topic.
+func parsePubsubTopic(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	_, err := protocol.ToWakuPubsubTopic(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid pubsub topic %q: %w", s, err)
+	}
+
+	return s, nil
+}
+
+// checkTopicShards reports every content topic whose auto-sharded shard
+// differs from the explicit pubsub topic. It runs once at startup so each
+// mismatch is reported once.
+func checkTopicShards(topics topicMatcher, pubsubTopic string) {
+	if pubsubTopic == "" {
+		return
+	}
+
+	for _, ct := range topics.ContentTopics() {
+		if derived := contentTopicShard(ct); derived != pubsubTopic {
+			configError("content topic %s derives shard %s but %s is %s", ct, derived, envPubsubTopic, pubsubTopic)
+		}
+	}
+}
+
+// contentFilters groups the concrete content topics into one filter per pubsub
+// topic. Without an explicit pubsub topic each content topic goes to its
+// auto-sharded shard and the extra shards; with one, every content topic is
+// subscribed on it.
+func contentFilters(topics topicMatcher, pubsubTopic string) []protocol.ContentFilter {
+	shardTopics := map[string][]string{}
+	for _, ct := range topics.ContentTopics() {
+		if pubsubTopic != "" {
+			shardTopics[pubsubTopic] = append(shardTopics[pubsubTopic], ct.String())
+			continue
+		}
+
+		for _, shard := range getShardsFromContentTopic(ct.ApplicationName, ct.ApplicationVersion, shardCount) {
+			pt := shardPubsubTopic(shard)
+			shardTopics[pt] = append(shardTopics[pt], ct.String())
+		}
+	}
+
+	cfs := []protocol.ContentFilter{}
+	for pt, contentTopics := range shardTopics {
+		cfs = append(cfs, protocol.NewContentFilter(pt, contentTopics...))
+	}
+
+	return cfs
+}
+
+// unmatchedTopics counts envelopes on unexpected content topics, with the
+// topic label bounded to the first limit distinct topics.
+type unmatchedTopics struct {
+	labels *boundedLabels
+}
+
+func newUnmatchedTopics(limit int) *unmatchedTopics {
+	return &unmatchedTopics{labels: newBoundedLabels(limit)}
+}
+
+func (u *unmatchedTopics) Observe(topic string) {
+	if u == nil {
+		return
+	}
+
+	snapUnmatchedTopic.WithLabelValues(u.labels.Value(topic)).Inc()
+}
+
+// topicDispatcher drops envelopes on content topics (and, if configured, the
+// pubsub topic) we are not subscribed for before they reach the cache.
+type topicDispatcher struct {
+	topics      topicMatcher
+	pubsubTopic string
+	unmatched   *unmatchedTopics
+	migration   *topicMigration
+	next        filter.EnevelopeProcessor
+}
+
+func (d *topicDispatcher) OnNewEnvelope(envelope *protocol.Envelope) error {
+	if d.pubsubTopic != "" && envelope.PubsubTopic() != d.pubsubTopic {
+		envelopesNonMatching.Inc()
+		return nil
+	}
+
+	if !d.topics.Match(envelope.Message().ContentTopic) && !d.migration.Match(envelope.Message().ContentTopic) {
+		envelopesNonMatching.Inc()
+		d.unmatched.Observe(envelope.Message().ContentTopic)
+		return nil
+	}
+	envelopesReceived.Inc()
+
+	return d.next.OnNewEnvelope(envelope)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/waku-org/go-waku/waku/v2/protocol"
+	"github.com/waku-org/go-waku/waku/v2/protocol/pb"
+)
+
+func TestTopicMatcher(t *testing.T) {
+	tests := []struct {
+		patterns string
+		topic    string
+		want     bool
+	}{
+		{patterns: "/0/qaku/1/persist/json", topic: "/qaku/1/persist/json", want: true},
+		{patterns: "/0/qaku/1/persist/json", topic: "/qaku/2/persist/json", want: false},
+		{patterns: "/0/qaku/*/persist/json", topic: "/qaku/2/persist/json", want: true},
+		{patterns: "/0/qaku/*/persist/json", topic: "/qaku/2/persist/proto", want: false},
+		{patterns: "/0/*/*/*/*", topic: "/other/9/name/enc", want: true},
+		{patterns: "/0/qaku/1/persist/json,/0/qaku/1/*/json", topic: "/qaku/1/live/json", want: true},
+		{patterns: "/0/qaku/1/*/json", topic: "not a topic", want: false},
+	}
+
+	for _, tt := range tests {
+		m, err := parseTopicMatcher(tt.patterns)
+		if err != nil {
+			t.Fatalf("parseTopicMatcher(%q): %v", tt.patterns, err)
+		}
+		if got := m.Match(tt.topic); got != tt.want {
+			t.Errorf("%q matching %q = %t, want %t", tt.patterns, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestParseTopicPatternRejectsPartialWildcards(t *testing.T) {
+	for _, s := range []string{"/0/qa*/1/persist/json", "/0/qaku/1*/persist/json", ""} {
+		if _, err := parseTopicMatcher(s); err == nil {
+			t.Errorf("parseTopicMatcher(%q) accepted the pattern", s)
+		}
+	}
+}
+
+func TestContentTopicsSkipWildcards(t *testing.T) {
+	m, err := parseTopicMatcher("/0/qaku/1/persist/json,/0/qaku/*/persist/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topics := m.ContentTopics()
+	if len(topics) != 1 || topics[0].String() != "/qaku/1/persist/json" {
+		t.Errorf("ContentTopics() = %v, want only the concrete topic", topics)
+	}
+}
+
+func TestParsePubsubTopic(t *testing.T) {
+	tests := []struct {
+		topic   string
+		wantErr bool
+	}{
+		{topic: ""},
+		{topic: "/waku/2/rs/1/0"},
+		{topic: "/waku/2/default-waku/proto"},
+		{topic: "/waku/2/rs/1", wantErr: true},
+		{topic: "garbage", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := parsePubsubTopic(tt.topic)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePubsubTopic(%q) = %v, want error %t", tt.topic, err, tt.wantErr)
+		}
+	}
+}
+
+func TestContentFiltersExplicitPubsubTopic(t *testing.T) {
+	topics, err := parseTopicMatcher("/0/qaku/1/persist/json,/0/other/1/persist/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfs := contentFilters(topics, "/waku/2/rs/1/5")
+	if len(cfs) != 1 {
+		t.Fatalf("got %d filters, want one on the explicit topic", len(cfs))
+	}
+	if cfs[0].PubsubTopic != "/waku/2/rs/1/5" || len(cfs[0].ContentTopicsList()) != 2 {
+		t.Errorf("got filter %s %v, want both topics on /waku/2/rs/1/5", cfs[0].PubsubTopic, cfs[0].ContentTopicsList())
+	}
+}
+
+func TestCheckTopicShards(t *testing.T) {
+	setGlobal(t, &configErrors, nil)
+	topics, err := parseTopicMatcher("/0/qaku/1/persist/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard := contentTopicShard(topics.ContentTopics()[0])
+
+	tests := []struct {
+		pubsubTopic string
+		wantErrors  int
+	}{
+		{pubsubTopic: ""},
+		{pubsubTopic: shard},
+		{pubsubTopic: "/waku/2/rs/1/7", wantErrors: 1},
+	}
+
+	for _, tt := range tests {
+		configErrors = nil
+		checkTopicShards(topics, tt.pubsubTopic)
+		if len(configErrors) != tt.wantErrors {
+			t.Errorf("pubsub topic %q reported %v, want %d errors", tt.pubsubTopic, configErrors, tt.wantErrors)
+		}
+	}
+}
+
+func TestConfiguredContentTopics(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{name: "default", want: "/0/qaku/1/persist/json"},
+		{name: "app and version", env: map[string]string{envAppName: "qaku-staging", envAppVersion: "2"}, want: "/0/qaku-staging/2/persist/json"},
+		{name: "content topic", env: map[string]string{envContentTopic: "/0/qaku/3/persist/json", envAppName: "ignored"}, want: "/0/qaku/3/persist/json"},
+		{name: "content topics", env: map[string]string{envContentTopics: "/0/qaku/*/persist/json", envContentTopic: "/0/qaku/3/persist/json"}, want: "/0/qaku/*/persist/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{envContentTopics, envContentTopic, envAppName, envAppVersion} {
+				t.Setenv(k, tt.env[k])
+			}
+			if got := configuredContentTopics(); got != tt.want {
+				t.Errorf("configuredContentTopics() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicDispatcherIgnoresOtherTopics(t *testing.T) {
+	t.Setenv(envAppName, "qaku-staging")
+	t.Setenv(envAppVersion, "2")
+	topics, err := parseTopicMatcher(configuredContentTopics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &countingProcessor{}
+	d := &topicDispatcher{topics: topics, next: next}
+
+	for _, topic := range []string{"/qaku-staging/2/persist/json", "/qaku/1/persist/json", "/qaku-staging/1/persist/json"} {
+		if err := d.OnNewEnvelope(testEnvelopeOn(topic, []byte("{}"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if next.envelopes != 1 {
+		t.Errorf("passed on %d envelopes, want only the one on the configured topic", next.envelopes)
+	}
+}
+
+func TestGetShardsFromContentTopic(t *testing.T) {
+	tests := []struct {
+		app        string
+		version    string
+		shardCount int
+		extra      []uint16
+		want       []uint16
+	}{
+		{app: "qaku", version: "1", shardCount: 8, want: []uint16{0}},
+		{app: "qaku", version: "1", shardCount: 64, want: []uint16{16}},
+		{app: "qaku-staging", version: "2", shardCount: 8, want: []uint16{5}},
+		{app: "qaku-staging", version: "2", shardCount: 64, want: []uint16{53}},
+		{app: "qaku", version: "1", shardCount: 8, extra: []uint16{3, 0, 7}, want: []uint16{0, 3, 7}},
+	}
+
+	for _, tt := range tests {
+		setGlobal(t, &extraShards, tt.extra)
+		got := getShardsFromContentTopic(tt.app, tt.version, tt.shardCount)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("getShardsFromContentTopic(%q, %q, %d) with extra %v = %v, want %v", tt.app, tt.version, tt.shardCount, tt.extra, got, tt.want)
+		}
+		if shard := getShardFromContentTopic(tt.app, tt.version, tt.shardCount); shard != tt.want[0] {
+			t.Errorf("getShardFromContentTopic(%q, %q, %d) = %d, want %d", tt.app, tt.version, tt.shardCount, shard, tt.want[0])
+		}
+	}
+}
+
+func TestContentFiltersExtraShards(t *testing.T) {
+	topics, err := parseTopicMatcher("/0/qaku/1/persist/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setGlobal(t, &extraShards, []uint16{3})
+
+	got := []string{}
+	for _, cf := range contentFilters(topics, "") {
+		got = append(got, cf.PubsubTopic)
+	}
+	slices.Sort(got)
+
+	want := []string{"/waku/2/rs/1/0", "/waku/2/rs/1/3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("contentFilters subscribed on %v, want %v", got, want)
+	}
+}
+
+func TestShardPubsubTopicUsesClusterID(t *testing.T) {
+	if got := shardPubsubTopic(3); got != "/waku/2/rs/1/3" {
+		t.Errorf("shardPubsubTopic(3) = %s, want the default cluster", got)
+	}
+
+	setGlobal(t, &clusterID, 16)
+	if got := shardPubsubTopic(3); got != "/waku/2/rs/16/3" {
+		t.Errorf("shardPubsubTopic(3) = %s, want the configured cluster", got)
+	}
+}
+
+func TestTopicDispatcherCountsEnvelopes(t *testing.T) {
+	topics, err := parseTopicMatcher(testContentTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &countingProcessor{}
+	d := &topicDispatcher{topics: topics, pubsubTopic: testPubsubTopic, next: next}
+
+	envelopes := []*protocol.Envelope{
+		testEnvelope([]byte("{}")),
+		testEnvelope([]byte("not json")),
+		testEnvelopeOn("/qaku/1/other/json", []byte("{}")),
+		protocol.NewEnvelope(&pb.WakuMessage{Payload: []byte("{}"), ContentTopic: testContentTopic}, time.Now().UnixNano(), "/waku/2/rs/1/7"),
+	}
+	received, nonMatching := testutil.ToFloat64(envelopesReceived), testutil.ToFloat64(envelopesNonMatching)
+	for _, e := range envelopes {
+		if err := d.OnNewEnvelope(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := testutil.ToFloat64(envelopesReceived) - received; got != 2 {
+		t.Errorf("counted %v received envelopes, want both on the topic, even the invalid one", got)
+	}
+	if got := testutil.ToFloat64(envelopesNonMatching) - nonMatching; got != 2 {
+		t.Errorf("counted %v non-matching envelopes, want the other content and pubsub topic", got)
+	}
+	if next.envelopes != 2 {
+		t.Errorf("passed on %d envelopes, want 2", next.envelopes)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	envTTL              = "QAKU_CACHE_TTL"
+	envOwnerTTLs        = "QAKU_CACHE_OWNER_TTLS"
+	envTTLPurgeInterval = "QAKU_CACHE_TTL_PURGE_INTERVAL"
+
+	defaultTTLPurgeInterval = 10 * time.Minute
+)
+
+// ttlPolicy decides how long a new entry is retained. Owners listed in the
+// overrides get their own TTL, everyone else the default. A zero TTL means the
+// entry does not expire.
+type ttlPolicy struct {
+	def    time.Duration
+	owners map[string]time.Duration
+}
+
+// parseTTLPolicy parses the overrides as a comma separated list of
+// owner=duration pairs.
+func parseTTLPolicy(def time.Duration, overrides string) (ttlPolicy, error) {
+	p := ttlPolicy{def: def, owners: make(map[string]time.Duration)}
+
+	for _, pair := range strings.Split(overrides, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		owner, ttl, ok := strings.Cut(pair, "=")
+		if !ok || owner == "" {
+			return p, fmt.Errorf("invalid owner TTL %q, expected owner=duration", pair)
+		}
+
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d < 0 {
+			return p, fmt.Errorf("invalid TTL for owner %s: %q", owner, ttl)
+		}
+		p.owners[owner] = d
+	}
+
+	return p, nil
+}
+
+func (p ttlPolicy) For(owner string) time.Duration {
+	if d, ok := p.owners[owner]; ok {
+		return d
+	}
+
+	return p.def
+}
+
+// ExpiresAt returns when an entry of owner created at t expires, or the zero
+// time if it does not.
+func (p ttlPolicy) ExpiresAt(owner string, t time.Time) time.Time {
+	d := p.For(owner)
+	if d <= 0 {
+		return time.Time{}
+	}
+
+	return t.Add(d)
+}
+
+// purgeExpired evicts the expired entries every interval until ctx is done.
+// now is the clock used to decide what expired.
+func (c *Cache) purgeExpired(ctx context.Context, interval time.Duration, now func() time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, e := range c.index.Expired(now()) {
+			err := c.evict(ctx, e, evictTTL)
+			if err != nil {
+				c.logger.Error("failed to evict expired entry", "cid", e.CID, "error", err)
+			}
+		}
+	}
+}
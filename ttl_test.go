@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseTTLPolicy(t *testing.T) {
+	tests := []struct {
+		overrides string
+		owner     string
+		want      time.Duration
+		wantErr   bool
+	}{
+		{overrides: "", owner: "alice", want: time.Hour},
+		{overrides: "alice=24h", owner: "alice", want: 24 * time.Hour},
+		{overrides: "alice=24h, bob=0s", owner: "bob", want: 0},
+		{overrides: "alice=24h", owner: "carol", want: time.Hour},
+		{overrides: "alice", wantErr: true},
+		{overrides: "=1h", wantErr: true},
+		{overrides: "alice=forever", wantErr: true},
+		{overrides: "alice=-1h", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		p, err := parseTTLPolicy(time.Hour, tt.overrides)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTTLPolicy(%q) = %v, want error %t", tt.overrides, err, tt.wantErr)
+			continue
+		}
+		if err == nil && p.For(tt.owner) != tt.want {
+			t.Errorf("%q: TTL of %s = %s, want %s", tt.overrides, tt.owner, p.For(tt.owner), tt.want)
+		}
+	}
+}
+
+func TestOwnerTTLApplied(t *testing.T) {
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	ttl, err := parseTTLPolicy(time.Hour, "alice=24h,bob=0s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ttl = ttl
+
+	tests := []struct {
+		owner string
+		want  time.Duration
+	}{
+		{owner: "alice", want: 24 * time.Hour},
+		{owner: "bob", want: 0},
+		{owner: "carol", want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		cid := testCID(tt.owner)
+		m.Add(cid, []byte("data"))
+		before := time.Now()
+		err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, tt.owner)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, ok := indexedEntry(c, cid)
+		if !ok {
+			t.Fatalf("%s: dataset was not cached", tt.owner)
+		}
+		switch {
+		case tt.want == 0:
+			if !e.ExpiresAt.IsZero() {
+				t.Errorf("%s: entry expires at %s, want never", tt.owner, e.ExpiresAt)
+			}
+		case e.ExpiresAt.Before(before.Add(tt.want)) || e.ExpiresAt.After(time.Now().Add(tt.want)):
+			t.Errorf("%s: entry expires at %s, want %s after caching", tt.owner, e.ExpiresAt, tt.want)
+		}
+	}
+}
+
+func TestPurgeExpiredUnpins(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	ttl, err := parseTTLPolicy(time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ttl = ttl
+
+	cid := testCID("expiring")
+	m.Add(cid, []byte("snapshot"))
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+
+	var offset atomic.Int64
+	now := func() time.Time { return time.Now().Add(time.Duration(offset.Load())) }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.purgeExpired(ctx, 5*time.Millisecond, now)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if m.Calls("unpin") != 0 || !c.index.Has(cid) {
+		t.Fatal("purged an entry before its TTL passed")
+	}
+
+	offset.Store(int64(2 * time.Hour))
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Calls("unpin") == 0 || c.index.Has(cid) {
+		if time.Now().After(deadline) {
+			t.Fatal("did not unpin the expired entry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if m.Local(cid) {
+		t.Error("the expired dataset is still in the store")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("purge worker did not stop on shutdown")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envSnapshotValidation     = "QAKU_CACHE_SNAPSHOT_VALIDATION"
+	envSnapshotRequiredFields = "QAKU_CACHE_SNAPSHOT_REQUIRED_FIELDS"
+
+	validationJSON   = "json"
+	validationSchema = "schema"
+)
+
+var snapInvalid = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "qaku_cache_invalid_snapshots",
+	Help: "The number of cached datasets rejected by snapshot validation",
+})
+
+var errInvalidSnapshot = errors.New("invalid snapshot")
+
+// SnapshotValidator checks the content of a downloaded snapshot.
+type SnapshotValidator interface {
+	Validate(data []byte) error
+}
+
+// jsonValidator accepts any JSON object.
+type jsonValidator struct{}
+
+func (jsonValidator) Validate(data []byte) error {
+	obj := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &obj)
+	if err != nil {
+		return fmt.Errorf("snapshot is not a JSON object: %w", err)
+	}
+
+	return nil
+}
+
+// schemaValidator accepts JSON objects that contain all required fields.
+type schemaValidator struct {
+	required []string
+}
+
+func (v schemaValidator) Validate(data []byte) error {
+	obj := map[string]json.RawMessage{}
+	err := json.Unmarshal(data, &obj)
+	if err != nil {
+		return fmt.Errorf("snapshot is not a JSON object: %w", err)
+	}
+
+	for _, f := range v.required {
+		if _, ok := obj[f]; !ok {
+			return fmt.Errorf("snapshot is missing field %q", f)
+		}
+	}
+
+	return nil
+}
+
+// newSnapshotValidator returns the validator for the given mode, or nil if
+// validation is disabled.
+func newSnapshotValidator(mode string, requiredFields string) (SnapshotValidator, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case validationJSON:
+		return jsonValidator{}, nil
+	case validationSchema:
+		v := schemaValidator{}
+		for _, f := range strings.Split(requiredFields, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				v.required = append(v.required, f)
+			}
+		}
+		if len(v.required) == 0 {
+			return nil, fmt.Errorf("%s=%s requires %s", envSnapshotValidation, validationSchema, envSnapshotRequiredFields)
+		}
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("unknown %s %q, expected %s or %s", envSnapshotValidation, mode, validationJSON, validationSchema)
+}
+
+// inspectSnapshot streams the dataset through the backend once, checks its
+// digest against wantHash if set and runs it through the validator if set.
+// The network stream is used since the pin may still be in progress. Reads
+// are capped at limit bytes.
+func inspectSnapshot(ctx context.Context, backend Backend, cid string, limit int, wantHash string, v SnapshotValidator) error {
+	resp, err := backend.Stream(ctx, cid)
+	if err != nil {
+		return fmt.Errorf("failed to download snapshot: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("failed to download snapshot: %s", resp.Status)
+	}
+
+	writers := []io.Writer{}
+	var h hash.Hash
+	if wantHash != "" {
+		h = newContentHasher()
+		writers = append(writers, h)
+	}
+	var buf bytes.Buffer
+	if v != nil {
+		writers = append(writers, &buf)
+	}
+
+	n, err := io.Copy(io.MultiWriter(writers...), io.LimitReader(countingReader{resp.Body}, int64(limit)+1))
+	if err != nil {
+		return fmt.Errorf("failed to download snapshot: %w", err)
+	}
+	if n > int64(limit) {
+		return fmt.Errorf("snapshot is larger than %d bytes", limit)
+	}
+
+	if h != nil {
+		err = checkHash(h.Sum(nil), wantHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	if v != nil {
+		err = v.Validate(buf.Bytes())
+		if err != nil {
+			return fmt.Errorf("%w: %s", errInvalidSnapshot, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewSnapshotValidator(t *testing.T) {
+	tests := []struct {
+		mode     string
+		required string
+		wantNil  bool
+		wantErr  bool
+	}{
+		{mode: "", wantNil: true},
+		{mode: validationJSON},
+		{mode: validationSchema, required: "title, questions"},
+		{mode: validationSchema, required: " , ", wantErr: true},
+		{mode: validationSchema, wantErr: true},
+		{mode: "xml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		v, err := newSnapshotValidator(tt.mode, tt.required)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newSnapshotValidator(%q, %q) = %v, want error %t", tt.mode, tt.required, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (v == nil) != tt.wantNil {
+			t.Errorf("newSnapshotValidator(%q, %q) = %v, want nil %t", tt.mode, tt.required, v, tt.wantNil)
+		}
+	}
+}
+
+func TestSnapshotValidators(t *testing.T) {
+	schema := schemaValidator{required: []string{"title", "questions"}}
+	tests := []struct {
+		name       string
+		body       string
+		wantJSON   bool
+		wantSchema bool
+	}{
+		{name: "valid", body: `{"title":"AMA","questions":[]}`, wantJSON: true, wantSchema: true},
+		{name: "missing field", body: `{"title":"AMA"}`, wantJSON: true},
+		{name: "array", body: `[{"title":"AMA","questions":[]}]`},
+		{name: "truncated", body: `{"title":"AMA","quest`},
+		{name: "binary", body: "\x00\x01\x02"},
+	}
+
+	for _, tt := range tests {
+		if err := (jsonValidator{}).Validate([]byte(tt.body)); (err == nil) != tt.wantJSON {
+			t.Errorf("%s: json validation = %v, want success %t", tt.name, err, tt.wantJSON)
+		}
+		if err := schema.Validate([]byte(tt.body)); (err == nil) != tt.wantSchema {
+			t.Errorf("%s: schema validation = %v, want success %t", tt.name, err, tt.wantSchema)
+		}
+	}
+}
+
+func TestProcessValidatesSnapshots(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		encrypted bool
+		wantErr   bool
+	}{
+		{name: "valid", body: `{"title":"AMA","questions":[]}`},
+		{name: "malformed", body: `{"title":"AMA"}`, wantErr: true},
+		{name: "encrypted", body: "ciphertext", encrypted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockCodex(t)
+			c := newTestCache(t)
+			c.validator = schemaValidator{required: []string{"title", "questions"}}
+
+			cid := testCID(tt.name)
+			m.Add(cid, []byte(tt.body))
+			err := c.OnNewEnvelope(testEnvelope(encodeMessage(t, QakuMessage{
+				Type:      cacheMessageType,
+				Payload:   CacheRequest{CID: cid, Encrypted: tt.encrypted},
+				Timestamp: Timestamp(time.Now().UnixMilli()),
+			})))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if got := c.index.Has(cid); got != !tt.wantErr {
+				t.Errorf("cached = %t, want %t", got, !tt.wantErr)
+			}
+			if tt.wantErr && m.Local(cid) {
+				t.Error("rejected snapshot is still pinned")
+			}
+		})
+	}
+}
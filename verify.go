@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envVerifyInterval = "QAKU_CACHE_VERIFY_INTERVAL"
+	envVerifySample   = "QAKU_CACHE_VERIFY_SAMPLE"
+	envVerifyRehash   = "QAKU_CACHE_VERIFY_REHASH"
+
+	defaultVerifySample = 10
+)
+
+var (
+	verifyOK = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_audit_ok",
+		Help: "The total number of verified snapshots that were still available and intact",
+	})
+	verifyFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_audit_failed",
+		Help: "The total number of verified snapshots that were unavailable or did not match the index",
+	})
+)
+
+// verifySnapshots periodically checks up to sample cached snapshots, those
+// verified longest ago first, and marks the ones that fail as degraded. With
+// rehash the dataset is downloaded and compared against the stored hash as
+// well.
+func verifySnapshots(ctx context.Context, interval time.Duration, sample int, rehash bool, backend Backend, index *cacheIndex, now func() time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			verifySample(ctx, sample, rehash, backend, index, now)
+		}
+	}
+}
+
+func verifySample(ctx context.Context, sample int, rehash bool, backend Backend, index *cacheIndex, now func() time.Time) {
+	entries := index.Entries()
+	sort.Slice(entries, func(a, b int) bool { return entries[a].VerifiedAt.Before(entries[b].VerifiedAt) })
+	if len(entries) > sample {
+		entries = entries[:sample]
+	}
+
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+
+		err := verifyEntry(ctx, backend, e, rehash)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			verifyFailed.Inc()
+			slog.Warn("snapshot failed verification", "cid", e.CID, "owner", e.Owner, "error", err)
+		} else {
+			verifyOK.Inc()
+			if e.Degraded {
+				slog.Info("snapshot recovered", "cid", e.CID, "owner", e.Owner)
+			}
+		}
+		index.Verified(e.CID, now(), err != nil)
+	}
+}
+
+// verifyEntry checks that the manifest is still available and matches the
+// indexed size, and with rehash that the stored content matches its hash.
+func verifyEntry(ctx context.Context, backend Backend, e CacheEntry, rehash bool) error {
+	cdc, err := backend.FetchManifest(ctx, e.CID)
+	if err != nil {
+		return err
+	}
+	if cdc.Manifest.DatasetSize != e.Size {
+		return fmt.Errorf("dataset size changed from %d to %d bytes", e.Size, cdc.Manifest.DatasetSize)
+	}
+
+	if !rehash || e.Hash == "" || newContentHasher == nil {
+		return nil
+	}
+
+	resp, err := backend.Download(ctx, e.CID, http.Header{})
+	if err != nil {
+		return fmt.Errorf("failed to download snapshot: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download snapshot: %s", resp.Status)
+	}
+
+	h := newContentHasher()
+	_, err = io.Copy(h, resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download snapshot: %w", err)
+	}
+
+	return checkHash(h.Sum(nil), e.Hash)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVerifySnapshotsFlagsLostDataset(t *testing.T) {
+	noRetries(t)
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	lost, kept := testCID("lost"), testCID("kept")
+	for _, cid := range []string{lost, kept} {
+		m.Add(cid, []byte("snapshot"))
+		c.index.Put(CacheEntry{CID: cid, Size: len("snapshot"), CachedAt: time.Now()})
+	}
+
+	start := time.Now()
+	var offset atomic.Int64
+	now := func() time.Time { return start.Add(time.Duration(offset.Load())) }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		verifySnapshots(ctx, 5*time.Millisecond, 2, false, c.backend, c.index, now)
+	}()
+
+	waitVerified := func(at time.Time) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			a, _ := c.index.Get(lost)
+			b, _ := c.index.Get(kept)
+			if !a.VerifiedAt.Before(at) && !b.VerifiedAt.Before(at) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("snapshots not verified at %s", at)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitVerified(start)
+	if e, _ := c.index.Get(lost); e.Degraded {
+		t.Error("flagged an available snapshot")
+	}
+
+	ok, failed := testutil.ToFloat64(verifyOK), testutil.ToFloat64(verifyFailed)
+	m.Remove(lost)
+	offset.Store(int64(time.Hour))
+	waitVerified(start.Add(time.Hour))
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("verification did not stop on shutdown")
+	}
+	if e, _ := c.index.Get(lost); !e.Degraded {
+		t.Error("did not flag the lost snapshot")
+	}
+	if e, _ := c.index.Get(kept); e.Degraded {
+		t.Error("flagged the available snapshot")
+	}
+	if testutil.ToFloat64(verifyFailed)-failed < 1 || testutil.ToFloat64(verifyOK)-ok < 1 {
+		t.Error("did not count the failed and the passed verification")
+	}
+
+	var snapshots []SnapshotInfo
+	if err := json.Unmarshal(get(newTestServer(t, c, nil), "/api/qaku/v1/snapshots", nil).Body.Bytes(), &snapshots); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range snapshots {
+		if s.Degraded != (s.CID == lost) {
+			t.Errorf("/snapshots lists %s degraded %t", s.CID, s.Degraded)
+		}
+	}
+
+	// A recovered snapshot loses the flag.
+	m.Add(lost, []byte("snapshot"))
+	verifySample(context.Background(), 2, false, c.backend, c.index, now)
+	if e, _ := c.index.Get(lost); e.Degraded {
+		t.Error("kept the flag of a recovered snapshot")
+	}
+}
+
+func TestVerifyEntryRehash(t *testing.T) {
+	noRetries(t)
+	setGlobal(t, &newContentHasher, sha256.New)
+	m := newMockCodex(t)
+	b := m.Backend()
+	cid := testCID("rehashed")
+	m.Add(cid, []byte("snapshot"))
+	if err := b.FetchToNetwork(context.Background(), cid); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("snapshot"))
+	e := CacheEntry{CID: cid, Size: len("snapshot"), Hash: hex.EncodeToString(sum[:])}
+
+	if err := verifyEntry(context.Background(), b, e, true); err != nil {
+		t.Errorf("intact snapshot failed the rehash: %v", err)
+	}
+
+	m.Serve(cid, []byte("tampered"))
+	if err := verifyEntry(context.Background(), b, e, false); err != nil {
+		t.Errorf("checked the content without rehash: %v", err)
+	}
+	if err := verifyEntry(context.Background(), b, e, true); err == nil {
+		t.Error("tampered snapshot passed the rehash")
+	}
+
+	e.Size++
+	if err := verifyEntry(context.Background(), b, e, false); err == nil {
+		t.Error("snapshot of another size passed verification")
+	}
+}
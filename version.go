@@ -0,0 +1,37 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Build metadata, set with -ldflags "-X main.version=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+var buildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "qaku_cache_build_info",
+	Help: "Always 1, the labels describe the running build",
+}, []string{"version", "commit", "build_date", "go_version"})
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+func versionInfo() VersionInfo {
+	return VersionInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+}
+
+// observeBuildInfo exports the build metadata as a metric.
+func observeBuildInfo() {
+	v := versionInfo()
+	buildInfo.WithLabelValues(v.Version, v.Commit, v.BuildDate, v.GoVersion).Set(1)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVersionEndpoint(t *testing.T) {
+	setGlobal(t, &version, "1.2.3")
+	setGlobal(t, &commit, "abc123")
+	setGlobal(t, &buildDate, "2024-01-02")
+	h := newTestServer(t, newTestCache(t), nil)
+
+	w := get(h, "/api/qaku/v1/version", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	var got VersionInfo
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := VersionInfo{Version: "1.2.3", Commit: "abc123", BuildDate: "2024-01-02", GoVersion: runtime.Version()}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestBuildInfoMetric(t *testing.T) {
+	setGlobal(t, &version, "1.2.3")
+	setGlobal(t, &commit, "abc123")
+	setGlobal(t, &buildDate, "2024-01-02")
+
+	observeBuildInfo()
+	if got := testutil.ToFloat64(buildInfo.WithLabelValues("1.2.3", "abc123", "2024-01-02", runtime.Version())); got != 1 {
+		t.Errorf("qaku_cache_build_info = %v, want 1", got)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	envWebhookURL       = "QAKU_CACHE_WEBHOOK_URL"
+	envWebhookRetries   = "QAKU_CACHE_WEBHOOK_RETRIES"
+	envWebhookBackoff   = "QAKU_CACHE_WEBHOOK_BACKOFF"
+	envWebhookTimeout   = "QAKU_CACHE_WEBHOOK_TIMEOUT"
+	envWebhookQueueSize = "QAKU_CACHE_WEBHOOK_QUEUE_SIZE"
+
+	defaultWebhookRetries   = 3
+	defaultWebhookBackoff   = time.Second
+	defaultWebhookTimeout   = 10 * time.Second
+	defaultWebhookQueueSize = 100
+
+	outcomeSuccess   = "success"
+	outcomeFailure   = "failure"
+	outcomeCancelled = "cancelled"
+)
+
+var (
+	webhookFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_webhook_failures",
+		Help: "The total number of webhook deliveries that failed after all retries",
+	})
+	webhookDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qaku_cache_webhook_dropped",
+		Help: "The total number of webhook events dropped because the delivery queue was full",
+	})
+)
+
+type WebhookEvent struct {
+	CID     string `json:"cid"`
+	Owner   string `json:"owner"`
+	Outcome string `json:"outcome"`
+	Size    int    `json:"size"`
+	Error   string `json:"error,omitempty"`
+	// Reason is the failure reason also used for the failure metrics.
+	Reason string `json:"reason,omitempty"`
+}
+
+// webhook delivers cache events to an external receiver. Events are queued
+// and sent from a single goroutine so a slow or failing receiver never blocks
+// envelope processing; when the queue is full new events are dropped.
+type webhook struct {
+	url     string
+	retries int
+	backoff time.Duration
+	client  *http.Client
+	queue   chan WebhookEvent
+}
+
+func newWebhook(url string, retries int, backoff time.Duration, timeout time.Duration, queueSize int) *webhook {
+	return &webhook{
+		url:     url,
+		retries: retries,
+		backoff: backoff,
+		client:  &http.Client{Timeout: timeout},
+		queue:   make(chan WebhookEvent, queueSize),
+	}
+}
+
+// Notify queues the event for delivery without blocking.
+func (w *webhook) Notify(e WebhookEvent) {
+	if w == nil {
+		return
+	}
+
+	select {
+	case w.queue <- e:
+	default:
+		webhookDropped.Inc()
+		slog.Warn("webhook queue full, dropping event", "outcome", e.Outcome, "cid", e.CID)
+	}
+}
+
+func (w *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-w.queue:
+			err := w.deliver(ctx, e)
+			if err != nil {
+				webhookFailures.Inc()
+				slog.Error("failed to deliver webhook", "cid", e.CID, "error", err)
+			}
+		}
+	}
+}
+
+// deliver POSTs the event, retrying with exponential backoff.
+func (w *webhook) deliver(ctx context.Context, e WebhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil || attempt >= w.retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (w *webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
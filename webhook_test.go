@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// webhookReceiver records the events posted to it and fails the first
+// failures deliveries.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int
+	attempts int
+	events   []WebhookEvent
+}
+
+func newWebhookReceiver(t *testing.T, failures int) *webhookReceiver {
+	t.Helper()
+
+	rcv := &webhookReceiver{failures: failures}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+
+		rcv.attempts++
+		if rcv.attempts <= rcv.failures {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		var e WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rcv.events = append(rcv.events, e)
+	}))
+	t.Cleanup(rcv.Close)
+
+	return rcv
+}
+
+func (r *webhookReceiver) Attempts() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.attempts
+}
+
+func (r *webhookReceiver) Events() []WebhookEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]WebhookEvent(nil), r.events...)
+}
+
+func TestWebhookDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		retries      int
+		wantErr      bool
+		wantAttempts int
+	}{
+		{name: "first try", failures: 0, retries: 3, wantAttempts: 1},
+		{name: "after retries", failures: 2, retries: 3, wantAttempts: 3},
+		{name: "retries exhausted", failures: 5, retries: 2, wantErr: true, wantAttempts: 3},
+		{name: "no retries", failures: 1, retries: 0, wantErr: true, wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv := newWebhookReceiver(t, tt.failures)
+			w := newWebhook(rcv.URL, tt.retries, time.Millisecond, time.Second, 1)
+
+			err := w.deliver(context.Background(), WebhookEvent{CID: "cid", Outcome: outcomeSuccess})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deliver = %v, want error %t", err, tt.wantErr)
+			}
+			if got := rcv.Attempts(); got != tt.wantAttempts {
+				t.Errorf("made %d attempts, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestWebhookDeliverStopsOnCancel(t *testing.T) {
+	rcv := newWebhookReceiver(t, 10)
+	w := newWebhook(rcv.URL, 10, time.Hour, time.Second, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := w.deliver(ctx, WebhookEvent{CID: "cid"})
+	if err != context.Canceled {
+		t.Errorf("deliver = %v, want context.Canceled during the backoff", err)
+	}
+}
+
+func TestOnNewEnvelopeNotifiesWebhook(t *testing.T) {
+	noRetries(t)
+	rcv := newWebhookReceiver(t, 0)
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	c.webhook = newWebhook(rcv.URL, 0, time.Millisecond, time.Second, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.webhook.run(ctx)
+
+	cached, missing := testCID("cached"), testCID("missing")
+	m.Add(cached, []byte("snapshot"))
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cached, "alice"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, missing, "bob"))); err == nil {
+		t.Fatal("caching an unknown dataset succeeded")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rcv.Events()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d events, want 2", len(rcv.Events()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	events := rcv.Events()
+	if e := events[0]; e.CID != cached || e.Owner != "alice" || e.Outcome != outcomeSuccess || e.Size != len("snapshot") || e.Error != "" {
+		t.Errorf("got success event %+v", e)
+	}
+	if e := events[1]; e.CID != missing || e.Owner != "bob" || e.Outcome != outcomeFailure || e.Error == "" || e.Reason != "manifest" {
+		t.Errorf("got failure event %+v", e)
+	}
+}
+
+func TestWebhookNeverBlocksProcessing(t *testing.T) {
+	// Nothing delivers, so the queue of one fills up at once.
+	rcv := newWebhookReceiver(t, 0)
+	m := newMockCodex(t)
+	c := newTestCache(t)
+	c.webhook = newWebhook(rcv.URL, 0, time.Millisecond, time.Second, 1)
+
+	dropped := testutil.ToFloat64(webhookDropped)
+	for _, seed := range []string{"first", "second", "third"} {
+		cid := testCID(seed)
+		m.Add(cid, []byte("snapshot"))
+		if err := c.OnNewEnvelope(testEnvelope(cacheMessage(t, cid, ""))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(webhookDropped) - dropped; got != 2 {
+		t.Errorf("dropped %v events, want 2", got)
+	}
+
+	// Failed deliveries are counted once the retries are used up.
+	failing := newWebhookReceiver(t, 10)
+	w := newWebhook(failing.URL, 1, time.Millisecond, time.Second, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx)
+
+	failures := testutil.ToFloat64(webhookFailures)
+	w.Notify(WebhookEvent{CID: "cid", Outcome: outcomeSuccess})
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(webhookFailures)-failures < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("did not count the failed delivery")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := failing.Attempts(); got != 2 {
+		t.Errorf("made %d delivery attempts, want 2", got)
+	}
+}